@@ -0,0 +1,18 @@
+-- migrate:up
+CREATE TABLE trusted_devices (
+  id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  fingerprint VARBINARY(32) NOT NULL,
+  user_agent VARCHAR(255) NOT NULL DEFAULT '',
+  ip VARCHAR(45) DEFAULT NULL,
+  expired_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  last_used_at TIMESTAMP NULL DEFAULT NULL,
+
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  CONSTRAINT FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+-- migrate:down
+DROP TABLE trusted_devices;
@@ -0,0 +1,7 @@
+-- migrate:up
+
+ALTER TABLE `sessions` ADD COLUMN `last_mfa_verified_at` timestamp NULL DEFAULT NULL;
+
+-- migrate:down
+
+ALTER TABLE `sessions` DROP COLUMN `last_mfa_verified_at`;
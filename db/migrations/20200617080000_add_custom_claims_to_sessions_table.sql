@@ -0,0 +1,7 @@
+-- migrate:up
+
+ALTER TABLE `sessions` ADD COLUMN `custom_claims` json DEFAULT NULL;
+
+-- migrate:down
+
+ALTER TABLE `sessions` DROP COLUMN `custom_claims`;
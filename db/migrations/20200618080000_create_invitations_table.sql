@@ -0,0 +1,21 @@
+-- migrate:up
+CREATE TABLE invitations (
+  id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  email VARCHAR(255) NOT NULL,
+  client_id VARCHAR(255) NOT NULL,
+  role_ids JSON NOT NULL,
+  invited_by BIGINT DEFAULT NULL,
+  accepted_by BIGINT DEFAULT NULL,
+  accepted_at TIMESTAMP NULL DEFAULT NULL,
+  expired_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  KEY email (email),
+  CONSTRAINT FOREIGN KEY (invited_by) REFERENCES users (id) ON DELETE SET NULL,
+  CONSTRAINT FOREIGN KEY (accepted_by) REFERENCES users (id) ON DELETE SET NULL
+);
+
+-- migrate:down
+DROP TABLE invitations;
@@ -0,0 +1,8 @@
+-- migrate:up
+
+ALTER TABLE `users` ADD COLUMN `encrypted_legacy_password_hash` varchar(1024) DEFAULT NULL AFTER `encrypted_password_verifier_l`;
+
+-- migrate:down
+
+ALTER TABLE `users` DROP COLUMN `encrypted_legacy_password_hash`;
+
@@ -0,0 +1,15 @@
+-- migrate:up
+
+ALTER TABLE `users`
+  ADD COLUMN `password_changed_at` timestamp NULL DEFAULT NULL AFTER `encrypted_legacy_password_hash`,
+  ADD COLUMN `password_change_required` tinyint(1) NOT NULL DEFAULT '0' AFTER `password_changed_at`;
+
+-- The password age of existing users is counted from this migration.
+UPDATE `users` SET `password_changed_at` = CURRENT_TIMESTAMP, `updated_at` = `updated_at`;
+
+-- migrate:down
+
+ALTER TABLE `users`
+  DROP COLUMN `password_changed_at`,
+  DROP COLUMN `password_change_required`;
+
@@ -0,0 +1,21 @@
+-- migrate:up
+
+ALTER TABLE `sessions`
+  ADD COLUMN `impersonator_id` bigint DEFAULT NULL AFTER `custom_claims`;
+
+ALTER TABLE `audit_logs`
+  ADD COLUMN `impersonator_id` bigint DEFAULT NULL AFTER `actor_display`,
+  ADD COLUMN `impersonator_display` varchar(255) DEFAULT NULL AFTER `impersonator_id`;
+
+INSERT INTO `roles` (`name`, `is_system_role`) VALUES ("authcore.impersonator", 1);
+
+-- migrate:down
+
+DELETE FROM `roles` WHERE `name` = "authcore.impersonator";
+
+ALTER TABLE `audit_logs`
+  DROP COLUMN `impersonator_id`,
+  DROP COLUMN `impersonator_display`;
+
+ALTER TABLE `sessions`
+  DROP COLUMN `impersonator_id`;
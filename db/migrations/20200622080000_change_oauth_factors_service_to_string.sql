@@ -0,0 +1,28 @@
+-- migrate:up
+
+ALTER TABLE `oauth_factors`
+  MODIFY COLUMN `service` varchar(64) NOT NULL;
+
+UPDATE `oauth_factors` SET `service` = CASE `service`
+  WHEN '0' THEN 'facebook'
+  WHEN '1' THEN 'google'
+  WHEN '2' THEN 'apple'
+  WHEN '3' THEN 'matters'
+  WHEN '4' THEN 'twitter'
+  ELSE `service`
+END;
+
+-- migrate:down
+
+DELETE FROM `oauth_factors` WHERE `service` NOT IN ('facebook', 'google', 'apple', 'matters', 'twitter');
+
+UPDATE `oauth_factors` SET `service` = CASE `service`
+  WHEN 'facebook' THEN '0'
+  WHEN 'google' THEN '1'
+  WHEN 'apple' THEN '2'
+  WHEN 'matters' THEN '3'
+  WHEN 'twitter' THEN '4'
+END;
+
+ALTER TABLE `oauth_factors`
+  MODIFY COLUMN `service` smallint NOT NULL;
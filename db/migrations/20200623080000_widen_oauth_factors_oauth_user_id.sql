@@ -0,0 +1,9 @@
+-- migrate:up
+
+ALTER TABLE `oauth_factors`
+  MODIFY COLUMN `oauth_user_id` varchar(255) NOT NULL;
+
+-- migrate:down
+
+ALTER TABLE `oauth_factors`
+  MODIFY COLUMN `oauth_user_id` varchar(50) NOT NULL;
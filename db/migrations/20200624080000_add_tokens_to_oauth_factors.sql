@@ -0,0 +1,17 @@
+-- migrate:up
+
+ALTER TABLE `oauth_factors`
+  ADD COLUMN `encrypted_access_token` text DEFAULT NULL AFTER `metadata`,
+  ADD COLUMN `encrypted_access_secret` text DEFAULT NULL AFTER `encrypted_access_token`,
+  ADD COLUMN `encrypted_refresh_token` text DEFAULT NULL AFTER `encrypted_access_secret`,
+  ADD COLUMN `token_type` varchar(64) DEFAULT NULL AFTER `encrypted_refresh_token`,
+  ADD COLUMN `token_expires_at` timestamp NULL DEFAULT NULL AFTER `token_type`;
+
+-- migrate:down
+
+ALTER TABLE `oauth_factors`
+  DROP COLUMN `encrypted_access_token`,
+  DROP COLUMN `encrypted_access_secret`,
+  DROP COLUMN `encrypted_refresh_token`,
+  DROP COLUMN `token_type`,
+  DROP COLUMN `token_expires_at`;
@@ -19,6 +19,8 @@ CREATE TABLE `audit_logs` (
   `id` bigint NOT NULL AUTO_INCREMENT,
   `actor_id` bigint DEFAULT NULL,
   `actor_display` varchar(255) DEFAULT NULL,
+  `impersonator_id` bigint DEFAULT NULL,
+  `impersonator_display` varchar(255) DEFAULT NULL,
   `action` varchar(255) NOT NULL,
   `target` json DEFAULT NULL,
   `session_id` bigint DEFAULT NULL,
@@ -89,6 +91,32 @@ CREATE TABLE `devices_users` (
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `invitations`
+--
+
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `invitations` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `email` varchar(255) NOT NULL,
+  `client_id` varchar(255) NOT NULL,
+  `role_ids` json NOT NULL,
+  `invited_by` bigint DEFAULT NULL,
+  `accepted_by` bigint DEFAULT NULL,
+  `accepted_at` timestamp NULL DEFAULT NULL,
+  `expired_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `email` (`email`),
+  KEY `invited_by` (`invited_by`),
+  KEY `accepted_by` (`accepted_by`),
+  CONSTRAINT `invitations_ibfk_1` FOREIGN KEY (`invited_by`) REFERENCES `users` (`id`) ON DELETE SET NULL,
+  CONSTRAINT `invitations_ibfk_2` FOREIGN KEY (`accepted_by`) REFERENCES `users` (`id`) ON DELETE SET NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `oauth_factors`
 --
@@ -98,9 +126,14 @@ CREATE TABLE `devices_users` (
 CREATE TABLE `oauth_factors` (
   `id` bigint NOT NULL AUTO_INCREMENT,
   `user_id` bigint NOT NULL,
-  `service` smallint NOT NULL,
-  `oauth_user_id` varchar(50) NOT NULL,
+  `service` varchar(64) NOT NULL,
+  `oauth_user_id` varchar(255) NOT NULL,
   `metadata` json DEFAULT NULL,
+  `encrypted_access_token` text,
+  `encrypted_access_secret` text,
+  `encrypted_refresh_token` text,
+  `token_type` varchar(64) DEFAULT NULL,
+  `token_expires_at` timestamp NULL DEFAULT NULL,
   `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `last_used_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
@@ -219,6 +252,9 @@ CREATE TABLE `sessions` (
   `expired_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `is_invalid` tinyint(1) NOT NULL DEFAULT '0',
   `last_password_verified_at` timestamp NULL DEFAULT NULL,
+  `last_mfa_verified_at` timestamp NULL DEFAULT NULL,
+  `custom_claims` json DEFAULT NULL,
+  `impersonator_id` bigint DEFAULT NULL,
   PRIMARY KEY (`id`),
   UNIQUE KEY `refresh_token` (`refresh_token`),
   KEY `user_id` (`user_id`),
@@ -244,6 +280,28 @@ CREATE TABLE `templates` (
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `trusted_devices`
+--
+
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `trusted_devices` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `user_id` bigint NOT NULL,
+  `fingerprint` varbinary(32) NOT NULL,
+  `user_agent` varchar(255) NOT NULL DEFAULT '',
+  `ip` varchar(45) DEFAULT NULL,
+  `expired_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `last_used_at` timestamp NULL DEFAULT NULL,
+  `updated_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `user_id` (`user_id`),
+  CONSTRAINT `trusted_devices_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `users`
 --
@@ -258,6 +316,9 @@ CREATE TABLE `users` (
   `password_salt` varchar(48) DEFAULT NULL,
   `encrypted_password_verifier_w0` varchar(1024) DEFAULT NULL,
   `encrypted_password_verifier_l` varchar(1024) DEFAULT NULL,
+  `encrypted_legacy_password_hash` varchar(1024) DEFAULT NULL,
+  `password_changed_at` timestamp NULL DEFAULT NULL,
+  `password_change_required` tinyint(1) NOT NULL DEFAULT '0',
   `email` varchar(256) DEFAULT NULL,
   `email_verified_at` timestamp NULL DEFAULT NULL,
   `phone` varchar(256) DEFAULT NULL,
@@ -338,5 +399,15 @@ INSERT INTO `schema_migrations` (version) VALUES
   ('20200415084615'),
   ('20200416072147'),
   ('20200501020607'),
-  ('20200509025853');
+  ('20200509025853'),
+  ('20200615080000'),
+  ('20200616080000'),
+  ('20200617080000'),
+  ('20200618080000'),
+  ('20200619080000'),
+  ('20200620080000'),
+  ('20200621080000'),
+  ('20200622080000'),
+  ('20200623080000'),
+  ('20200624080000');
 UNLOCK TABLES;
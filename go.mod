@@ -7,12 +7,16 @@ require (
 	github.com/alicebob/miniredis v2.5.0+incompatible
 	github.com/amacneil/dbmate v1.7.0
 	github.com/aws/aws-sdk-go v1.29.19
+	github.com/beevik/etree v1.1.0
 	github.com/casbin/casbin/v2 v2.2.2
+	github.com/crewjam/saml v0.4.14
 	github.com/dghubble/oauth1 v0.6.0
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/ethereum/go-ethereum v1.9.11
 	github.com/flynn/noise v0.0.0-20180327030543-2492fe189ae6
 	github.com/gchaincl/sqlhooks v1.3.0
+	github.com/go-asn1-ber/asn1-ber v1.5.5
+	github.com/go-ldap/ldap/v3 v3.4.6
 	github.com/go-playground/validator/v10 v10.2.0
 	github.com/go-redis/redis v6.15.7+incompatible
 	github.com/go-sql-driver/mysql v1.5.0
@@ -22,7 +26,7 @@ require (
 	github.com/golang-migrate/migrate v3.5.4+incompatible
 	github.com/golang/protobuf v1.3.3
 	github.com/gomodule/redigo v2.0.0+incompatible // indirect
-	github.com/google/uuid v1.1.1
+	github.com/google/uuid v1.3.1
 	github.com/grpc-ecosystem/go-grpc-middleware v1.2.0
 	github.com/grpc-ecosystem/grpc-gateway v1.13.0
 	github.com/huandu/go-sqlbuilder v1.7.0
@@ -32,7 +36,6 @@ require (
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0
 	github.com/labstack/echo/v4 v4.1.14
 	github.com/labstack/gommon v0.3.0
-	github.com/lestrrat-go/jwx v0.9.2
 	github.com/lib/pq v1.4.0 // indirect
 	github.com/mattn/go-isatty v0.0.12 // indirect
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
@@ -40,23 +43,24 @@ require (
 	github.com/nyaruka/phonenumbers v1.0.54
 	github.com/pkg/errors v0.9.1
 	github.com/pquerna/otp v1.2.0
+	github.com/russellhaering/goxmldsig v1.3.0
 	github.com/sendgrid/rest v2.4.1+incompatible // indirect
 	github.com/sendgrid/sendgrid-go v3.5.0+incompatible
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.6
 	github.com/spf13/viper v1.6.2
-	github.com/stretchr/testify v1.5.1
+	github.com/stretchr/testify v1.8.1
 	github.com/thoas/go-funk v0.6.0
 	github.com/vmihailenco/msgpack v4.0.4+incompatible
 	github.com/xo/dburl v0.0.0-20200124232849-e9ec94f52bc3
 	github.com/yuin/gopher-lua v0.0.0-20191220021717-ab39c6098bdb // indirect
 	gitlab.com/blocksq/secretd-client-go v0.0.0-20191121165057-9f6ba6cd7619
 	gitlab.com/blocksq/spake2-go v0.0.0-20190906105118-9484941bdff4
-	golang.org/x/crypto v0.0.0-20200220183623-bac4c82f6975
+	golang.org/x/crypto v0.14.0
 	golang.org/x/lint v0.0.0-20200302205851-738671d3881b // indirect
-	golang.org/x/net v0.0.0-20200219183655-46282727080f
+	golang.org/x/net v0.10.0
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
-	golang.org/x/text v0.3.2
+	golang.org/x/text v0.13.0
 	google.golang.org/genproto v0.0.0-20200218151345-dad8c97a84f5
 	google.golang.org/grpc v1.27.1
 	gopkg.in/go-playground/assert.v1 v1.2.1
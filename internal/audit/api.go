@@ -56,13 +56,14 @@ func (h *handler) ListAuditLogs(c echo.Context) error {
 
 // JSONEvent represents a event in management API
 type JSONEvent struct {
-	ID        int64        `json:"id"`
-	Action    string       `json:"action"`
-	Target    nulls.JSON   `json:"target"`
-	Device    string       `json:"device"`
-	IP        nulls.String `json:"ip"`
-	Result    string       `json:"result"`
-	CreatedAt time.Time    `json:"created_at"`
+	ID             int64        `json:"id"`
+	Action         string       `json:"action"`
+	Target         nulls.JSON   `json:"target"`
+	Device         string       `json:"device"`
+	IP             nulls.String `json:"ip"`
+	Result         string       `json:"result"`
+	ImpersonatorID nulls.Int64  `json:"impersonator_id"`
+	CreatedAt      time.Time    `json:"created_at"`
 }
 
 // NewJSONEvent converts a Event into JSONEvent.
@@ -37,12 +37,15 @@ type Event struct {
 	ID           int64        `db:"id"`
 	ActorID      nulls.Int64  `db:"actor_id" fieldtag:"insert"`
 	ActorDisplay nulls.String `db:"actor_display" fieldtag:"insert"`
-	Action       string       `db:"action" validate:"required" fieldtag:"insert"`
-	Target       nulls.JSON   `db:"target" fieldtag:"insert"`
-	Result       EventResult  `db:"result" fieldtag:"insert"`
-	IP           nulls.String `db:"ip" validate:"omitempty,ip" fieldtag:"insert"`
-	UserAgent    nulls.String `db:"user_agent" fieldtag:"insert"`
-	CreatedAt    time.Time    `db:"created_at"`
+	// ImpersonatorID and ImpersonatorDisplay identify the admin acting as the actor.
+	ImpersonatorID      nulls.Int64  `db:"impersonator_id" fieldtag:"insert"`
+	ImpersonatorDisplay nulls.String `db:"impersonator_display" fieldtag:"insert"`
+	Action              string       `db:"action" validate:"required" fieldtag:"insert"`
+	Target              nulls.JSON   `db:"target" fieldtag:"insert"`
+	Result              EventResult  `db:"result" fieldtag:"insert"`
+	IP                  nulls.String `db:"ip" validate:"omitempty,ip" fieldtag:"insert"`
+	UserAgent           nulls.String `db:"user_agent" fieldtag:"insert"`
+	CreatedAt           time.Time    `db:"created_at"`
 }
 
 // PublicID returns a ID string that is suitable to be used by clients.
@@ -32,19 +32,21 @@ func NewStore(db *db.DB) *Store {
 // InsertEvent is a low-level API to create a new event entry. It requires all audit log information to be provided.
 func (s *Store) InsertEvent(ctx context.Context, event *Event) error {
 	log.GetLogger(ctx).WithFields(logrus.Fields{
-		"actor_id":   event.ActorID.Int64,
-		"actor":      event.ActorDisplay.String,
-		"action":     event.Action,
-		"target":     event.Target.Struct,
-		"result":     event.Result.String(),
-		"ip":         event.IP.String,
-		"user_agent": event.UserAgent.String,
+		"actor_id":        event.ActorID.Int64,
+		"actor":           event.ActorDisplay.String,
+		"impersonator_id": event.ImpersonatorID.Int64,
+		"action":          event.Action,
+		"target":          event.Target.Struct,
+		"result":          event.Result.String(),
+		"ip":              event.IP.String,
+		"user_agent":      event.UserAgent.String,
 	}).Info("audit event")
 	return s.db.InsertModel(ctx, event)
 }
 
 // LogEvent inserts an audit event. If actor is nil, this method will attempt to get the
-// authenticated user from context. Target must be an JSON serializable struct.
+// authenticated user from context. If the request is made by an admin impersonating the user, the
+// admin is recorded as the impersonator. Target must be an JSON serializable struct.
 func (s *Store) LogEvent(c echo.Context, actor Actor, action string, target interface{}, result EventResult) {
 	var actorID nulls.Int64
 	var actorDisplay nulls.String
@@ -55,6 +57,12 @@ func (s *Store) LogEvent(c echo.Context, actor Actor, action string, target inte
 		actorID = nulls.NewInt64(actor.ActorID())
 		actorDisplay = nulls.NewString(actor.DisplayName())
 	}
+	var impersonatorID nulls.Int64
+	var impersonatorDisplay nulls.String
+	if impersonator, ok := c.Get("impersonator").(Actor); ok {
+		impersonatorID = nulls.NewInt64(impersonator.ActorID())
+		impersonatorDisplay = nulls.NewString(impersonator.DisplayName())
+	}
 
 	targetJSON := nulls.JSON{}
 	if target != nil {
@@ -63,13 +71,15 @@ func (s *Store) LogEvent(c echo.Context, actor Actor, action string, target inte
 	ip := c.RealIP()
 	ua := apiutil.FormatUserAgent(c.Request().UserAgent())
 	event := &Event{
-		ActorID:      actorID,
-		ActorDisplay: actorDisplay,
-		Action:       action,
-		Target:       targetJSON,
-		Result:       result,
-		IP:           nulls.NewString(ip),
-		UserAgent:    nulls.NewString(ua),
+		ActorID:             actorID,
+		ActorDisplay:        actorDisplay,
+		ImpersonatorID:      impersonatorID,
+		ImpersonatorDisplay: impersonatorDisplay,
+		Action:              action,
+		Target:              targetJSON,
+		Result:              result,
+		IP:                  nulls.NewString(ip),
+		UserAgent:           nulls.NewString(ua),
 	}
 
 	err := s.InsertEvent(c.Request().Context(), event)
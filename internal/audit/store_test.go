@@ -118,6 +118,28 @@ func TestLogEvent(t *testing.T) {
 	}
 }
 
+func TestLogEventImpersonated(t *testing.T) {
+	a, teardown := storeForTest()
+	defer teardown()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("user", &mockUser{ID: 3, Name: "test"})
+	c.Set("impersonator", &mockUser{ID: 1, Name: "bob"})
+
+	a.LogEvent(c, nil, "test", nil, EventResultSuccess)
+
+	auditLogs, _, err := a.AllEventsWithQuery(context.TODO(), EventsQuery{ActorID: "3"})
+	if assert.NoError(t, err) && assert.Len(t, *auditLogs, 1) {
+		event := (*auditLogs)[0]
+		assert.Equal(t, int64(3), event.ActorID.Int64)
+		assert.Equal(t, int64(1), event.ImpersonatorID.Int64)
+		assert.Equal(t, "bob", event.ImpersonatorDisplay.String)
+	}
+}
+
 type mockUser struct {
 	ID   int64
 	Name string
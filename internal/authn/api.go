@@ -1,18 +1,36 @@
 package authn
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"authcore.io/authcore/internal/apiutil"
 	"authcore.io/authcore/internal/audit"
+	"authcore.io/authcore/internal/authn/idp"
+	"authcore.io/authcore/internal/clientapp"
 	"authcore.io/authcore/internal/errors"
 	"authcore.io/authcore/internal/session"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/cryptoutil"
 	"authcore.io/authcore/pkg/log"
+	"authcore.io/authcore/pkg/paging"
 
 	"github.com/jinzhu/copier"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// deviceIDCookieName is the name of the cookie that identifies a device for risk assessment.
+	deviceIDCookieName = "authcore_device_id"
+	// trustedDeviceCookieName is the name of the cookie that holds the trusted device token.
+	trustedDeviceCookieName = "authcore_trusted_device"
 )
 
 // APIv2 returns a function that registers Auth API 2.0 endpoints with an Echo instance.
@@ -22,26 +40,49 @@ func APIv2(tc *TransactionController, auditor audit.Auditor) func(e *echo.Echo)
 
 		g := e.Group("/api/v2")
 		g.POST("/authn", h.StartPrimary)
+		g.POST("/authn/challenge/verify", h.VerifyChallenge)
 		g.POST("/authn/password", h.RequestPassword)
 		g.POST("/authn/password/verify", h.VerifyPassword)
+		g.POST("/authn/password/legacy/verify", h.VerifyLegacyPassword)
+		g.POST("/authn/password/ldap/verify", h.VerifyLDAPPassword)
 		g.POST("/authn/mfa/:method", h.RequestMFA)
 		g.POST("/authn/mfa/:method/verify", h.VerifyMFA)
+		g.POST("/authn/mfa_enrollment/:method", h.RequestMFAEnrollment)
+		g.POST("/authn/mfa_enrollment/:method/verify", h.VerifyMFAEnrollment)
 		g.POST("/authn/idp/:provider", h.StartIDP)
 		g.POST("/authn/idp/:provider/verify", h.VerifyIDP)
+		g.POST("/authn/idp_link/:method", h.RequestIDPLink)
+		g.POST("/authn/idp_link/:method/verify", h.VerifyIDPLink)
 		g.POST("/authn/idp_binding/:provider", h.StartIDPBinding)
 		g.POST("/authn/idp_binding/:provider/verify", h.VerifyIDPBinding)
+		g.POST("/authn/ethereum", h.StartEthereum)
+		g.POST("/authn/ethereum/verify", h.VerifyEthereum)
+		g.POST("/authn/ethereum_binding", h.StartEthereumBinding)
+		g.POST("/authn/ethereum_binding/verify", h.VerifyEthereumBinding)
+		g.POST("/authn/qr", h.StartQR)
+		g.POST("/authn/qr/scan", h.ScanQR)
+		g.POST("/authn/qr/approve", h.ApproveQR)
+		g.POST("/authn/qr/reject", h.RejectQR)
 		g.POST("/authn/step_up", h.StartStepUp)
 		g.POST("/authn/step_up/password", h.RequestPasswordStepUp)
 		g.POST("/authn/step_up/password/verify", h.VerifyPasswordStepUp)
+		g.POST("/authn/step_up/mfa/:method", h.RequestMFAStepUp)
+		g.POST("/authn/step_up/mfa/:method/verify", h.VerifyMFAStepUp)
 		g.POST("/authn/password_reset", h.StartPasswordReset)
 		g.POST("/authn/password_reset/verify", h.VerifyPasswordReset)
+		g.POST("/authn/password_change", h.ChangePassword)
 		g.POST("/signup", h.SignUp)
 		g.POST("/authn/get_state", h.GetState)
+		g.GET("/rate_limits", h.ListRateLimits)
+		g.DELETE("/rate_limits", h.ResetRateLimits)
+		g.POST("/users/:id/idp/:service/token", h.GetUpstreamToken)
 
 		// Endpoints for handling third-party OAuth IDP. They are defined in this package because
 		// they are part of the IDP authn flow.
 		e.GET("/oauth/redirect", h.OauthRedirect)
 		e.GET("/oauth/arbiter-redirect", h.OauthArbiterRedirect)
+		e.GET("/saml/:provider/metadata", h.SAMLMetadata)
+		e.POST("/saml/:provider/acs", h.SAMLAssertionConsumer)
 	}
 }
 
@@ -58,7 +99,7 @@ func (h *handler) StartPrimary(c echo.Context) error {
 	if err := c.Validate(r); err != nil {
 		return err
 	}
-	state, err := h.tc.StartPrimary(c.Request().Context(), r.ClientID, r.Handle, r.RedirectURI, r.CodeChallengeMethod, r.CodeChallenge, r.ClientState)
+	state, err := h.tc.StartPrimary(h.deviceContext(c), r.ClientID, r.Handle, r.RedirectURI, r.CodeChallengeMethod, r.CodeChallenge, r.ClientState)
 	if err != nil {
 		return err
 	}
@@ -90,22 +131,73 @@ func (h *handler) VerifyPassword(c echo.Context) error {
 	if err := c.Validate(r); err != nil {
 		return err
 	}
-	state, err := h.tc.VerifyPassword(c.Request().Context(), r.StateToken, r.Verifier)
+	state, err := h.tc.VerifyPassword(h.deviceContext(c), r.StateToken, r.Verifier)
+	if err != nil {
+		return err
+	}
+	return h.sendPasswordState(c, state, "password")
+}
+
+func (h *handler) VerifyLegacyPassword(c echo.Context) error {
+	r := new(VerifyLegacyPasswordRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	state, err := h.tc.VerifyLegacyPassword(h.deviceContext(c), r.StateToken, []byte(r.Password))
+	if err != nil {
+		return err
+	}
+	return h.sendPasswordState(c, state, "legacy_password")
+}
+
+func (h *handler) VerifyLDAPPassword(c echo.Context) error {
+	r := new(VerifyLDAPPasswordRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	state, err := h.tc.VerifyLDAPPassword(h.deviceContext(c), r.StateToken, []byte(r.Password))
 	if err != nil {
 		return err
 	}
+	return h.sendPasswordState(c, state, "ldap_password")
+}
+
+// sendPasswordState logs the audit events of a password authentication and sends the state.
+func (h *handler) sendPasswordState(c echo.Context, state *State, method string) error {
+	h.logRiskAuditEvent(c, state)
 
 	if state.Status == StatusSuccess {
-		target := map[string]interface{}{"method": "password"}
+		target := map[string]interface{}{"method": method}
 		h.logStateAuditEvent(c, state, "user.authn", true, target)
 	} else if state.Status == StatusBlocked {
-		target := map[string]interface{}{"method": "password", "blocked": true}
+		target := map[string]interface{}{"method": method, "blocked": true}
 		h.logStateAuditEvent(c, state, "user.authn", false, target)
 	}
 
 	return sendState(c, state)
 }
 
+func (h *handler) VerifyChallenge(c echo.Context) error {
+	r := new(VerifyChallengeRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	state, err := h.tc.VerifyChallenge(c.Request().Context(), r.StateToken, r.Response)
+	if err != nil {
+		return err
+	}
+	return sendState(c, state)
+}
+
 func (h *handler) RequestMFA(c echo.Context) error {
 	method := c.Param("method")
 	r := new(MFARequest)
@@ -133,11 +225,26 @@ func (h *handler) VerifyMFA(c echo.Context) error {
 	if err := c.Validate(r); err != nil {
 		return err
 	}
-	state, err := h.tc.VerifyMFA(c.Request().Context(), r.StateToken, method, r.Verifier)
+	state, err := h.tc.VerifyMFA(h.deviceContext(c), r.StateToken, method, r.Verifier, r.TrustDevice)
 	if err != nil {
 		return err
 	}
+	if state.TrustedDeviceToken != "" {
+		c.SetCookie(&http.Cookie{
+			Name:     trustedDeviceCookieName,
+			Value:    state.TrustedDeviceToken,
+			Path:     "/",
+			MaxAge:   int(viper.GetDuration("trusted_device_expires_in").Seconds()),
+			Secure:   strings.HasPrefix(viper.GetString("base_url"), "https://"),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
 
+	if state.IDPLinked {
+		target := map[string]interface{}{"provider": state.IDP, "method": method}
+		h.logStateAuditEvent(c, state, "user.idp_link", true, target)
+	}
 	if state.Status == StatusSuccess {
 		target := map[string]interface{}{"method": "mfa"}
 		h.logStateAuditEvent(c, state, "user.authn", true, target)
@@ -149,6 +256,51 @@ func (h *handler) VerifyMFA(c echo.Context) error {
 	return sendState(c, state)
 }
 
+func (h *handler) RequestMFAEnrollment(c echo.Context) error {
+	method := c.Param("method")
+	r := new(MFAEnrollmentRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	enrollment, err := h.tc.RequestMFAEnrollment(c.Request().Context(), r.StateToken, method, r.PhoneNumber)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, &MFAEnrollmentResponse{
+		Secret:      enrollment.Secret,
+		URI:         enrollment.URI,
+		BackupCodes: enrollment.BackupCodes,
+	})
+}
+
+func (h *handler) VerifyMFAEnrollment(c echo.Context) error {
+	method := c.Param("method")
+	r := new(VerifyMFARequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	state, err := h.tc.VerifyMFAEnrollment(h.deviceContext(c), r.StateToken, method, r.Verifier)
+	if err != nil {
+		return err
+	}
+
+	if state.Status == StatusSuccess {
+		target := map[string]interface{}{"method": "mfa_enrollment", "mfa_method": method}
+		h.logStateAuditEvent(c, state, "user.authn", true, target)
+	} else if state.Status == StatusBlocked {
+		target := map[string]interface{}{"method": "mfa_enrollment", "blocked": true}
+		h.logStateAuditEvent(c, state, "user.authn", false, target)
+	}
+
+	return sendState(c, state)
+}
+
 func (h *handler) StartIDP(c echo.Context) error {
 	idpID := c.Param("provider")
 	r := new(StartIDPRequest)
@@ -173,15 +325,66 @@ func (h *handler) VerifyIDP(c echo.Context) error {
 	if err := c.Validate(r); err != nil {
 		return err
 	}
-	ctx := c.Request().Context()
-	state, err := h.tc.VerifyIDP(ctx, r.StateToken, r.Code)
+	state, err := h.tc.VerifyIDP(h.deviceContext(c), r.StateToken, r.Code)
+	if err != nil {
+		return err
+	}
+
+	h.logRiskAuditEvent(c, state)
+	if state.Status == StatusSuccess {
+		target := map[string]interface{}{"method": "idp", "provider": state.IDP}
+		h.logStateAuditEvent(c, state, "user.authn", true, target)
+	} else if state.Status == StatusBlocked {
+		target := map[string]interface{}{"method": "idp", "provider": state.IDP, "blocked": true}
+		h.logStateAuditEvent(c, state, "user.authn", false, target)
+	}
+
+	return sendState(c, state)
+}
+
+func (h *handler) RequestIDPLink(c echo.Context) error {
+	method := c.Param("method")
+	r := new(IDPLinkRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	challenge, err := h.tc.RequestIDPLink(c.Request().Context(), r.StateToken, method, r.Message)
 	if err != nil {
 		return err
 	}
+	return c.JSON(http.StatusOK, &IDPLinkResponse{
+		Challenge: challenge,
+	})
+}
 
+func (h *handler) VerifyIDPLink(c echo.Context) error {
+	method := c.Param("method")
+	r := new(VerifyIDPLinkRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	state, err := h.tc.VerifyIDPLink(h.deviceContext(c), r.StateToken, method, r.Verifier)
+	if err != nil {
+		return err
+	}
+
+	if state.IDPLinked {
+		target := map[string]interface{}{"provider": state.IDP, "method": method}
+		h.logStateAuditEvent(c, state, "user.idp_link", true, target)
+	}
+	h.logRiskAuditEvent(c, state)
 	if state.Status == StatusSuccess {
 		target := map[string]interface{}{"method": "idp", "provider": state.IDP}
 		h.logStateAuditEvent(c, state, "user.authn", true, target)
+	} else if state.Status == StatusBlocked {
+		target := map[string]interface{}{"method": "idp", "provider": state.IDP, "blocked": true}
+		h.logStateAuditEvent(c, state, "user.authn", false, target)
 	}
 
 	return sendState(c, state)
@@ -232,6 +435,172 @@ func (h *handler) VerifyIDPBinding(c echo.Context) error {
 	return sendState(c, state)
 }
 
+func (h *handler) StartEthereum(c echo.Context) error {
+	r := new(StartEthereumRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	state, err := h.tc.StartEthereum(c.Request().Context(), r.ClientID, r.Address, r.ChainID, r.RedirectURI, r.CodeChallengeMethod, r.CodeChallenge, r.ClientState)
+	if err != nil {
+		return err
+	}
+	return sendState(c, state)
+}
+
+func (h *handler) VerifyEthereum(c echo.Context) error {
+	r := new(VerifyEthereumRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	state, err := h.tc.VerifyEthereum(h.deviceContext(c), r.StateToken, r.Signature)
+	if err != nil {
+		return err
+	}
+
+	h.logRiskAuditEvent(c, state)
+	if state.Status == StatusSuccess {
+		target := map[string]interface{}{"method": "ethereum", "address": state.EthereumAddress}
+		h.logStateAuditEvent(c, state, "user.authn", true, target)
+	} else if state.Status == StatusBlocked {
+		target := map[string]interface{}{"method": "ethereum", "address": state.EthereumAddress, "blocked": true}
+		h.logStateAuditEvent(c, state, "user.authn", false, target)
+	}
+
+	return sendState(c, state)
+}
+
+func (h *handler) StartEthereumBinding(c echo.Context) error {
+	currentSess, ok := session.FromContext(c)
+	if !ok {
+		return errors.New(errors.ErrorUnauthenticated, "")
+	}
+	r := new(StartEthereumBindingRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	state, err := h.tc.StartEthereumBinding(c.Request().Context(), currentSess.UserID, currentSess.ClientID.String, r.Address, r.ChainID)
+	if err != nil {
+		return err
+	}
+	return sendState(c, state)
+}
+
+func (h *handler) VerifyEthereumBinding(c echo.Context) error {
+	currentSess, ok := session.FromContext(c)
+	if !ok {
+		return errors.New(errors.ErrorUnauthenticated, "")
+	}
+	r := new(VerifyEthereumRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	state, err := h.tc.VerifyEthereumBinding(c.Request().Context(), r.StateToken, currentSess.UserID, currentSess.ClientID.String, r.Signature)
+	if err != nil {
+		return err
+	}
+
+	if state.Status == StatusIDPBindingSuccess {
+		target := map[string]interface{}{"provider": "ethereum", "address": state.EthereumAddress}
+		h.logStateAuditEvent(c, state, "user.bind_idp", true, target)
+	}
+
+	return sendState(c, state)
+}
+
+func (h *handler) StartQR(c echo.Context) error {
+	r := new(StartQRRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	state, err := h.tc.StartQR(h.deviceContext(c), r.ClientID, r.RedirectURI, r.CodeChallengeMethod, r.CodeChallenge, r.ClientState)
+	if err != nil {
+		return err
+	}
+	h.logStateAuditEvent(c, state, "user.qr_sign_in_request", true, qrAuditTarget(state))
+	return sendState(c, state)
+}
+
+func (h *handler) ScanQR(c echo.Context) error {
+	currentSess, ok := session.FromContext(c)
+	if !ok {
+		return errors.New(errors.ErrorUnauthenticated, "")
+	}
+	r := new(QRCodeRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	state, err := h.tc.ScanQR(c.Request().Context(), currentSess, r.Code)
+	h.logQRAuditEvent(c, "user.qr_sign_in_scan", state, err)
+	if err != nil {
+		return err
+	}
+	return sendQRSignIn(c, state)
+}
+
+func (h *handler) ApproveQR(c echo.Context) error {
+	currentSess, ok := session.FromContext(c)
+	if !ok {
+		return errors.New(errors.ErrorUnauthenticated, "")
+	}
+	r := new(QRCodeRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	state, err := h.tc.ApproveQR(c.Request().Context(), currentSess, r.Code)
+	h.logQRAuditEvent(c, "user.qr_sign_in_approve", state, err)
+	if err != nil {
+		return err
+	}
+	h.logRiskAuditEvent(c, state)
+
+	if state.Status == StatusSuccess {
+		h.logStateAuditEvent(c, state, "user.authn", true, qrAuditTarget(state))
+	}
+
+	return sendQRSignIn(c, state)
+}
+
+func (h *handler) RejectQR(c echo.Context) error {
+	currentSess, ok := session.FromContext(c)
+	if !ok {
+		return errors.New(errors.ErrorUnauthenticated, "")
+	}
+	r := new(QRCodeRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	state, err := h.tc.RejectQR(c.Request().Context(), currentSess, r.Code)
+	h.logQRAuditEvent(c, "user.qr_sign_in_reject", state, err)
+	if err != nil {
+		return err
+	}
+	return sendQRSignIn(c, state)
+}
+
 func (h *handler) StartStepUp(c echo.Context) error {
 	currentSess, ok := session.FromContext(c)
 	if !ok {
@@ -293,6 +662,54 @@ func (h *handler) VerifyPasswordStepUp(c echo.Context) error {
 	return sendState(c, state)
 }
 
+func (h *handler) RequestMFAStepUp(c echo.Context) error {
+	currentSess, ok := session.FromContext(c)
+	if !ok {
+		return errors.New(errors.ErrorUnauthenticated, "")
+	}
+	method := c.Param("method")
+	r := new(MFARequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	challenge, err := h.tc.RequestMFAStepUp(c.Request().Context(), r.StateToken, currentSess.ID, method, r.Message)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, &MFAResponse{
+		Challenge: challenge,
+	})
+}
+
+func (h *handler) VerifyMFAStepUp(c echo.Context) error {
+	currentSess, ok := session.FromContext(c)
+	if !ok {
+		return errors.New(errors.ErrorUnauthenticated, "")
+	}
+	method := c.Param("method")
+	r := new(VerifyMFARequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	state, err := h.tc.VerifyMFAStepUp(c.Request().Context(), r.StateToken, currentSess.ID, method, r.Verifier)
+	if err != nil {
+		return err
+	}
+
+	if state.Status == StatusStepUpSuccess {
+		target := map[string]interface{}{"method": "mfa"}
+		h.logStateAuditEvent(c, state, "user.step_up_authn", true, target)
+	}
+
+	return sendState(c, state)
+}
+
 func (h *handler) StartPasswordReset(c echo.Context) error {
 	r := new(StartPasswordResetRequest)
 	if err := c.Bind(r); err != nil {
@@ -334,6 +751,30 @@ func (h *handler) VerifyPasswordReset(c echo.Context) error {
 	return sendState(c, state)
 }
 
+func (h *handler) ChangePassword(c echo.Context) error {
+	r := new(ChangePasswordRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	verifierJSON, err := json.Marshal(r.PasswordVerifier)
+	if err != nil {
+		return errors.New(errors.ErrorInvalidArgument, "invalid password_verifier")
+	}
+	state, err := h.tc.ChangePassword(h.deviceContext(c), r.StateToken, string(verifierJSON))
+	if err != nil {
+		return err
+	}
+	h.logStateAuditEvent(c, state, "user.password_change", true, nil)
+	if state.Status == StatusSuccess {
+		target := map[string]interface{}{"method": "password"}
+		h.logStateAuditEvent(c, state, "user.authn", true, target)
+	}
+	return sendState(c, state)
+}
+
 func (h *handler) GetState(c echo.Context) error {
 	r := new(GetStateRequest)
 	if err := c.Bind(r); err != nil {
@@ -342,7 +783,14 @@ func (h *handler) GetState(c echo.Context) error {
 	if err := c.Validate(r); err != nil {
 		return err
 	}
-	state, err := h.tc.store.GetState(c.Request().Context(), r.StateToken)
+	ctx := c.Request().Context()
+	var state *State
+	var err error
+	if r.Wait > 0 {
+		state, err = h.tc.WaitState(ctx, r.StateToken, r.Status, time.Duration(r.Wait)*time.Second)
+	} else {
+		state, err = h.tc.store.GetState(ctx, r.StateToken)
+	}
 	if err != nil {
 		return err
 	}
@@ -362,10 +810,13 @@ func (h *handler) SignUp(c echo.Context) error {
 		return errors.New(errors.ErrorInvalidArgument, "invalid password_verifier")
 	}
 	ctx := c.Request().Context()
-	state, err := h.tc.SignUp(ctx, r.ClientID, r.RedirectURI, r.Email, r.Phone, string(verifierJSON), r.Name, r.Language)
+	state, err := h.tc.SignUp(ctx, r.ClientID, r.RedirectURI, r.Email, r.Phone, string(verifierJSON), r.Name, r.Language, r.InvitationToken, r.StateToken, r.ChallengeResponse)
 	if err != nil {
 		return err
 	}
+	if state.Status == StatusChallengeRequired {
+		return sendState(c, state)
+	}
 
 	h.logStateAuditEvent(c, state, "user.sign_up", true, nil)
 
@@ -390,16 +841,76 @@ func (h *handler) OauthRedirect(c echo.Context) error {
 		return errors.New(errors.ErrorPermissionDenied, "illegal state")
 	}
 
-	// Redirect to client-side arbiter to verify the code grant
+	return redirectToArbiter(c, state, r.Code, r.OauthVerifier)
+}
+
+// SAMLMetadata returns the SAML service provider metadata for a SAML IDP.
+func (h *handler) SAMLMetadata(c echo.Context) error {
+	provider, err := h.samlProvider(c.Param("provider"))
+	if err != nil {
+		return err
+	}
+	metadata, err := provider.Metadata()
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, "application/samlmetadata+xml", metadata)
+}
+
+// SAMLAssertionConsumer receives a SAML response with the HTTP-POST binding. The response is stored
+// and exchanged with a one-time code by the client-side arbiter, as with an OAuth redirect.
+func (h *handler) SAMLAssertionConsumer(c echo.Context) error {
+	provider, err := h.samlProvider(c.Param("provider"))
+	if err != nil {
+		return err
+	}
+	r := new(SAMLAssertionConsumerRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	state, err := h.tc.store.GetState(ctx, r.RelayState)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorPermissionDenied, "state not found")
+	}
+	if (state.Status != StatusIDP && state.Status != StatusIDPBinding) || state.IDP != provider.ID() {
+		return errors.New(errors.ErrorPermissionDenied, "illegal state")
+	}
+
+	code, err := provider.StoreResponse(r.SAMLResponse)
+	if err != nil {
+		return err
+	}
+	return redirectToArbiter(c, state, code, "")
+}
+
+func (h *handler) samlProvider(id string) (*idp.SAMLProvider, error) {
+	provider, err := h.tc.idpFactory.IDP(id)
+	if err != nil {
+		return nil, errors.New(errors.ErrorNotFound, "invalid IDP")
+	}
+	samlProvider, ok := provider.(*idp.SAMLProvider)
+	if !ok {
+		return nil, errors.New(errors.ErrorNotFound, "invalid IDP")
+	}
+	return samlProvider, nil
+}
+
+// redirectToArbiter redirects to the client-side arbiter to verify the code grant.
+func redirectToArbiter(c echo.Context, state *State, code, oauthVerifier string) error {
 	redirectURL, err := url.Parse("/widgets/oauth/arbiter")
 	if err != nil {
 		logrus.Fatal(err.Error())
 	}
 	q := redirectURL.Query()
 	q.Add("clientId", state.ClientID)
-	q.Add("state", r.State)
-	q.Add("code", r.Code)
-	q.Add("oauth_verifier", r.OauthVerifier)
+	q.Add("state", state.StateToken)
+	q.Add("code", code)
+	q.Add("oauth_verifier", oauthVerifier)
 	redirectURL.RawQuery = q.Encode()
 	c.Redirect(http.StatusFound, redirectURL.String())
 	return nil
@@ -422,6 +933,113 @@ func (h *handler) OauthArbiterRedirect(c echo.Context) error {
 	return nil
 }
 
+func (h *handler) ListRateLimits(c echo.Context) error {
+	r, userID, err := bindRateLimitsRequest(c)
+	if err != nil {
+		return err
+	}
+	buckets, err := h.tc.store.ListRateLimiterBuckets(c.Request().Context(), userID, r.IP, r.Handle)
+	if err != nil {
+		return err
+	}
+	resp := apiutil.NewListPagination(buckets, &paging.Page{})
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *handler) ResetRateLimits(c echo.Context) error {
+	r, userID, err := bindRateLimitsRequest(c)
+	if err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	err = h.tc.store.ResetRateLimiterBuckets(ctx, userID, r.IP, r.Handle)
+	if err != nil {
+		return err
+	}
+	log.GetLogger(ctx).WithFields(logrus.Fields{
+		"user_id": r.UserID,
+		"ip":      r.IP,
+	}).Info("rate limiters reset")
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetUpstreamToken returns a fresh upstream access token of the user for an IDP. It is only
+// available to service accounts.
+func (h *handler) GetUpstreamToken(c echo.Context) error {
+	if _, ok := user.FromContext(c); ok {
+		return errors.New(errors.ErrorPermissionDenied, "token vault is only available to service accounts")
+	}
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorInvalidArgument, "")
+	}
+	ctx := c.Request().Context()
+	grant, err := h.tc.UpstreamGrant(ctx, userID, c.Param("service"))
+	if err != nil {
+		return err
+	}
+	target := map[string]interface{}{
+		"user_id": c.Param("id"),
+		"idp":     c.Param("service"),
+	}
+	h.auditor.LogEvent(c, nil, "user.idp_token", target, audit.EventResultSuccess)
+
+	resp := UpstreamTokenResponse{
+		AccessToken:  grant.AccessToken,
+		AccessSecret: grant.AccessSecret,
+		TokenType:    grant.TokenType,
+	}
+	if !grant.Expiry.IsZero() {
+		resp.ExpiresAt = &grant.Expiry
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func bindRateLimitsRequest(c echo.Context) (r *RateLimitsRequest, userID int64, err error) {
+	r = new(RateLimitsRequest)
+	if err = c.Bind(r); err != nil {
+		return
+	}
+	if r.UserID == "" && r.IP == "" && r.Handle == "" {
+		err = errors.New(errors.ErrorInvalidArgument, "one of user_id, ip or handle is required")
+		return
+	}
+	if r.UserID != "" {
+		userID, err = strconv.ParseInt(r.UserID, 10, 64)
+		if err != nil {
+			err = errors.Wrap(err, errors.ErrorInvalidArgument, "invalid user_id")
+			return
+		}
+	}
+	return
+}
+
+// deviceContext returns the request context with the device ID from the device cookie and the
+// trusted device token if presented. A new device ID is issued if the cookie is not present.
+func (h *handler) deviceContext(c echo.Context) context.Context {
+	deviceID := ""
+	if cookie, err := c.Cookie(deviceIDCookieName); err == nil {
+		deviceID = cookie.Value
+	}
+	if deviceID == "" {
+		deviceID = cryptoutil.RandomToken32()
+		c.SetCookie(&http.Cookie{
+			Name:     deviceIDCookieName,
+			Value:    deviceID,
+			Path:     "/",
+			MaxAge:   int(viper.GetDuration("risk_known_device_expiry").Seconds()),
+			Secure:   strings.HasPrefix(viper.GetString("base_url"), "https://"),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	ctx := WithDeviceID(c.Request().Context(), deviceID)
+	if cookie, err := c.Cookie(trustedDeviceCookieName); err == nil {
+		ctx = WithTrustedDeviceToken(ctx, cookie.Value)
+	}
+	return ctx
+}
+
 func (h *handler) logStateAuditEvent(c echo.Context, state *State, action string, success bool, target interface{}) {
 	var actor audit.Actor
 	var err error
@@ -442,6 +1060,31 @@ func (h *handler) logStateAuditEvent(c echo.Context, state *State, action string
 	h.auditor.LogEvent(c, actor, action, target, result)
 }
 
+// logRiskAuditEvent logs the risk assessment of the state if the risk engine has assessed it.
+func (h *handler) logRiskAuditEvent(c echo.Context, state *State) {
+	if state.Risk != nil {
+		h.logStateAuditEvent(c, state, "user.authn_risk", state.Risk.Decision != RiskBlock, state.Risk)
+	}
+}
+
+// logQRAuditEvent logs an audit event of the current user on the device approving a QR sign-in.
+// state is nil if the request failed.
+func (h *handler) logQRAuditEvent(c echo.Context, action string, state *State, err error) {
+	if err != nil {
+		h.auditor.LogEvent(c, nil, action, map[string]interface{}{"method": "qr"}, audit.EventResultFail)
+		return
+	}
+	h.auditor.LogEvent(c, nil, action, qrAuditTarget(state), audit.EventResultSuccess)
+}
+
+func qrAuditTarget(state *State) map[string]interface{} {
+	return map[string]interface{}{
+		"method":    "qr",
+		"client_id": state.ClientID,
+		"device":    state.QRDevice,
+	}
+}
+
 // StartPrimaryRequest is the request for StartPrimary.
 type StartPrimaryRequest struct {
 	ClientID            string `json:"client_id"`
@@ -464,16 +1107,41 @@ type VerifyPasswordRequest struct {
 	Verifier   []byte `json:"verifier" validate:"required"`
 }
 
+// VerifyLegacyPasswordRequest is the request for VerifyLegacyPassword.
+type VerifyLegacyPasswordRequest struct {
+	StateToken string `json:"state_token" validate:"required"`
+	Password   string `json:"password" validate:"required"`
+}
+
+// VerifyLDAPPasswordRequest is the request for VerifyLDAPPassword.
+type VerifyLDAPPasswordRequest struct {
+	StateToken string `json:"state_token" validate:"required"`
+	Password   string `json:"password" validate:"required"`
+}
+
+// VerifyChallengeRequest is the request for VerifyChallenge.
+type VerifyChallengeRequest struct {
+	StateToken string `json:"state_token" validate:"required"`
+	Response   string `json:"response" validate:"required"`
+}
+
 // MFARequest is the request for RequestMFA.
 type MFARequest struct {
 	StateToken string `json:"state_token" validate:"required"`
 	Message    []byte `json:"message"`
 }
 
+// MFAEnrollmentRequest is the request for RequestMFAEnrollment.
+type MFAEnrollmentRequest struct {
+	StateToken  string `json:"state_token" validate:"required"`
+	PhoneNumber string `json:"phone_number" validate:"omitempty,phone"`
+}
+
 // VerifyMFARequest is the request for VerifyMFA.
 type VerifyMFARequest struct {
-	StateToken string `json:"state_token" validate:"required"`
-	Verifier   []byte `json:"verifier" validate:"required"`
+	StateToken  string `json:"state_token" validate:"required"`
+	Verifier    []byte `json:"verifier" validate:"required"`
+	TrustDevice bool   `json:"trust_device"`
 }
 
 // StartIDPRequest is the request for StartIDP.
@@ -491,6 +1159,18 @@ type VerifyIDPRequest struct {
 	Code       string `json:"code" validate:"required"`
 }
 
+// IDPLinkRequest is the request for RequestIDPLink.
+type IDPLinkRequest struct {
+	StateToken string `json:"state_token" validate:"required"`
+	Message    []byte `json:"message"`
+}
+
+// VerifyIDPLinkRequest is the request for VerifyIDPLink.
+type VerifyIDPLinkRequest struct {
+	StateToken string `json:"state_token" validate:"required"`
+	Verifier   []byte `json:"verifier" validate:"required"`
+}
+
 // StartIDPBindingRequest is the request for StartIDPBinding.
 type StartIDPBindingRequest struct {
 	RedirectURI string `json:"redirect_uri"`
@@ -502,6 +1182,46 @@ type VerifyIDPBindingRequest struct {
 	Code       string `json:"code" validate:"required"`
 }
 
+// StartEthereumRequest is the request for StartEthereum. ChainID is the EIP-155 chain ID of the
+// network that the wallet is connected to.
+type StartEthereumRequest struct {
+	ClientID            string `json:"client_id"`
+	Address             string `json:"address" validate:"required"`
+	ChainID             int64  `json:"chain_id" validate:"required"`
+	RedirectURI         string `json:"redirect_uri"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	CodeChallenge       string `json:"code_challenge"`
+	ClientState         string `json:"client_state"`
+}
+
+// VerifyEthereumRequest is the request for VerifyEthereum and VerifyEthereumBinding. Signature is
+// the hex-encoded personal_sign signature of the SIWE message of the state.
+type VerifyEthereumRequest struct {
+	StateToken string `json:"state_token" validate:"required"`
+	Signature  string `json:"signature" validate:"required"`
+}
+
+// StartEthereumBindingRequest is the request for StartEthereumBinding.
+type StartEthereumBindingRequest struct {
+	Address string `json:"address" validate:"required"`
+	ChainID int64  `json:"chain_id" validate:"required"`
+}
+
+// StartQRRequest is the request for StartQR.
+type StartQRRequest struct {
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	CodeChallenge       string `json:"code_challenge"`
+	ClientState         string `json:"client_state"`
+}
+
+// QRCodeRequest is the request for ScanQR, ApproveQR and RejectQR. Code is the code or the payload
+// of the QR code.
+type QRCodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
 // StartPasswordResetRequest is the request for StartPasswordReset.
 type StartPasswordResetRequest struct {
 	Handle   string `json:"handle"`
@@ -515,9 +1235,20 @@ type VerifyPasswordResetRequest struct {
 	PasswordVerifier map[string]interface{} `json:"password_verifier"`
 }
 
+// ChangePasswordRequest is the request for ChangePassword.
+type ChangePasswordRequest struct {
+	StateToken       string                 `json:"state_token" validate:"required"`
+	PasswordVerifier map[string]interface{} `json:"password_verifier" validate:"required"`
+}
+
 // GetStateRequest is the request for GetState.
+//
+// If Wait is set, the response is held for at most Wait seconds until the status of the state is
+// different from Status, or from the current status if Status is empty.
 type GetStateRequest struct {
 	StateToken string `json:"state_token" validate:"required"`
+	Status     string `json:"status"`
+	Wait       int    `json:"wait" validate:"min=0"`
 }
 
 // OauthRedirectRequest is the request OauthRedirect.
@@ -527,6 +1258,13 @@ type OauthRedirectRequest struct {
 	OauthVerifier string `query:"oauth_verifier"`
 }
 
+// SAMLAssertionConsumerRequest is the request for SAMLAssertionConsumer. RelayState is the state
+// token.
+type SAMLAssertionConsumerRequest struct {
+	SAMLResponse string `form:"SAMLResponse" validate:"required"`
+	RelayState   string `form:"RelayState" validate:"required"`
+}
+
 // OauthRedirectArbiterRequest is the request for OauthRedirectArbiter.
 type OauthRedirectArbiterRequest struct {
 	ClientID    string `query:"client_id" validate:"required"`
@@ -545,6 +1283,19 @@ type SignUpRequest struct {
 	Phone    string `json:"phone" validate:"required_without=Email,omitempty,phone"`
 	Name     string `json:"name"`
 	Language string `json:"language"`
+	// InvitationToken is the token in an invitation link. It allows sign-up when the client only
+	// allows invited users.
+	InvitationToken string `json:"invitation_token"`
+	// StateToken and ChallengeResponse are the solution to a sign up challenge.
+	StateToken        string `json:"state_token"`
+	ChallengeResponse string `json:"challenge_response"`
+}
+
+// RateLimitsRequest is the request for ListRateLimits and ResetRateLimits.
+type RateLimitsRequest struct {
+	UserID string `query:"user_id"`
+	IP     string `query:"ip"`
+	Handle string `query:"handle"`
 }
 
 // PasswordResponse is the response body for RequestPassword.
@@ -557,18 +1308,52 @@ type MFAResponse struct {
 	Challenge []byte `json:"challenge"`
 }
 
+// IDPLinkResponse is the response for RequestIDPLink.
+type IDPLinkResponse struct {
+	Challenge []byte `json:"challenge"`
+}
+
+// MFAEnrollmentResponse is the response for RequestMFAEnrollment.
+type MFAEnrollmentResponse struct {
+	Secret      string   `json:"secret,omitempty"`
+	URI         string   `json:"uri,omitempty"`
+	BackupCodes []string `json:"backup_codes,omitempty"`
+}
+
+// UpstreamTokenResponse is the response for GetUpstreamToken.
+type UpstreamTokenResponse struct {
+	AccessToken  string     `json:"access_token"`
+	AccessSecret string     `json:"access_secret,omitempty"` // OAuth 1.0
+	TokenType    string     `json:"token_type,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+}
+
+// QRSignInResponse is the response for ScanQR, ApproveQR and RejectQR. It describes the device
+// requesting the sign-in without exposing the state of the transaction.
+type QRSignInResponse struct {
+	Status     string     `json:"status"`
+	ClientID   string     `json:"client_id"`
+	ClientName string     `json:"client_name"`
+	Device     *QRDevice  `json:"device"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
 // JSONState represents a AuthnState in Authn API.
 type JSONState struct {
-	StateToken          string   `json:"state_token" validate:"required"`
-	Status              string   `json:"status" validate:"required"`
-	PasswordMethod      string   `json:"password_method"`
-	PasswordSalt        []byte   `json:"password_salt"`
-	Factors             []string `json:"factors"`
-	IDP                 string   `json:"idp"`
-	IDPAuthorizationURL string   `json:"idp_authorization_url"`
-	AuthorizationCode   string   `json:"authorization_code"`
-	RedirectURI         string   `json:"redirect_uri"`
-	ClientState         string   `json:"client_state"`
+	StateToken          string     `json:"state_token" validate:"required"`
+	Status              string     `json:"status" validate:"required"`
+	PasswordMethod      string     `json:"password_method"`
+	PasswordSalt        []byte     `json:"password_salt"`
+	Factors             []string   `json:"factors"`
+	IDP                 string     `json:"idp"`
+	IDPAuthorizationURL string     `json:"idp_authorization_url"`
+	SIWEMessage         string     `json:"siwe_message,omitempty"`
+	QRPayload           string     `json:"qr_payload,omitempty"`
+	QRExpiresAt         *time.Time `json:"qr_expires_at,omitempty"`
+	AuthorizationCode   string     `json:"authorization_code"`
+	RedirectURI         string     `json:"redirect_uri"`
+	ClientState         string     `json:"client_state"`
+	Challenge           *Challenge `json:"challenge,omitempty"`
 }
 
 // NewJSONState converts a State into JSONState.
@@ -585,3 +1370,17 @@ func sendState(c echo.Context, state *State) error {
 	}
 	return c.JSON(http.StatusOK, resp)
 }
+
+func sendQRSignIn(c echo.Context, state *State) error {
+	clientApp, err := clientapp.GetByClientID(state.ClientID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, &QRSignInResponse{
+		Status:     state.Status,
+		ClientID:   clientApp.ID,
+		ClientName: clientApp.Name,
+		Device:     state.QRDevice,
+		ExpiresAt:  state.QRExpiresAt,
+	})
+}
@@ -0,0 +1,306 @@
+package authn
+
+import (
+	"context"
+	"crypto/subtle"
+
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/session"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/cryptoutil"
+	"authcore.io/authcore/pkg/log"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// ChallengePoW is a proof-of-work challenge.
+	ChallengePoW = "pow"
+	// ChallengeCaptcha is a CAPTCHA challenge.
+	ChallengeCaptcha = "captcha"
+)
+
+// Challenge is a challenge that must be solved by the client before an authentication transaction
+// proceeds.
+type Challenge struct {
+	Type       string `json:"type"`
+	Challenge  string `json:"challenge,omitempty"`
+	Difficulty int64  `json:"difficulty,omitempty"`
+	SiteKey    string `json:"site_key,omitempty"`
+}
+
+// Challenger issues and verifies challenges.
+type Challenger interface {
+	// Type returns the challenge type.
+	Type() string
+	// Issue returns a new challenge. failures is the number of recent failed authentications from
+	// the same source and may be used to adjust the difficulty.
+	Issue(ctx context.Context, failures int64) (*Challenge, error)
+	// Verify returns whether response solves the challenge.
+	Verify(ctx context.Context, challenge *Challenge, response string) (bool, error)
+}
+
+// CaptchaProvider verifies CAPTCHA responses with a CAPTCHA service.
+type CaptchaProvider interface {
+	// SiteKey returns the public key for rendering the CAPTCHA widget.
+	SiteKey() string
+	// Verify verifies a CAPTCHA response submitted from remoteIP.
+	Verify(ctx context.Context, response, remoteIP string) (bool, error)
+}
+
+// PoWChallenger issues proof-of-work challenges. The difficulty is doubled for every failed
+// authentication above challenge_failure_threshold, up to pow_challenge_max_difficulty.
+type PoWChallenger struct{}
+
+// NewPoWChallenger returns a new PoWChallenger.
+func NewPoWChallenger() *PoWChallenger {
+	return &PoWChallenger{}
+}
+
+// Type implements Challenger.
+func (*PoWChallenger) Type() string {
+	return ChallengePoW
+}
+
+// Issue implements Challenger.
+func (*PoWChallenger) Issue(ctx context.Context, failures int64) (*Challenge, error) {
+	challenge, err := cryptoutil.CreateProofOfWorkChallenge("authn")
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return &Challenge{
+		Type:       ChallengePoW,
+		Challenge:  challenge,
+		Difficulty: powDifficulty(failures),
+	}, nil
+}
+
+// Verify implements Challenger.
+func (*PoWChallenger) Verify(ctx context.Context, challenge *Challenge, response string) (bool, error) {
+	ok, _ := cryptoutil.VerifyProofOfWork(challenge.Challenge, response, challenge.Difficulty)
+	return ok, nil
+}
+
+func powDifficulty(failures int64) int64 {
+	difficulty := viper.GetInt64("pow_challenge_difficulty")
+	maxDifficulty := viper.GetInt64("pow_challenge_max_difficulty")
+	for i := viper.GetInt64("challenge_failure_threshold"); i < failures && difficulty < maxDifficulty; i++ {
+		difficulty *= 2
+	}
+	if difficulty > maxDifficulty {
+		difficulty = maxDifficulty
+	}
+	return difficulty
+}
+
+// CaptchaChallenger issues CAPTCHA challenges verified by a CaptchaProvider.
+type CaptchaChallenger struct {
+	provider CaptchaProvider
+}
+
+// NewCaptchaChallenger returns a new CaptchaChallenger.
+func NewCaptchaChallenger(provider CaptchaProvider) *CaptchaChallenger {
+	return &CaptchaChallenger{provider: provider}
+}
+
+// Type implements Challenger.
+func (*CaptchaChallenger) Type() string {
+	return ChallengeCaptcha
+}
+
+// Issue implements Challenger.
+func (c *CaptchaChallenger) Issue(ctx context.Context, failures int64) (*Challenge, error) {
+	return &Challenge{
+		Type:    ChallengeCaptcha,
+		SiteKey: c.provider.SiteKey(),
+	}, nil
+}
+
+// Verify implements Challenger.
+func (c *CaptchaChallenger) Verify(ctx context.Context, challenge *Challenge, response string) (bool, error) {
+	ip, _ := ctx.Value(session.IPKey{}).(string)
+	return c.provider.Verify(ctx, response, ip)
+}
+
+// StubCaptchaProvider is a CaptchaProvider for development and testing. It accepts a fixed
+// response.
+type StubCaptchaProvider struct {
+	siteKey  string
+	response string
+}
+
+// NewStubCaptchaProvider returns a new StubCaptchaProvider.
+func NewStubCaptchaProvider(siteKey, response string) *StubCaptchaProvider {
+	return &StubCaptchaProvider{siteKey: siteKey, response: response}
+}
+
+// SiteKey implements CaptchaProvider.
+func (p *StubCaptchaProvider) SiteKey() string {
+	return p.siteKey
+}
+
+// Verify implements CaptchaProvider.
+func (p *StubCaptchaProvider) Verify(ctx context.Context, response, remoteIP string) (bool, error) {
+	return response != "" && subtle.ConstantTimeCompare([]byte(response), []byte(p.response)) == 1, nil
+}
+
+// RegisterChallenger adds a challenger. The challenger of type challenge_type is used.
+func (tc *TransactionController) RegisterChallenger(challenger Challenger) {
+	tc.challengers[challenger.Type()] = challenger
+}
+
+// VerifyChallenge verifies the response to the challenge of an authentication transaction and
+// resumes the transaction.
+func (tc *TransactionController) VerifyChallenge(ctx context.Context, stateToken, response string) (*State, error) {
+	return tc.stateMutation(ctx, stateToken, StatusChallengeRequired, func(state *State, u *user.User) error {
+		err := tc.verifyChallenge(ctx, state, response)
+		if err != nil {
+			tc.store.IncrementSourceRateLimiter(ctx, state.Handle)
+			return err
+		}
+		state.Status = state.ChallengeNextStatus
+		state.ChallengeNextStatus = ""
+		if state.Status == StatusLDAP {
+			mutateLDAP(state)
+			return nil
+		}
+		return mutatePrimary(state, u)
+	})
+}
+
+// issueChallenge puts the state to CHALLENGE_REQUIRED if the recent failed authentications from
+// the source have exceeded challenge_failure_threshold, challenge_required is set or a risk signal
+// of the user triggers a challenge rule.
+func (tc *TransactionController) issueChallenge(ctx context.Context, state *State, userID int64) error {
+	challenger, ok := tc.challengers[viper.GetString("challenge_type")]
+	if !ok {
+		return nil
+	}
+	failures, err := tc.store.CountSourceFailures(ctx, state.Handle)
+	if err != nil {
+		return err
+	}
+	if userID != 0 {
+		userFailures, err := tc.store.CountFailedAttempts(ctx, userID)
+		if err != nil {
+			return errors.Wrap(err, errors.ErrorUnknown, "")
+		}
+		if userFailures > failures {
+			failures = userFailures
+		}
+	}
+	required := viper.GetBool("challenge_required") || failures >= viper.GetInt64("challenge_failure_threshold")
+	if !required && userID != 0 {
+		required, err = tc.isRiskChallengeRequired(ctx, userID)
+		if err != nil {
+			return err
+		}
+	}
+	if !required {
+		return nil
+	}
+
+	challenge, err := challenger.Issue(ctx, failures)
+	if err != nil {
+		return err
+	}
+	log.GetLogger(ctx).WithFields(logrus.Fields{
+		"type":     challenge.Type,
+		"failures": failures,
+	}).Info("authentication challenge required")
+	state.Challenge = challenge
+	state.ChallengeNextStatus = state.Status
+	state.Status = StatusChallengeRequired
+	return nil
+}
+
+// isRiskChallengeRequired returns whether any risk signal of the authentication by the user is
+// ruled to require a challenge. It returns false if the risk engine is disabled.
+func (tc *TransactionController) isRiskChallengeRequired(ctx context.Context, userID int64) (bool, error) {
+	if !tc.riskEngine.Enabled() {
+		return false, nil
+	}
+	u, err := tc.userStore.UserByID(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	secondFactors, err := tc.userStore.FindAllSecondFactorsByUserID(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	assessment, err := tc.riskEngine.Assess(ctx, u, *secondFactors)
+	if err != nil {
+		return false, err
+	}
+	rules := viper.GetStringMapString("risk_rules")
+	for _, reason := range assessment.Reasons {
+		if rules[reason] == RiskChallenge {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// signUpChallenge returns a CHALLENGE_REQUIRED state if a challenge is required before signing up.
+func (tc *TransactionController) signUpChallenge(ctx context.Context, clientID, redirectURI string) (*State, error) {
+	state := &State{
+		StateToken:      cryptoutil.RandomToken32(),
+		Status:          StatusPrimary,
+		ClientID:        clientID,
+		RedirectURI:     redirectURI,
+		SignUpChallenge: true,
+	}
+	err := tc.issueChallenge(ctx, state, 0)
+	if err != nil {
+		return nil, err
+	}
+	if state.Status != StatusChallengeRequired {
+		return nil, nil
+	}
+	err = tc.store.PutState(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// solveSignUpChallenge verifies the response to a sign up challenge. The state is deleted so that
+// the response cannot be replayed.
+func (tc *TransactionController) solveSignUpChallenge(ctx context.Context, clientID, stateToken, response string) error {
+	state, err := tc.store.GetState(ctx, stateToken)
+	if err != nil {
+		return err
+	}
+	if !state.SignUpChallenge || state.Status != StatusChallengeRequired || state.ClientID != clientID {
+		return errors.New(errors.ErrorPermissionDenied, "illegal state")
+	}
+	err = tc.verifyChallenge(ctx, state, response)
+	if err != nil {
+		tc.store.IncrementSourceRateLimiter(ctx, "")
+		return err
+	}
+	return tc.store.DeleteState(ctx, stateToken)
+}
+
+func (tc *TransactionController) verifyChallenge(ctx context.Context, state *State, response string) error {
+	if state.Challenge == nil {
+		return errors.New(errors.ErrorFailedPrecondition, "no challenge is issued")
+	}
+	challenger, ok := tc.challengers[state.Challenge.Type]
+	if !ok {
+		return errors.New(errors.ErrorFailedPrecondition, "challenge type is not supported")
+	}
+	ok, err := challenger.Verify(ctx, state.Challenge, response)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"type": state.Challenge.Type,
+		}).Warn("authentication challenge rejected")
+		return errors.New(errors.ErrorPermissionDenied, "challenge response is incorrect")
+	}
+	state.Challenge = nil
+	return nil
+}
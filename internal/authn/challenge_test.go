@@ -0,0 +1,170 @@
+package authn
+
+import (
+	"context"
+	"testing"
+
+	"authcore.io/authcore/internal/config"
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/pkg/cryptoutil"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSignUpVerifierJSON = `
+{
+	"method": "spake2plus",
+	"salt": "/Jb4pAuatq5rrwdNRGRqW+PhlqzNR1pYtp1N5YWEn7s=",
+	"w0": "H9EeC9z9ndtqPVIz59/hWUUh8/TFdowJApvxHkbRhTZeTsrue0cxUgqUkZ/3QJShr3sjEVFbs/L5Ca3LFIHbPlpWULzMUxmbZSVDQkLSQMdxxxNP1CH9",
+	"l": "89obToiiylZJ2bWw9neAUtD+Xvu/zhhj+HHzQveMHMUNhFZh719/tYgBRvp2LRflO6Rko9q7bUCCRgz4mSBYSibpmCo9y8GoFvWBarSUu+dBqAh2OMVT/ifCPAu2qLqdFJQZRAzM"
+}
+`
+
+func TestPoWDifficulty(t *testing.T) {
+	config.InitDefaults()
+	defer viper.Reset()
+
+	assert.Equal(t, int64(65536), powDifficulty(0))
+	assert.Equal(t, int64(65536), powDifficulty(3))
+	assert.Equal(t, int64(262144), powDifficulty(5))
+	assert.Equal(t, int64(4194304), powDifficulty(100))
+}
+
+func TestPoWChallenger(t *testing.T) {
+	config.InitDefaults()
+	viper.Set("pow_challenge_difficulty", 16)
+	defer viper.Reset()
+	ctx := context.Background()
+
+	c := NewPoWChallenger()
+	challenge, err := c.Issue(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, ChallengePoW, challenge.Type)
+	assert.Equal(t, int64(16), challenge.Difficulty)
+
+	ok, err := c.Verify(ctx, challenge, "invalid")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	response, err := cryptoutil.SolveProofOfWork(challenge.Challenge, challenge.Difficulty)
+	assert.NoError(t, err)
+	ok, err = c.Verify(ctx, challenge, response)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestCaptchaChallenger(t *testing.T) {
+	ctx := context.Background()
+	c := NewCaptchaChallenger(NewStubCaptchaProvider("site_key", "solved"))
+
+	challenge, err := c.Issue(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, ChallengeCaptcha, challenge.Type)
+	assert.Equal(t, "site_key", challenge.SiteKey)
+
+	ok, _ := c.Verify(ctx, challenge, "wrong")
+	assert.False(t, ok)
+	ok, _ = c.Verify(ctx, challenge, "solved")
+	assert.True(t, ok)
+}
+
+func TestStartPrimaryChallenge(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	viper.Set("challenge_required", true)
+	viper.Set("pow_challenge_difficulty", 16)
+	tc.RegisterChallenger(NewPoWChallenger())
+	ctx := context.Background()
+
+	state, err := tc.StartPrimary(ctx, "app", "carol@example.com", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusChallengeRequired, state.Status)
+	assert.Equal(t, ChallengePoW, state.Challenge.Type)
+	assert.Empty(t, state.PasswordSalt)
+
+	// The transaction cannot proceed before the challenge is solved
+	_, err = tc.RequestPassword(ctx, state.StateToken, []byte{})
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	_, err = tc.VerifyChallenge(ctx, state.StateToken, "invalid")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	response, err := cryptoutil.SolveProofOfWork(state.Challenge.Challenge, state.Challenge.Difficulty)
+	assert.NoError(t, err)
+	state, err = tc.VerifyChallenge(ctx, state.StateToken, response)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPrimary, state.Status)
+	assert.Nil(t, state.Challenge)
+	assert.Equal(t, []string{FactorPassword}, state.Factors)
+	assert.NotEmpty(t, state.PasswordSalt)
+
+	// The response cannot be replayed
+	_, err = tc.VerifyChallenge(ctx, state.StateToken, response)
+	assert.Error(t, err)
+}
+
+func TestStartPrimaryChallengeByFailures(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	viper.Set("challenge_failure_threshold", 2)
+	tc.RegisterChallenger(NewPoWChallenger())
+	ctx := context.Background()
+
+	state, err := tc.StartPrimary(ctx, "app", "carol@example.com", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPrimary, state.Status)
+
+	tc.store.IncrementSourceRateLimiter(ctx, "carol@example.com")
+	tc.store.IncrementSourceRateLimiter(ctx, "carol@example.com")
+
+	state, err = tc.StartPrimary(ctx, "app", "carol@example.com", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusChallengeRequired, state.Status)
+}
+
+func TestStartPrimaryChallengeByRisk(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	viper.Set("risk_engine_enabled", true)
+	viper.Set("risk_rules", map[string]string{RiskSignalNewDevice: RiskChallenge})
+	tc.RegisterChallenger(NewPoWChallenger())
+	ctx := WithDeviceID(context.Background(), "device")
+
+	state, err := tc.StartPrimary(ctx, "app", "carol@example.com", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusChallengeRequired, state.Status)
+
+	// A known device does not trigger the challenge
+	assert.NoError(t, tc.riskEngine.RecordSuccess(ctx, 2))
+	state, err = tc.StartPrimary(ctx, "app", "carol@example.com", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPrimary, state.Status)
+}
+
+func TestSignUpChallenge(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	viper.Set("challenge_required", true)
+	viper.Set("challenge_type", ChallengeCaptcha)
+	tc.RegisterChallenger(NewCaptchaChallenger(NewStubCaptchaProvider("site_key", "solved")))
+	ctx := context.Background()
+
+	state, err := tc.SignUp(ctx, "app", "https://example.com/", "testsignup@example.com", "", testSignUpVerifierJSON, "", "en", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusChallengeRequired, state.Status)
+	assert.Equal(t, "site_key", state.Challenge.SiteKey)
+	assert.Empty(t, state.UserID)
+
+	_, err = tc.SignUp(ctx, "app", "https://example.com/", "testsignup@example.com", "", testSignUpVerifierJSON, "", "en", "", state.StateToken, "wrong")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	state2, err := tc.SignUp(ctx, "app", "https://example.com/", "testsignup@example.com", "", testSignUpVerifierJSON, "", "en", "", state.StateToken, "solved")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSuccess, state2.Status)
+	assert.NotEmpty(t, state2.UserID)
+
+	// The challenge state is burnt
+	_, err = tc.SignUp(ctx, "app", "https://example.com/", "testsignup2@example.com", "", testSignUpVerifierJSON, "", "en", "", state.StateToken, "solved")
+	assert.True(t, errors.IsKind(err, errors.ErrorNotFound))
+}
@@ -0,0 +1,61 @@
+package authn
+
+import (
+	"context"
+	"crypto/sha256"
+
+	"authcore.io/authcore/internal/apiutil"
+	"authcore.io/authcore/internal/session"
+
+	"github.com/mssola/user_agent"
+)
+
+type deviceIDKey struct{}
+
+type trustedDeviceTokenKey struct{}
+
+// WithDeviceID returns a copy of the context with a device ID. The device ID is used by the risk
+// engine to recognize the device.
+func WithDeviceID(ctx context.Context, deviceID string) context.Context {
+	return context.WithValue(ctx, deviceIDKey{}, deviceID)
+}
+
+// DeviceIDFromContext returns the device ID from the context.
+func DeviceIDFromContext(ctx context.Context) string {
+	deviceID, _ := ctx.Value(deviceIDKey{}).(string)
+	return deviceID
+}
+
+// WithTrustedDeviceToken returns a copy of the context with a trusted device token presented by
+// the device.
+func WithTrustedDeviceToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, trustedDeviceTokenKey{}, token)
+}
+
+// TrustedDeviceTokenFromContext returns the trusted device token from the context.
+func TrustedDeviceTokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(trustedDeviceTokenKey{}).(string)
+	return token
+}
+
+// deviceFingerprint returns a fingerprint of the device with the device ID and the user agent.
+func deviceFingerprint(ctx context.Context) []byte {
+	ua := ""
+	if userAgent, ok := ctx.Value(session.UserAgentKey{}).(*user_agent.UserAgent); ok {
+		ua = userAgent.UA()
+	}
+	h := sha256.New()
+	h.Write([]byte(DeviceIDFromContext(ctx)))
+	h.Write([]byte{0})
+	h.Write([]byte(ua))
+	return h.Sum(nil)
+}
+
+// deviceUserAgent returns a readable name of the device for listing trusted devices.
+func deviceUserAgent(ctx context.Context) string {
+	userAgent, ok := ctx.Value(session.UserAgentKey{}).(*user_agent.UserAgent)
+	if !ok {
+		return ""
+	}
+	return apiutil.FormatUserAgent(userAgent.UA())
+}
@@ -0,0 +1,78 @@
+package authn
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"authcore.io/authcore/internal/session"
+	"authcore.io/authcore/pkg/cryptoutil"
+
+	"github.com/mssola/user_agent"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceFingerprint(t *testing.T) {
+	ctx := WithDeviceID(context.Background(), "device")
+	fingerprint := deviceFingerprint(ctx)
+	assert.Len(t, fingerprint, 32)
+	assert.Equal(t, fingerprint, deviceFingerprint(ctx))
+
+	assert.NotEqual(t, fingerprint, deviceFingerprint(WithDeviceID(context.Background(), "other")))
+	ua := user_agent.New("Mozilla/5.0 (iPhone; CPU iPhone OS 10_3_1 like Mac OS X) AppleWebKit/603.1.30 (KHTML, like Gecko) Version/10.0 Mobile/14E304 Safari/602.1")
+	assert.NotEqual(t, fingerprint, deviceFingerprint(context.WithValue(ctx, session.UserAgentKey{}, ua)))
+}
+
+func TestTrustedDevice(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := WithDeviceID(context.Background(), "device")
+
+	state := verifyPasswordForTest(ctx, t, tc, "factor@example.com")
+	assert.Equal(t, "MFA_REQUIRED", state.Status)
+
+	code := cryptoutil.GetTOTPPin("THISISAWEAKTOTPSECRETFORTESTSXX2", time.Now())
+	state, err := tc.VerifyMFA(ctx, state.StateToken, "totp", []byte(code), true)
+	assert.NoError(t, err)
+	assert.Equal(t, "SUCCESS", state.Status)
+	token := state.TrustedDeviceToken
+	assert.NotEmpty(t, token)
+
+	// Trusted device skips MFA
+	state = verifyPasswordForTest(WithTrustedDeviceToken(ctx, token), t, tc, "factor@example.com")
+	assert.Equal(t, "SUCCESS", state.Status)
+
+	// Token presented by another device
+	otherCtx := WithTrustedDeviceToken(WithDeviceID(context.Background(), "other"), token)
+	state = verifyPasswordForTest(otherCtx, t, tc, "factor@example.com")
+	assert.Equal(t, "MFA_REQUIRED", state.Status)
+
+	// Revoked device
+	err = tc.userStore.DeleteAllTrustedDevicesByUserID(ctx, state.UserID)
+	assert.NoError(t, err)
+	state = verifyPasswordForTest(WithTrustedDeviceToken(ctx, token), t, tc, "factor@example.com")
+	assert.Equal(t, "MFA_REQUIRED", state.Status)
+}
+
+func TestTrustedDeviceRiskRequireMFA(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := WithDeviceID(context.Background(), "device")
+
+	state := verifyPasswordForTest(ctx, t, tc, "factor@example.com")
+	code := cryptoutil.GetTOTPPin("THISISAWEAKTOTPSECRETFORTESTSXX2", time.Now())
+	state, err := tc.VerifyMFA(ctx, state.StateToken, "totp", []byte(code), true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	token := state.TrustedDeviceToken
+
+	// MFA required by the risk engine cannot be skipped on a trusted device
+	viper.Set("risk_engine_enabled", true)
+	viper.Set("risk_rules", map[string]string{RiskSignalFailedAttempts: RiskRequireMFA})
+	viper.Set("risk_failed_attempts_threshold", 0)
+	state = verifyPasswordForTest(WithTrustedDeviceToken(ctx, token), t, tc, "factor@example.com")
+	assert.Equal(t, "MFA_REQUIRED", state.Status)
+	assert.Equal(t, RiskRequireMFA, state.Risk.Decision)
+}
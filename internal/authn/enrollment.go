@@ -0,0 +1,252 @@
+package authn
+
+import (
+	"context"
+	"net/url"
+
+	"authcore.io/authcore/internal/authn/verifier"
+	"authcore.io/authcore/internal/clientapp"
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/cryptoutil"
+	"authcore.io/authcore/pkg/log"
+	"authcore.io/authcore/pkg/nulls"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// backupCodeCount is the number of codes generated for a backup code factor.
+const backupCodeCount = 10
+
+// MFAEnrollment is the provisioning data returned when enrolling a second factor.
+type MFAEnrollment struct {
+	Secret      string
+	URI         string
+	BackupCodes []string
+}
+
+// RequestMFAEnrollment starts enrolling a second factor in a MFA_ENROLLMENT_REQUIRED transaction.
+// A TOTP secret is provisioned for totp, and a code is sent to the phone number for sms_otp. Backup
+// codes are created immediately but do not complete the transaction.
+func (tc *TransactionController) RequestMFAEnrollment(ctx context.Context, stateToken, method, phoneNumber string) (enrollment *MFAEnrollment, err error) {
+	_, err = tc.stateMutation(ctx, stateToken, StatusMFAEnrollmentRequired, func(state *State, u *user.User) error {
+		if method != verifier.BackupCode && !isMFAEnrollmentMethod(method) {
+			return errors.Errorf(errors.ErrorInvalidArgument, "cannot enroll %v", method)
+		}
+		switch method {
+		case verifier.TOTP:
+			secret := cryptoutil.RandomTOTPSecret()
+			uri, err := totpURI(state.ClientID, u, secret)
+			if err != nil {
+				return err
+			}
+			state.MFAMethod = method
+			state.MFAEnrollmentSecret = secret
+			state.MFAVerifierState = nil
+			enrollment = &MFAEnrollment{Secret: secret, URI: uri}
+			return nil
+		case verifier.SMSOTP:
+			if phoneNumber == "" {
+				return errors.New(errors.ErrorInvalidArgument, "phone number is required")
+			}
+			factor := &user.SecondFactor{
+				UserID: u.ID,
+				Type:   user.SecondFactorSMS,
+				Content: user.SecondFactorContent{
+					PhoneNumber: nulls.NewString(phoneNumber),
+				},
+			}
+			v, err := factor.ToVerifier(tc.verifierFactory)
+			if err != nil {
+				return err
+			}
+			state.MFAVerifierState, _, err = v.Request(nil)
+			if err != nil {
+				return err
+			}
+			state.MFAMethod = method
+			state.MFAEnrollmentPhone = phoneNumber
+			enrollment = &MFAEnrollment{}
+			return nil
+		case verifier.BackupCode:
+			codes, err := tc.createBackupCode(ctx, u)
+			if err != nil {
+				return err
+			}
+			enrollment = &MFAEnrollment{BackupCodes: codes}
+			return nil
+		}
+		return errors.Errorf(errors.ErrorInvalidArgument, "cannot enroll %v", method)
+	})
+	return
+}
+
+// VerifyMFAEnrollment confirms the second factor requested by RequestMFAEnrollment. The factor is
+// created and the transaction completes successfully.
+func (tc *TransactionController) VerifyMFAEnrollment(ctx context.Context, stateToken, method string, response []byte) (state *State, err error) {
+	return tc.stateMutation(ctx, stateToken, StatusMFAEnrollmentRequired, func(state *State, u *user.User) error {
+		if state.MFAMethod != method {
+			return errors.New(errors.ErrorFailedPrecondition, "enrollment is not requested")
+		}
+
+		err := tc.store.CheckRateLimiter(ctx, u.ID)
+		if err != nil {
+			state.Status = StatusBlocked
+			return nil
+		}
+
+		factor := &user.SecondFactor{UserID: u.ID}
+		switch method {
+		case verifier.TOTP:
+			factor.Type = user.SecondFactorTOTP
+			factor.Content.Secret = nulls.NewString(state.MFAEnrollmentSecret)
+		case verifier.SMSOTP:
+			factor.Type = user.SecondFactorSMS
+			factor.Content.PhoneNumber = nulls.NewString(state.MFAEnrollmentPhone)
+		default:
+			return errors.Errorf(errors.ErrorInvalidArgument, "cannot enroll %v", method)
+		}
+
+		v, err := factor.ToVerifier(tc.verifierFactory)
+		if err != nil {
+			return err
+		}
+		ok, _ := v.Verify(state.MFAVerifierState, response)
+		if !ok {
+			log.GetLogger(ctx).WithFields(logrus.Fields{
+				"user_id": u.PublicID(),
+			}).Warn("MFA enrollment rejected")
+			tc.store.IncrementRateLimiter(ctx, u.ID)
+			return errors.New(errors.ErrorPermissionDenied, "MFA enrollment rejected")
+		}
+
+		_, err = tc.userStore.CreateSecondFactor(ctx, factor)
+		if err != nil {
+			return err
+		}
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"user_id": u.PublicID(),
+			"method":  method,
+		}).Info("MFA enrollment completed")
+
+		state.MFAVerified = true
+		state.MFAEnrollmentSecret = ""
+		state.MFAEnrollmentPhone = ""
+		state.MFAVerifierState = nil
+
+		// SUCCESS
+		return tc.mutateSuccess(ctx, state)
+	})
+}
+
+// isMFAEnrollmentRequired returns whether the user must enroll a second factor before signing in
+// to the client. It is required if MFA is required by the global policy, the client or any of the
+// user's roles, and the user has not enrolled any second factor other than backup codes.
+func (tc *TransactionController) isMFAEnrollmentRequired(ctx context.Context, clientID string, u *user.User, secondFactors []user.SecondFactor) (bool, error) {
+	for _, factor := range secondFactors {
+		if factor.Type != user.SecondFactorBackupCode {
+			return false, nil
+		}
+	}
+	if viper.GetBool("mfa_required") {
+		return true, nil
+	}
+	clientApp, err := clientapp.GetByClientID(clientID)
+	if err != nil {
+		return false, err
+	}
+	if clientApp.RequireMFA {
+		return true, nil
+	}
+	requiredRoles := viper.GetStringSlice("mfa_required_roles")
+	if len(requiredRoles) == 0 {
+		return false, nil
+	}
+	roles, err := tc.userStore.FindAllRolesByUserID(ctx, u.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range *roles {
+		for _, requiredRole := range requiredRoles {
+			if role.Name == requiredRole {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// mutateMFAEnrollmentRequired moves the state to MFA_ENROLLMENT_REQUIRED with the second factors
+// that can be enrolled.
+func mutateMFAEnrollmentRequired(ctx context.Context, state *State) {
+	log.GetLogger(ctx).WithFields(logrus.Fields{
+		"user_id": state.UserID,
+	}).Info("MFA enrollment is required")
+	state.Status = StatusMFAEnrollmentRequired
+	state.ClearFactors()
+	for _, method := range viper.GetStringSlice("mfa_enrollment_methods") {
+		state.AppendFactor(method)
+	}
+}
+
+func isMFAEnrollmentMethod(method string) bool {
+	for _, m := range viper.GetStringSlice("mfa_enrollment_methods") {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// createBackupCode creates a backup code factor for the user and returns the codes.
+func (tc *TransactionController) createBackupCode(ctx context.Context, u *user.User) ([]string, error) {
+	factors, err := tc.userStore.FindAllSecondFactorsByUserIDAndType(ctx, u.ID, user.SecondFactorBackupCode)
+	if err != nil {
+		return nil, err
+	}
+	if len(*factors) > 0 {
+		return nil, errors.New(errors.ErrorAlreadyExists, "backup code already exists")
+	}
+	secret := cryptoutil.RandomBackupCodeSecret()
+	_, err = tc.userStore.CreateSecondFactor(ctx, &user.SecondFactor{
+		UserID: u.ID,
+		Type:   user.SecondFactorBackupCode,
+		Content: user.SecondFactorContent{
+			Secret:       nulls.NewString(secret),
+			UsedCodeMask: nulls.NewInt64(0),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, backupCodeCount)
+	for i := range codes {
+		codes[i] = cryptoutil.GetBackupCodePin(secret, uint64(i))
+	}
+	return codes, nil
+}
+
+// totpURI returns a Key URI for provisioning the TOTP secret in an authenticator app.
+func totpURI(clientID string, u *user.User, secret string) (string, error) {
+	clientApp, err := clientapp.GetByClientID(clientID)
+	if err != nil {
+		return "", err
+	}
+	account := u.PublicID()
+	if u.Email.Valid {
+		account = u.Email.String
+	} else if u.Phone.Valid {
+		account = u.Phone.String
+	}
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", clientApp.Name)
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + clientApp.Name + ":" + account,
+		RawQuery: params.Encode(),
+	}
+	return uri.String(), nil
+}
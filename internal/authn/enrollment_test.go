@@ -0,0 +1,140 @@
+package authn
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"authcore.io/authcore/pkg/cryptoutil"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMFAEnrollmentTOTP(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	viper.Set("mfa_required", true)
+	ctx := context.Background()
+
+	state := verifyPasswordForTest(ctx, t, tc, "carol@example.com")
+	assert.Equal(t, "MFA_ENROLLMENT_REQUIRED", state.Status)
+	assert.Equal(t, []string{"totp", "sms_otp"}, state.Factors)
+	assert.Empty(t, state.AuthorizationCode)
+
+	// Backup codes do not complete the transaction
+	enrollment, err := tc.RequestMFAEnrollment(ctx, state.StateToken, "backup_code", "")
+	assert.NoError(t, err)
+	assert.Len(t, enrollment.BackupCodes, 10)
+	_, err = tc.RequestMFAEnrollment(ctx, state.StateToken, "backup_code", "")
+	assert.Error(t, err)
+
+	// Not requested
+	_, err = tc.VerifyMFAEnrollment(ctx, state.StateToken, "totp", []byte("000000"))
+	assert.Error(t, err)
+
+	enrollment, err = tc.RequestMFAEnrollment(ctx, state.StateToken, "totp", "")
+	assert.NoError(t, err)
+	assert.Len(t, enrollment.Secret, 32)
+	assert.Contains(t, enrollment.URI, "otpauth://totp/app:carol@example.com?")
+
+	// Invalid code
+	_, err = tc.VerifyMFAEnrollment(ctx, state.StateToken, "totp", []byte("000000"))
+	assert.Error(t, err)
+
+	code := cryptoutil.GetTOTPPin(enrollment.Secret, time.Now())
+	state, err = tc.VerifyMFAEnrollment(ctx, state.StateToken, "totp", []byte(code))
+	assert.NoError(t, err)
+	assert.Equal(t, "SUCCESS", state.Status)
+	assert.NotEmpty(t, state.AuthorizationCode)
+	assert.True(t, state.MFAVerified)
+
+	// The enrolled factor is required in the next authentication
+	state = verifyPasswordForTest(ctx, t, tc, "carol@example.com")
+	assert.Equal(t, "MFA_REQUIRED", state.Status)
+	assert.Equal(t, []string{"backup_code", "totp"}, state.Factors)
+}
+
+func TestMFAEnrollmentWithBackupCode(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	viper.Set("mfa_required", true)
+	ctx := context.Background()
+
+	state := verifyPasswordForTest(ctx, t, tc, "carol@example.com")
+	enrollment, err := tc.RequestMFAEnrollment(ctx, state.StateToken, "backup_code", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Backup codes must be verified before enrolling another factor
+	state = verifyPasswordForTest(ctx, t, tc, "carol@example.com")
+	assert.Equal(t, "MFA_REQUIRED", state.Status)
+	assert.Equal(t, []string{"backup_code"}, state.Factors)
+	_, err = tc.RequestMFAEnrollment(ctx, state.StateToken, "totp", "")
+	assert.Error(t, err)
+
+	state, err = tc.VerifyMFA(ctx, state.StateToken, "backup_code", []byte(enrollment.BackupCodes[0]), false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "MFA_ENROLLMENT_REQUIRED", state.Status)
+	assert.Empty(t, state.AuthorizationCode)
+
+	enrollment, err = tc.RequestMFAEnrollment(ctx, state.StateToken, "totp", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	code := cryptoutil.GetTOTPPin(enrollment.Secret, time.Now())
+	state, err = tc.VerifyMFAEnrollment(ctx, state.StateToken, "totp", []byte(code))
+	assert.NoError(t, err)
+	assert.Equal(t, "SUCCESS", state.Status)
+}
+
+func TestMFAEnrollmentSMS(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	viper.Set("mfa_required", true)
+	ctx := context.Background()
+
+	state := verifyPasswordForTest(ctx, t, tc, "carol@example.com")
+	assert.Equal(t, "MFA_ENROLLMENT_REQUIRED", state.Status)
+
+	// Phone number is required
+	_, err := tc.RequestMFAEnrollment(ctx, state.StateToken, "sms_otp", "")
+	assert.Error(t, err)
+
+	_, err = tc.RequestMFAEnrollment(ctx, state.StateToken, "sms_otp", "+85298765432")
+	assert.NoError(t, err)
+
+	state2, err := tc.store.GetState(ctx, state.StateToken)
+	assert.NoError(t, err)
+	smsCode := make(map[string]interface{})
+	err = json.Unmarshal([]byte(state2.MFAVerifierState), &smsCode)
+	assert.NoError(t, err)
+	code := smsCode["code"].(string)
+
+	state, err = tc.VerifyMFAEnrollment(ctx, state.StateToken, "sms_otp", []byte(code))
+	assert.NoError(t, err)
+	assert.Equal(t, "SUCCESS", state.Status)
+	assert.NotEmpty(t, state.AuthorizationCode)
+}
+
+func TestMFAEnrollmentRequiredByRole(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	viper.Set("mfa_required_roles", []string{"snowdrop.admin"})
+	state := verifyPasswordForTest(ctx, t, tc, "carol@example.com")
+	assert.Equal(t, "SUCCESS", state.Status)
+
+	viper.Set("mfa_required_roles", []string{"authcore.editor"})
+	state = verifyPasswordForTest(ctx, t, tc, "carol@example.com")
+	assert.Equal(t, "MFA_ENROLLMENT_REQUIRED", state.Status)
+
+	// Users with MFA enrolled are not affected
+	state = verifyPasswordForTest(ctx, t, tc, "factor@example.com")
+	assert.Equal(t, "MFA_REQUIRED", state.Status)
+}
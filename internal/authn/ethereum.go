@@ -0,0 +1,231 @@
+package authn
+
+import (
+	"context"
+	"time"
+
+	"authcore.io/authcore/internal/authn/hook"
+	"authcore.io/authcore/internal/authn/verifier"
+	"authcore.io/authcore/internal/clientapp"
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/cryptoutil"
+	"authcore.io/authcore/pkg/log"
+	"authcore.io/authcore/pkg/nulls"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// StartEthereum starts a Sign-In with Ethereum transaction for the Ethereum account of the address.
+// The SIWE message of the state must be signed by the account to verify the transaction.
+func (tc *TransactionController) StartEthereum(ctx context.Context, clientID, address string, chainID int64, redirectURI, codeChallengeMethod, codeChallenge, clientState string) (*State, error) {
+	if codeChallenge != "" && codeChallengeMethod != "S256" {
+		return nil, errors.New(errors.ErrorInvalidArgument, "invalid code challenge method")
+	}
+	if err := ValidateRedirectURI(clientID, redirectURI); err != nil {
+		return nil, err
+	}
+	clientApp, err := clientapp.GetByClientID(clientID)
+	if err != nil {
+		return nil, errors.New(errors.ErrorInvalidArgument, "invalid client id")
+	}
+	if !clientApp.EthereumEnabled {
+		return nil, errors.New(errors.ErrorPermissionDenied, "Sign-In with Ethereum is not enabled")
+	}
+
+	state := &State{
+		StateToken:          cryptoutil.RandomToken32(),
+		Status:              StatusEthereum,
+		ClientID:            clientApp.ID,
+		Factors:             []string{},
+		RedirectURI:         redirectURI,
+		PKCEChallengeMethod: codeChallengeMethod,
+		PKCEChallenge:       codeChallenge,
+		ClientState:         clientState,
+	}
+	err = requestSIWE(state, address, chainID)
+	if err != nil {
+		return nil, err
+	}
+	err = tc.store.PutState(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// VerifyEthereum verifies the signature of the SIWE message. The user linked with the Ethereum
+// account is signed in, or a new user is created for the account if sign-up is enabled.
+func (tc *TransactionController) VerifyEthereum(ctx context.Context, stateToken, signature string) (*State, error) {
+	return tc.stateMutation(ctx, stateToken, StatusEthereum, func(state *State, _ *user.User) error {
+		err := tc.verifySIWE(ctx, state, signature)
+		if err != nil {
+			return err
+		}
+		u, err := tc.provisionEthereumUser(ctx, state)
+		if err != nil {
+			return err
+		}
+		if u.IsCurrentlyLocked() {
+			return errors.New(errors.ErrorPermissionDenied, "user is locked")
+		}
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"user_id":          u.PublicID(),
+			"ethereum_address": state.EthereumAddress,
+		}).Info("Sign-In with Ethereum accepted")
+		return tc.mutateIDPAuthenticated(ctx, state, u)
+	})
+}
+
+// StartEthereumBinding starts a transaction linking the Ethereum account of the address to the
+// user.
+func (tc *TransactionController) StartEthereumBinding(ctx context.Context, userID int64, clientID, address string, chainID int64) (*State, error) {
+	clientApp, err := clientapp.GetByClientID(clientID)
+	if err != nil {
+		return nil, errors.New(errors.ErrorInvalidArgument, "invalid client id")
+	}
+	if !clientApp.EthereumEnabled {
+		return nil, errors.New(errors.ErrorPermissionDenied, "Sign-In with Ethereum is not enabled")
+	}
+
+	state := &State{
+		StateToken: cryptoutil.RandomToken32(),
+		Status:     StatusEthereumBinding,
+		ClientID:   clientApp.ID,
+		UserID:     userID,
+	}
+	err = requestSIWE(state, address, chainID)
+	if err != nil {
+		return nil, err
+	}
+	err = tc.store.PutState(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// VerifyEthereumBinding verifies the signature of the SIWE message and links the Ethereum account
+// to the user. A user may link more than one Ethereum account, but an account can only be linked
+// to one user.
+func (tc *TransactionController) VerifyEthereumBinding(ctx context.Context, stateToken string, userID int64, clientID, signature string) (*State, error) {
+	return tc.stateMutation(ctx, stateToken, StatusEthereumBinding, func(state *State, u *user.User) error {
+		// Make sure the user id and client ID from request match the state
+		if userID != state.UserID || clientID != state.ClientID {
+			return errors.New(errors.ErrorPermissionDenied, "illegal state")
+		}
+		err := tc.verifySIWE(ctx, state, signature)
+		if err != nil {
+			return err
+		}
+
+		_, err = tc.userStore.FindOAuthFactorByOAuthIdentity(ctx, user.OAuthEthereum, state.EthereumAddress)
+		if err != nil && !errors.IsKind(err, errors.ErrorNotFound) {
+			return err
+		} else if err == nil {
+			return errors.New(errors.ErrorAlreadyExists, "Ethereum account is bound to a user")
+		}
+		_, err = tc.userStore.CreateOAuthFactor(ctx, u.ID, user.OAuthEthereum, state.EthereumAddress, ethereumMetadata(state))
+		if err != nil {
+			return err
+		}
+
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"user_id":          u.PublicID(),
+			"ethereum_address": state.EthereumAddress,
+		}).Info("Ethereum account binding completed successfully")
+		state.Status = StatusIDPBindingSuccess
+		return nil
+	})
+}
+
+// requestSIWE sets a new SIWE message for the Ethereum account to the state.
+func requestSIWE(state *State, address string, chainID int64) error {
+	v, err := verifier.NewEIP4361Verifier(address, chainID, state.StateToken)
+	if err != nil {
+		return err
+	}
+	siweState, challenge, err := v.Request(nil)
+	if err != nil {
+		return err
+	}
+	state.Handle = v.Address
+	state.EthereumAddress = v.Address
+	state.EthereumChainID = v.ChainID
+	state.SIWEState = siweState
+	state.SIWEMessage = string(challenge)
+	return nil
+}
+
+// verifySIWE verifies the signature of the SIWE message of the state. The message cannot be used
+// again once the signature is accepted.
+func (tc *TransactionController) verifySIWE(ctx context.Context, state *State, signature string) error {
+	err := tc.store.CheckSourceRateLimiter(ctx, state.Handle)
+	if err != nil {
+		return err
+	}
+	v, err := verifier.NewEIP4361Verifier(state.EthereumAddress, state.EthereumChainID, state.StateToken)
+	if err != nil {
+		return err
+	}
+	ok, _ := v.Verify(state.SIWEState, []byte(signature))
+	if !ok {
+		tc.store.IncrementSourceRateLimiter(ctx, state.Handle)
+		return errors.New(errors.ErrorPermissionDenied, "SIWE signature rejected")
+	}
+	state.SIWEState = nil
+	return nil
+}
+
+// provisionEthereumUser returns the user linked with the Ethereum account of the state. A new user
+// without an email address or a phone number is created if no user is linked with the account.
+func (tc *TransactionController) provisionEthereumUser(ctx context.Context, state *State) (*user.User, error) {
+	oauthFactor, err := tc.userStore.FindOAuthFactorByOAuthIdentity(ctx, user.OAuthEthereum, state.EthereumAddress)
+	if err == nil {
+		_, err = tc.userStore.UpdateOAuthFactorLastUsedAt(ctx, oauthFactor.ID, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return tc.userStore.UserByID(ctx, oauthFactor.UserID)
+	} else if !errors.IsKind(err, errors.ErrorNotFound) {
+		return nil, err
+	}
+
+	if !viper.GetBool("sign_up_enabled") {
+		return nil, errors.New(errors.ErrorPermissionDenied, "create user is not allowed")
+	}
+	clientApp, err := clientapp.GetByClientID(state.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	if err := clientApp.CheckSignUpEmail(""); err != nil {
+		return nil, err
+	}
+	u := &user.User{}
+	claims, err := tc.runHooks(ctx, hook.PreSignUp, state.ClientID, u)
+	if err != nil {
+		return nil, err
+	}
+	state.HookClaims = mergeClaims(state.HookClaims, claims)
+	err = tc.userStore.InsertUser(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tc.userStore.CreateOAuthFactor(ctx, u.ID, user.OAuthEthereum, state.EthereumAddress, ethereumMetadata(state))
+	if err != nil {
+		return nil, err
+	}
+	log.GetLogger(ctx).WithFields(logrus.Fields{
+		"user_id":          u.PublicID(),
+		"ethereum_address": state.EthereumAddress,
+	}).Info("register new Ethereum user")
+	return u, nil
+}
+
+func ethereumMetadata(state *State) nulls.JSON {
+	return nulls.NewJSON(map[string]interface{}{
+		"address":  state.EthereumAddress,
+		"chain_id": state.EthereumChainID,
+	})
+}
@@ -0,0 +1,104 @@
+package authn
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/user"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func signSIWE(t *testing.T, hexKey string, state *State) string {
+	key, err := crypto.HexToECDSA(hexKey)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	sig, err := crypto.Sign(accounts.TextHash([]byte(state.SIWEMessage)), key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+	return "0x" + hex.EncodeToString(sig)
+}
+
+func TestVerifyEthereum(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	key := "b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291"
+	privateKey, _ := crypto.HexToECDSA(key)
+	address := crypto.PubkeyToAddress(privateKey.PublicKey).Hex()
+	otherKey := "289c2857d4598e37fb9647507e47a309d6133539bf21a8b9cb6df88fd5232032"
+	otherPrivateKey, _ := crypto.HexToECDSA(otherKey)
+	otherAddress := crypto.PubkeyToAddress(otherPrivateKey.PublicKey).Hex()
+
+	// Sign-In with Ethereum is not enabled for the client
+	_, err := tc.StartEthereum(ctx, "app", address, 1, "https://example.com/", "", "", "")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	_, err = tc.StartEthereum(ctx, "web3", "0x1234", 1, "https://example.com/", "", "", "")
+	assert.True(t, errors.IsKind(err, errors.ErrorInvalidArgument))
+
+	// First sign in creates a user
+	state, err := tc.StartEthereum(ctx, "web3", address, 1, "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, StatusEthereum, state.Status)
+	assert.Contains(t, state.SIWEMessage, address)
+	assert.Contains(t, state.SIWEMessage, "Request ID: "+state.StateToken)
+
+	_, err = tc.VerifyEthereum(ctx, state.StateToken, signSIWE(t, otherKey, state))
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	state, err = tc.VerifyEthereum(ctx, state.StateToken, signSIWE(t, key, state))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, StatusSuccess, state.Status)
+	userID := state.UserID
+	oauthFactor, err := tc.userStore.FindOAuthFactorByOAuthIdentity(ctx, user.OAuthEthereum, address)
+	if assert.NoError(t, err) {
+		assert.Equal(t, userID, oauthFactor.UserID)
+	}
+
+	// Next sign in returns the same user
+	state, err = tc.StartEthereum(ctx, "web3", address, 1, "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	state, err = tc.VerifyEthereum(ctx, state.StateToken, signSIWE(t, key, state))
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusSuccess, state.Status)
+		assert.Equal(t, userID, state.UserID)
+	}
+
+	// Link another Ethereum account to an existing user
+	state, err = tc.StartEthereumBinding(ctx, 1, "web3", otherAddress, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, StatusEthereumBinding, state.Status)
+	_, err = tc.VerifyEthereumBinding(ctx, state.StateToken, 2, "web3", signSIWE(t, otherKey, state))
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	state, err = tc.VerifyEthereumBinding(ctx, state.StateToken, 1, "web3", signSIWE(t, otherKey, state))
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusIDPBindingSuccess, state.Status)
+	}
+	oauthFactor, err = tc.userStore.FindOAuthFactorByOAuthIdentity(ctx, user.OAuthEthereum, otherAddress)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), oauthFactor.UserID)
+	}
+
+	// An Ethereum account cannot be linked to more than one user
+	state, err = tc.StartEthereumBinding(ctx, 1, "web3", address, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = tc.VerifyEthereumBinding(ctx, state.StateToken, 1, "web3", signSIWE(t, key, state))
+	assert.True(t, errors.IsKind(err, errors.ErrorAlreadyExists))
+}
@@ -0,0 +1,228 @@
+// Package hook calls external HTTP endpoints at defined points of an authentication transaction.
+// A hook can allow the transaction to proceed, deny it with a message, or add custom claims to the
+// tokens issued at the end of the transaction.
+package hook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/log"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// PreSignUp is triggered before a new user is created by sign-up.
+	PreSignUp = "pre_sign_up"
+	// PostPrimary is triggered after the user has passed the primary authentication, i.e. password
+	// or a third-party identity provider.
+	PostPrimary = "post_primary"
+	// PreToken is triggered before an authorization code is exchanged for a session and tokens.
+	PreToken = "pre_token"
+)
+
+const (
+	// DecisionAllow allows the transaction to proceed.
+	DecisionAllow = "allow"
+	// DecisionDeny stops the transaction.
+	DecisionDeny = "deny"
+)
+
+const (
+	// SignatureHeader is the header carrying the HMAC-SHA256 signature of a hook request.
+	SignatureHeader = "X-Authcore-Signature"
+	// TimestampHeader is the header carrying the unix time a hook request is signed.
+	TimestampHeader = "X-Authcore-Timestamp"
+	// EventHeader is the header carrying the event of a hook request.
+	EventHeader = "X-Authcore-Event"
+)
+
+// maxResponseSize limits the size of a hook response body.
+const maxResponseSize = 64 * 1024
+
+// Hook is an HTTP endpoint called on authentication events.
+type Hook struct {
+	Name     string        `mapstructure:"-"`
+	URL      string        `mapstructure:"url"`
+	Secret   string        `mapstructure:"secret"`
+	Events   []string      `mapstructure:"events"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+	FailOpen bool          `mapstructure:"fail_open"`
+}
+
+// Request is the JSON body sent to a hook.
+type Request struct {
+	Event     string `json:"event"`
+	ClientID  string `json:"client_id"`
+	User      *User  `json:"user,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// User is the user described in a hook request. ID is empty before sign-up.
+type User struct {
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Phone    string `json:"phone,omitempty"`
+}
+
+// NewUser returns the hook representation of a user.
+func NewUser(u *user.User) *User {
+	hu := &User{
+		Name:     u.DisplayName(),
+		Username: u.Username.String,
+		Email:    u.Email.String,
+		Phone:    u.Phone.String,
+	}
+	if u.ID != 0 {
+		hu.ID = u.PublicID()
+	}
+	return hu
+}
+
+// Response is the JSON body returned by a hook.
+type Response struct {
+	Decision string                 `json:"decision"`
+	Message  string                 `json:"message"`
+	Claims   map[string]interface{} `json:"claims"`
+}
+
+// LoadHooks loads hooks from the authn_hooks config, sorted by name.
+func LoadHooks() ([]*Hook, error) {
+	rawMap := make(map[string]*Hook)
+	err := viper.UnmarshalKey("authn_hooks", &rawMap)
+	if err != nil {
+		return nil, errors.Errorf(errors.ErrorUnknown, "error reading authn_hooks config: %v", err)
+	}
+
+	hooks := make([]*Hook, 0, len(rawMap))
+	for k, h := range rawMap {
+		h.Name = strings.ToLower(k)
+		if h.Timeout == 0 {
+			h.Timeout = viper.GetDuration("authn_hook_timeout")
+		}
+		hooks = append(hooks, h)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].Name < hooks[j].Name })
+	return hooks, nil
+}
+
+// Subscribes returns whether the hook is called on the given event.
+func (h *Hook) Subscribes(event string) bool {
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Call sends a signed request to the hook and returns its response.
+func (h *Hook) Call(ctx context.Context, req *Request) (*Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(EventHeader, req.Event)
+	httpReq.Header.Set(TimestampHeader, timestamp)
+	httpReq.Header.Set(SignatureHeader, Sign(h.Secret, timestamp, body))
+
+	httpResp, err := http.DefaultClient.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnavailable, "")
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode < 200 || httpResp.StatusCode >= 300 {
+		return nil, errors.Errorf(errors.ErrorUnavailable, "hook responded with status %d", httpResp.StatusCode)
+	}
+	respBody, err := ioutil.ReadAll(http.MaxBytesReader(nil, httpResp.Body, maxResponseSize))
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnavailable, "")
+	}
+	resp := &Response{}
+	if err = json.Unmarshal(respBody, resp); err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnavailable, "")
+	}
+	if resp.Decision != DecisionAllow && resp.Decision != DecisionDeny {
+		return nil, errors.Errorf(errors.ErrorUnavailable, "invalid hook decision %q", resp.Decision)
+	}
+	return resp, nil
+}
+
+// Run calls the hooks subscribing to the event of req in order. It returns a PermissionDenied error
+// with the hook's message if any hook denies. Otherwise it returns the claims added by the hooks,
+// where later hooks override earlier ones. A hook that cannot be reached denies the request unless
+// it fails open.
+func Run(ctx context.Context, hooks []*Hook, req *Request) (map[string]interface{}, error) {
+	var claims map[string]interface{}
+	for _, h := range hooks {
+		if !h.Subscribes(req.Event) {
+			continue
+		}
+		logger := log.GetLogger(ctx).WithFields(logrus.Fields{
+			"hook":  h.Name,
+			"event": req.Event,
+		})
+		resp, err := h.Call(ctx, req)
+		if err != nil {
+			if h.FailOpen {
+				logger.WithField("error", err.Error()).Warn("authentication hook failed open")
+				continue
+			}
+			logger.WithField("error", err.Error()).Error("authentication hook failed")
+			return nil, errors.New(errors.ErrorUnavailable, "authentication hook failed")
+		}
+		if resp.Decision == DecisionDeny {
+			logger.WithField("message", resp.Message).Info("authentication denied by hook")
+			message := resp.Message
+			if message == "" {
+				message = "denied by authentication hook"
+			}
+			return nil, errors.New(errors.ErrorPermissionDenied, message)
+		}
+		for k, v := range resp.Claims {
+			if claims == nil {
+				claims = map[string]interface{}{}
+			}
+			claims[k] = v
+		}
+	}
+	return claims, nil
+}
+
+// Sign returns the hex-encoded HMAC-SHA256 signature of a hook request, computed over the
+// timestamp, a dot and the request body.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,114 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func hookServerForTest(t *testing.T, secret string, handler func(req *Request) (int, interface{})) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, Sign(secret, r.Header.Get(TimestampHeader), body), r.Header.Get(SignatureHeader))
+
+		req := &Request{}
+		assert.NoError(t, json.Unmarshal(body, req))
+		assert.Equal(t, req.Event, r.Header.Get(EventHeader))
+
+		code, resp := handler(req)
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestRun(t *testing.T) {
+	srv := hookServerForTest(t, "secret", func(req *Request) (int, interface{}) {
+		if req.User.Email == "suspended@example.com" {
+			return http.StatusOK, Response{Decision: DecisionDeny, Message: "account suspended"}
+		}
+		return http.StatusOK, Response{Decision: DecisionAllow, Claims: map[string]interface{}{"plan": "pro"}}
+	})
+	defer srv.Close()
+	hooks := []*Hook{
+		{Name: "crm", URL: srv.URL, Secret: "secret", Events: []string{PostPrimary}},
+	}
+	ctx := context.Background()
+
+	claims, err := Run(ctx, hooks, &Request{Event: PostPrimary, User: &User{Email: "carol@example.com"}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"plan": "pro"}, claims)
+
+	_, err = Run(ctx, hooks, &Request{Event: PostPrimary, User: &User{Email: "suspended@example.com"}})
+	if assert.Error(t, err) {
+		assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+		assert.Contains(t, err.Error(), "account suspended")
+	}
+
+	// Hooks are not called for other events
+	claims, err = Run(ctx, hooks, &Request{Event: PreSignUp, User: &User{Email: "suspended@example.com"}})
+	assert.NoError(t, err)
+	assert.Nil(t, claims)
+}
+
+func TestRunFailure(t *testing.T) {
+	srv := hookServerForTest(t, "secret", func(req *Request) (int, interface{}) {
+		return http.StatusInternalServerError, nil
+	})
+	defer srv.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	ctx := context.Background()
+	req := &Request{Event: PreToken}
+
+	hooks := []*Hook{{Name: "broken", URL: srv.URL, Secret: "secret", Events: []string{PreToken}}}
+	_, err := Run(ctx, hooks, req)
+	assert.True(t, errors.IsKind(err, errors.ErrorUnavailable))
+
+	hooks = []*Hook{{Name: "slow", URL: slow.URL, Events: []string{PreToken}, Timeout: 50 * time.Millisecond}}
+	_, err = Run(ctx, hooks, req)
+	assert.True(t, errors.IsKind(err, errors.ErrorUnavailable))
+
+	hooks[0].FailOpen = true
+	_, err = Run(ctx, hooks, req)
+	assert.NoError(t, err)
+}
+
+func TestLoadHooks(t *testing.T) {
+	viper.Set("authn_hook_timeout", "5s")
+	viper.Set("authn_hooks", map[string]interface{}{
+		"CRM": map[string]interface{}{
+			"url":     "https://crm.example.com/hook",
+			"secret":  "secret",
+			"events":  []string{PostPrimary, PreToken},
+			"timeout": "2s",
+		},
+		"billing": map[string]interface{}{
+			"url":    "https://billing.example.com/hook",
+			"events": []string{PostPrimary},
+		},
+	})
+	defer viper.Reset()
+
+	hooks, err := LoadHooks()
+	assert.NoError(t, err)
+	if assert.Len(t, hooks, 2) {
+		assert.Equal(t, "billing", hooks[0].Name)
+		assert.Equal(t, 5*time.Second, hooks[0].Timeout)
+		assert.Equal(t, "crm", hooks[1].Name)
+		assert.Equal(t, 2*time.Second, hooks[1].Timeout)
+		assert.True(t, hooks[1].Subscribes(PreToken))
+		assert.False(t, hooks[0].Subscribes(PreToken))
+	}
+}
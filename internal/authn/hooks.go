@@ -0,0 +1,51 @@
+package authn
+
+import (
+	"context"
+
+	"authcore.io/authcore/internal/authn/hook"
+	"authcore.io/authcore/internal/session"
+	"authcore.io/authcore/internal/user"
+)
+
+// Claims are custom token claims added by authentication hooks.
+type Claims map[string]interface{}
+
+// RegisterHook adds an authentication hook. Hooks are called in the order they are registered.
+func (tc *TransactionController) RegisterHook(h *hook.Hook) {
+	tc.hooks = append(tc.hooks, h)
+}
+
+// runHooks calls the hooks subscribing to event and returns the custom claims they added.
+func (tc *TransactionController) runHooks(ctx context.Context, event, clientID string, u *user.User) (Claims, error) {
+	if len(tc.hooks) == 0 {
+		return nil, nil
+	}
+	req := &hook.Request{
+		Event:    event,
+		ClientID: clientID,
+		User:     hook.NewUser(u),
+	}
+	if ip, ok := ctx.Value(session.IPKey{}).(string); ok {
+		req.IP = ip
+	}
+	if userAgent, ok := ctx.Value(session.UserAgentKey{}).(string); ok {
+		req.UserAgent = userAgent
+	}
+	return hook.Run(ctx, tc.hooks, req)
+}
+
+// mergeClaims returns claims with the entries of override added. Either map may be nil.
+func mergeClaims(claims, override Claims) Claims {
+	if len(override) == 0 {
+		return claims
+	}
+	merged := make(Claims, len(claims)+len(override))
+	for k, v := range claims {
+		merged[k] = v
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+	return merged
+}
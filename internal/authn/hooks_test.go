@@ -0,0 +1,121 @@
+package authn
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"authcore.io/authcore/internal/authn/hook"
+	"authcore.io/authcore/internal/authn/verifier"
+	"authcore.io/authcore/internal/errors"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// hookServerForTest starts a hook server that denies users with the given email and adds a "plan"
+// claim for other users.
+func hookServerForTest(t *testing.T, denyEmail string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &hook.Request{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(req))
+		resp := hook.Response{Decision: hook.DecisionAllow}
+		switch {
+		case req.User.Email == denyEmail:
+			resp = hook.Response{Decision: hook.DecisionDeny, Message: "account suspended"}
+		case req.Event == hook.PreToken:
+			resp.Claims = map[string]interface{}{"plan": "pro"}
+		default:
+			resp.Claims = map[string]interface{}{"plan": "free", "crm_id": req.Event}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestPostPrimaryHook(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	srv := hookServerForTest(t, "factor@example.com")
+	defer srv.Close()
+	tc.RegisterHook(&hook.Hook{Name: "crm", URL: srv.URL, Secret: "secret", Events: []string{hook.PostPrimary, hook.PreToken}})
+	ctx := context.Background()
+
+	state := verifyPasswordForTest(ctx, t, tc, "carol@example.com")
+	assert.Equal(t, StatusSuccess, state.Status)
+	assert.Equal(t, Claims{"plan": "free", "crm_id": hook.PostPrimary}, state.HookClaims)
+
+	sess, err := tc.ExchangeSession(ctx, "app", "https://example.com/", state.AuthorizationCode, "")
+	assert.NoError(t, err)
+	// Claims from pre_token hooks override those from earlier hooks
+	assert.Equal(t, map[string]interface{}{"plan": "pro", "crm_id": hook.PostPrimary}, sess.CustomClaims.Struct)
+
+	token, err := tc.sessionStore.GenerateAccessToken(ctx, sess, true)
+	assert.NoError(t, err)
+	claims := jwt.MapClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(token.IDToken, claims)
+	assert.NoError(t, err)
+	assert.Equal(t, "pro", claims["plan"])
+
+	// The hook denies after the password is verified
+	state, err = tc.StartPrimary(ctx, "app", "factor@example.com", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	spake2, err := verifier.NewSPAKE2Plus()
+	assert.NoError(t, err)
+	cs, message, err := spake2.StartClient([]byte("authcoreuser"), []byte("authcore"), []byte("password"), state.PasswordSalt, nil)
+	assert.NoError(t, err)
+	challenge, err := tc.RequestPassword(ctx, state.StateToken, message)
+	assert.NoError(t, err)
+	sk, err := cs.Finish(challenge)
+	assert.NoError(t, err)
+	_, err = tc.VerifyPassword(ctx, state.StateToken, sk.GetConfirmation())
+	if assert.Error(t, err) {
+		assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+		assert.Contains(t, err.Error(), "account suspended")
+	}
+}
+
+func TestPreSignUpHook(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	srv := hookServerForTest(t, "blocked@example.com")
+	defer srv.Close()
+	tc.RegisterHook(&hook.Hook{Name: "domains", URL: srv.URL, Events: []string{hook.PreSignUp}})
+	ctx := context.Background()
+
+	_, err := tc.SignUp(ctx, "app", "https://example.com/", "blocked@example.com", "", testSignUpVerifierJSON, "", "en", "", "", "")
+	if assert.Error(t, err) {
+		assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+		assert.Contains(t, err.Error(), "account suspended")
+	}
+	_, err = tc.userStore.UserByEmail(ctx, "blocked@example.com")
+	assert.True(t, errors.IsKind(err, errors.ErrorNotFound))
+
+	state, err := tc.SignUp(ctx, "app", "https://example.com/", "testhook@example.com", "", testSignUpVerifierJSON, "", "en", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSuccess, state.Status)
+	assert.Equal(t, Claims{"plan": "free", "crm_id": hook.PreSignUp}, state.HookClaims)
+}
+
+func TestPreTokenHookUnavailable(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	h := &hook.Hook{Name: "broken", URL: srv.URL, Events: []string{hook.PreToken}}
+	tc.RegisterHook(h)
+	ctx := context.Background()
+
+	state := verifyPasswordForTest(ctx, t, tc, "carol@example.com")
+	_, err := tc.ExchangeSession(ctx, "app", "https://example.com/", state.AuthorizationCode, "")
+	assert.True(t, errors.IsKind(err, errors.ErrorUnavailable))
+
+	h.FailOpen = true
+	state = verifyPasswordForTest(ctx, t, tc, "carol@example.com")
+	sess, err := tc.ExchangeSession(ctx, "app", "https://example.com/", state.AuthorizationCode, "")
+	assert.NoError(t, err)
+	assert.False(t, sess.CustomClaims.Valid)
+}
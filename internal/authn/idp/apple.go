@@ -1,8 +1,8 @@
 package idp
 
 import (
+	"context"
 	"crypto/ecdsa"
-	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"time"
@@ -11,7 +11,6 @@ import (
 	"authcore.io/authcore/pkg/secret"
 
 	"github.com/dgrijalva/jwt-go"
-	"github.com/lestrrat-go/jwx/jwk"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"golang.org/x/oauth2"
@@ -50,8 +49,9 @@ func NewAppleIDP() IDP {
 		AuthCodeURLOptions: []oauth2.AuthCodeOption{
 			oauth2.SetAuthURLParam("response_mode", "form_post"),
 		},
-		UseIDToken: true,
-		JWTKeyFunc: appleJWTKeyFunc,
+		RevocationURL: "https://appleid.apple.com/auth/revoke",
+		UseIDToken:    true,
+		JWTKeyFunc:    appleJWTKeyFunc,
 		ClientSecretFunc: func() (string, error) {
 			return appleSignClientJWT(privateKey.(*ecdsa.PrivateKey))
 		},
@@ -82,25 +82,5 @@ func appleJWTKeyFunc(token *jwt.Token) (interface{}, error) {
 	if !ok {
 		return nil, errors.New(errors.ErrorInvalidArgument, "")
 	}
-	return appleGetCertificate(kid)
-}
-
-func appleGetCertificate(keyID string) (*rsa.PublicKey, error) {
-	set, err := jwk.Fetch("https://appleid.apple.com/auth/keys")
-	if err != nil {
-		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
-	}
-	keys := set.LookupKeyID(keyID)
-	if len(keys) == 0 {
-		return nil, errors.New(errors.ErrorInvalidArgument, "key not found")
-	}
-	key, err := keys[0].Materialize()
-	if err != nil {
-		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
-	}
-	rsaKey, ok := key.(*rsa.PublicKey)
-	if !ok {
-		return nil, errors.New(errors.ErrorUnknown, "verification key not being rsa key")
-	}
-	return rsaKey, nil
+	return SharedJWKSCache(AppleJWKSURL).Key(context.Background(), kid)
 }
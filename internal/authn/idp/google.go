@@ -1,10 +1,7 @@
 package idp
 
 import (
-	"crypto/rsa"
-	"encoding/json"
-	"io/ioutil"
-	"net/http"
+	"context"
 
 	"authcore.io/authcore/internal/errors"
 	"authcore.io/authcore/pkg/secret"
@@ -24,6 +21,16 @@ const (
 func NewGoogleIDP() IDP {
 	clientID := viper.GetString("google_app_id")
 	appSecret := viper.Get("google_app_secret").(secret.String).SecretString()
+	authCodeURLOptions := []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("prompt", "select_account"),
+	}
+	if viper.GetBool("google_offline_access") {
+		// Google issues a refresh token only when the user is asked for consent.
+		authCodeURLOptions = []oauth2.AuthCodeOption{
+			oauth2.AccessTypeOffline,
+			oauth2.SetAuthURLParam("prompt", "consent select_account"),
+		}
+	}
 
 	return &OAuth2Provider{
 		IDString: Google,
@@ -31,14 +38,13 @@ func NewGoogleIDP() IDP {
 			ClientID:     clientID,
 			ClientSecret: appSecret,
 			RedirectURL:  OauthRedirectURL(Google),
-			Scopes:       []string{"email"},
+			Scopes:       viper.GetStringSlice("google_scopes"),
 			Endpoint:     google.Endpoint,
 		},
-		AuthCodeURLOptions: []oauth2.AuthCodeOption{
-			oauth2.SetAuthURLParam("prompt", "select_account"),
-		},
-		UseIDToken: true,
-		JWTKeyFunc: googleJWTKeyFunc,
+		AuthCodeURLOptions: authCodeURLOptions,
+		RevocationURL:      "https://oauth2.googleapis.com/revoke",
+		UseIDToken:         true,
+		JWTKeyFunc:         googleJWTKeyFunc,
 	}
 }
 
@@ -47,36 +53,5 @@ func googleJWTKeyFunc(token *jwt.Token) (interface{}, error) {
 	if !ok {
 		return nil, errors.New(errors.ErrorInvalidArgument, "")
 	}
-	return googleGetCertificate(kid)
-}
-
-func googleGetCertificate(keyID string) (*rsa.PublicKey, error) {
-	resp, err := http.Get("https://www.googleapis.com/oauth2/v1/certs")
-	if err != nil {
-		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
-	}
-	response, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
-	}
-	var certificates map[string]string
-	err = json.Unmarshal(response, &certificates)
-	if err != nil {
-		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
-	}
-	var googleOAuthCertificates map[string]*rsa.PublicKey
-	googleOAuthCertificates = make(map[string]*rsa.PublicKey)
-	for kid, certificate := range certificates {
-		parsedCertificate, err := jwt.ParseRSAPublicKeyFromPEM([]byte(certificate))
-		if err != nil {
-			panic("cannot parse certificate from google for oauth")
-		}
-		googleOAuthCertificates[kid] = parsedCertificate
-	}
-	certificate, ok := googleOAuthCertificates[keyID]
-	if !ok {
-		return nil, errors.New(errors.ErrorInvalidArgument, "certificate not found")
-	}
-	return certificate, nil
+	return SharedJWKSCache(GoogleJWKSURL).Key(context.Background(), kid)
 }
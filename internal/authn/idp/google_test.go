@@ -20,4 +20,12 @@ func TestGoogleIDP(t *testing.T) {
 	assert.Equal(t, "google", provider.ID())
 	assert.NoError(t, err)
 	assert.Equal(t, "https://accounts.google.com/o/oauth2/auth?client_id=testing&prompt=select_account&redirect_uri=https%3A%2F%2Fauthcore.localhost%2Foauth%2Fredirect&response_type=code&scope=email&state=testing", url)
+
+	// Offline access for the token vault
+	viper.Set("google_scopes", []string{"email", "https://www.googleapis.com/auth/calendar.readonly"})
+	viper.Set("google_offline_access", true)
+	provider = NewGoogleIDP()
+	url, _, err = provider.AuthorizationURL("testing")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://accounts.google.com/o/oauth2/auth?access_type=offline&client_id=testing&prompt=consent+select_account&redirect_uri=https%3A%2F%2Fauthcore.localhost%2Foauth%2Fredirect&response_type=code&scope=email+https%3A%2F%2Fwww.googleapis.com%2Fauth%2Fcalendar.readonly&state=testing", url)
 }
@@ -7,6 +7,7 @@ import (
 
 	"authcore.io/authcore/internal/errors"
 	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/kvstore"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-playground/validator/v10"
@@ -49,6 +50,8 @@ type Identity struct {
 	EmailVerified       bool   `json:"email_verified"`
 	PhoneNumber         string `json:"phone_number"`
 	PhoneNumberVerified bool   `json:"phone_number_verified"`
+	// Claims are all claims of the identity for provisioning rules, e.g. groups.
+	Claims map[string]interface{} `json:"claims,omitempty"`
 }
 
 // IdentityFromIDToken converts an IDToken to Identity.
@@ -68,7 +71,11 @@ func IdentityFromIDToken(idToken string, keyFunc jwt.Keyfunc) (*Identity, error)
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorInvalidArgument, "")
 	}
+	return identityFromClaims(mapClaims)
+}
 
+// identityFromClaims converts the claims of an ID token to Identity.
+func identityFromClaims(mapClaims jwt.MapClaims) (*Identity, error) {
 	jsonString, err := json.Marshal(mapClaims)
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
@@ -78,6 +85,7 @@ func IdentityFromIDToken(idToken string, keyFunc jwt.Keyfunc) (*Identity, error)
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
 	}
+	ident.Claims = map[string]interface{}(mapClaims)
 	err = validate.Struct(ident)
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorInvalidArgument, "")
@@ -109,47 +117,56 @@ func (f *Factory) Register(idp IDP) {
 func (f *Factory) IDP(identifier string) (IDP, error) {
 	idp, ok := f.idps[identifier]
 	if !ok {
-		errors.Errorf("unknown ID provider: %v", identifier)
+		return nil, errors.Errorf(errors.ErrorInvalidArgument, "unknown ID provider: %v", identifier)
 	}
 	return idp, nil
 }
 
-// IDToOAuthService converts a string into user.OAuthService used in database models.
-func IDToOAuthService(idp string) (user.OAuthService, error) {
-	switch idp {
-	case Google:
-		return user.OAuthGoogle, nil
-	case Facebook:
-		return user.OAuthFacebook, nil
-	case Twitter:
-		return user.OAuthTwitter, nil
-	case Apple:
-		return user.OAuthApple, nil
-	case Matters:
-		return user.OAuthMatters, nil
-	case "mock":
-		return user.OAuthService(999), nil // for testing only
-	default:
-		return 0, errors.New(errors.ErrorInvalidArgument, "unknown IDP")
+// builtinIDPs lists the IDs of the hard-coded IDPs and of the other services of OAuth factors, which
+// cannot be used by configured IDPs.
+var builtinIDPs = []string{Google, Facebook, Twitter, Apple, Matters, string(user.OAuthLDAP), string(user.OAuthEthereum)}
+
+// LoadIDPs loads the IDPs configured in oidc_providers, oauth2_providers and saml_providers. The
+// names of the IDPs must be unique and must not conflict with the built-in IDPs.
+func LoadIDPs(kv kvstore.Store) ([]IDP, error) {
+	oidcIDPs, err := LoadOIDCIDPs()
+	if err != nil {
+		return nil, err
 	}
+	oauth2IDPs, err := LoadOAuth2IDPs()
+	if err != nil {
+		return nil, err
+	}
+	samlIDPs, err := LoadSAMLIDPs(kv)
+	if err != nil {
+		return nil, err
+	}
+	idps := append(append(oidcIDPs, oauth2IDPs...), samlIDPs...)
+	ids := make(map[string]bool)
+	for _, id := range builtinIDPs {
+		ids[id] = true
+	}
+	for _, idp := range idps {
+		if ids[idp.ID()] {
+			return nil, errors.Errorf(errors.ErrorInvalidArgument, "duplicated IDP %v", idp.ID())
+		}
+		ids[idp.ID()] = true
+	}
+	return idps, nil
+}
+
+// IDToOAuthService converts an IDP identifier into user.OAuthService used in database models. The
+// identifier is stored as is so that new IDPs do not require a schema change.
+func IDToOAuthService(idp string) (user.OAuthService, error) {
+	return user.ToOAuthService(idp)
 }
 
 // OAuthServiceToID converts a user.OAuthService to IDP identifier.
 func OAuthServiceToID(service user.OAuthService) (string, error) {
-	switch service {
-	case user.OAuthGoogle:
-		return Google, nil
-	case user.OAuthFacebook:
-		return Facebook, nil
-	case user.OAuthTwitter:
-		return Twitter, nil
-	case user.OAuthApple:
-		return Apple, nil
-	case user.OAuthMatters:
-		return Matters, nil
-	default:
+	if service == "" {
 		return "", errors.New(errors.ErrorInvalidArgument, "unknown IDP")
 	}
+	return user.OAuthServiceToName(service), nil
 }
 
 var validate = validator.New()
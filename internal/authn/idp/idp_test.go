@@ -120,4 +120,7 @@ func TestFactory(t *testing.T) {
 	idp, err := f.IDP("google")
 	assert.NoError(t, err)
 	assert.Equal(t, "google", idp.ID())
+
+	_, err = f.IDP("unknown")
+	assert.Error(t, err)
 }
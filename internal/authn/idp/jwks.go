@@ -0,0 +1,249 @@
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+
+	"github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// AppleJWKSURL is the JWKS endpoint of Sign-in with Apple.
+	AppleJWKSURL = "https://appleid.apple.com/auth/keys"
+	// GoogleJWKSURL is the JWKS endpoint of Google.
+	GoogleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+)
+
+const (
+	// jwksDefaultTTL is used if the JWKS endpoint does not send cache headers.
+	jwksDefaultTTL = time.Hour
+	// jwksMinTTL and jwksMaxTTL bound the lifetime given by the cache headers. Key sets sent with
+	// no-cache are kept for jwksMinTTL, so that tokens are not verified against the endpoint.
+	jwksMinTTL = time.Minute
+	jwksMaxTTL = 24 * time.Hour
+)
+
+var (
+	sharedJWKSCachesMu sync.Mutex
+	sharedJWKSCaches   = map[string]*JWKSCache{}
+)
+
+// JWKSCache caches the JSON Web Key Set of an IDP for verifying ID tokens. The key set is kept
+// for the lifetime given by the HTTP cache headers of the endpoint. Expired keys are still used
+// for up to jwks_max_stale while a fresh key set is fetched in the background, so that sign-ins
+// neither wait for nor fail with the endpoint. An unknown key ID triggers a fetch in case the IDP
+// has rotated its keys, at most once every jwks_refetch_interval.
+type JWKSCache struct {
+	url    string
+	client *http.Client
+	now    func() time.Time
+
+	refetchInterval time.Duration
+	maxStale        time.Duration
+
+	loadMu     sync.Mutex
+	mu         sync.Mutex
+	keySet     *jose.JSONWebKeySet
+	expiresAt  time.Time
+	lastFetch  time.Time
+	lastErr    error
+	refreshing bool
+}
+
+// NewJWKSCache returns a new JWKSCache for the key set at url.
+func NewJWKSCache(url string, client *http.Client) *JWKSCache {
+	return &JWKSCache{
+		url:             url,
+		client:          client,
+		now:             time.Now,
+		refetchInterval: viper.GetDuration("jwks_refetch_interval"),
+		maxStale:        viper.GetDuration("jwks_max_stale"),
+	}
+}
+
+// SharedJWKSCache returns the JWKSCache of the process for the key set at url.
+func SharedJWKSCache(url string) *JWKSCache {
+	sharedJWKSCachesMu.Lock()
+	defer sharedJWKSCachesMu.Unlock()
+	c, ok := sharedJWKSCaches[url]
+	if !ok {
+		c = NewJWKSCache(url, &http.Client{Timeout: 10 * time.Second})
+		sharedJWKSCaches[url] = c
+	}
+	return c
+}
+
+// Key returns the signing key with the given key ID. If kid is empty, the only signing key in the
+// key set is returned.
+func (c *JWKSCache) Key(ctx context.Context, kid string) (interface{}, error) {
+	c.mu.Lock()
+	keySet, now := c.keySet, c.now()
+	usable := keySet != nil && now.Before(c.expiresAt.Add(c.maxStale))
+	if usable && !now.Before(c.expiresAt) && !c.refreshing && c.allowFetchLocked(now) {
+		c.refreshing = true
+		go c.refresh()
+	}
+	c.mu.Unlock()
+
+	if !usable {
+		var err error
+		keySet, err = c.load(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if key, ok := findKey(keySet, kid); ok {
+		return key, nil
+	}
+
+	// The IDP may have rotated its keys
+	c.mu.Lock()
+	fetch := c.allowFetchLocked(c.now())
+	c.mu.Unlock()
+	if fetch {
+		keySet, err := c.fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := findKey(keySet, kid); ok {
+			return key, nil
+		}
+	}
+	return nil, errors.New(errors.ErrorInvalidArgument, "key not found")
+}
+
+// KeyFunc returns a jwt.Keyfunc returning the key with the kid header of the token.
+func (c *JWKSCache) KeyFunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return c.Key(ctx, kid)
+	}
+}
+
+// load fetches the key set when there is no usable key set. Concurrent callers wait for a single
+// fetch, and a failed fetch is not retried within the refetch interval so that an unreachable
+// endpoint does not hold up every sign-in.
+func (c *JWKSCache) load(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+	c.mu.Lock()
+	now := c.now()
+	if c.keySet != nil && now.Before(c.expiresAt.Add(c.maxStale)) {
+		keySet := c.keySet
+		c.mu.Unlock()
+		return keySet, nil
+	}
+	if c.lastErr != nil && !c.allowFetchLocked(now) {
+		err := c.lastErr
+		c.mu.Unlock()
+		return nil, err
+	}
+	c.lastFetch = now
+	c.mu.Unlock()
+	return c.fetch(ctx)
+}
+
+// allowFetchLocked reserves a fetch if there was none within the refetch interval.
+func (c *JWKSCache) allowFetchLocked(now time.Time) bool {
+	if !c.lastFetch.IsZero() && now.Sub(c.lastFetch) < c.refetchInterval {
+		return false
+	}
+	c.lastFetch = now
+	return true
+}
+
+func (c *JWKSCache) refresh() {
+	_, err := c.fetch(context.Background())
+	c.mu.Lock()
+	c.refreshing = false
+	c.mu.Unlock()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"url":   c.url,
+			"error": err,
+		}).Warn("cannot refresh JWKS, using stale keys")
+	}
+}
+
+// fetch fetches the key set and replaces the cached key set.
+func (c *JWKSCache) fetch(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	keySet, ttl, err := c.get(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastErr = err
+	if err != nil {
+		return nil, err
+	}
+	c.keySet = keySet
+	c.expiresAt = c.now().Add(ttl)
+	return keySet, nil
+}
+
+func (c *JWKSCache) get(ctx context.Context) (*jose.JSONWebKeySet, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, errors.ErrorUnavailable, "")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.Errorf(errors.ErrorUnavailable, "unexpected status %v from %v", resp.StatusCode, c.url)
+	}
+	keySet := &jose.JSONWebKeySet{}
+	err = json.NewDecoder(resp.Body).Decode(keySet)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, errors.ErrorUnavailable, "invalid JWKS")
+	}
+	return keySet, jwksTTL(resp.Header, c.now()), nil
+}
+
+// jwksTTL returns the lifetime of a key set from the Cache-Control, Age and Expires headers of the
+// response.
+func jwksTTL(header http.Header, now time.Time) time.Duration {
+	ttl, found := time.Duration(0), false
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return jwksMinTTL
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err == nil {
+				ttl, found = time.Duration(seconds)*time.Second, true
+			}
+		}
+	}
+	if found {
+		if age, err := strconv.Atoi(header.Get("Age")); err == nil {
+			ttl -= time.Duration(age) * time.Second
+		}
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		ttl, found = expires.Sub(date), true
+	}
+	switch {
+	case !found:
+		return jwksDefaultTTL
+	case ttl < jwksMinTTL:
+		return jwksMinTTL
+	case ttl > jwksMaxTTL:
+		return jwksMaxTTL
+	}
+	return ttl
+}
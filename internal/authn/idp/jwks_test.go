@@ -0,0 +1,149 @@
+package idp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestJWKSCache(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var mu sync.Mutex
+	keys := []jose.JSONWebKey{{Key: key.Public(), KeyID: "key1", Algorithm: "RS256", Use: "sig"}}
+	fetches, unavailable := 0, false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		if unavailable {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=600")
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: keys})
+	}))
+	defer server.Close()
+	fetchCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fetches
+	}
+	setUnavailable := func(v bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		unavailable = v
+	}
+	ctx := context.Background()
+
+	now := time.Now()
+	c := NewJWKSCache(server.URL, server.Client())
+	c.refetchInterval = time.Minute
+	c.maxStale = time.Hour
+	c.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+
+	// The key set is cached
+	k, err := c.Key(ctx, "key1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, key.Public(), k)
+	}
+	_, err = c.Key(ctx, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fetchCount())
+
+	// An unknown key ID triggers a fetch at most once within the refetch interval
+	advance(2 * time.Minute)
+	_, err = c.Key(ctx, "key2")
+	assert.True(t, errors.IsKind(err, errors.ErrorInvalidArgument))
+	assert.Equal(t, 2, fetchCount())
+	_, err = c.Key(ctx, "key2")
+	assert.True(t, errors.IsKind(err, errors.ErrorInvalidArgument))
+	assert.Equal(t, 2, fetchCount())
+
+	mu.Lock()
+	keys = append(keys, jose.JSONWebKey{Key: key.Public(), KeyID: "key2", Algorithm: "RS256", Use: "sig"})
+	mu.Unlock()
+	advance(2 * time.Minute)
+	_, err = c.Key(ctx, "key2")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, fetchCount())
+
+	// Expired keys are served while the key set is refreshed in the background
+	setUnavailable(true)
+	advance(11 * time.Minute)
+	_, err = c.Key(ctx, "key1")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return fetchCount() == 4 }, time.Second, 10*time.Millisecond)
+	_, err = c.Key(ctx, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, fetchCount())
+
+	// Keys are not used beyond the maximum staleness
+	advance(2 * time.Hour)
+	_, err = c.Key(ctx, "key1")
+	assert.True(t, errors.IsKind(err, errors.ErrorUnavailable))
+	assert.Equal(t, 5, fetchCount())
+	_, err = c.Key(ctx, "key1")
+	assert.True(t, errors.IsKind(err, errors.ErrorUnavailable))
+	assert.Equal(t, 5, fetchCount())
+
+	setUnavailable(false)
+	advance(2 * time.Minute)
+	_, err = c.Key(ctx, "key1")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, fetchCount())
+
+	advance(11 * time.Minute)
+	_, err = c.Key(ctx, "key1")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return !c.refreshing && c.expiresAt.After(c.now())
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 7, fetchCount())
+}
+
+func TestJWKSTTL(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		header http.Header
+		ttl    time.Duration
+	}{
+		{http.Header{}, time.Hour},
+		{http.Header{"Cache-Control": {"public, max-age=600"}}, 10 * time.Minute},
+		{http.Header{"Cache-Control": {"max-age=600"}, "Age": {"120"}}, 8 * time.Minute},
+		{http.Header{"Cache-Control": {"max-age=10"}}, time.Minute},
+		{http.Header{"Cache-Control": {"max-age=604800"}}, 24 * time.Hour},
+		{http.Header{"Cache-Control": {"no-cache"}, "Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}}, time.Minute},
+		{http.Header{
+			"Date":    {now.UTC().Format(http.TimeFormat)},
+			"Expires": {now.Add(2 * time.Hour).UTC().Format(http.TimeFormat)},
+		}, 2 * time.Hour},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.ttl, jwksTTL(test.header, now), "%v", test.header)
+	}
+}
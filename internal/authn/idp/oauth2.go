@@ -18,6 +18,7 @@ type OAuth2Provider struct {
 	Config             *oauth2.Config
 	AuthCodeURLOptions []oauth2.AuthCodeOption
 	ExchangeOptions    []oauth2.AuthCodeOption
+	RevocationURL      string
 	UseIDToken         bool
 	JWTKeyFunc         jwt.Keyfunc
 	IdentityFunc       IdentityFunc
@@ -0,0 +1,267 @@
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/pkg/cryptoutil"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// OIDCConfig is the configuration of a generic OpenID Connect provider.
+type OIDCConfig struct {
+	Name         string   `mapstructure:"-"`
+	Issuer       string   `mapstructure:"issuer"`
+	ClientID     string   `mapstructure:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret"`
+	Scopes       []string `mapstructure:"scopes"`
+}
+
+// oidcMetadata is the subset of OpenID Provider Metadata used by OIDCProvider.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	RevocationEndpoint    string `json:"revocation_endpoint"`
+}
+
+// OIDCProvider authenticates users with an OpenID Connect provider. The endpoints and the signing
+// keys of the provider are resolved using OpenID Connect Discovery on first use.
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	metadata *oidcMetadata
+	jwks     *JWKSCache
+}
+
+// NewOIDCIDP returns a new IDP to authenticate using an OpenID Connect provider.
+func NewOIDCIDP(config OIDCConfig) IDP {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &OIDCProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// LoadOIDCIDPs loads OpenID Connect providers from the oidc_providers config, sorted by name.
+func LoadOIDCIDPs() ([]IDP, error) {
+	rawMap := make(map[string]*OIDCConfig)
+	err := viper.UnmarshalKey("oidc_providers", &rawMap)
+	if err != nil {
+		return nil, errors.Errorf(errors.ErrorUnknown, "error reading oidc_providers config: %v", err)
+	}
+
+	names := make([]string, 0, len(rawMap))
+	for k := range rawMap {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	idps := make([]IDP, 0, len(names))
+	for _, k := range names {
+		c := rawMap[k]
+		c.Name = strings.ToLower(k)
+		if c.Issuer == "" || c.ClientID == "" {
+			return nil, errors.Errorf(errors.ErrorInvalidArgument, "OIDC provider %v requires issuer and client_id", k)
+		}
+		idps = append(idps, NewOIDCIDP(*c))
+	}
+	return idps, nil
+}
+
+// ID returns the name of the provider.
+func (p *OIDCProvider) ID() string {
+	return p.config.Name
+}
+
+// AuthorizationURL returns the authorization endpoint URI of the provider. The returned state is
+// the nonce that must be present in the ID token.
+func (p *OIDCProvider) AuthorizationURL(stateToken string) (string, State, error) {
+	metadata, err := p.discover(context.Background())
+	if err != nil {
+		return "", "", err
+	}
+	nonce := cryptoutil.RandomToken32()
+	url := p.oauth2Config(metadata).AuthCodeURL(stateToken, oauth2.SetAuthURLParam("nonce", nonce))
+	return url, State(nonce), nil
+}
+
+// Exchange converts an authorization code into tokens and the user's identity in the ID token.
+func (p *OIDCProvider) Exchange(ctx context.Context, state State, code string) (*AuthorizationGrant, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.client)
+	token, err := p.oauth2Config(metadata).Exchange(ctx, code)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorPermissionDenied, "")
+	}
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok || len(idToken) == 0 {
+		return nil, errors.New(errors.ErrorPermissionDenied, "id_token required but it is empty")
+	}
+	ident, err := p.verifyIDToken(ctx, metadata, idToken, string(state))
+	if err != nil {
+		return nil, err
+	}
+	return &AuthorizationGrant{
+		AccessToken:  token.AccessToken,
+		TokenType:    token.TokenType,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+		IDToken:      idToken,
+		Identity:     ident,
+	}, nil
+}
+
+func (p *OIDCProvider) oauth2Config(metadata *oidcMetadata) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  OauthRedirectURL(p.config.Name),
+		Scopes:       p.config.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  metadata.AuthorizationEndpoint,
+			TokenURL: metadata.TokenEndpoint,
+		},
+	}
+}
+
+// verifyIDToken verifies the signature and the claims of an ID token and converts it to Identity.
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, metadata *oidcMetadata, idToken, nonce string) (*Identity, error) {
+	token, err := jwt.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		default:
+			return nil, errors.Errorf(errors.ErrorInvalidArgument, "unsupported signing method %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, metadata, kid)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorPermissionDenied, "invalid id_token")
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New(errors.ErrorPermissionDenied, "invalid id_token")
+	}
+	if !claims.VerifyIssuer(metadata.Issuer, true) {
+		return nil, errors.New(errors.ErrorPermissionDenied, "id_token issuer mismatch")
+	}
+	if !audienceContains(claims["aud"], p.config.ClientID) {
+		return nil, errors.New(errors.ErrorPermissionDenied, "id_token audience mismatch")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.config.ClientID {
+		return nil, errors.New(errors.ErrorPermissionDenied, "id_token authorized party mismatch")
+	}
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return nil, errors.New(errors.ErrorPermissionDenied, "id_token nonce mismatch")
+	}
+	return identityFromClaims(claims)
+}
+
+// discover fetches the provider metadata from the discovery endpoint of the issuer.
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	metadata := &oidcMetadata{}
+	err := p.getJSON(ctx, strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", metadata)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.Issuer != p.config.Issuer {
+		return nil, errors.Errorf(errors.ErrorUnknown, "OIDC issuer mismatch: expected %v, got %v", p.config.Issuer, metadata.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New(errors.ErrorUnknown, "incomplete OIDC provider metadata")
+	}
+	p.metadata = metadata
+	return metadata, nil
+}
+
+// key returns the public key with the given key ID from the cached key set of the provider.
+func (p *OIDCProvider) key(ctx context.Context, metadata *oidcMetadata, kid string) (interface{}, error) {
+	p.mu.Lock()
+	if p.jwks == nil {
+		p.jwks = NewJWKSCache(metadata.JWKSURI, p.client)
+	}
+	jwks := p.jwks
+	p.mu.Unlock()
+	return jwks.Key(ctx, kid)
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnavailable, "")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf(errors.ErrorUnavailable, "unexpected status %v from %v", resp.StatusCode, url)
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return nil
+}
+
+// findKey returns the signing key with the given key ID. If kid is empty, the only signing key in
+// the key set is returned.
+func findKey(keySet *jose.JSONWebKeySet, kid string) (interface{}, bool) {
+	var keys []jose.JSONWebKey
+	if kid == "" {
+		keys = keySet.Keys
+	} else {
+		keys = keySet.Key(kid)
+	}
+	var found []jose.JSONWebKey
+	for _, key := range keys {
+		if key.Use == "" || key.Use == "sig" {
+			found = append(found, key)
+		}
+	}
+	if len(found) != 1 {
+		return nil, false
+	}
+	return found[0].Key, true
+}
+
+// audienceContains returns whether the aud claim, which is either a string or an array of strings,
+// contains clientID.
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package idp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"authcore.io/authcore/internal/config"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// mockOIDCServer is a minimal OpenID Connect provider for testing.
+type mockOIDCServer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims jwt.MapClaims
+}
+
+func newMockOIDCServer(t *testing.T) *mockOIDCServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	s := &mockOIDCServer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 s.URL,
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"jwks_uri":               s.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "key1", Algorithm: "RS256", Use: "sig"}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "code" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, s.claims)
+		token.Header["kid"] = "key1"
+		idToken, _ := token.SignedString(key)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access_token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func TestOIDCIDP(t *testing.T) {
+	config.InitDefaults()
+	defer viper.Reset()
+	server := newMockOIDCServer(t)
+	defer server.Close()
+
+	provider := NewOIDCIDP(OIDCConfig{
+		Name:         "okta",
+		Issuer:       server.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+	})
+	assert.Equal(t, "okta", provider.ID())
+
+	authURL, state, err := provider.AuthorizationURL("testing")
+	if !assert.NoError(t, err) {
+		return
+	}
+	u, err := url.Parse(authURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, server.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	assert.Equal(t, "client", u.Query().Get("client_id"))
+	assert.Equal(t, "openid email profile", u.Query().Get("scope"))
+	assert.Equal(t, "testing", u.Query().Get("state"))
+	assert.Equal(t, string(state), u.Query().Get("nonce"))
+
+	validClaims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":            server.URL,
+			"aud":            []string{"client", "other"},
+			"azp":            "client",
+			"sub":            "sub_test",
+			"email":          "okta@example.com",
+			"email_verified": true,
+			"nonce":          string(state),
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Minute).Unix(),
+		}
+	}
+
+	// Success
+	server.claims = validClaims()
+	grant, err := provider.Exchange(context.Background(), state, "code")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "access_token", grant.AccessToken)
+		assert.Equal(t, "sub_test", grant.Identity.ID)
+		assert.Equal(t, "okta@example.com", grant.Identity.Email)
+		assert.True(t, grant.Identity.EmailVerified)
+	}
+
+	// Invalid code
+	_, err = provider.Exchange(context.Background(), state, "invalid")
+	assert.Error(t, err)
+
+	// Nonce mismatch
+	_, err = provider.Exchange(context.Background(), State("other"), "code")
+	assert.Error(t, err)
+
+	// Audience mismatch
+	server.claims = validClaims()
+	server.claims["aud"] = "other"
+	delete(server.claims, "azp")
+	_, err = provider.Exchange(context.Background(), state, "code")
+	assert.Error(t, err)
+
+	// Issuer mismatch
+	server.claims = validClaims()
+	server.claims["iss"] = "https://evil.example.com"
+	_, err = provider.Exchange(context.Background(), state, "code")
+	assert.Error(t, err)
+
+	// Expired
+	server.claims = validClaims()
+	server.claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = provider.Exchange(context.Background(), state, "code")
+	assert.Error(t, err)
+}
+
+func TestOIDCIDPDiscoveryIssuerMismatch(t *testing.T) {
+	config.InitDefaults()
+	defer viper.Reset()
+	server := newMockOIDCServer(t)
+	defer server.Close()
+
+	provider := NewOIDCIDP(OIDCConfig{
+		Name:     "okta",
+		Issuer:   server.URL + "/",
+		ClientID: "client",
+	})
+	_, _, err := provider.AuthorizationURL("testing")
+	assert.Error(t, err)
+}
+
+func TestLoadOIDCIDPs(t *testing.T) {
+	viper.Set("oidc_providers", map[string]interface{}{
+		"Keycloak": map[string]interface{}{
+			"issuer":    "https://keycloak.example.com/realms/corp",
+			"client_id": "authcore",
+		},
+		"okta": map[string]interface{}{
+			"issuer":    "https://corp.okta.com",
+			"client_id": "authcore",
+			"scopes":    []string{"openid", "email"},
+		},
+	})
+	defer viper.Reset()
+
+	idps, err := LoadOIDCIDPs()
+	if assert.NoError(t, err) && assert.Len(t, idps, 2) {
+		assert.Equal(t, "keycloak", idps[0].ID())
+		assert.Equal(t, "okta", idps[1].ID())
+		assert.Equal(t, []string{"openid", "email"}, idps[1].(*OIDCProvider).config.Scopes)
+	}
+
+	// Missing issuer
+	viper.Set("oidc_providers", map[string]interface{}{
+		"okta": map[string]interface{}{
+			"client_id": "authcore",
+		},
+	})
+	_, err = LoadOIDCIDPs()
+	assert.Error(t, err)
+}
@@ -0,0 +1,216 @@
+package idp
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/nulls"
+
+	"github.com/spf13/viper"
+)
+
+// ProvisioningRules control how users are provisioned from the identities of an IDP. The zero value
+// trusts email_verified and copies only the name, email and phone number at creation.
+type ProvisioningRules struct {
+	// TrustEmailVerified trusts the email_verified claim of the IDP. It is true if unset. Emails
+	// that are not trusted are neither marked as verified nor used to find existing users.
+	TrustEmailVerified *bool `mapstructure:"trust_email_verified"`
+	// UpdateOnLogin updates the attributes, metadata and roles of the user on every login instead
+	// of only at creation.
+	UpdateOnLogin bool `mapstructure:"update_on_login"`
+	// Metadata copies claims to user or app metadata.
+	Metadata []MetadataMapping `mapstructure:"metadata"`
+	// Roles assigns roles to users by claims. The directory of the IDP is the source of truth of
+	// the roles, which are unassigned when the claims no longer match.
+	Roles []RoleMapping `mapstructure:"roles"`
+}
+
+// MetadataMapping copies the claim at a path, e.g. address.country or groups.0, to a field of the
+// user, e.g. user_metadata.country or app_metadata.org.department.
+type MetadataMapping struct {
+	Claim string `mapstructure:"claim"`
+	Field string `mapstructure:"field"`
+}
+
+// RoleMapping assigns a role to users whose claim equals the value, or contains the value if the
+// claim is an array such as groups.
+type RoleMapping struct {
+	Claim string `mapstructure:"claim"`
+	Value string `mapstructure:"value"`
+	Role  string `mapstructure:"role"`
+}
+
+// LoadProvisioningRules loads the rules in idp_provisioning, which are keyed by IDP ID.
+func LoadProvisioningRules() (map[string]*ProvisioningRules, error) {
+	rawMap := make(map[string]*ProvisioningRules)
+	err := viper.UnmarshalKey("idp_provisioning", &rawMap)
+	if err != nil {
+		return nil, errors.Errorf(errors.ErrorUnknown, "error reading idp_provisioning config: %v", err)
+	}
+	rules := make(map[string]*ProvisioningRules, len(rawMap))
+	for k, r := range rawMap {
+		if r == nil {
+			r = &ProvisioningRules{}
+		}
+		err := r.validate()
+		if err != nil {
+			return nil, errors.Wrapf(err, errors.ErrorInvalidArgument, "invalid provisioning rules of IDP %v", k)
+		}
+		rules[strings.ToLower(k)] = r
+	}
+	return rules, nil
+}
+
+func (r *ProvisioningRules) validate() error {
+	for _, m := range r.Metadata {
+		if m.Claim == "" {
+			return errors.New(errors.ErrorInvalidArgument, "metadata mapping requires claim")
+		}
+		if _, _, ok := metadataField(m.Field); !ok {
+			return errors.Errorf(errors.ErrorInvalidArgument, "metadata field %v must be prefixed with user_metadata. or app_metadata.", m.Field)
+		}
+	}
+	for _, m := range r.Roles {
+		if m.Claim == "" || m.Value == "" || m.Role == "" {
+			return errors.New(errors.ErrorInvalidArgument, "role mapping requires claim, value and role")
+		}
+	}
+	return nil
+}
+
+// IsEmailVerifiedTrusted returns true if the email_verified claim of the IDP is trusted.
+func (r *ProvisioningRules) IsEmailVerifiedTrusted() bool {
+	return r.TrustEmailVerified == nil || *r.TrustEmailVerified
+}
+
+// UpdateUser copies the name, email, phone number and the mapped claims of the identity to the
+// user. Attributes and claims missing in the identity are left unchanged.
+func (r *ProvisioningRules) UpdateUser(u *user.User, ident *Identity) {
+	now := time.Now()
+	if ident.Name != "" {
+		u.Name = nulls.NewString(ident.Name)
+		u.DisplayNameOld = ident.Name
+	}
+	if ident.Email != "" {
+		if u.Email.String != ident.Email {
+			u.Email = nulls.NewString(ident.Email)
+			u.EmailVerifiedAt = nulls.Time{}
+		}
+		if ident.EmailVerified && r.IsEmailVerifiedTrusted() && !u.EmailVerifiedAt.Valid {
+			u.EmailVerifiedAt = nulls.NewTime(now)
+		}
+	}
+	if ident.PhoneNumber != "" {
+		if u.Phone.String != ident.PhoneNumber {
+			u.Phone = nulls.NewString(ident.PhoneNumber)
+			u.PhoneVerifiedAt = nulls.Time{}
+		}
+		if ident.PhoneNumberVerified && !u.PhoneVerifiedAt.Valid {
+			u.PhoneVerifiedAt = nulls.NewTime(now)
+		}
+	}
+
+	for _, m := range r.Metadata {
+		v, ok := lookupJSONPath(map[string]interface{}(ident.Claims), m.Claim)
+		if !ok || v == nil {
+			continue
+		}
+		prefix, path, _ := metadataField(m.Field)
+		switch prefix {
+		case "user_metadata":
+			setMetadata(&u.UserMetadata, path, v)
+		case "app_metadata":
+			setMetadata(&u.AppMetadata, path, v)
+		}
+	}
+}
+
+// AssignedRoles returns the roles mapped from the claims of the identity.
+func (r *ProvisioningRules) AssignedRoles(ident *Identity) []string {
+	var roles []string
+	for _, m := range r.Roles {
+		v, ok := lookupJSONPath(map[string]interface{}(ident.Claims), m.Claim)
+		if !ok || !claimMatches(v, m.Value) || containsString(roles, m.Role) {
+			continue
+		}
+		roles = append(roles, m.Role)
+	}
+	return roles
+}
+
+// ManagedRoles returns the roles that are assigned by the rules.
+func (r *ProvisioningRules) ManagedRoles() []string {
+	var roles []string
+	for _, m := range r.Roles {
+		if !containsString(roles, m.Role) {
+			roles = append(roles, m.Role)
+		}
+	}
+	return roles
+}
+
+// claimMatches returns true if a scalar claim equals the value or an array claim contains it.
+func claimMatches(claim interface{}, value string) bool {
+	if values, ok := claim.([]interface{}); ok {
+		for _, v := range values {
+			if claimString(v) == value {
+				return true
+			}
+		}
+		return false
+	}
+	return claimString(claim) == value
+}
+
+// claimString returns a scalar claim as a string. Numbers in ID tokens are decoded as float64.
+func claimString(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return jsonString(v)
+}
+
+// metadataField splits a user_metadata.<path> or app_metadata.<path> field.
+func metadataField(field string) (prefix, path string, ok bool) {
+	parts := strings.SplitN(field, ".", 2)
+	if len(parts) != 2 || parts[1] == "" || (parts[0] != "user_metadata" && parts[0] != "app_metadata") {
+		return "", "", false
+	}
+	for _, key := range strings.Split(parts[1], ".") {
+		if key == "" {
+			return "", "", false
+		}
+	}
+	return parts[0], parts[1], true
+}
+
+// setMetadata sets the value at a dot-separated path of the metadata, replacing non-object values
+// on the path with objects.
+func setMetadata(metadata *nulls.JSON, path string, value interface{}) {
+	if !metadata.Valid || metadata.Struct == nil {
+		*metadata = nulls.JSON{Struct: make(map[string]interface{}), Valid: true}
+	}
+	m := metadata.Struct
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := m[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			m[key] = next
+		}
+		m = next
+	}
+	m[keys[len(keys)-1]] = value
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
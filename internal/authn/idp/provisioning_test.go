@@ -0,0 +1,183 @@
+package idp
+
+import (
+	"testing"
+	"time"
+
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/nulls"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvisioningRulesUpdateUser(t *testing.T) {
+	untrusted := false
+	ident := &Identity{
+		ID:            "alice-id",
+		Name:          "Alice",
+		Email:         "alice@example.com",
+		EmailVerified: true,
+		Claims: map[string]interface{}{
+			"department": "Engineering",
+			"address":    map[string]interface{}{"country": "HK"},
+			"groups":     []interface{}{"staff", "admins"},
+		},
+	}
+	tests := []struct {
+		name          string
+		rules         ProvisioningRules
+		user          user.User
+		emailVerified bool
+		userMetadata  map[string]interface{}
+		appMetadata   map[string]interface{}
+	}{
+		{
+			name:          "default",
+			emailVerified: true,
+		},
+		{
+			name:  "untrusted email_verified",
+			rules: ProvisioningRules{TrustEmailVerified: &untrusted},
+		},
+		{
+			name: "metadata",
+			rules: ProvisioningRules{Metadata: []MetadataMapping{
+				{Claim: "department", Field: "app_metadata.org.department"},
+				{Claim: "address.country", Field: "user_metadata.country"},
+				{Claim: "groups", Field: "app_metadata.groups"},
+				{Claim: "missing", Field: "user_metadata.missing"},
+			}},
+			emailVerified: true,
+			userMetadata:  map[string]interface{}{"country": "HK"},
+			appMetadata: map[string]interface{}{
+				"org":    map[string]interface{}{"department": "Engineering"},
+				"groups": []interface{}{"staff", "admins"},
+			},
+		},
+		{
+			name: "existing metadata",
+			rules: ProvisioningRules{Metadata: []MetadataMapping{
+				{Claim: "department", Field: "user_metadata.org.department"},
+			}},
+			user: user.User{
+				Email:           nulls.NewString("alice@example.com"),
+				EmailVerifiedAt: nulls.NewTime(time.Now()),
+				UserMetadata: nulls.JSON{Struct: map[string]interface{}{
+					"language": "en",
+					"org":      "replaced",
+				}, Valid: true},
+			},
+			emailVerified: true,
+			userMetadata: map[string]interface{}{
+				"language": "en",
+				"org":      map[string]interface{}{"department": "Engineering"},
+			},
+		},
+		{
+			name:  "changed email",
+			rules: ProvisioningRules{TrustEmailVerified: &untrusted},
+			user: user.User{
+				Email:           nulls.NewString("old@example.com"),
+				EmailVerifiedAt: nulls.NewTime(time.Now()),
+			},
+		},
+	}
+	for _, test := range tests {
+		u := test.user
+		test.rules.UpdateUser(&u, ident)
+		assert.Equal(t, "Alice", u.Name.String, test.name)
+		assert.Equal(t, "Alice", u.DisplayNameOld, test.name)
+		assert.Equal(t, "alice@example.com", u.Email.String, test.name)
+		assert.Equal(t, test.emailVerified, u.EmailVerifiedAt.Valid, test.name)
+		if test.userMetadata == nil {
+			assert.False(t, u.UserMetadata.Valid, test.name)
+		} else {
+			assert.Equal(t, test.userMetadata, u.UserMetadata.Struct, test.name)
+		}
+		if test.appMetadata == nil {
+			assert.False(t, u.AppMetadata.Valid, test.name)
+		} else {
+			assert.Equal(t, test.appMetadata, u.AppMetadata.Struct, test.name)
+		}
+	}
+}
+
+func TestProvisioningRulesRoles(t *testing.T) {
+	rules := ProvisioningRules{Roles: []RoleMapping{
+		{Claim: "groups", Value: "admins", Role: "authcore.admin"},
+		{Claim: "groups", Value: "editors", Role: "authcore.editor"},
+		{Claim: "department", Value: "Engineering", Role: "authcore.editor"},
+		{Claim: "org.level", Value: "3", Role: "snowdrop.admin"},
+	}}
+	assert.Equal(t, []string{"authcore.admin", "authcore.editor", "snowdrop.admin"}, rules.ManagedRoles())
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		roles  []string
+	}{
+		{"no claims", nil, nil},
+		{"array claim", map[string]interface{}{"groups": []interface{}{"staff", "admins"}}, []string{"authcore.admin"}},
+		{"scalar claim", map[string]interface{}{"groups": "editors"}, []string{"authcore.editor"}},
+		{"duplicate role", map[string]interface{}{"groups": []interface{}{"editors"}, "department": "Engineering"}, []string{"authcore.editor"}},
+		{"case-sensitive", map[string]interface{}{"groups": []interface{}{"Admins"}}, nil},
+		{"nested number claim", map[string]interface{}{"org": map[string]interface{}{"level": float64(3)}}, []string{"snowdrop.admin"}},
+	}
+	for _, test := range tests {
+		roles := rules.AssignedRoles(&Identity{ID: "id", Claims: test.claims})
+		assert.Equal(t, test.roles, roles, test.name)
+	}
+}
+
+func TestLoadProvisioningRules(t *testing.T) {
+	defer viper.Reset()
+
+	rules, err := LoadProvisioningRules()
+	assert.NoError(t, err)
+	assert.Empty(t, rules)
+
+	viper.Set("idp_provisioning", map[string]interface{}{
+		"Corp": map[string]interface{}{
+			"trust_email_verified": false,
+			"update_on_login":      true,
+			"metadata": []interface{}{
+				map[string]interface{}{"claim": "employeeNumber", "field": "app_metadata.employee_number"},
+			},
+			"roles": []interface{}{
+				map[string]interface{}{"claim": "groups", "value": "Admins", "role": "authcore.admin"},
+			},
+		},
+	})
+	rules, err = LoadProvisioningRules()
+	if assert.NoError(t, err) && assert.Contains(t, rules, "corp") {
+		r := rules["corp"]
+		assert.False(t, r.IsEmailVerifiedTrusted())
+		assert.True(t, r.UpdateOnLogin)
+		assert.Equal(t, []MetadataMapping{{Claim: "employeeNumber", Field: "app_metadata.employee_number"}}, r.Metadata)
+		assert.Equal(t, []RoleMapping{{Claim: "groups", Value: "Admins", Role: "authcore.admin"}}, r.Roles)
+	}
+
+	tests := []struct {
+		name  string
+		rules map[string]interface{}
+	}{
+		{"missing claim", map[string]interface{}{
+			"metadata": []interface{}{map[string]interface{}{"field": "user_metadata.x"}},
+		}},
+		{"unknown field", map[string]interface{}{
+			"metadata": []interface{}{map[string]interface{}{"claim": "x", "field": "email"}},
+		}},
+		{"empty path", map[string]interface{}{
+			"metadata": []interface{}{map[string]interface{}{"claim": "x", "field": "user_metadata.a..b"}},
+		}},
+		{"missing role", map[string]interface{}{
+			"roles": []interface{}{map[string]interface{}{"claim": "groups", "value": "admins"}},
+		}},
+	}
+	for _, test := range tests {
+		viper.Set("idp_provisioning", map[string]interface{}{"corp": test.rules})
+		_, err := LoadProvisioningRules()
+		assert.Error(t, err, test.name)
+	}
+}
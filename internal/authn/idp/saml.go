@@ -0,0 +1,358 @@
+package idp
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/pkg/cryptoutil"
+	"authcore.io/authcore/pkg/kvstore"
+	"authcore.io/authcore/pkg/secret"
+
+	"github.com/crewjam/saml"
+	"github.com/dgrijalva/jwt-go"
+	dsig "github.com/russellhaering/goxmldsig"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// samlResponseExpiry is the lifetime of a SAML response stored by the assertion consumer service
+	// before it is exchanged.
+	samlResponseExpiry = 5 * time.Minute
+	// samlIDPPath is the path under /saml/ of the endpoints of Authcore as a SAML identity provider.
+	samlIDPPath = "idp"
+)
+
+// samlAttributes lists the SAML attribute names or friendly names that are mapped to Identity
+// fields by default.
+var samlAttributes = map[string][]string{
+	"email": {
+		"email",
+		"mail",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+		"urn:oid:0.9.2342.19200300.100.1.3",
+	},
+	"name": {
+		"name",
+		"displayName",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name",
+		"urn:oid:2.16.840.1.113730.3.1.241",
+	},
+	"username": {
+		"username",
+		"uid",
+		"urn:oid:0.9.2342.19200300.100.1.1",
+	},
+}
+
+// SAMLConfig is the configuration of a SAML 2.0 identity provider. Attributes maps the Identity
+// fields sub, email, name and username to SAML attribute names. The subject is the NameID unless
+// it is mapped to an attribute. As SAML has no equivalent of email_verified, TrustEmail sets
+// whether the email addresses asserted by the IdP are considered verified.
+type SAMLConfig struct {
+	Name         string            `mapstructure:"-"`
+	IDPMetadata  string            `mapstructure:"idp_metadata"`
+	EntityID     string            `mapstructure:"entity_id"`
+	NameIDFormat string            `mapstructure:"name_id_format"`
+	Attributes   map[string]string `mapstructure:"attributes"`
+	TrustEmail   bool              `mapstructure:"trust_email"`
+}
+
+// SAMLProvider authenticates users with a SAML 2.0 identity provider. Authentication requests are
+// signed and sent with the HTTP-Redirect binding. Responses are received with the HTTP-POST binding
+// by the assertion consumer service, which stores them with a one-time code that is exchanged
+// in the same way as an OAuth authorization code.
+type SAMLProvider struct {
+	config SAMLConfig
+	sp     *saml.ServiceProvider
+	kv     kvstore.Store
+}
+
+// NewSAMLIDP returns a new IDP to authenticate using a SAML 2.0 identity provider. The service
+// provider signs requests with key and publishes cert in its metadata.
+func NewSAMLIDP(config SAMLConfig, key *rsa.PrivateKey, cert *x509.Certificate, kv kvstore.Store) (*SAMLProvider, error) {
+	metadata := &saml.EntityDescriptor{}
+	err := xml.Unmarshal([]byte(config.IDPMetadata), metadata)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorInvalidArgument, "invalid IdP metadata")
+	}
+	if len(metadata.IDPSSODescriptors) == 0 {
+		return nil, errors.New(errors.ErrorInvalidArgument, "IdP metadata has no IDPSSODescriptor")
+	}
+	metadataURL := samlURL(config.Name, "metadata")
+	acsURL := samlURL(config.Name, "acs")
+	sp := &saml.ServiceProvider{
+		EntityID:          config.EntityID,
+		Key:               key,
+		Certificate:       cert,
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		IDPMetadata:       metadata,
+		AuthnNameIDFormat: saml.NameIDFormat(config.NameIDFormat),
+		SignatureMethod:   dsig.RSASHA256SignatureMethod,
+	}
+	if sp.GetSSOBindingLocation(saml.HTTPRedirectBinding) == "" {
+		return nil, errors.New(errors.ErrorInvalidArgument, "IdP metadata has no HTTP-Redirect SSO endpoint")
+	}
+	return &SAMLProvider{
+		config: config,
+		sp:     sp,
+		kv:     kv,
+	}, nil
+}
+
+// LoadSAMLIDPs loads SAML 2.0 identity providers from the saml_providers config, sorted by name.
+func LoadSAMLIDPs(kv kvstore.Store) ([]IDP, error) {
+	rawMap := make(map[string]*SAMLConfig)
+	err := viper.UnmarshalKey("saml_providers", &rawMap)
+	if err != nil {
+		return nil, errors.Errorf(errors.ErrorUnknown, "error reading saml_providers config: %v", err)
+	}
+	if len(rawMap) == 0 {
+		return nil, nil
+	}
+	key, cert, err := SAMLKeyPair("saml_sp_private_key", "saml_sp_certificate")
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(rawMap))
+	for k := range rawMap {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	idps := make([]IDP, 0, len(names))
+	for _, k := range names {
+		c := rawMap[k]
+		c.Name = strings.ToLower(k)
+		if c.Name == samlIDPPath {
+			return nil, errors.Errorf(errors.ErrorInvalidArgument, "SAML provider name %v is reserved", k)
+		}
+		p, err := NewSAMLIDP(*c, key, cert, kv)
+		if err != nil {
+			return nil, errors.Errorf(errors.ErrorInvalidArgument, "SAML provider %v: %v", k, err)
+		}
+		idps = append(idps, p)
+	}
+	return idps, nil
+}
+
+// ID returns the name of the provider.
+func (p *SAMLProvider) ID() string {
+	return p.config.Name
+}
+
+// AuthorizationURL returns the SSO endpoint URL of the IdP with a signed AuthnRequest. The state
+// token is sent as the RelayState. The returned state is the ID of the AuthnRequest.
+func (p *SAMLProvider) AuthorizationURL(stateToken string) (string, State, error) {
+	req, err := p.sp.MakeAuthenticationRequest(p.sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	redirectURL, err := req.Redirect(url.QueryEscape(stateToken), p.sp)
+	if err != nil {
+		return "", "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return redirectURL.String(), State(req.ID), nil
+}
+
+// StoreResponse stores a base64-encoded SAML response received by the assertion consumer service
+// and returns a one-time code for Exchange.
+func (p *SAMLProvider) StoreResponse(samlResponse string) (string, error) {
+	code := cryptoutil.RandomToken32()
+	err := p.kv.Set(samlResponseKey(p.config.Name, code), samlResponse, samlResponseExpiry)
+	if err != nil {
+		return "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return code, nil
+}
+
+// Exchange verifies the SAML response stored with the code and converts the assertion into the
+// user's identity. The response must be in response to the AuthnRequest in state. Each assertion
+// can only be used once.
+func (p *SAMLProvider) Exchange(ctx context.Context, state State, code string) (*AuthorizationGrant, error) {
+	key := samlResponseKey(p.config.Name, code)
+	samlResponse, err := p.kv.Get(key)
+	if err == kvstore.ErrNotFound {
+		return nil, errors.New(errors.ErrorPermissionDenied, "invalid SAML response code")
+	} else if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	_, err = p.kv.Delete(key)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	responseXML, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorPermissionDenied, "invalid SAML response")
+	}
+
+	assertion, err := p.sp.ParseXMLResponse(responseXML, []string{string(state)})
+	if err != nil {
+		if invalidErr, ok := err.(*saml.InvalidResponseError); ok {
+			log.WithField("error", invalidErr.PrivateErr).Info("invalid SAML response")
+		}
+		return nil, errors.Wrap(err, errors.ErrorPermissionDenied, "invalid SAML response")
+	}
+	err = p.checkReplay(assertion)
+	if err != nil {
+		return nil, err
+	}
+
+	ident, err := p.identity(assertion)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthorizationGrant{Identity: ident}, nil
+}
+
+// Metadata returns the SAML metadata of the service provider.
+func (p *SAMLProvider) Metadata() ([]byte, error) {
+	data, err := xml.MarshalIndent(p.sp.Metadata(), "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return data, nil
+}
+
+// checkReplay returns an error if the assertion has been used. Assertion IDs are remembered until
+// the assertion expires.
+func (p *SAMLProvider) checkReplay(assertion *saml.Assertion) error {
+	if assertion.ID == "" {
+		return errors.New(errors.ErrorPermissionDenied, "SAML assertion has no ID")
+	}
+	expiry := saml.MaxIssueDelay + saml.MaxClockSkew
+	if assertion.Conditions != nil && !assertion.Conditions.NotOnOrAfter.IsZero() {
+		if d := time.Until(assertion.Conditions.NotOnOrAfter) + saml.MaxClockSkew; d > expiry {
+			expiry = d
+		}
+	}
+	key := "saml_assertion/" + p.config.Name + "/" + assertion.ID
+	count, err := p.kv.Incr(key)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	err = p.kv.Expire(key, expiry)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	if count > 1 {
+		return errors.New(errors.ErrorPermissionDenied, "SAML assertion has been used")
+	}
+	return nil
+}
+
+// identity maps the subject and attributes of an assertion to Identity.
+func (p *SAMLProvider) identity(assertion *saml.Assertion) (*Identity, error) {
+	ident := &Identity{}
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		ident.ID = assertion.Subject.NameID.Value
+	}
+	if name, ok := p.config.Attributes["sub"]; ok {
+		ident.ID = samlAttribute(assertion, []string{name})
+	}
+	ident.Email = p.attribute(assertion, "email")
+	ident.EmailVerified = p.config.TrustEmail && ident.Email != ""
+	ident.Name = p.attribute(assertion, "name")
+	ident.PreferredUsername = p.attribute(assertion, "username")
+	ident.Claims = samlClaims(assertion)
+	err := validate.Struct(ident)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorPermissionDenied, "SAML assertion has no subject")
+	}
+	return ident, nil
+}
+
+// samlClaims returns the attributes of an assertion by name. Attributes with multiple values, e.g.
+// groups, are arrays.
+func samlClaims(assertion *saml.Assertion) map[string]interface{} {
+	claims := make(map[string]interface{})
+	for _, statement := range assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			if len(attr.Values) == 1 {
+				claims[attr.Name] = strings.TrimSpace(attr.Values[0].Value)
+				continue
+			}
+			values := make([]interface{}, len(attr.Values))
+			for i, v := range attr.Values {
+				values[i] = strings.TrimSpace(v.Value)
+			}
+			claims[attr.Name] = values
+		}
+	}
+	return claims
+}
+
+func (p *SAMLProvider) attribute(assertion *saml.Assertion, field string) string {
+	if name, ok := p.config.Attributes[field]; ok {
+		return samlAttribute(assertion, []string{name})
+	}
+	return samlAttribute(assertion, samlAttributes[field])
+}
+
+// samlAttribute returns the first value of the first attribute matching one of the names, by
+// either its name or friendly name.
+func samlAttribute(assertion *saml.Assertion, names []string) string {
+	for _, name := range names {
+		for _, statement := range assertion.AttributeStatements {
+			for _, attr := range statement.Attributes {
+				if (attr.Name == name || attr.FriendlyName == name) && len(attr.Values) > 0 {
+					return strings.TrimSpace(attr.Values[0].Value)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func samlResponseKey(idp, code string) string {
+	return "saml_response/" + idp + "/" + code
+}
+
+// samlURL returns an Authcore endpoint of the SAML service provider for an IDP.
+func samlURL(idp, endpoint string) *url.URL {
+	baseURL, err := url.Parse(viper.GetString("base_url"))
+	if err != nil {
+		log.Fatalf("invalid base_url: %v", err)
+	}
+	u, err := baseURL.Parse("/saml/" + url.PathEscape(idp) + "/" + endpoint)
+	if err != nil {
+		log.Fatalf("error building SAML URL: %v", err)
+	}
+	return u
+}
+
+// SAMLKeyPair returns the RSA private key and the certificate in PEM format in the config keys.
+func SAMLKeyPair(keyConfig, certConfig string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	keyPEM := ""
+	if v, ok := viper.Get(keyConfig).(secret.String); ok {
+		keyPEM = v.SecretString()
+	} else {
+		keyPEM = viper.GetString(keyConfig)
+	}
+	if keyPEM == "" {
+		return nil, nil, errors.Errorf(errors.ErrorInvalidArgument, "%v is required for SAML", keyConfig)
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(keyPEM))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, errors.ErrorInvalidArgument, "invalid %v", keyConfig)
+	}
+	block, _ := pem.Decode([]byte(viper.GetString(certConfig)))
+	if block == nil {
+		return nil, nil, errors.Errorf(errors.ErrorInvalidArgument, "%v is required for SAML", certConfig)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, errors.ErrorInvalidArgument, "invalid %v", certConfig)
+	}
+	return key, cert, nil
+}
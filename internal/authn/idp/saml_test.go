@@ -0,0 +1,229 @@
+package idp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"authcore.io/authcore/internal/config"
+	"authcore.io/authcore/pkg/kvstore"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func keyPairForTest(t *testing.T, cn string) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cert, err := x509.ParseCertificate(der)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return key, cert
+}
+
+// mockSAMLServiceProviders serves the metadata of a SAMLProvider to a crewjam/saml IdP.
+type mockSAMLServiceProviders struct {
+	provider *SAMLProvider
+}
+
+func (m mockSAMLServiceProviders) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	metadata := m.provider.sp.Metadata()
+	if serviceProviderID != metadata.EntityID {
+		return nil, os.ErrNotExist
+	}
+	return metadata, nil
+}
+
+func TestSAMLIDP(t *testing.T) {
+	config.InitDefaults()
+	defer viper.Reset()
+
+	idpKey, idpCert := keyPairForTest(t, "idp.example.com")
+	spKey, spCert := keyPairForTest(t, "authcore.localhost")
+	idpMetadataURL, _ := url.Parse("https://idp.example.com/saml/metadata")
+	idpSSOURL, _ := url.Parse("https://idp.example.com/saml/sso")
+	mockIDP := &saml.IdentityProvider{
+		Key:         idpKey,
+		Certificate: idpCert,
+		MetadataURL: *idpMetadataURL,
+		SSOURL:      *idpSSOURL,
+	}
+	idpMetadata, err := xml.Marshal(mockIDP.Metadata())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	provider, err := NewSAMLIDP(SAMLConfig{
+		Name:        "corp",
+		IDPMetadata: string(idpMetadata),
+		Attributes: map[string]string{
+			"email": "urn:oid:1.3.6.1.4.1.5923.1.1.1.6",
+			"name":  "cn",
+		},
+		TrustEmail: true,
+	}, spKey, spCert, kvstore.NewMemoryStore())
+	if !assert.NoError(t, err) {
+		return
+	}
+	mockIDP.ServiceProviderProvider = mockSAMLServiceProviders{provider}
+	assert.Equal(t, "corp", provider.ID())
+
+	metadata, err := provider.Metadata()
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(metadata), "https://authcore.localhost/saml/corp/acs")
+	}
+
+	// AuthnRequest
+	authURL, state, err := provider.AuthorizationURL("statetoken")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEmpty(t, state)
+	u, err := url.Parse(authURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, idpSSOURL.String(), u.Scheme+"://"+u.Host+u.Path)
+	assert.Equal(t, "statetoken", u.Query().Get("RelayState"))
+	assert.NotEmpty(t, u.Query().Get("SigAlg"))
+	assert.NotEmpty(t, u.Query().Get("Signature"))
+
+	makeResponse := func(nameID string) string {
+		req, err := saml.NewIdpAuthnRequest(mockIDP, httptest.NewRequest(http.MethodGet, authURL, nil))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		if !assert.NoError(t, req.Validate()) {
+			t.FailNow()
+		}
+		assert.Equal(t, string(state), req.Request.ID)
+		err = saml.DefaultAssertionMaker{}.MakeAssertion(req, &saml.Session{
+			ID:             "session",
+			CreateTime:     time.Now(),
+			ExpireTime:     time.Now().Add(time.Hour),
+			NameID:         nameID,
+			UserName:       "alice",
+			UserEmail:      "alice@example.com",
+			UserCommonName: "Alice",
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		if !assert.NoError(t, req.MakeAssertionEl()) || !assert.NoError(t, req.MakeResponse()) {
+			t.FailNow()
+		}
+		doc := etree.NewDocument()
+		doc.SetRoot(req.ResponseEl)
+		responseXML, err := doc.WriteToString()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return responseXML
+	}
+	exchange := func(state State, responseXML string) (*AuthorizationGrant, error) {
+		code, err := provider.StoreResponse(base64.StdEncoding.EncodeToString([]byte(responseXML)))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return provider.Exchange(context.Background(), state, code)
+	}
+
+	// Success
+	responseXML := makeResponse("alice-id")
+	grant, err := exchange(state, responseXML)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice-id", grant.Identity.ID)
+		assert.Equal(t, "alice@example.com", grant.Identity.Email)
+		assert.True(t, grant.Identity.EmailVerified)
+		assert.Equal(t, "Alice", grant.Identity.Name)
+		assert.Equal(t, "alice", grant.Identity.PreferredUsername)
+	}
+
+	// Replay
+	_, err = exchange(state, responseXML)
+	assert.Error(t, err)
+
+	// Not in response to the AuthnRequest
+	_, err = exchange(State("other"), makeResponse("alice-id"))
+	assert.Error(t, err)
+
+	// Tampered
+	_, err = exchange(state, strings.Replace(makeResponse("alice-id"), "https://authcore.localhost/saml/corp/acs", "https://evil.example.com/acs", 1))
+	assert.Error(t, err)
+
+	// Invalid code
+	_, err = provider.Exchange(context.Background(), state, "invalid")
+	assert.Error(t, err)
+}
+
+func TestLoadSAMLIDPs(t *testing.T) {
+	config.InitDefaults()
+	defer viper.Reset()
+
+	idpKey, idpCert := keyPairForTest(t, "idp.example.com")
+	spKey, spCert := keyPairForTest(t, "authcore.localhost")
+	idpMetadataURL, _ := url.Parse("https://idp.example.com/saml/metadata")
+	idpSSOURL, _ := url.Parse("https://idp.example.com/saml/sso")
+	idpMetadata, err := xml.Marshal((&saml.IdentityProvider{
+		Key:         idpKey,
+		Certificate: idpCert,
+		MetadataURL: *idpMetadataURL,
+		SSOURL:      *idpSSOURL,
+	}).Metadata())
+	if !assert.NoError(t, err) {
+		return
+	}
+	viper.Set("saml_providers", map[string]interface{}{
+		"Corp": map[string]interface{}{
+			"idp_metadata": string(idpMetadata),
+		},
+	})
+
+	// Missing key pair
+	_, err = LoadSAMLIDPs(kvstore.NewMemoryStore())
+	assert.Error(t, err)
+
+	viper.Set("saml_sp_private_key", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(spKey)})))
+	viper.Set("saml_sp_certificate", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: spCert.Raw})))
+	idps, err := LoadSAMLIDPs(kvstore.NewMemoryStore())
+	if assert.NoError(t, err) && assert.Len(t, idps, 1) {
+		assert.Equal(t, "corp", idps[0].ID())
+	}
+
+	// Invalid metadata
+	viper.Set("saml_providers", map[string]interface{}{
+		"corp": map[string]interface{}{
+			"idp_metadata": "<invalid",
+		},
+	})
+	_, err = LoadSAMLIDPs(kvstore.NewMemoryStore())
+	assert.Error(t, err)
+}
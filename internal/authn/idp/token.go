@@ -0,0 +1,135 @@
+package idp
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"authcore.io/authcore/internal/errors"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenRefresher is implemented by IDPs that can refresh the upstream tokens of a grant.
+type TokenRefresher interface {
+	// Refresh exchanges the refresh token of the grant for a new access token. The refresh token
+	// is kept if the IDP does not issue a new one.
+	Refresh(ctx context.Context, grant *AuthorizationGrant) (*AuthorizationGrant, error)
+}
+
+// TokenRevoker is implemented by IDPs that can revoke the upstream tokens of a grant.
+type TokenRevoker interface {
+	// Revoke revokes the refresh token of the grant, or the access token if there is no refresh
+	// token.
+	Revoke(ctx context.Context, grant *AuthorizationGrant) error
+}
+
+// Refresh exchanges the refresh token of the grant for a new access token.
+func (p *OAuth2Provider) Refresh(ctx context.Context, grant *AuthorizationGrant) (*AuthorizationGrant, error) {
+	if p.ClientSecretFunc != nil {
+		var err error
+		p.Config.ClientSecret, err = p.ClientSecretFunc()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refreshOAuth2Grant(ctx, p.Config, grant)
+}
+
+// Revoke revokes the tokens of the grant with the revocation endpoint. The tokens are not revoked
+// if the provider has no revocation endpoint.
+func (p *OAuth2Provider) Revoke(ctx context.Context, grant *AuthorizationGrant) error {
+	if p.RevocationURL == "" {
+		return nil
+	}
+	if p.ClientSecretFunc != nil {
+		var err error
+		p.Config.ClientSecret, err = p.ClientSecretFunc()
+		if err != nil {
+			return err
+		}
+	}
+	return revokeOAuth2Grant(ctx, http.DefaultClient, p.Config, p.RevocationURL, grant)
+}
+
+// Refresh exchanges the refresh token of the grant for a new access token.
+func (p *OIDCProvider) Refresh(ctx context.Context, grant *AuthorizationGrant) (*AuthorizationGrant, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.client)
+	return refreshOAuth2Grant(ctx, p.oauth2Config(metadata), grant)
+}
+
+// Revoke revokes the tokens of the grant with the revocation endpoint in the provider metadata.
+// The tokens are not revoked if the provider does not publish a revocation endpoint.
+func (p *OIDCProvider) Revoke(ctx context.Context, grant *AuthorizationGrant) error {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return err
+	}
+	if metadata.RevocationEndpoint == "" {
+		return nil
+	}
+	return revokeOAuth2Grant(ctx, p.client, p.oauth2Config(metadata), metadata.RevocationEndpoint, grant)
+}
+
+func refreshOAuth2Grant(ctx context.Context, config *oauth2.Config, grant *AuthorizationGrant) (*AuthorizationGrant, error) {
+	if grant.RefreshToken == "" {
+		return nil, errors.New(errors.ErrorFailedPrecondition, "grant has no refresh token")
+	}
+	token, err := config.TokenSource(ctx, &oauth2.Token{RefreshToken: grant.RefreshToken}).Token()
+	if _, ok := err.(*oauth2.RetrieveError); ok {
+		return nil, errors.Wrap(err, errors.ErrorPermissionDenied, "refresh token rejected")
+	} else if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnavailable, "")
+	}
+	refreshed := &AuthorizationGrant{
+		AccessToken:  token.AccessToken,
+		TokenType:    token.TokenType,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+	}
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = grant.RefreshToken
+	}
+	return refreshed, nil
+}
+
+// revokeOAuth2Grant revokes a token with OAuth 2.0 Token Revocation (RFC 7009). Revoking a refresh
+// token also invalidates the access tokens issued with it.
+func revokeOAuth2Grant(ctx context.Context, client *http.Client, config *oauth2.Config, revocationURL string, grant *AuthorizationGrant) error {
+	form := url.Values{}
+	if grant.RefreshToken != "" {
+		form.Set("token", grant.RefreshToken)
+		form.Set("token_type_hint", "refresh_token")
+	} else if grant.AccessToken != "" {
+		form.Set("token", grant.AccessToken)
+		form.Set("token_type_hint", "access_token")
+	} else {
+		return nil
+	}
+	if config.Endpoint.AuthStyle == oauth2.AuthStyleInParams {
+		form.Set("client_id", config.ClientID)
+		form.Set("client_secret", config.ClientSecret)
+	}
+	req, err := http.NewRequest(http.MethodPost, revocationURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if config.Endpoint.AuthStyle != oauth2.AuthStyleInParams {
+		req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnavailable, "")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf(errors.ErrorUnavailable, "unexpected status %v from %v", resp.StatusCode, revocationURL)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"authcore.io/authcore/internal/errors"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestOAuth2ProviderRefreshAndRevoke(t *testing.T) {
+	var revoked []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/token":
+			clientID, clientSecret, _ := r.BasicAuth()
+			if clientID != "client" || clientSecret != "secret" || r.PostForm.Get("grant_type") != "refresh_token" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			switch r.PostForm.Get("refresh_token") {
+			case "refresh-token":
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"access_token": "new-access-token",
+					"token_type":   "Bearer",
+					"expires_in":   3600,
+				})
+			case "rotated-refresh-token":
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"access_token":  "new-access-token",
+					"token_type":    "Bearer",
+					"refresh_token": "new-refresh-token",
+				})
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]interface{}{"error": "invalid_grant"})
+			}
+		case "/revoke":
+			if r.PostForm.Get("client_id") == "" {
+				clientID, _, _ := r.BasicAuth()
+				r.PostForm.Set("client_id", clientID)
+			}
+			revoked = append(revoked, r.PostForm)
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	p := &OAuth2Provider{
+		IDString: "example",
+		Config: &oauth2.Config{
+			ClientID:     "client",
+			ClientSecret: "secret",
+			Endpoint: oauth2.Endpoint{
+				TokenURL:  server.URL + "/token",
+				AuthStyle: oauth2.AuthStyleInHeader,
+			},
+		},
+		RevocationURL: server.URL + "/revoke",
+	}
+	var _ TokenRefresher = p
+	var _ TokenRevoker = p
+
+	// The refresh token is kept if the provider does not rotate it
+	grant, err := p.Refresh(ctx, &AuthorizationGrant{AccessToken: "old-access-token", RefreshToken: "refresh-token"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "new-access-token", grant.AccessToken)
+		assert.Equal(t, "Bearer", grant.TokenType)
+		assert.Equal(t, "refresh-token", grant.RefreshToken)
+		assert.False(t, grant.Expiry.IsZero())
+	}
+
+	grant, err = p.Refresh(ctx, &AuthorizationGrant{RefreshToken: "rotated-refresh-token"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "new-refresh-token", grant.RefreshToken)
+	}
+
+	_, err = p.Refresh(ctx, &AuthorizationGrant{RefreshToken: "revoked-refresh-token"})
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	_, err = p.Refresh(ctx, &AuthorizationGrant{AccessToken: "access-token"})
+	assert.True(t, errors.IsKind(err, errors.ErrorFailedPrecondition))
+
+	// The refresh token is revoked in preference to the access token
+	err = p.Revoke(ctx, &AuthorizationGrant{AccessToken: "access-token", RefreshToken: "refresh-token"})
+	assert.NoError(t, err)
+	err = p.Revoke(ctx, &AuthorizationGrant{AccessToken: "access-token"})
+	assert.NoError(t, err)
+	p.Config.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	err = p.Revoke(ctx, &AuthorizationGrant{AccessToken: "access-token"})
+	assert.NoError(t, err)
+	if assert.Len(t, revoked, 3) {
+		assert.Equal(t, "refresh-token", revoked[0].Get("token"))
+		assert.Equal(t, "refresh_token", revoked[0].Get("token_type_hint"))
+		assert.Equal(t, "client", revoked[0].Get("client_id"))
+		assert.Equal(t, "access-token", revoked[1].Get("token"))
+		assert.Equal(t, "access_token", revoked[1].Get("token_type_hint"))
+		assert.Equal(t, "secret", revoked[2].Get("client_secret"))
+	}
+
+	// Tokens are not revoked without a revocation endpoint
+	p.RevocationURL = ""
+	err = p.Revoke(ctx, &AuthorizationGrant{AccessToken: "access-token"})
+	assert.NoError(t, err)
+	assert.Len(t, revoked, 3)
+}
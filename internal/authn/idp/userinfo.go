@@ -0,0 +1,246 @@
+package idp
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+// userinfoClaims lists the claims that can be mapped from a userinfo response to Identity, with
+// their default JSON paths as defined in the OIDC userinfo response.
+var userinfoClaims = map[string]string{
+	"sub":            "sub",
+	"email":          "email",
+	"email_verified": "email_verified",
+	"name":           "name",
+	"username":       "preferred_username",
+}
+
+// OAuth2Config is the configuration of a generic OAuth 2.0 provider that identifies users with a
+// userinfo endpoint. Claims maps the claims in userinfoClaims to JSON paths in the userinfo
+// response. A path is a list of segments separated by dots, each being an object key, an array
+// index or a selector like "[primary=true]" matching the first array element with the given field.
+type OAuth2Config struct {
+	Name             string            `mapstructure:"-"`
+	ClientID         string            `mapstructure:"client_id"`
+	ClientSecret     string            `mapstructure:"client_secret"`
+	AuthorizationURL string            `mapstructure:"authorization_url"`
+	TokenURL         string            `mapstructure:"token_url"`
+	RevocationURL    string            `mapstructure:"revocation_url"`
+	Scopes           []string          `mapstructure:"scopes"`
+	UserinfoURL      string            `mapstructure:"userinfo_url"`
+	Claims           map[string]string `mapstructure:"claims"`
+	ExtraRequests    []UserinfoRequest `mapstructure:"extra_requests"`
+}
+
+// UserinfoRequest is an additional request made after the userinfo request, e.g. GitHub's emails
+// endpoint. The claims found in its response override those from the previous requests.
+type UserinfoRequest struct {
+	URL    string            `mapstructure:"url"`
+	Claims map[string]string `mapstructure:"claims"`
+}
+
+// NewOAuth2IDP returns a new IDP to authenticate using a generic OAuth 2.0 provider.
+func NewOAuth2IDP(config OAuth2Config) IDP {
+	claims := make(map[string]string)
+	for k, v := range userinfoClaims {
+		claims[k] = v
+	}
+	for k, v := range config.Claims {
+		claims[k] = v
+	}
+	requests := append([]UserinfoRequest{{URL: config.UserinfoURL, Claims: claims}}, config.ExtraRequests...)
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	return &OAuth2Provider{
+		IDString: config.Name,
+		Config: &oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  OauthRedirectURL(config.Name),
+			Scopes:       config.Scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  config.AuthorizationURL,
+				TokenURL: config.TokenURL,
+			},
+		},
+		IdentityFunc: func(accessToken string) (*Identity, error) {
+			return fetchUserinfoIdentity(client, accessToken, requests)
+		},
+		RevocationURL: config.RevocationURL,
+	}
+}
+
+// LoadOAuth2IDPs loads generic OAuth 2.0 providers from the oauth2_providers config, sorted by name.
+func LoadOAuth2IDPs() ([]IDP, error) {
+	rawMap := make(map[string]*OAuth2Config)
+	err := viper.UnmarshalKey("oauth2_providers", &rawMap)
+	if err != nil {
+		return nil, errors.Errorf(errors.ErrorUnknown, "error reading oauth2_providers config: %v", err)
+	}
+
+	names := make([]string, 0, len(rawMap))
+	for k := range rawMap {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	idps := make([]IDP, 0, len(names))
+	for _, k := range names {
+		c := rawMap[k]
+		c.Name = strings.ToLower(k)
+		if c.ClientID == "" || c.AuthorizationURL == "" || c.TokenURL == "" || c.UserinfoURL == "" {
+			return nil, errors.Errorf(errors.ErrorInvalidArgument, "OAuth 2.0 provider %v requires client_id, authorization_url, token_url and userinfo_url", k)
+		}
+		for _, r := range append([]UserinfoRequest{{Claims: c.Claims}}, c.ExtraRequests...) {
+			for claim := range r.Claims {
+				if _, ok := userinfoClaims[claim]; !ok {
+					return nil, errors.Errorf(errors.ErrorInvalidArgument, "OAuth 2.0 provider %v maps unknown claim %v", k, claim)
+				}
+			}
+		}
+		idps = append(idps, NewOAuth2IDP(*c))
+	}
+	return idps, nil
+}
+
+// fetchUserinfoIdentity makes the userinfo requests with the access token and builds an Identity
+// from the claims found in the responses. The claims of the identity are the members of the JSON
+// objects of the responses, and the mapped claims.
+func fetchUserinfoIdentity(client *http.Client, accessToken string, requests []UserinfoRequest) (*Identity, error) {
+	values := make(map[string]interface{})
+	claims := make(map[string]interface{})
+	for _, r := range requests {
+		req, err := http.NewRequest(http.MethodGet, r.URL, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		req.Header.Set("Accept", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrorUnavailable, "")
+		}
+		var data interface{}
+		decoder := json.NewDecoder(resp.Body)
+		decoder.UseNumber()
+		err = decoder.Decode(&data)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Errorf(errors.ErrorPermissionDenied, "unexpected status %v from %v", resp.StatusCode, r.URL)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+		}
+		if m, ok := data.(map[string]interface{}); ok {
+			for k, v := range m {
+				if _, ok := claims[k]; !ok {
+					claims[k] = v
+				}
+			}
+		}
+		for claim, path := range r.Claims {
+			if v, ok := lookupJSONPath(data, path); ok && v != nil {
+				values[claim] = v
+			}
+		}
+	}
+
+	for k, v := range values {
+		claims[k] = v
+	}
+	ident := &Identity{
+		ID:                jsonString(values["sub"]),
+		Email:             jsonString(values["email"]),
+		EmailVerified:     jsonString(values["email_verified"]) == "true",
+		Name:              jsonString(values["name"]),
+		PreferredUsername: jsonString(values["username"]),
+		Claims:            claims,
+	}
+	err := validate.Struct(ident)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorPermissionDenied, "userinfo response has no subject")
+	}
+	return ident, nil
+}
+
+// lookupJSONPath returns the value at the path of a decoded JSON document.
+func lookupJSONPath(data interface{}, path string) (interface{}, bool) {
+	for _, segment := range splitJSONPath(path) {
+		switch v := data.(type) {
+		case map[string]interface{}:
+			var ok bool
+			data, ok = v[segment]
+			if !ok {
+				return nil, false
+			}
+		case []interface{}:
+			if strings.HasPrefix(segment, "[") && strings.HasSuffix(segment, "]") {
+				selector := strings.SplitN(segment[1:len(segment)-1], "=", 2)
+				if len(selector) != 2 {
+					return nil, false
+				}
+				data = nil
+				for _, e := range v {
+					if m, ok := e.(map[string]interface{}); ok && jsonString(m[selector[0]]) == selector[1] {
+						data = e
+						break
+					}
+				}
+				if data == nil {
+					return nil, false
+				}
+			} else {
+				i, err := strconv.Atoi(segment)
+				if err != nil || i < 0 || i >= len(v) {
+					return nil, false
+				}
+				data = v[i]
+			}
+		default:
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// splitJSONPath splits a path by dots outside of selectors.
+func splitJSONPath(path string) []string {
+	var segments []string
+	depth, start := 0, 0
+	for i, c := range path {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case '.':
+			if depth == 0 {
+				segments = append(segments, path[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(segments, path[start:])
+}
+
+// jsonString converts a scalar JSON value to string. It returns an empty string for null, objects
+// and arrays.
+func jsonString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
@@ -0,0 +1,208 @@
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"authcore.io/authcore/internal/config"
+	"authcore.io/authcore/pkg/kvstore"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOAuth2IDP(t *testing.T) {
+	config.InitDefaults()
+	defer viper.Reset()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "code" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access_token",
+			"token_type":   "bearer",
+		})
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id": 12345678901, "login": "octocat", "name": "The Octocat", "email": null}`))
+	})
+	mux.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"email": "octocat@old.example.com", "primary": false, "verified": true},
+			{"email": "octocat@example.com", "primary": true, "verified": true}
+		]`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	provider := NewOAuth2IDP(OAuth2Config{
+		Name:             "github",
+		ClientID:         "client",
+		ClientSecret:     "secret",
+		AuthorizationURL: server.URL + "/authorize",
+		TokenURL:         server.URL + "/token",
+		Scopes:           []string{"read:user", "user:email"},
+		UserinfoURL:      server.URL + "/user",
+		Claims: map[string]string{
+			"sub":      "id",
+			"username": "login",
+		},
+		ExtraRequests: []UserinfoRequest{{
+			URL: server.URL + "/user/emails",
+			Claims: map[string]string{
+				"email":          "[primary=true].email",
+				"email_verified": "[primary=true].verified",
+			},
+		}},
+	})
+	assert.Equal(t, "github", provider.ID())
+
+	url, _, err := provider.AuthorizationURL("testing")
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL+"/authorize?client_id=client&redirect_uri=https%3A%2F%2Fauthcore.localhost%2Foauth%2Fredirect&response_type=code&scope=read%3Auser+user%3Aemail&state=testing", url)
+
+	grant, err := provider.Exchange(context.Background(), "", "code")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "12345678901", grant.Identity.ID)
+		assert.Equal(t, "octocat", grant.Identity.PreferredUsername)
+		assert.Equal(t, "The Octocat", grant.Identity.Name)
+		assert.Equal(t, "octocat@example.com", grant.Identity.Email)
+		assert.True(t, grant.Identity.EmailVerified)
+	}
+
+	_, err = provider.Exchange(context.Background(), "", "invalid")
+	assert.Error(t, err)
+
+	// Missing subject
+	provider = NewOAuth2IDP(OAuth2Config{
+		Name:        "github",
+		ClientID:    "client",
+		TokenURL:    server.URL + "/token",
+		UserinfoURL: server.URL + "/user",
+	})
+	_, err = provider.Exchange(context.Background(), "", "code")
+	assert.Error(t, err)
+}
+
+func TestLookupJSONPath(t *testing.T) {
+	var data interface{}
+	err := json.Unmarshal([]byte(`{
+		"data": {"user": {"id": "u1"}},
+		"emails": [{"email": "a@example.com", "primary": false}, {"email": "b@example.com", "primary": true}]
+	}`), &data)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	v, ok := lookupJSONPath(data, "data.user.id")
+	assert.True(t, ok)
+	assert.Equal(t, "u1", v)
+	v, ok = lookupJSONPath(data, "emails.0.email")
+	assert.True(t, ok)
+	assert.Equal(t, "a@example.com", v)
+	v, ok = lookupJSONPath(data, "emails.[primary=true].email")
+	assert.True(t, ok)
+	assert.Equal(t, "b@example.com", v)
+	v, ok = lookupJSONPath(data, "emails.[email=b@example.com].primary")
+	assert.True(t, ok)
+	assert.Equal(t, true, v)
+
+	_, ok = lookupJSONPath(data, "data.user.missing")
+	assert.False(t, ok)
+	_, ok = lookupJSONPath(data, "emails.2.email")
+	assert.False(t, ok)
+	_, ok = lookupJSONPath(data, "emails.[primary=maybe].email")
+	assert.False(t, ok)
+	_, ok = lookupJSONPath(data, "data.user.id.more")
+	assert.False(t, ok)
+}
+
+func TestLoadIDPs(t *testing.T) {
+	viper.Set("oidc_providers", map[string]interface{}{
+		"okta": map[string]interface{}{
+			"issuer":    "https://corp.okta.com",
+			"client_id": "authcore",
+		},
+	})
+	viper.Set("oauth2_providers", map[string]interface{}{
+		"github": map[string]interface{}{
+			"client_id":         "authcore",
+			"authorization_url": "https://github.com/login/oauth/authorize",
+			"token_url":         "https://github.com/login/oauth/access_token",
+			"userinfo_url":      "https://api.github.com/user",
+			"claims":            map[string]interface{}{"sub": "id", "username": "login"},
+			"extra_requests": []interface{}{
+				map[string]interface{}{
+					"url":    "https://api.github.com/user/emails",
+					"claims": map[string]interface{}{"email": "[primary=true].email"},
+				},
+			},
+		},
+	})
+	defer viper.Reset()
+
+	idps, err := LoadIDPs(kvstore.NewMemoryStore())
+	if assert.NoError(t, err) && assert.Len(t, idps, 2) {
+		assert.Equal(t, "okta", idps[0].ID())
+		assert.Equal(t, "github", idps[1].ID())
+	}
+
+	// Unknown claim
+	viper.Set("oauth2_providers", map[string]interface{}{
+		"github": map[string]interface{}{
+			"client_id":         "authcore",
+			"authorization_url": "https://github.com/login/oauth/authorize",
+			"token_url":         "https://github.com/login/oauth/access_token",
+			"userinfo_url":      "https://api.github.com/user",
+			"claims":            map[string]interface{}{"avatar": "avatar_url"},
+		},
+	})
+	_, err = LoadIDPs(kvstore.NewMemoryStore())
+	assert.Error(t, err)
+
+	// Duplicated name
+	viper.Set("oauth2_providers", map[string]interface{}{
+		"okta": map[string]interface{}{
+			"client_id":         "authcore",
+			"authorization_url": "https://corp.okta.com/authorize",
+			"token_url":         "https://corp.okta.com/token",
+			"userinfo_url":      "https://corp.okta.com/userinfo",
+		},
+	})
+	_, err = LoadIDPs(kvstore.NewMemoryStore())
+	assert.Error(t, err)
+
+	// Conflicts with a built-in IDP
+	viper.Set("oauth2_providers", map[string]interface{}{})
+	viper.Set("oidc_providers", map[string]interface{}{
+		"google": map[string]interface{}{
+			"issuer":    "https://accounts.google.com",
+			"client_id": "authcore",
+		},
+	})
+	_, err = LoadIDPs(kvstore.NewMemoryStore())
+	assert.Error(t, err)
+
+	// Conflicts with the service of Ethereum accounts
+	viper.Set("oidc_providers", map[string]interface{}{
+		"ethereum": map[string]interface{}{
+			"issuer":    "https://ethereum.example.com",
+			"client_id": "authcore",
+		},
+	})
+	_, err = LoadIDPs(kvstore.NewMemoryStore())
+	assert.Error(t, err)
+}
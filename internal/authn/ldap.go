@@ -0,0 +1,265 @@
+package authn
+
+import (
+	"context"
+	"time"
+
+	"authcore.io/authcore/internal/authn/hook"
+	"authcore.io/authcore/internal/authn/idp"
+	"authcore.io/authcore/internal/authn/ldap"
+	"authcore.io/authcore/internal/clientapp"
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/cryptoutil"
+	"authcore.io/authcore/pkg/log"
+	"authcore.io/authcore/pkg/nulls"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// RegisterLDAPDirectory enables authenticating the users of client apps with ldap_enabled with the
+// LDAP directory.
+func (tc *TransactionController) RegisterLDAPDirectory(directory *ldap.Directory) {
+	tc.directory = directory
+}
+
+// isLDAPEnabled returns true if the users of the client app without a local password authenticate
+// with the LDAP directory.
+func (tc *TransactionController) isLDAPEnabled(clientApp *clientapp.ClientApp) bool {
+	return tc.directory != nil && clientApp.LDAPEnabled
+}
+
+// isLDAPState returns true if the user of the state authenticates with the LDAP directory. The user
+// may not be provisioned until the password is verified.
+func isLDAPState(state *State) bool {
+	return state.Status == StatusLDAP || state.ChallengeNextStatus == StatusLDAP
+}
+
+// startLDAP returns a state for the user to authenticate with the password in the LDAP directory.
+// userID is the ID of the local user of the handle, or 0 if the user has not been provisioned.
+func (tc *TransactionController) startLDAP(ctx context.Context, clientApp *clientapp.ClientApp, userID int64, handle, redirectURI, codeChallengeMethod, codeChallenge, clientState string) (*State, error) {
+	state := &State{
+		StateToken:          cryptoutil.RandomToken32(),
+		Status:              StatusLDAP,
+		ClientID:            clientApp.ID,
+		UserID:              userID,
+		Handle:              handle,
+		Factors:             []string{},
+		RedirectURI:         redirectURI,
+		PKCEChallengeMethod: codeChallengeMethod,
+		PKCEChallenge:       codeChallenge,
+		ClientState:         clientState,
+	}
+	if userID != 0 && tc.store.CheckRateLimiter(ctx, userID) != nil {
+		state.Status = StatusBlocked
+	}
+
+	err := tc.issueChallenge(ctx, state, userID)
+	if err != nil {
+		return nil, err
+	}
+	if state.Status == StatusLDAP {
+		mutateLDAP(state)
+	}
+
+	err = tc.store.PutState(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// mutateLDAP sets the LDAP password factor to the state.
+func mutateLDAP(state *State) {
+	state.ClearFactors()
+	state.AppendFactor(FactorLDAPPassword)
+}
+
+// VerifyLDAPPassword verifies a plaintext password with the LDAP directory. The user linked with
+// the directory entry is provisioned on the first sign in, and its attributes and the roles mapped
+// from groups are updated from the directory on every sign in.
+func (tc *TransactionController) VerifyLDAPPassword(ctx context.Context, stateToken string, password []byte) (*State, error) {
+	return tc.stateMutation(ctx, stateToken, StatusLDAP, func(state *State, _ *user.User) error {
+		if tc.directory == nil {
+			return errors.New(errors.ErrorFailedPrecondition, "LDAP directory is not enabled")
+		}
+		if state.UserID != 0 {
+			err := tc.store.CheckRateLimiter(ctx, state.UserID)
+			if err != nil {
+				retryAfter := tc.store.UserRateLimiterRetryAfter(ctx, state.UserID)
+				return errors.WithRetryAfter(errors.ErrorUserTemporarilyBlocked, "too many authentication attempts", retryAfter)
+			}
+		}
+		err := tc.store.CheckSourceRateLimiter(ctx, state.Handle)
+		if err != nil {
+			return err
+		}
+
+		entry, err := tc.directory.Authenticate(ctx, state.Handle, string(password))
+		if errors.IsKind(err, errors.ErrorPermissionDenied) {
+			if state.UserID != 0 {
+				tc.store.IncrementRateLimiter(ctx, state.UserID)
+			}
+			tc.store.IncrementSourceRateLimiter(ctx, state.Handle)
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		u, err := tc.provisionLDAPUser(ctx, state, entry)
+		if err != nil {
+			return err
+		}
+		if state.Status == StatusIDPAlreadyExists {
+			return nil
+		}
+		if u.IsCurrentlyLocked() {
+			return errors.New(errors.ErrorPermissionDenied, "user is locked")
+		}
+		state.UserID = u.ID
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"user_id": u.PublicID(),
+			"ldap_dn": entry.DN,
+		}).Info("LDAP password authentication accepted")
+		return tc.mutatePasswordVerified(ctx, state, u, false)
+	})
+}
+
+// provisionLDAPUser returns the user linked with the directory entry. On the first sign in, a new
+// user is created. If a user has the same email address, the entry is linked with the user only if
+// ldap_link_users_by_email is set and the email address is verified; otherwise the state becomes
+// IDP_ALREADY_EXISTS and nil is returned, so that the user must prove the ownership of the existing
+// account before linking. The directory is trusted, so the email address and the phone number from
+// the directory are verified, except that an email address of another user is never taken over.
+func (tc *TransactionController) provisionLDAPUser(ctx context.Context, state *State, entry *ldap.Entry) (*user.User, error) {
+	var u *user.User
+	oauthFactor, err := tc.userStore.FindOAuthFactorByOAuthIdentity(ctx, user.OAuthLDAP, entry.ID)
+	if err != nil && !errors.IsKind(err, errors.ErrorNotFound) {
+		return nil, err
+	}
+	if oauthFactor != nil {
+		u, err = tc.userStore.UserByID(ctx, oauthFactor.UserID)
+		if err != nil {
+			return nil, err
+		}
+		updateLDAPUser(u, entry)
+		err = tc.userStore.UpdateUser(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tc.userStore.UpdateOAuthFactorMetadata(ctx, oauthFactor.ID, nulls.NewJSON(entry))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if entry.Email != "" {
+			u, err = tc.userStore.UserByEmail(ctx, entry.Email)
+			if err != nil && !errors.IsKind(err, errors.ErrorNotFound) {
+				return nil, err
+			}
+		}
+		if u != nil && !(viper.GetBool("ldap_link_users_by_email") && u.EmailVerified()) {
+			log.GetLogger(ctx).WithFields(logrus.Fields{
+				"user_id": u.PublicID(),
+				"ldap_dn": entry.DN,
+			}).Info("LDAP entry's email is found but it is not linked with the entry")
+			state.IDP = string(user.OAuthLDAP)
+			return nil, tc.mutateIDPAlreadyExists(ctx, state, u, ldapIdentity(entry))
+		}
+		if u == nil {
+			u = &user.User{}
+			updateLDAPUser(u, entry)
+			claims, err := tc.runHooks(ctx, hook.PreSignUp, state.ClientID, u)
+			if err != nil {
+				return nil, err
+			}
+			state.HookClaims = mergeClaims(state.HookClaims, claims)
+			err = tc.userStore.InsertUser(ctx, u)
+			if err != nil {
+				return nil, err
+			}
+			log.GetLogger(ctx).WithFields(logrus.Fields{
+				"user_id": u.PublicID(),
+				"ldap_dn": entry.DN,
+			}).Info("register new LDAP user")
+		} else {
+			updateLDAPUser(u, entry)
+			err = tc.userStore.UpdateUser(ctx, u)
+			if err != nil {
+				return nil, err
+			}
+			log.GetLogger(ctx).WithFields(logrus.Fields{
+				"user_id": u.PublicID(),
+				"ldap_dn": entry.DN,
+			}).Info("LDAP entry linked with user by email")
+		}
+		_, err = tc.userStore.CreateOAuthFactor(ctx, u.ID, user.OAuthLDAP, entry.ID, nulls.NewJSON(entry))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tc.userStore.SyncRoles(ctx, u.ID, tc.directory.ManagedRoles(), entry.Roles)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// ldapEntryForUser returns the directory entry to be copied to u. The email address is omitted if
+// it belongs to another user.
+func (tc *TransactionController) ldapEntryForUser(ctx context.Context, u *user.User, entry *ldap.Entry) (*ldap.Entry, error) {
+	if entry.Email == "" || entry.Email == u.Email.String {
+		return entry, nil
+	}
+	owner, err := tc.userStore.UserByEmail(ctx, entry.Email)
+	if errors.IsKind(err, errors.ErrorNotFound) {
+		return entry, nil
+	} else if err != nil {
+		return nil, err
+	}
+	log.GetLogger(ctx).WithFields(logrus.Fields{
+		"user_id":  u.PublicID(),
+		"owner_id": owner.PublicID(),
+		"ldap_dn":  entry.DN,
+	}).Warn("LDAP entry's email belongs to another user")
+	userEntry := *entry
+	userEntry.Email = ""
+	return &userEntry, nil
+}
+
+// ldapIdentity returns the IDP identity of the directory entry to be linked in an
+// IDP_ALREADY_EXISTS transaction.
+func ldapIdentity(entry *ldap.Entry) *idp.Identity {
+	return &idp.Identity{
+		ID:                  entry.ID,
+		Name:                entry.Name,
+		PreferredUsername:   entry.Username,
+		Email:               entry.Email,
+		EmailVerified:       entry.Email != "",
+		PhoneNumber:         entry.Phone,
+		PhoneNumberVerified: entry.Phone != "",
+	}
+}
+
+// updateLDAPUser copies the mapped attributes of the directory entry to the user. Attributes that
+// are not set in the entry are left unchanged.
+func updateLDAPUser(u *user.User, entry *ldap.Entry) {
+	now := time.Now()
+	if entry.Name != "" {
+		u.Name = nulls.NewString(entry.Name)
+		u.DisplayNameOld = entry.Name
+	}
+	if entry.Username != "" {
+		u.Username = nulls.NewString(entry.Username)
+	}
+	if entry.Email != "" && (u.Email.String != entry.Email || !u.EmailVerifiedAt.Valid) {
+		u.Email = nulls.NewString(entry.Email)
+		u.EmailVerifiedAt = nulls.NewTime(now)
+	}
+	if entry.Phone != "" && (u.Phone.String != entry.Phone || !u.PhoneVerifiedAt.Valid) {
+		u.Phone = nulls.NewString(entry.Phone)
+		u.PhoneVerifiedAt = nulls.NewTime(now)
+	}
+}
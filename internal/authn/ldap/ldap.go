@@ -0,0 +1,354 @@
+// Package ldap authenticates users with the passwords in an LDAP directory such as Active
+// Directory.
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/pkg/log"
+	"authcore.io/authcore/pkg/secret"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// timeout is the timeout of connecting to the directory and of each request.
+	timeout = 10 * time.Second
+	// handlePlaceholder is replaced by the escaped user handle in the user filter.
+	handlePlaceholder = "{handle}"
+)
+
+// fields lists the user fields that can be mapped from LDAP attributes.
+var fields = []string{"name", "email", "phone", "username"}
+
+// Config is the configuration of an LDAP directory.
+type Config struct {
+	URL           string
+	StartTLS      bool
+	CACertificate string
+	BindDN        string
+	BindPassword  string
+	BaseDN        string
+	// UserFilter is the filter to search users by handle, e.g. (|(sAMAccountName={handle})(mail={handle})).
+	UserFilter string
+	// IDAttribute is the attribute with the immutable ID of an entry, e.g. objectGUID or entryUUID.
+	IDAttribute string
+	// Attributes maps user fields to LDAP attributes.
+	Attributes map[string]string
+	// GroupAttribute is the attribute listing the DNs of the groups of an entry.
+	GroupAttribute string
+	// GroupRoles maps groups to roles.
+	GroupRoles []GroupRole
+}
+
+// GroupRole maps the members of an LDAP group to a role.
+type GroupRole struct {
+	Group string `mapstructure:"group"`
+	Role  string `mapstructure:"role"`
+}
+
+// Entry is a user entry in the directory.
+type Entry struct {
+	DN       string   `json:"dn"`
+	ID       string   `json:"id"`
+	Name     string   `json:"name,omitempty"`
+	Email    string   `json:"email,omitempty"`
+	Phone    string   `json:"phone,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	// Roles lists the roles mapped from the groups of the entry.
+	Roles []string `json:"roles,omitempty"`
+}
+
+// Directory authenticates users with an LDAP directory.
+type Directory struct {
+	config    Config
+	tlsConfig *tls.Config
+}
+
+// LoadConfig reads the LDAP directory config. It returns nil if ldap_url is not set.
+func LoadConfig() (*Config, error) {
+	if viper.GetString("ldap_url") == "" {
+		return nil, nil
+	}
+	c := &Config{
+		URL:            viper.GetString("ldap_url"),
+		StartTLS:       viper.GetBool("ldap_start_tls"),
+		CACertificate:  viper.GetString("ldap_ca_certificate"),
+		BindDN:         viper.GetString("ldap_bind_dn"),
+		BaseDN:         viper.GetString("ldap_base_dn"),
+		UserFilter:     viper.GetString("ldap_user_filter"),
+		IDAttribute:    viper.GetString("ldap_id_attribute"),
+		Attributes:     viper.GetStringMapString("ldap_attributes"),
+		GroupAttribute: viper.GetString("ldap_group_attribute"),
+	}
+	if v, ok := viper.Get("ldap_bind_password").(secret.String); ok {
+		c.BindPassword = v.SecretString()
+	} else {
+		c.BindPassword = viper.GetString("ldap_bind_password")
+	}
+	err := viper.UnmarshalKey("ldap_group_roles", &c.GroupRoles)
+	if err != nil {
+		return nil, errors.Errorf(errors.ErrorUnknown, "error reading ldap_group_roles config: %v", err)
+	}
+	return c, nil
+}
+
+// NewDirectory returns a Directory. Connections must be protected by TLS, either with an ldaps://
+// URL or with StartTLS.
+func NewDirectory(c Config) (*Directory, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorInvalidArgument, "invalid LDAP URL")
+	}
+	switch u.Scheme {
+	case "ldaps":
+		// StartTLS only applies to ldap:// URLs.
+		c.StartTLS = false
+	case "ldap":
+		if !c.StartTLS {
+			return nil, errors.New(errors.ErrorInvalidArgument, "LDAP connection requires ldaps:// or StartTLS")
+		}
+	default:
+		return nil, errors.Errorf(errors.ErrorInvalidArgument, "unsupported LDAP URL scheme %v", u.Scheme)
+	}
+	if c.BaseDN == "" || c.IDAttribute == "" {
+		return nil, errors.New(errors.ErrorInvalidArgument, "LDAP directory requires base DN and ID attribute")
+	}
+	if !strings.Contains(c.UserFilter, handlePlaceholder) {
+		return nil, errors.Errorf(errors.ErrorInvalidArgument, "LDAP user filter must contain %v", handlePlaceholder)
+	}
+	if _, err := goldap.CompileFilter(strings.ReplaceAll(c.UserFilter, handlePlaceholder, "handle")); err != nil {
+		return nil, errors.Wrap(err, errors.ErrorInvalidArgument, "invalid LDAP user filter")
+	}
+	for field := range c.Attributes {
+		if !isField(field) {
+			return nil, errors.Errorf(errors.ErrorInvalidArgument, "unknown LDAP attribute mapping for %v", field)
+		}
+	}
+	for _, groupRole := range c.GroupRoles {
+		if groupRole.Group == "" || groupRole.Role == "" {
+			return nil, errors.New(errors.ErrorInvalidArgument, "LDAP group role mapping requires group and role")
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: u.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.CACertificate != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(c.CACertificate)) {
+			return nil, errors.New(errors.ErrorInvalidArgument, "invalid LDAP CA certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &Directory{
+		config:    c,
+		tlsConfig: tlsConfig,
+	}, nil
+}
+
+// ManagedRoles returns the roles mapped from groups. The directory is the source of truth of the
+// assignments of these roles.
+func (d *Directory) ManagedRoles() []string {
+	var roles []string
+	for _, groupRole := range d.config.GroupRoles {
+		if !contains(roles, groupRole.Role) {
+			roles = append(roles, groupRole.Role)
+		}
+	}
+	return roles
+}
+
+// Authenticate searches the user entry by handle and verifies the password by binding as the
+// entry. It returns a PermissionDenied error if the user is not found or the password is incorrect,
+// and an Unavailable error if the directory cannot be reached.
+func (d *Directory) Authenticate(ctx context.Context, handle, password string) (*Entry, error) {
+	// An empty password makes an unauthenticated bind which always succeeds.
+	if handle == "" || password == "" {
+		return nil, errors.New(errors.ErrorPermissionDenied, "password incorrect")
+	}
+	conn, err := d.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if d.config.BindDN != "" {
+		err = conn.Bind(d.config.BindDN, d.config.BindPassword)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrorUnavailable, "LDAP service account bind failed")
+		}
+	}
+	ldapEntry, err := d.search(ctx, conn, handle)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := d.entry(ldapEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.Bind(ldapEntry.DN, password)
+	if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"ldap_dn": ldapEntry.DN,
+		}).Warn("LDAP bind rejected")
+		return nil, errors.New(errors.ErrorPermissionDenied, "password incorrect")
+	} else if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnavailable, "LDAP bind failed")
+	}
+	return entry, nil
+}
+
+func (d *Directory) dial() (*goldap.Conn, error) {
+	conn, err := goldap.DialURL(
+		d.config.URL,
+		goldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+		goldap.DialWithTLSConfig(d.tlsConfig),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnavailable, "error connecting to LDAP directory")
+	}
+	conn.SetTimeout(timeout)
+	if d.config.StartTLS {
+		err = conn.StartTLS(d.tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, errors.ErrorUnavailable, "LDAP StartTLS failed")
+		}
+	}
+	return conn, nil
+}
+
+// search returns the only entry matching the handle.
+func (d *Directory) search(ctx context.Context, conn *goldap.Conn, handle string) (*goldap.Entry, error) {
+	attributes := []string{d.config.IDAttribute}
+	for _, attribute := range d.config.Attributes {
+		attributes = append(attributes, attribute)
+	}
+	if d.config.GroupAttribute != "" {
+		attributes = append(attributes, d.config.GroupAttribute)
+	}
+	req := goldap.NewSearchRequest(
+		d.config.BaseDN,
+		goldap.ScopeWholeSubtree,
+		goldap.NeverDerefAliases,
+		2,
+		int(timeout/time.Second),
+		false,
+		strings.ReplaceAll(d.config.UserFilter, handlePlaceholder, goldap.EscapeFilter(handle)),
+		attributes,
+		nil,
+	)
+	result, err := conn.Search(req)
+	if goldap.IsErrorWithCode(err, goldap.LDAPResultSizeLimitExceeded) {
+		log.GetLogger(ctx).Warn("LDAP user search matches more than one entry")
+		return nil, errors.New(errors.ErrorPermissionDenied, "password incorrect")
+	} else if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnavailable, "LDAP search failed")
+	}
+	if len(result.Entries) != 1 {
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"entries": len(result.Entries),
+		}).Warn("LDAP user search does not match exactly one entry")
+		return nil, errors.New(errors.ErrorPermissionDenied, "password incorrect")
+	}
+	return result.Entries[0], nil
+}
+
+// entry maps an LDAP entry to an Entry.
+func (d *Directory) entry(ldapEntry *goldap.Entry) (*Entry, error) {
+	id := attributeString(ldapEntry.GetRawAttributeValue(d.config.IDAttribute))
+	if id == "" {
+		return nil, errors.Errorf(errors.ErrorFailedPrecondition, "LDAP entry has no %v attribute", d.config.IDAttribute)
+	}
+	entry := &Entry{
+		DN:       ldapEntry.DN,
+		ID:       id,
+		Name:     d.attribute(ldapEntry, "name"),
+		Email:    d.attribute(ldapEntry, "email"),
+		Phone:    d.attribute(ldapEntry, "phone"),
+		Username: d.attribute(ldapEntry, "username"),
+	}
+	if d.config.GroupAttribute != "" {
+		entry.Groups = ldapEntry.GetAttributeValues(d.config.GroupAttribute)
+	}
+	for _, groupRole := range d.config.GroupRoles {
+		if containsDN(entry.Groups, groupRole.Group) && !contains(entry.Roles, groupRole.Role) {
+			entry.Roles = append(entry.Roles, groupRole.Role)
+		}
+	}
+	return entry, nil
+}
+
+func (d *Directory) attribute(ldapEntry *goldap.Entry, field string) string {
+	attribute, ok := d.config.Attributes[field]
+	if !ok {
+		return ""
+	}
+	return ldapEntry.GetAttributeValue(attribute)
+}
+
+// attributeString returns a printable attribute value as is, and hex encodes a binary value such as
+// the objectGUID of Active Directory.
+func attributeString(value []byte) string {
+	s := string(value)
+	if utf8.Valid(value) && strings.IndexFunc(s, func(r rune) bool { return !unicode.IsPrint(r) }) < 0 {
+		return s
+	}
+	return hex.EncodeToString(value)
+}
+
+func isField(field string) bool {
+	return contains(fields, field)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsDN returns true if the list contains the DN. DNs are compared case-insensitively and
+// ignoring spaces around the separators.
+func containsDN(dns []string, dn string) bool {
+	for _, v := range dns {
+		if normalizeDN(v) == normalizeDN(dn) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeDN(dn string) string {
+	parsed, err := goldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+	rdns := make([]string, 0, len(parsed.RDNs))
+	for _, rdn := range parsed.RDNs {
+		attributes := make([]string, 0, len(rdn.Attributes))
+		for _, attribute := range rdn.Attributes {
+			attributes = append(attributes, strings.ToLower(attribute.Type)+"="+strings.ToLower(attribute.Value))
+		}
+		rdns = append(rdns, strings.Join(attributes, "+"))
+	}
+	return strings.Join(rdns, ",")
+}
@@ -0,0 +1,207 @@
+package ldap
+
+import (
+	"context"
+	"testing"
+
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/testutil"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func directoryForTest(t *testing.T) (*Directory, *testutil.LDAPServer) {
+	server, err := testutil.NewLDAPServer(
+		&testutil.LDAPEntry{
+			DN:       "cn=svc-authcore,ou=services,dc=example,dc=com",
+			Password: "service-password",
+		},
+		&testutil.LDAPEntry{
+			DN:       "cn=Alice,ou=people,dc=example,dc=com",
+			Password: "alice-password",
+			Attributes: map[string][]string{
+				"objectClass":     {"top", "person"},
+				"entryUUID":       {"0f4b7f2c-6a0e-4b8e-9d3a-1c2b3d4e5f60"},
+				"uid":             {"alice"},
+				"cn":              {"Alice"},
+				"mail":            {"alice@example.com"},
+				"telephoneNumber": {"+85221234567"},
+				"memberOf": {
+					"CN=Admins,OU=Groups,DC=example,DC=com",
+					"cn=staff,ou=groups,dc=example,dc=com",
+				},
+			},
+		},
+		&testutil.LDAPEntry{
+			DN:       "cn=Bob,ou=people,dc=example,dc=com",
+			Password: "bob-password",
+			Attributes: map[string][]string{
+				"objectClass": {"top", "person"},
+				"uid":         {"bob"},
+				"mail":        {"shared@example.com"},
+			},
+		},
+		&testutil.LDAPEntry{
+			DN:       "cn=Carol,ou=people,dc=example,dc=com",
+			Password: "carol-password",
+			Attributes: map[string][]string{
+				"objectClass": {"top", "person"},
+				"entryUUID":   {"c4d1"},
+				"uid":         {"carol"},
+				"mail":        {"shared@example.com"},
+			},
+		},
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	d, err := NewDirectory(Config{
+		URL:           server.URL(),
+		CACertificate: server.CACertificate(),
+		BindDN:        "cn=svc-authcore,ou=services,dc=example,dc=com",
+		BindPassword:  "service-password",
+		BaseDN:        "ou=people,dc=example,dc=com",
+		UserFilter:    "(&(objectClass=person)(|(uid={handle})(mail={handle})))",
+		IDAttribute:   "entryUUID",
+		Attributes: map[string]string{
+			"name":  "cn",
+			"email": "mail",
+			"phone": "telephoneNumber",
+		},
+		GroupAttribute: "memberOf",
+		GroupRoles: []GroupRole{
+			{Group: "cn=admins,ou=groups,dc=example,dc=com", Role: "authcore.admin"},
+			{Group: "cn=staff, ou=groups, dc=example, dc=com", Role: "staff"},
+			{Group: "cn=finance,ou=groups,dc=example,dc=com", Role: "finance"},
+		},
+	})
+	if !assert.NoError(t, err) {
+		server.Close()
+		t.FailNow()
+	}
+	return d, server
+}
+
+func TestAuthenticate(t *testing.T) {
+	d, server := directoryForTest(t)
+	defer server.Close()
+	ctx := context.Background()
+
+	entry, err := d.Authenticate(ctx, "alice", "alice-password")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "cn=Alice,ou=people,dc=example,dc=com", entry.DN)
+		assert.Equal(t, "0f4b7f2c-6a0e-4b8e-9d3a-1c2b3d4e5f60", entry.ID)
+		assert.Equal(t, "Alice", entry.Name)
+		assert.Equal(t, "alice@example.com", entry.Email)
+		assert.Equal(t, "+85221234567", entry.Phone)
+		assert.Empty(t, entry.Username)
+		assert.Len(t, entry.Groups, 2)
+		assert.Equal(t, []string{"authcore.admin", "staff"}, entry.Roles)
+	}
+	assert.Equal(t, []string{"authcore.admin", "staff", "finance"}, d.ManagedRoles())
+
+	// Search by email
+	entry, err = d.Authenticate(ctx, "alice@example.com", "alice-password")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "0f4b7f2c-6a0e-4b8e-9d3a-1c2b3d4e5f60", entry.ID)
+	}
+
+	// Incorrect password
+	_, err = d.Authenticate(ctx, "alice", "bob-password")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	// Empty password is an unauthenticated bind
+	_, err = d.Authenticate(ctx, "alice", "")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	// Unknown user
+	_, err = d.Authenticate(ctx, "mallory", "alice-password")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	// Filter injection
+	_, err = d.Authenticate(ctx, "*", "alice-password")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	// More than one entry
+	_, err = d.Authenticate(ctx, "shared@example.com", "carol-password")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	// Entry without ID
+	_, err = d.Authenticate(ctx, "bob", "bob-password")
+	assert.True(t, errors.IsKind(err, errors.ErrorFailedPrecondition))
+
+	// Service account bind failure
+	d.config.BindPassword = "incorrect"
+	_, err = d.Authenticate(ctx, "alice", "alice-password")
+	assert.True(t, errors.IsKind(err, errors.ErrorUnavailable))
+
+	// Untrusted server certificate
+	d, err = NewDirectory(Config{
+		URL:         server.URL(),
+		BaseDN:      "ou=people,dc=example,dc=com",
+		UserFilter:  "(uid={handle})",
+		IDAttribute: "entryUUID",
+	})
+	if assert.NoError(t, err) {
+		_, err = d.Authenticate(ctx, "alice", "alice-password")
+		assert.True(t, errors.IsKind(err, errors.ErrorUnavailable))
+	}
+}
+
+func TestNewDirectory(t *testing.T) {
+	valid := Config{
+		URL:         "ldaps://ldap.example.com",
+		BaseDN:      "dc=example,dc=com",
+		UserFilter:  "(uid={handle})",
+		IDAttribute: "entryUUID",
+	}
+	tests := []struct {
+		name   string
+		mutate func(c *Config)
+		ok     bool
+	}{
+		{"valid", func(c *Config) {}, true},
+		{"StartTLS", func(c *Config) { c.URL = "ldap://ldap.example.com"; c.StartTLS = true }, true},
+		{"plaintext", func(c *Config) { c.URL = "ldap://ldap.example.com" }, false},
+		{"unknown scheme", func(c *Config) { c.URL = "https://ldap.example.com" }, false},
+		{"missing base DN", func(c *Config) { c.BaseDN = "" }, false},
+		{"missing placeholder", func(c *Config) { c.UserFilter = "(uid=alice)" }, false},
+		{"invalid filter", func(c *Config) { c.UserFilter = "(uid={handle}" }, false},
+		{"unknown field", func(c *Config) { c.Attributes = map[string]string{"password": "userPassword"} }, false},
+		{"invalid group role", func(c *Config) { c.GroupRoles = []GroupRole{{Group: "cn=admins"}} }, false},
+		{"invalid CA certificate", func(c *Config) { c.CACertificate = "invalid" }, false},
+	}
+	for _, test := range tests {
+		c := valid
+		test.mutate(&c)
+		_, err := NewDirectory(c)
+		assert.Equal(t, test.ok, err == nil, test.name)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	defer viper.Reset()
+
+	c, err := LoadConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+
+	viper.Set("ldap_url", "ldaps://ldap.example.com")
+	viper.Set("ldap_attributes", map[string]interface{}{"email": "mail"})
+	viper.Set("ldap_group_roles", []interface{}{
+		map[string]interface{}{"group": "CN=Admins,DC=example,DC=com", "role": "authcore.admin"},
+	})
+	c, err = LoadConfig()
+	if assert.NoError(t, err) && assert.NotNil(t, c) {
+		assert.Equal(t, "ldaps://ldap.example.com", c.URL)
+		assert.Equal(t, map[string]string{"email": "mail"}, c.Attributes)
+		assert.Equal(t, []GroupRole{{Group: "CN=Admins,DC=example,DC=com", Role: "authcore.admin"}}, c.GroupRoles)
+	}
+}
+
+func TestAttributeString(t *testing.T) {
+	assert.Equal(t, "0f4b7f2c", attributeString([]byte("0f4b7f2c")))
+	assert.Equal(t, "00ff10", attributeString([]byte{0x00, 0xff, 0x10}))
+	assert.Equal(t, "", attributeString(nil))
+}
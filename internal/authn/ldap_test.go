@@ -0,0 +1,212 @@
+package authn
+
+import (
+	"context"
+	"testing"
+
+	"authcore.io/authcore/internal/authn/ldap"
+	"authcore.io/authcore/internal/authn/verifier"
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/testutil"
+	"authcore.io/authcore/internal/user"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyLDAPPassword(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	dave := &testutil.LDAPEntry{
+		DN:       "cn=Dave,ou=people,dc=example,dc=com",
+		Password: "dave-password",
+		Attributes: map[string][]string{
+			"objectClass": {"person"},
+			"entryUUID":   {"dave-uuid"},
+			"uid":         {"dave"},
+			"displayName": {"Dave"},
+			"mail":        {"dave@example.com"},
+			"memberOf":    {"cn=admins,ou=groups,dc=example,dc=com"},
+		},
+	}
+	server, err := testutil.NewLDAPServer(dave, &testutil.LDAPEntry{
+		DN:       "cn=Carol,ou=people,dc=example,dc=com",
+		Password: "carol-password",
+		Attributes: map[string][]string{
+			"objectClass": {"person"},
+			"entryUUID":   {"carol-uuid"},
+			"uid":         {"carol.ad"},
+			"displayName": {"Carol AD"},
+			"mail":        {"carol@example.com"},
+		},
+	}, &testutil.LDAPEntry{
+		DN:       "cn=Factor,ou=people,dc=example,dc=com",
+		Password: "factor-password",
+		Attributes: map[string][]string{
+			"objectClass": {"person"},
+			"entryUUID":   {"factor-uuid"},
+			"uid":         {"factor.ad"},
+			"mail":        {"factor@example.com"},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	directory, err := ldap.NewDirectory(ldap.Config{
+		URL:           server.URL(),
+		CACertificate: server.CACertificate(),
+		BaseDN:        "ou=people,dc=example,dc=com",
+		UserFilter:    "(&(objectClass=person)(|(uid={handle})(mail={handle})))",
+		IDAttribute:   "entryUUID",
+		Attributes: map[string]string{
+			"name":  "displayName",
+			"email": "mail",
+		},
+		GroupAttribute: "memberOf",
+		GroupRoles: []ldap.GroupRole{
+			{Group: "cn=admins,ou=groups,dc=example,dc=com", Role: "authcore.admin"},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	tc.RegisterLDAPDirectory(directory)
+
+	// LDAP is not enabled for the client
+	_, err = tc.StartPrimary(ctx, "app", "dave", "https://example.com/", "", "", "")
+	assert.True(t, errors.IsKind(err, errors.ErrorNotFound))
+
+	// First sign in provisions the user
+	state, err := tc.StartPrimary(ctx, "staff", "dave", "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, StatusLDAP, state.Status)
+	assert.Equal(t, []string{FactorLDAPPassword}, state.Factors)
+	assert.Zero(t, state.UserID)
+	_, err = tc.VerifyPassword(ctx, state.StateToken, []byte("verifier"))
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	_, err = tc.VerifyLDAPPassword(ctx, state.StateToken, []byte("wrong password"))
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	state, err = tc.VerifyLDAPPassword(ctx, state.StateToken, []byte("dave-password"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, StatusSuccess, state.Status)
+	assert.True(t, state.PasswordVerified)
+
+	u, err := tc.userStore.UserByID(ctx, state.UserID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "Dave", u.Name.String)
+	assert.Equal(t, "dave@example.com", u.Email.String)
+	assert.True(t, u.EmailVerified())
+	assert.False(t, u.IsPasswordAuthenticationEnabled())
+	oauthFactor, err := tc.userStore.FindOAuthFactorByOAuthIdentity(ctx, user.OAuthLDAP, "dave-uuid")
+	if assert.NoError(t, err) {
+		assert.Equal(t, u.ID, oauthFactor.UserID)
+	}
+	roles, err := tc.userStore.FindAllRolesByUserID(ctx, u.ID)
+	if assert.NoError(t, err) && assert.Len(t, *roles, 1) {
+		assert.Equal(t, "authcore.admin", (*roles)[0].Name)
+	}
+
+	// Attributes and roles are updated on subsequent sign in
+	dave.Attributes["displayName"] = []string{"David"}
+	delete(dave.Attributes, "memberOf")
+	state, err = tc.StartPrimary(ctx, "staff", "dave@example.com", "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, StatusLDAP, state.Status)
+	assert.Equal(t, u.ID, state.UserID)
+	state, err = tc.VerifyLDAPPassword(ctx, state.StateToken, []byte("dave-password"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusSuccess, state.Status)
+		assert.Equal(t, u.ID, state.UserID)
+	}
+	u, err = tc.userStore.UserByID(ctx, u.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "David", u.Name.String)
+	}
+	roles, err = tc.userStore.FindAllRolesByUserID(ctx, u.ID)
+	if assert.NoError(t, err) {
+		assert.Empty(t, *roles)
+	}
+
+	// The user of the same email must prove the ownership before linking the entry
+	carol, err := tc.userStore.UserByEmail(ctx, "carol@example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	state, err = tc.StartPrimary(ctx, "staff", "carol.ad", "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, StatusLDAP, state.Status)
+	state, err = tc.VerifyLDAPPassword(ctx, state.StateToken, []byte("carol-password"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, StatusIDPAlreadyExists, state.Status)
+	assert.Equal(t, carol.ID, state.UserID)
+	assert.Equal(t, string(user.OAuthLDAP), state.IDP)
+	_, err = tc.userStore.FindOAuthFactorByOAuthIdentity(ctx, user.OAuthLDAP, "carol-uuid")
+	assert.True(t, errors.IsKind(err, errors.ErrorNotFound))
+
+	spake2, err := verifier.NewSPAKE2Plus()
+	assert.NoError(t, err)
+	cs, message, err := spake2.StartClient([]byte("authcoreuser"), []byte("authcore"), []byte("password"), state.PasswordSalt, nil)
+	assert.NoError(t, err)
+	challenge, err := tc.RequestIDPLink(ctx, state.StateToken, "spake2plus", message)
+	assert.NoError(t, err)
+	sk, err := cs.Finish(challenge)
+	assert.NoError(t, err)
+	state, err = tc.VerifyIDPLink(ctx, state.StateToken, "spake2plus", sk.GetConfirmation())
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusSuccess, state.Status)
+		assert.Equal(t, carol.ID, state.UserID)
+	}
+	oauthFactor, err = tc.userStore.FindOAuthFactorByOAuthIdentity(ctx, user.OAuthLDAP, "carol-uuid")
+	if assert.NoError(t, err) {
+		assert.Equal(t, carol.ID, oauthFactor.UserID)
+	}
+
+	// The email of another user is not taken over
+	dave.Attributes["mail"] = []string{"carol@example.com"}
+	state, err = tc.StartPrimary(ctx, "staff", "dave", "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	state, err = tc.VerifyLDAPPassword(ctx, state.StateToken, []byte("dave-password"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, u.ID, state.UserID)
+	}
+	u, err = tc.userStore.UserByID(ctx, u.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "dave@example.com", u.Email.String)
+	}
+
+	// The entry is linked with the user of the same email if ldap_link_users_by_email is set
+	viper.Set("ldap_link_users_by_email", true)
+	state, err = tc.StartPrimary(ctx, "staff", "factor.ad", "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	state, err = tc.VerifyLDAPPassword(ctx, state.StateToken, []byte("factor-password"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(3), state.UserID)
+		assert.Equal(t, StatusMFARequired, state.Status)
+	}
+
+	// Users with a local password authenticate with the password
+	state, err = tc.StartPrimary(ctx, "staff", "carol@example.com", "https://example.com/", "", "", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusPrimary, state.Status)
+		assert.Equal(t, []string{FactorPassword}, state.Factors)
+	}
+}
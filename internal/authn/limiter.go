@@ -0,0 +1,203 @@
+package authn
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/session"
+	"authcore.io/authcore/pkg/kvstore"
+	"authcore.io/authcore/pkg/ratelimiter"
+
+	"github.com/spf13/viper"
+)
+
+// Names of the authentication rate limiters.
+const (
+	LimiterUser   = "user"
+	LimiterIP     = "ip"
+	LimiterHandle = "handle"
+	LimiterGlobal = "global"
+)
+
+const globalLimiterKey = "failures"
+
+// LimiterBucket is the state of a rate limiter for a key.
+type LimiterBucket struct {
+	Limiter    string `json:"limiter"`
+	Key        string `json:"key"`
+	Count      int64  `json:"count"`
+	Limit      int64  `json:"limit"`
+	RetryAfter int64  `json:"retry_after"`
+}
+
+// sourceLimiters contains the rate limiters that count failed authentications by their source
+// rather than by the user.
+type sourceLimiters struct {
+	ip     *ratelimiter.RateLimiter
+	handle *ratelimiter.RateLimiter
+	global *ratelimiter.RateLimiter
+}
+
+func newSourceLimiters(kv kvstore.Store) *sourceLimiters {
+	return &sourceLimiters{
+		ip: ratelimiter.NewRateLimiter(kv, "rate_limiter/authn_ip/",
+			viper.GetInt64("authentication_ip_rate_limit_count"),
+			viper.GetDuration("authentication_ip_rate_limit_interval")),
+		handle: ratelimiter.NewRateLimiter(kv, "rate_limiter/authn_handle/",
+			viper.GetInt64("authentication_handle_rate_limit_count"),
+			viper.GetDuration("authentication_handle_rate_limit_interval")),
+		global: ratelimiter.NewRateLimiter(kv, "rate_limiter/authn_global/",
+			viper.GetInt64("authentication_global_rate_limit_count"),
+			viper.GetDuration("authentication_global_rate_limit_interval")),
+	}
+}
+
+// CheckSourceRateLimiter checks whether the IP address in the context, the handle or the whole
+// service has exceeded the failed authentication rate limits. The returned error carries the
+// duration after which the client may retry.
+func (s *Store) CheckSourceRateLimiter(ctx context.Context, handle string) error {
+	var retryAfter time.Duration
+	for _, b := range s.sourceBuckets(ctx, handle) {
+		d, err := b.limiter.RetryAfter(b.key)
+		if err != nil {
+			return errors.Wrap(err, errors.ErrorUnknown, "")
+		}
+		if d > retryAfter {
+			retryAfter = d
+		}
+	}
+	if retryAfter > 0 {
+		return errors.WithRetryAfter(errors.ErrorResourceExhausted, "too many authentication attempts", retryAfter)
+	}
+	return nil
+}
+
+// IncrementSourceRateLimiter records a failed authentication from the IP address in the context
+// with the handle.
+func (s *Store) IncrementSourceRateLimiter(ctx context.Context, handle string) {
+	for _, b := range s.sourceBuckets(ctx, handle) {
+		b.limiter.Increment(b.key)
+	}
+}
+
+// CountSourceFailures returns the number of recent failed authentications from the IP address in
+// the context or with the handle, whichever is larger.
+func (s *Store) CountSourceFailures(ctx context.Context, handle string) (int64, error) {
+	ip, _ := ctx.Value(session.IPKey{}).(string)
+	var failures int64
+	for _, b := range s.buckets(0, ip, handle, false) {
+		count, err := b.limiter.Count(b.key)
+		if err != nil {
+			return 0, errors.Wrap(err, errors.ErrorUnknown, "")
+		}
+		if count > failures {
+			failures = count
+		}
+	}
+	return failures, nil
+}
+
+// UserRateLimiterRetryAfter returns the duration until a blocked user may authenticate again.
+func (s *Store) UserRateLimiterRetryAfter(ctx context.Context, userID int64) time.Duration {
+	d, _ := s.rateLimiter.RetryAfter(userLimiterKey(userID))
+	return d
+}
+
+// ListRateLimiterBuckets returns the rate limiter buckets of a user, an IP address and a handle.
+// Empty arguments are ignored.
+func (s *Store) ListRateLimiterBuckets(ctx context.Context, userID int64, ip, handle string) ([]LimiterBucket, error) {
+	buckets := []LimiterBucket{}
+	for _, b := range s.buckets(userID, ip, handle, false) {
+		count, err := b.limiter.Count(b.key)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+		}
+		retryAfter, err := b.limiter.RetryAfter(b.key)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+		}
+		buckets = append(buckets, LimiterBucket{
+			Limiter:    b.name,
+			Key:        b.key,
+			Count:      count,
+			Limit:      b.limiter.Limit(),
+			RetryAfter: int64((retryAfter + time.Second - 1) / time.Second),
+		})
+	}
+	return buckets, nil
+}
+
+// ResetRateLimiterBuckets clears the rate limiter buckets of a user, an IP address and a handle.
+// Empty arguments are ignored.
+func (s *Store) ResetRateLimiterBuckets(ctx context.Context, userID int64, ip, handle string) error {
+	for _, b := range s.buckets(userID, ip, handle, false) {
+		err := b.limiter.Reset(b.key)
+		if err != nil {
+			return errors.Wrap(err, errors.ErrorUnknown, "")
+		}
+	}
+	return nil
+}
+
+type limiterBucketRef struct {
+	name    string
+	limiter *ratelimiter.RateLimiter
+	key     string
+}
+
+func (s *Store) sourceBuckets(ctx context.Context, handle string) []limiterBucketRef {
+	ip, _ := ctx.Value(session.IPKey{}).(string)
+	return s.buckets(0, ip, handle, true)
+}
+
+func (s *Store) buckets(userID int64, ip, handle string, global bool) []limiterBucketRef {
+	var refs []limiterBucketRef
+	if userID != 0 {
+		refs = append(refs, limiterBucketRef{LimiterUser, s.rateLimiter, userLimiterKey(userID)})
+	}
+	if key := ipLimiterKey(ip); key != "" {
+		refs = append(refs, limiterBucketRef{LimiterIP, s.limiters.ip, key})
+	}
+	if key := handleLimiterKey(handle); key != "" {
+		refs = append(refs, limiterBucketRef{LimiterHandle, s.limiters.handle, key})
+	}
+	if global && s.limiters.global.Limit() > 0 {
+		refs = append(refs, limiterBucketRef{LimiterGlobal, s.limiters.global, globalLimiterKey})
+	}
+	return refs
+}
+
+func userLimiterKey(userID int64) string {
+	return fmt.Sprintf("%d/password", userID)
+}
+
+// ipLimiterKey returns the subnet of an IP address so that an attacker cannot evade the limit by
+// rotating addresses within a subnet.
+func ipLimiterKey(ip string) string {
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return ""
+	}
+	if ip4 := parsed.To4(); ip4 != nil {
+		mask := net.CIDRMask(viper.GetInt("authentication_ip_rate_limit_ipv4_prefix"), 32)
+		return (&net.IPNet{IP: ip4.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(viper.GetInt("authentication_ip_rate_limit_ipv6_prefix"), 128)
+	return (&net.IPNet{IP: parsed.Mask(mask), Mask: mask}).String()
+}
+
+// handleLimiterKey hashes a normalized handle so that handles are not stored in plain text.
+func handleLimiterKey(handle string) string {
+	handle = strings.ToLower(strings.TrimSpace(handle))
+	if handle == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(handle))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,108 @@
+package authn
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/session"
+	"authcore.io/authcore/internal/testutil"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceRateLimiter(t *testing.T) {
+	store, teardown := storeForTest()
+	defer teardown()
+	viper.Set("authentication_handle_rate_limit_count", 2)
+	store = NewStore(store.kv, store.encryptor)
+	ctx := context.WithValue(context.Background(), session.IPKey{}, "192.168.1.20")
+
+	assert.NoError(t, store.CheckSourceRateLimiter(ctx, "bob"))
+	store.IncrementSourceRateLimiter(ctx, "bob")
+	store.IncrementSourceRateLimiter(ctx, " BOB ")
+
+	err := store.CheckSourceRateLimiter(ctx, "bob")
+	if assert.Error(t, err) {
+		assert.True(t, errors.IsKind(err, errors.ErrorResourceExhausted))
+		assert.True(t, err.(*errors.Error).RetryAfter() > 0)
+	}
+	// Other handles from the same IP address are not blocked yet.
+	assert.NoError(t, store.CheckSourceRateLimiter(ctx, "carol"))
+
+	buckets, err := store.ListRateLimiterBuckets(ctx, 0, "192.168.1.21", "bob")
+	assert.NoError(t, err)
+	if assert.Len(t, buckets, 2) {
+		assert.Equal(t, LimiterIP, buckets[0].Limiter)
+		assert.Equal(t, "192.168.1.21/32", buckets[0].Key)
+		assert.Equal(t, int64(0), buckets[0].Count)
+		assert.Equal(t, LimiterHandle, buckets[1].Limiter)
+		assert.Equal(t, int64(2), buckets[1].Count)
+		assert.Equal(t, int64(2), buckets[1].Limit)
+		assert.True(t, buckets[1].RetryAfter > 0)
+	}
+
+	err = store.ResetRateLimiterBuckets(ctx, 0, "", "bob")
+	assert.NoError(t, err)
+	assert.NoError(t, store.CheckSourceRateLimiter(ctx, "bob"))
+}
+
+func TestGlobalRateLimiter(t *testing.T) {
+	store, teardown := storeForTest()
+	defer teardown()
+	viper.Set("authentication_global_rate_limit_count", 3)
+	store = NewStore(store.kv, store.encryptor)
+	ctx := context.Background()
+
+	store.IncrementSourceRateLimiter(ctx, "a")
+	store.IncrementSourceRateLimiter(ctx, "b")
+	assert.NoError(t, store.CheckSourceRateLimiter(ctx, "c"))
+	store.IncrementSourceRateLimiter(ctx, "c")
+	err := store.CheckSourceRateLimiter(ctx, "d")
+	assert.True(t, errors.IsKind(err, errors.ErrorResourceExhausted))
+}
+
+func TestIPLimiterKey(t *testing.T) {
+	viper.Set("authentication_ip_rate_limit_ipv4_prefix", 24)
+	viper.Set("authentication_ip_rate_limit_ipv6_prefix", 64)
+	defer viper.Reset()
+
+	assert.Equal(t, "192.168.1.0/24", ipLimiterKey("192.168.1.20"))
+	assert.Equal(t, "2001:db8::/64", ipLimiterKey("2001:db8::1"))
+	assert.Equal(t, "", ipLimiterKey("invalid"))
+	assert.Equal(t, "", ipLimiterKey(""))
+}
+
+func TestStartPrimaryUnknownHandleRateLimited(t *testing.T) {
+	viper.Set("authentication_handle_rate_limit_count", 2)
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := tc.StartPrimary(ctx, "app", "nobody@example.com", "https://example.com/", "", "", "")
+		assert.True(t, errors.IsKind(err, errors.ErrorNotFound))
+	}
+	_, err := tc.StartPrimary(ctx, "app", "nobody@example.com", "https://example.com/", "", "", "")
+	assert.True(t, errors.IsKind(err, errors.ErrorResourceExhausted))
+}
+
+func TestAPIRateLimits(t *testing.T) {
+	e, teardown := echoForTest()
+	defer teardown()
+
+	code, _, err := testutil.JSONRequest(e, http.MethodGet, "/api/v2/rate_limits", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, res, err := testutil.JSONRequest(e, http.MethodGet, "/api/v2/rate_limits?user_id=2&handle=carol@example.com", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, res["results"], 2)
+
+	code, _, err = testutil.JSONRequest(e, http.MethodDelete, "/api/v2/rate_limits?user_id=2", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, code)
+}
@@ -0,0 +1,196 @@
+package authn
+
+import (
+	"context"
+
+	"authcore.io/authcore/internal/authn/hook"
+	"authcore.io/authcore/internal/authn/idp"
+	"authcore.io/authcore/internal/authn/verifier"
+	"authcore.io/authcore/internal/clientapp"
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/log"
+	"authcore.io/authcore/pkg/nulls"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDPLink requests a challenge for the user to prove the ownership of the existing account
+// in an IDP_ALREADY_EXISTS transaction. The method is either the password method of the user or
+// email_otp, which sends a code to the verified email address of the user. email_otp is not
+// accepted from users with second factors.
+func (tc *TransactionController) RequestIDPLink(ctx context.Context, stateToken, method string, message []byte) (challenge verifier.Challenge, err error) {
+	_, err = tc.stateMutation(ctx, stateToken, StatusIDPAlreadyExists, func(state *State, u *user.User) error {
+		v, err := tc.idpLinkVerifier(ctx, u, method)
+		if err != nil {
+			return err
+		}
+		if method == verifier.EmailOTP {
+			state.MFAMethod = method
+			state.MFAVerifierState, challenge, err = v.Request(message)
+			return err
+		}
+		state.PasswordVerifierState, challenge, err = v.Request(message)
+		return err
+	})
+	return
+}
+
+// VerifyIDPLink verifies the response to the challenge requested by RequestIDPLink. On success, the
+// IDP identity is linked to the user and the transaction completes as an IDP authentication. If the
+// user has second factors, the state becomes MFA_REQUIRED instead and the IDP identity is linked
+// once a second factor is verified.
+func (tc *TransactionController) VerifyIDPLink(ctx context.Context, stateToken, method string, response []byte) (*State, error) {
+	return tc.stateMutation(ctx, stateToken, StatusIDPAlreadyExists, func(state *State, u *user.User) error {
+		ident := state.IDPIdentity
+		if ident == nil || len(ident.ID) == 0 {
+			return errors.New(errors.ErrorFailedPrecondition, "no IDP identity to link")
+		}
+		v, err := tc.idpLinkVerifier(ctx, u, method)
+		if err != nil {
+			return err
+		}
+
+		err = tc.store.CheckRateLimiter(ctx, u.ID)
+		if err != nil {
+			retryAfter := tc.store.UserRateLimiterRetryAfter(ctx, u.ID)
+			return errors.WithRetryAfter(errors.ErrorUserTemporarilyBlocked, "too many authentication attempts", retryAfter)
+		}
+		err = tc.store.CheckSourceRateLimiter(ctx, state.Handle)
+		if err != nil {
+			return err
+		}
+
+		verifierState := state.PasswordVerifierState
+		if method == verifier.EmailOTP {
+			if state.MFAMethod != method {
+				return errors.New(errors.ErrorFailedPrecondition, "verification is not requested")
+			}
+			verifierState = state.MFAVerifierState
+		}
+		ok, _ := v.Verify(verifierState, response)
+		if !ok {
+			log.GetLogger(ctx).WithFields(logrus.Fields{
+				"user_id": u.PublicID(),
+				"idp":     state.IDP,
+				"method":  method,
+			}).Warn("IDP link verification rejected")
+			tc.store.IncrementRateLimiter(ctx, u.ID)
+			tc.store.IncrementSourceRateLimiter(ctx, state.Handle)
+			return errors.New(errors.ErrorPermissionDenied, "verification rejected")
+		}
+
+		if method == verifier.LegacyPassword {
+			if err := tc.upgradeLegacyPassword(ctx, u, response); err != nil {
+				return err
+			}
+		}
+		if v.IsPrimary() {
+			clientApp, err := clientapp.GetByClientID(state.ClientID)
+			if err != nil {
+				return err
+			}
+			state.PasswordVerified = true
+			state.ForcePasswordChange = u.IsPasswordChangeRequired(clientApp.MaxPasswordAge)
+		}
+
+		state.PasswordVerifierState = nil
+		state.MFAMethod = ""
+		state.MFAVerifierState = nil
+
+		secondFactors, err := tc.userStore.FindAllSecondFactorsByUserID(ctx, u.ID)
+		if err != nil {
+			return err
+		}
+		if len(*secondFactors) > 0 {
+			claims, err := tc.runHooks(ctx, hook.PostPrimary, state.ClientID, u)
+			if err != nil {
+				return err
+			}
+			state.HookClaims = mergeClaims(state.HookClaims, claims)
+			decision, err := tc.assessRisk(ctx, state, u, *secondFactors)
+			if err != nil {
+				return err
+			}
+			if decision == RiskBlock {
+				return nil
+			}
+			// MFA_REQUIRED
+			mutateMFARequired(state, *secondFactors)
+			return nil
+		}
+		err = tc.linkIDPIdentity(ctx, state, u)
+		if err != nil {
+			return err
+		}
+		return tc.mutateIDPAuthenticated(ctx, state, u)
+	})
+}
+
+// linkIDPIdentity links the IDP identity of an IDP_ALREADY_EXISTS transaction to u after the user
+// has proven the ownership of u.
+func (tc *TransactionController) linkIDPIdentity(ctx context.Context, state *State, u *user.User) error {
+	ident := state.IDPIdentity
+	oauthService, err := idp.IDToOAuthService(state.IDP)
+	if err != nil {
+		return err
+	}
+	_, err = tc.userStore.CreateOAuthFactor(ctx, u.ID, oauthService, ident.ID, nulls.NewJSON(ident))
+	if err != nil {
+		return err
+	}
+	log.GetLogger(ctx).WithFields(logrus.Fields{
+		"idp":     state.IDP,
+		"idp_id":  ident.ID,
+		"user_id": u.PublicID(),
+	}).Info("IDP linked with existing user")
+
+	state.IDPIdentity = nil
+	state.IDPLinked = true
+	return nil
+}
+
+// idpLinkVerifier returns the verifier for proving the ownership of the user with the method.
+func (tc *TransactionController) idpLinkVerifier(ctx context.Context, u *user.User, method string) (verifier.Verifier, error) {
+	switch method {
+	case verifier.SPAKE2Plus, verifier.LegacyPassword:
+		if !u.IsPasswordAuthenticationEnabled() {
+			return nil, errors.New(errors.ErrorFailedPrecondition, "password is not set")
+		}
+		v, err := u.PasswordVerifier()
+		if err != nil {
+			return nil, err
+		}
+		if v.Method() != method {
+			return nil, errors.Errorf(errors.ErrorFailedPrecondition, "password must be verified with %v method", v.Method())
+		}
+		return v, nil
+	case verifier.EmailOTP:
+		if !u.EmailVerified() {
+			return nil, errors.New(errors.ErrorFailedPrecondition, "email is not verified")
+		}
+		secondFactors, err := tc.userStore.FindAllSecondFactorsByUserID(ctx, u.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(*secondFactors) > 0 {
+			return nil, errors.New(errors.ErrorFailedPrecondition, "email OTP cannot prove the ownership of users with second factors")
+		}
+		factor := &user.SecondFactor{
+			UserID: u.ID,
+			Type:   user.SecondFactorEmailOTP,
+			Content: user.SecondFactorContent{
+				Email: u.Email,
+			},
+		}
+		v, err := factor.ToVerifier(tc.verifierFactory)
+		if err != nil {
+			return nil, err
+		}
+		if ev, ok := v.(verifier.EmailOTPVerifier); ok {
+			v = ev.WithLanguage(u.RealLanguage())
+		}
+		return v, nil
+	}
+	return nil, errors.Errorf(errors.ErrorInvalidArgument, "cannot link with %v", method)
+}
@@ -0,0 +1,256 @@
+package authn
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"authcore.io/authcore/internal/clientapp"
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/session"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/cryptoutil"
+	"authcore.io/authcore/pkg/log"
+
+	"github.com/mssola/user_agent"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// qrPayloadPrefix is the prefix of the QR code payload recognized by the mobile apps.
+	qrPayloadPrefix = "authcore-qr:"
+	// stateWaitInterval is the interval for reloading the state when waiting for a status change.
+	stateWaitInterval = time.Second
+)
+
+// QRDevice is the device that requested a QR sign-in. It is shown to the user before approving
+// the sign-in.
+type QRDevice struct {
+	IP        string          `json:"ip"`
+	UserAgent string          `json:"user_agent"`
+	Location  *DeviceLocation `json:"location,omitempty"`
+}
+
+// DeviceLocation is the approximate location of a device according to its IP address.
+type DeviceLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// StartQR starts a cross-device sign-in transaction. The QR payload of the state contains a
+// short-lived code to be scanned by a device where the user has signed in. The transaction
+// completes once the user approves the sign-in on that device.
+func (tc *TransactionController) StartQR(ctx context.Context, clientID, redirectURI, codeChallengeMethod, codeChallenge, clientState string) (*State, error) {
+	if codeChallenge != "" && codeChallengeMethod != "S256" {
+		return nil, errors.New(errors.ErrorInvalidArgument, "invalid code challenge method")
+	}
+	if err := ValidateRedirectURI(clientID, redirectURI); err != nil {
+		return nil, err
+	}
+	clientApp, err := clientapp.GetByClientID(clientID)
+	if err != nil {
+		return nil, errors.New(errors.ErrorInvalidArgument, "invalid client id")
+	}
+	if !clientApp.QRSignInEnabled {
+		return nil, errors.New(errors.ErrorPermissionDenied, "QR sign-in is not enabled")
+	}
+
+	ip, _ := ctx.Value(session.IPKey{}).(string)
+	device := &QRDevice{
+		IP:        ip,
+		UserAgent: deviceUserAgent(ctx),
+	}
+	if loc, ok := tc.riskEngine.Locate(ip); ok {
+		device.Location = &DeviceLocation{Latitude: loc.Latitude, Longitude: loc.Longitude}
+	}
+	expiry := viper.GetDuration("qr_code_expiry")
+	expiresAt := time.Now().Add(expiry)
+	code := cryptoutil.RandomToken32()
+
+	userAgent := ""
+	if ua, ok := ctx.Value(session.UserAgentKey{}).(*user_agent.UserAgent); ok {
+		userAgent = ua.UA()
+	}
+
+	state := &State{
+		StateToken:          cryptoutil.RandomToken32(),
+		Status:              StatusQRPending,
+		ClientID:            clientApp.ID,
+		Factors:             []string{},
+		QRCode:              code,
+		QRExpiresAt:         &expiresAt,
+		QRDevice:            device,
+		QRDeviceID:          DeviceIDFromContext(ctx),
+		QRUserAgent:         userAgent,
+		QRPayload:           qrPayloadPrefix + code,
+		RedirectURI:         redirectURI,
+		PKCEChallengeMethod: codeChallengeMethod,
+		PKCEChallenge:       codeChallenge,
+		ClientState:         clientState,
+	}
+	err = tc.store.PutState(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	err = tc.store.PutQRCode(ctx, code, state.StateToken, expiry)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// ScanQR binds the QR sign-in transaction of the code to the user of the session. The state is
+// returned with the details of the requesting device for the user to review before approving.
+func (tc *TransactionController) ScanQR(ctx context.Context, sess *session.Session, code string) (*State, error) {
+	if sess.ImpersonatorID.Valid {
+		return nil, errors.New(errors.ErrorPermissionDenied, "QR sign-in cannot be approved by an impersonation session")
+	}
+	stateToken, err := tc.qrStateToken(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	return tc.stateMutation(ctx, stateToken, StatusQRPending, func(state *State, _ *user.User) error {
+		state.UserID = sess.UserID
+		state.Status = StatusQRScanned
+		return nil
+	})
+}
+
+// ApproveQR approves the QR sign-in transaction of the code scanned by the user of the session.
+// The user must have completed a step-up authentication in the session within step_up_max_age.
+// The sign-in is completed on behalf of the requesting device, so the risk engine assesses and
+// remembers that device instead of the approving one.
+func (tc *TransactionController) ApproveQR(ctx context.Context, sess *session.Session, code string) (*State, error) {
+	stateToken, err := tc.qrStateToken(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	return tc.stateMutation(ctx, stateToken, StatusQRScanned, func(state *State, u *user.User) error {
+		if state.UserID != sess.UserID || sess.ImpersonatorID.Valid {
+			return errors.New(errors.ErrorPermissionDenied, "illegal state")
+		}
+		err := tc.requireStepUp(ctx, sess, u)
+		if err != nil {
+			return err
+		}
+		err = tc.consumeQRCode(ctx, state)
+		if err != nil {
+			return err
+		}
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"user_id":    u.PublicID(),
+			"session_id": sess.ID,
+		}).Info("QR sign-in approved")
+		return tc.mutateIDPAuthenticated(ctx, state, u)
+	})
+}
+
+// RejectQR rejects the QR sign-in transaction of the code scanned by the user of the session.
+func (tc *TransactionController) RejectQR(ctx context.Context, sess *session.Session, code string) (*State, error) {
+	stateToken, err := tc.qrStateToken(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	return tc.stateMutation(ctx, stateToken, StatusQRScanned, func(state *State, u *user.User) error {
+		if state.UserID != sess.UserID || sess.ImpersonatorID.Valid {
+			return errors.New(errors.ErrorPermissionDenied, "illegal state")
+		}
+		err := tc.consumeQRCode(ctx, state)
+		if err != nil {
+			return err
+		}
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"user_id":    u.PublicID(),
+			"session_id": sess.ID,
+		}).Info("QR sign-in rejected")
+		state.Status = StatusQRRejected
+		return nil
+	})
+}
+
+// WaitState returns the state once its status is different from status, or when wait elapses. The
+// current status of the state is used if status is empty. wait is capped at get_state_max_wait.
+func (tc *TransactionController) WaitState(ctx context.Context, stateToken, status string, wait time.Duration) (*State, error) {
+	state, err := tc.store.GetState(ctx, stateToken)
+	if err != nil {
+		return nil, err
+	}
+	if status == "" {
+		status = state.Status
+	}
+	if maxWait := viper.GetDuration("get_state_max_wait"); wait > maxWait {
+		wait = maxWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	ticker := time.NewTicker(stateWaitInterval)
+	defer ticker.Stop()
+	for state.Status == status {
+		select {
+		case <-ctx.Done():
+			return state, nil
+		case <-timer.C:
+			return state, nil
+		case <-ticker.C:
+		}
+		state, err = tc.store.GetState(ctx, stateToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// qrDeviceContext returns a copy of the context with the IP address, the user agent and the device
+// ID of the device that requested the QR sign-in of the state.
+func qrDeviceContext(ctx context.Context, state *State) context.Context {
+	ctx = context.WithValue(ctx, session.IPKey{}, state.QRDevice.IP)
+	ctx = context.WithValue(ctx, session.UserAgentKey{}, user_agent.New(state.QRUserAgent))
+	ctx = WithTrustedDeviceToken(ctx, "")
+	return WithDeviceID(ctx, state.QRDeviceID)
+}
+
+// qrStateToken returns the state token of the QR sign-in transaction of the code. The payload of
+// the QR code is also accepted.
+func (tc *TransactionController) qrStateToken(ctx context.Context, code string) (string, error) {
+	stateToken, err := tc.store.GetQRCode(ctx, strings.TrimPrefix(code, qrPayloadPrefix))
+	if errors.IsKind(err, errors.ErrorNotFound) {
+		return "", errors.New(errors.ErrorPermissionDenied, "invalid or expired QR code")
+	}
+	return stateToken, err
+}
+
+// consumeQRCode deletes the QR code of the state so that the sign-in can only be approved or
+// rejected once.
+func (tc *TransactionController) consumeQRCode(ctx context.Context, state *State) error {
+	err := tc.store.DeleteQRCode(ctx, state.QRCode)
+	if errors.IsKind(err, errors.ErrorNotFound) {
+		return errors.New(errors.ErrorPermissionDenied, "invalid or expired QR code")
+	}
+	return err
+}
+
+// requireStepUp returns an error if the user has not completed a step-up authentication in the
+// session within step_up_max_age. The assurance level is lowered to the highest level the user is
+// able to achieve with the enrolled factors. Users without any factor cannot step up and are not
+// allowed to approve.
+func (tc *TransactionController) requireStepUp(ctx context.Context, sess *session.Session, u *user.User) error {
+	secondFactors, err := tc.userStore.FindAllSecondFactorsByUserID(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	var level user.AssuranceLevel
+	switch {
+	case len(*secondFactors) > 0:
+		level = user.AssuranceLevel2
+	case u.IsPasswordAuthenticationEnabled():
+		level = user.AssuranceLevel1
+	default:
+		return errors.New(errors.ErrorPermissionDenied, "step-up authentication is not available")
+	}
+	if !sess.IsVerifiedWithin(level, viper.GetDuration("step_up_max_age")) {
+		return errors.New(errors.ErrorPermissionDenied, "step-up authentication is required")
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package authn
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/session"
+	"authcore.io/authcore/pkg/nulls"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQRSignIn(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.WithValue(context.Background(), session.IPKey{}, "203.0.113.1")
+
+	sess := &session.Session{ID: 1, UserID: 3}
+	otherSess := &session.Session{ID: 2, UserID: 2}
+
+	// QR sign-in is not enabled for the client
+	_, err := tc.StartQR(ctx, "app", "https://example.com/", "", "", "")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	state, err := tc.StartQR(ctx, "qr", "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, StatusQRPending, state.Status)
+	assert.Equal(t, qrPayloadPrefix+state.QRCode, state.QRPayload)
+	assert.Equal(t, "203.0.113.1", state.QRDevice.IP)
+
+	_, err = tc.ScanQR(ctx, sess, "invalid")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	scanned, err := tc.ScanQR(ctx, sess, state.QRPayload)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, StatusQRScanned, scanned.Status)
+	assert.Equal(t, int64(1), scanned.UserID)
+
+	// The code can only be scanned once, and only approved by the user scanning it
+	_, err = tc.ScanQR(ctx, otherSess, state.QRCode)
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	otherSess.LastPasswordVerifiedAt = nulls.NewTime(time.Now())
+	otherSess.LastMFAVerifiedAt = nulls.NewTime(time.Now())
+	_, err = tc.ApproveQR(ctx, otherSess, state.QRCode)
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	// Approval requires a fresh step-up
+	_, err = tc.ApproveQR(ctx, sess, state.QRCode)
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	sess.LastPasswordVerifiedAt = nulls.NewTime(time.Now())
+	sess.LastMFAVerifiedAt = nulls.NewTime(time.Now())
+	approved, err := tc.ApproveQR(ctx, sess, state.QRCode)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, StatusSuccess, approved.Status)
+
+	// The requesting device receives the authorization code
+	state, err = tc.WaitState(ctx, state.StateToken, StatusQRPending, time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusSuccess, state.Status)
+		assert.NotEmpty(t, state.AuthorizationCode)
+	}
+	_, err = tc.ApproveQR(ctx, sess, state.QRCode)
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	// A scanned sign-in can be rejected
+	state, err = tc.StartQR(ctx, "qr", "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = tc.ScanQR(ctx, sess, state.QRCode)
+	assert.NoError(t, err)
+	_, err = tc.RejectQR(ctx, &session.Session{ID: 3, UserID: 3, ImpersonatorID: nulls.NewInt64(2)}, state.QRCode)
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	rejected, err := tc.RejectQR(ctx, sess, state.QRCode)
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusQRRejected, rejected.Status)
+	}
+}
+
+func TestQRSignInWithoutFactor(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	// bob has neither a password nor a second factor to step up with
+	sess := &session.Session{ID: 1, UserID: 1}
+	sess.LastPasswordVerifiedAt = nulls.NewTime(time.Now())
+	sess.LastMFAVerifiedAt = nulls.NewTime(time.Now())
+
+	state, err := tc.StartQR(ctx, "qr", "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = tc.ScanQR(ctx, sess, state.QRCode)
+	assert.NoError(t, err)
+	_, err = tc.ApproveQR(ctx, sess, state.QRCode)
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+}
+
+func TestQRSignInRisk(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	viper.Set("risk_engine_enabled", true)
+	viper.Set("risk_rules", map[string]string{RiskSignalNewSubnet: RiskBlock})
+
+	// The phone is in the subnet of carol's recent session
+	phoneCtx := WithDeviceID(context.WithValue(context.Background(), session.IPKey{}, "1.1.1.2"), "phone")
+	sess := &session.Session{ID: 1, UserID: 2}
+	sess.LastPasswordVerifiedAt = nulls.NewTime(time.Now())
+
+	// The risk of the desktop in another subnet is assessed
+	desktopCtx := WithDeviceID(context.WithValue(context.Background(), session.IPKey{}, "203.0.113.1"), "desktop")
+	state, err := tc.StartQR(desktopCtx, "qr", "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = tc.ScanQR(phoneCtx, sess, state.QRCode)
+	assert.NoError(t, err)
+	state, err = tc.ApproveQR(phoneCtx, sess, state.QRCode)
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusBlocked, state.Status)
+		assert.Equal(t, []string{RiskSignalNewSubnet}, state.Risk.Reasons)
+	}
+
+	// The desktop is remembered instead of the phone
+	desktopCtx = WithDeviceID(context.WithValue(context.Background(), session.IPKey{}, "1.1.1.100"), "desktop")
+	state, err = tc.StartQR(desktopCtx, "qr", "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = tc.ScanQR(phoneCtx, sess, state.QRCode)
+	assert.NoError(t, err)
+	state, err = tc.ApproveQR(phoneCtx, sess, state.QRCode)
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusSuccess, state.Status)
+	}
+	known, err := tc.store.IsKnownDevice(phoneCtx, 2, "desktop")
+	if assert.NoError(t, err) {
+		assert.True(t, known)
+	}
+	known, err = tc.store.IsKnownDevice(phoneCtx, 2, "phone")
+	if assert.NoError(t, err) {
+		assert.False(t, known)
+	}
+}
@@ -0,0 +1,228 @@
+package authn
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"authcore.io/authcore/internal/session"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/geoip"
+	"authcore.io/authcore/pkg/log"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// RiskAllow allows the user to sign in without further authentication.
+	RiskAllow string = "allow"
+	// RiskChallenge requires the client to solve a challenge before the user authenticates.
+	RiskChallenge string = "challenge"
+	// RiskRequireMFA requires the user to complete a secondary authentication.
+	RiskRequireMFA string = "require_mfa"
+	// RiskBlock blocks the authentication.
+	RiskBlock string = "block"
+
+	// RiskSignalNewDevice is raised when the user has not authenticated with the device before.
+	RiskSignalNewDevice string = "new_device"
+	// RiskSignalNewSubnet is raised when the IP address is not in the same subnet as the recent sessions.
+	RiskSignalNewSubnet string = "new_subnet"
+	// RiskSignalImpossibleTravel is raised when the user could not have travelled from the location
+	// of the last session in time.
+	RiskSignalImpossibleTravel string = "impossible_travel"
+	// RiskSignalFailedAttempts is raised when there are too many recent failed attempts.
+	RiskSignalFailedAttempts string = "failed_attempts"
+	// RiskSignalMFAExpired is raised when the user has not completed MFA for a long time.
+	RiskSignalMFAExpired string = "mfa_expired"
+)
+
+// riskSeverity orders the decisions from the least to the most severe.
+var riskSeverity = map[string]int{
+	RiskAllow:      0,
+	RiskChallenge:  1,
+	RiskRequireMFA: 2,
+	RiskBlock:      3,
+}
+
+// RiskAssessment is the result of a risk assessment.
+type RiskAssessment struct {
+	Decision string   `json:"decision"`
+	Reasons  []string `json:"reasons"`
+}
+
+// RiskEngine assesses the risk of an authentication transaction with the configured rules.
+type RiskEngine struct {
+	store        *Store
+	sessionStore *session.Store
+	geoIP        *geoip.DB
+}
+
+// NewRiskEngine returns a new RiskEngine. The GeoIP database is loaded from geoip_database_path if
+// it is set.
+func NewRiskEngine(store *Store, sessionStore *session.Store) *RiskEngine {
+	e := &RiskEngine{
+		store:        store,
+		sessionStore: sessionStore,
+	}
+	if path := viper.GetString("geoip_database_path"); path != "" {
+		db, err := geoip.Open(path)
+		if err != nil {
+			logrus.Fatalf("cannot load GeoIP database: %v", err)
+		}
+		e.geoIP = db
+	}
+	return e
+}
+
+// Enabled returns whether the risk engine is enabled.
+func (e *RiskEngine) Enabled() bool {
+	return viper.GetBool("risk_engine_enabled")
+}
+
+// Assess evaluates the risk signals of an authentication by the user. The IP address and the device
+// ID are taken from the context.
+func (e *RiskEngine) Assess(ctx context.Context, u *user.User, secondFactors []user.SecondFactor) (*RiskAssessment, error) {
+	var signals []string
+
+	deviceID := DeviceIDFromContext(ctx)
+	known, err := e.store.IsKnownDevice(ctx, u.ID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if !known {
+		signals = append(signals, RiskSignalNewDevice)
+	}
+
+	ip, _ := ctx.Value(session.IPKey{}).(string)
+	sessions, err := e.sessionStore.FindRecentSessionsByUserID(ctx, u.ID, viper.GetInt("risk_recent_session_count"))
+	if err != nil {
+		return nil, err
+	}
+	if isNewSubnet(ip, *sessions) {
+		signals = append(signals, RiskSignalNewSubnet)
+	}
+	if e.isImpossibleTravel(ip, *sessions) {
+		signals = append(signals, RiskSignalImpossibleTravel)
+	}
+
+	failedAttempts, err := e.store.CountFailedAttempts(ctx, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	if failedAttempts >= viper.GetInt64("risk_failed_attempts_threshold") {
+		signals = append(signals, RiskSignalFailedAttempts)
+	}
+
+	if isMFAExpired(secondFactors) {
+		signals = append(signals, RiskSignalMFAExpired)
+	}
+
+	assessment := decideRisk(viper.GetStringMapString("risk_rules"), signals)
+	log.GetLogger(ctx).WithFields(logrus.Fields{
+		"user_id":  u.PublicID(),
+		"decision": assessment.Decision,
+		"reasons":  assessment.Reasons,
+	}).Info("risk assessment completed")
+	return assessment, nil
+}
+
+// RecordSuccess remembers the device of a successful authentication.
+func (e *RiskEngine) RecordSuccess(ctx context.Context, userID int64) error {
+	return e.store.PutKnownDevice(ctx, userID, DeviceIDFromContext(ctx))
+}
+
+// Locate returns the location of the IP address in the GeoIP database. It returns false if the
+// GeoIP database is not configured or the IP address is not found.
+func (e *RiskEngine) Locate(ip string) (geoip.Location, bool) {
+	if e.geoIP == nil {
+		return geoip.Location{}, false
+	}
+	return e.geoIP.Lookup(net.ParseIP(ip))
+}
+
+func (e *RiskEngine) isImpossibleTravel(ip string, sessions []session.Session) bool {
+	if e.geoIP == nil || len(sessions) == 0 {
+		return false
+	}
+	loc, ok := e.geoIP.Lookup(net.ParseIP(ip))
+	if !ok {
+		return false
+	}
+	last := sessions[0]
+	lastLoc, ok := e.geoIP.Lookup(net.ParseIP(last.LastSeenIP))
+	if !ok {
+		return false
+	}
+	distance := loc.DistanceTo(lastLoc)
+	hours := time.Since(last.LastSeenAt).Hours()
+	if hours <= 0 {
+		return distance > 0
+	}
+	return distance/hours > viper.GetFloat64("risk_impossible_travel_speed")
+}
+
+// decideRisk returns the most severe decision of the rules triggered by the signals. Signals
+// without a rule do not affect the decision.
+func decideRisk(rules map[string]string, signals []string) *RiskAssessment {
+	assessment := &RiskAssessment{
+		Decision: RiskAllow,
+		Reasons:  []string{},
+	}
+	for _, signal := range signals {
+		decision, ok := rules[signal]
+		if !ok {
+			continue
+		}
+		severity, ok := riskSeverity[decision]
+		if !ok {
+			logrus.Errorf("invalid risk decision %v for signal %v", decision, signal)
+			continue
+		}
+		if severity == 0 {
+			continue
+		}
+		assessment.Reasons = append(assessment.Reasons, signal)
+		if severity > riskSeverity[assessment.Decision] {
+			assessment.Decision = decision
+		}
+	}
+	return assessment
+}
+
+func isNewSubnet(ip string, sessions []session.Session) bool {
+	current := net.ParseIP(ip)
+	if current == nil {
+		return false
+	}
+	subnet := subnetOf(current)
+	for _, s := range sessions {
+		last := net.ParseIP(s.LastSeenIP)
+		if last != nil && subnet.Contains(last) {
+			return false
+		}
+	}
+	return true
+}
+
+func subnetOf(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(viper.GetInt("risk_subnet_ipv4_prefix"), 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(viper.GetInt("risk_subnet_ipv6_prefix"), 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+func isMFAExpired(secondFactors []user.SecondFactor) bool {
+	if len(secondFactors) == 0 {
+		return false
+	}
+	var lastUsedAt time.Time
+	for _, f := range secondFactors {
+		if f.LastUsedAt.After(lastUsedAt) {
+			lastUsedAt = f.LastUsedAt
+		}
+	}
+	return time.Since(lastUsedAt) > viper.GetDuration("risk_mfa_max_age")
+}
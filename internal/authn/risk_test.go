@@ -0,0 +1,185 @@
+package authn
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"authcore.io/authcore/internal/authn/verifier"
+	"authcore.io/authcore/internal/session"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/cryptoutil"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecideRisk(t *testing.T) {
+	rules := map[string]string{
+		RiskSignalNewDevice:        RiskRequireMFA,
+		RiskSignalNewSubnet:        RiskAllow,
+		RiskSignalImpossibleTravel: RiskBlock,
+		RiskSignalFailedAttempts:   "invalid",
+		RiskSignalMFAExpired:       RiskChallenge,
+	}
+	tests := []struct {
+		name     string
+		signals  []string
+		decision string
+		reasons  []string
+	}{
+		{"no signal", nil, RiskAllow, []string{}},
+		{"require mfa", []string{RiskSignalNewDevice}, RiskRequireMFA, []string{RiskSignalNewDevice}},
+		{"allowed signal", []string{RiskSignalNewSubnet}, RiskAllow, []string{}},
+		{"most severe", []string{RiskSignalImpossibleTravel, RiskSignalNewDevice}, RiskBlock, []string{RiskSignalImpossibleTravel, RiskSignalNewDevice}},
+		{"invalid rule", []string{RiskSignalFailedAttempts}, RiskAllow, []string{}},
+		{"challenge", []string{RiskSignalMFAExpired}, RiskChallenge, []string{RiskSignalMFAExpired}},
+		{"more severe than challenge", []string{RiskSignalMFAExpired, RiskSignalNewDevice}, RiskRequireMFA, []string{RiskSignalMFAExpired, RiskSignalNewDevice}},
+		{"no rule", []string{"unknown"}, RiskAllow, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := decideRisk(rules, tt.signals)
+			assert.Equal(t, tt.decision, a.Decision)
+			assert.Equal(t, tt.reasons, a.Reasons)
+		})
+	}
+}
+
+func TestIsNewSubnet(t *testing.T) {
+	viper.Set("risk_subnet_ipv4_prefix", 24)
+	viper.Set("risk_subnet_ipv6_prefix", 48)
+	defer viper.Reset()
+
+	sessions := []session.Session{
+		{LastSeenIP: "1.1.1.1"},
+		{LastSeenIP: "null"},
+		{LastSeenIP: "2001:db8:1::1"},
+	}
+	assert.False(t, isNewSubnet("1.1.1.200", sessions))
+	assert.True(t, isNewSubnet("1.1.2.1", sessions))
+	assert.False(t, isNewSubnet("2001:db8:1:ffff::1", sessions))
+	assert.True(t, isNewSubnet("2001:db8:2::1", sessions))
+	assert.True(t, isNewSubnet("1.1.1.1", nil))
+	// Unknown IP address is not a signal
+	assert.False(t, isNewSubnet("", sessions))
+}
+
+func TestIsMFAExpired(t *testing.T) {
+	viper.Set("risk_mfa_max_age", "24h")
+	defer viper.Reset()
+
+	assert.False(t, isMFAExpired(nil))
+	assert.False(t, isMFAExpired([]user.SecondFactor{
+		{LastUsedAt: time.Now().Add(-48 * time.Hour)},
+		{LastUsedAt: time.Now().Add(-1 * time.Hour)},
+	}))
+	assert.True(t, isMFAExpired([]user.SecondFactor{
+		{LastUsedAt: time.Now().Add(-48 * time.Hour)},
+	}))
+}
+
+func TestRiskEngineAdaptiveMFA(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	viper.Set("risk_engine_enabled", true)
+	ctx := context.WithValue(context.Background(), session.IPKey{}, "8.8.8.8")
+	ctx = WithDeviceID(ctx, "device")
+
+	// New device and subnet requires MFA
+	state := verifyPasswordForTest(ctx, t, tc, "factor@example.com")
+	assert.Equal(t, "MFA_REQUIRED", state.Status)
+	assert.Equal(t, RiskRequireMFA, state.Risk.Decision)
+	assert.Equal(t, []string{RiskSignalNewDevice, RiskSignalNewSubnet, RiskSignalMFAExpired}, state.Risk.Reasons)
+
+	code := cryptoutil.GetTOTPPin("THISISAWEAKTOTPSECRETFORTESTSXX2", time.Now())
+	state, err := tc.VerifyMFA(ctx, state.StateToken, "totp", []byte(code), false)
+	assert.NoError(t, err)
+	assert.Equal(t, "SUCCESS", state.Status)
+	_, err = tc.ExchangeSession(ctx, "app", "https://example.com/", state.AuthorizationCode, "")
+	assert.NoError(t, err)
+
+	// Known device from a known subnet is allowed to skip MFA
+	ctx = context.WithValue(ctx, session.IPKey{}, "8.8.8.9")
+	state = verifyPasswordForTest(ctx, t, tc, "factor@example.com")
+	assert.Equal(t, "SUCCESS", state.Status)
+	assert.Equal(t, RiskAllow, state.Risk.Decision)
+	assert.Empty(t, state.Risk.Reasons)
+}
+
+func TestRiskEngineBlock(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	viper.Set("risk_engine_enabled", true)
+	viper.Set("risk_rules", map[string]string{RiskSignalNewDevice: RiskBlock})
+	ctx := WithDeviceID(context.Background(), "device")
+
+	state := verifyPasswordForTest(ctx, t, tc, "carol@example.com")
+	assert.Equal(t, "BLOCKED", state.Status)
+	assert.Empty(t, state.AuthorizationCode)
+	assert.Equal(t, RiskBlock, state.Risk.Decision)
+	assert.Equal(t, []string{RiskSignalNewDevice}, state.Risk.Reasons)
+}
+
+func TestRiskEngineRequireMFAWithoutSecondFactor(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	viper.Set("risk_engine_enabled", true)
+	viper.Set("risk_rules", map[string]string{RiskSignalNewDevice: RiskRequireMFA})
+	ctx := WithDeviceID(context.Background(), "device")
+
+	// MFA cannot be required from a user without any second factor
+	state := verifyPasswordForTest(ctx, t, tc, "carol@example.com")
+	assert.Equal(t, "BLOCKED", state.Status)
+	assert.Empty(t, state.AuthorizationCode)
+	assert.Equal(t, RiskBlock, state.Risk.Decision)
+}
+
+func TestRiskEngineIDP(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	viper.Set("risk_engine_enabled", true)
+	viper.Set("risk_rules", map[string]string{RiskSignalNewDevice: RiskBlock})
+	ctx := WithDeviceID(context.Background(), "device")
+
+	// Users signing in with an IDP are assessed as well
+	key := "b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291"
+	privateKey, _ := crypto.HexToECDSA(key)
+	address := crypto.PubkeyToAddress(privateKey.PublicKey).Hex()
+	state, err := tc.StartEthereum(ctx, "web3", address, 1, "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	state, err = tc.VerifyEthereum(ctx, state.StateToken, signSIWE(t, key, state))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "BLOCKED", state.Status)
+		assert.Empty(t, state.AuthorizationCode)
+		assert.Equal(t, RiskBlock, state.Risk.Decision)
+	}
+}
+
+// verifyPasswordForTest starts a primary authentication transaction and verifies the password.
+func verifyPasswordForTest(ctx context.Context, t *testing.T, tc *TransactionController, handle string) *State {
+	return verifyClientPasswordForTest(ctx, t, tc, "app", handle)
+}
+
+func verifyClientPasswordForTest(ctx context.Context, t *testing.T, tc *TransactionController, clientID, handle string) *State {
+	state, err := tc.StartPrimary(ctx, clientID, handle, "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	spake2, err := verifier.NewSPAKE2Plus()
+	assert.NoError(t, err)
+	cs, message, err := spake2.StartClient([]byte("authcoreuser"), []byte("authcore"), []byte("password"), state.PasswordSalt, nil)
+	assert.NoError(t, err)
+	challenge, err := tc.RequestPassword(ctx, state.StateToken, message)
+	assert.NoError(t, err)
+	sk, err := cs.Finish(challenge)
+	assert.NoError(t, err)
+	state, err = tc.VerifyPassword(ctx, state.StateToken, sk.GetConfirmation())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return state
+}
@@ -3,6 +3,7 @@ package authn
 import (
 	"net/url"
 	"strings"
+	"time"
 
 	"authcore.io/authcore/internal/authn/idp"
 	"authcore.io/authcore/internal/authn/verifier"
@@ -21,6 +22,12 @@ const (
 	StatusPrimary string = "PRIMARY"
 	// StatusMFARequired represents that the user must complete a secondary authentication.
 	StatusMFARequired string = "MFA_REQUIRED"
+	// StatusMFAEnrollmentRequired represents that the user must enroll a second factor before
+	// completing the authentication.
+	StatusMFAEnrollmentRequired string = "MFA_ENROLLMENT_REQUIRED"
+	// StatusChallengeRequired represents that the client must solve a challenge before the
+	// transaction proceeds.
+	StatusChallengeRequired string = "CHALLENGE_REQUIRED"
 	// StatusSuccess represents the transaction completed successfully.
 	StatusSuccess string = "SUCCESS"
 	// StatusBlocked represents the user account is locked.
@@ -28,8 +35,12 @@ const (
 	// StatusIDP represents that the user has requested to authenticate with a third-party identity provider.
 	StatusIDP string = "IDP"
 	// StatusIDPAlreadyExists represents that the user has authenticated with an IDP but the email
-	// has already registered by a user.
+	// has already registered by a user. The IDP can be linked to the user after verifying one of
+	// the factors of the user.
 	StatusIDPAlreadyExists string = "IDP_ALREADY_EXISTS"
+	// StatusIDPRedirect represents that the user must authenticate with the IDP of the state
+	// according to the domain of the email address.
+	StatusIDPRedirect string = "IDP_REDIRECT"
 	// StatusIDPBinding represents that the user has requested to link with a third-party identity provider.
 	StatusIDPBinding string = "IDP_BINDING"
 	// StatusIDPBindingSuccess represents that the IDP binding transaction completed successfuly.
@@ -42,6 +53,26 @@ const (
 	StatusPasswordReset string = "PASSWORD_RESET"
 	// StatusPasswordResetSuccess represents that a password reset is completed successfully.
 	StatusPasswordResetSuccess string = "PASSWORD_RESET_SUCCESS"
+	// StatusPasswordChangeRequired represents that the user must set a new password before the
+	// transaction completes.
+	StatusPasswordChangeRequired string = "PASSWORD_CHANGE_REQUIRED"
+	// StatusLDAP represents that the user must authenticate with the password in the LDAP
+	// directory.
+	StatusLDAP string = "LDAP"
+	// StatusEthereum represents that the user must sign the SIWE message of the state with the
+	// Ethereum account.
+	StatusEthereum string = "ETHEREUM"
+	// StatusEthereumBinding represents that the user has requested to link an Ethereum account. The
+	// binding completes with StatusIDPBindingSuccess.
+	StatusEthereumBinding string = "ETHEREUM_BINDING"
+	// StatusQRPending represents that the QR code of the state must be scanned by a device where
+	// the user has signed in.
+	StatusQRPending string = "QR_PENDING"
+	// StatusQRScanned represents that the QR code has been scanned and the user must approve the
+	// sign-in on the device.
+	StatusQRScanned string = "QR_SCANNED"
+	// StatusQRRejected represents that the user has rejected the sign-in on the device.
+	StatusQRRejected string = "QR_REJECTED"
 
 	// FactorPassword is the password factor
 	FactorPassword string = "password"
@@ -49,38 +80,64 @@ const (
 	FactorSMS string = "sms"
 	// FactorTOTP is the TOTP factor
 	FactorTOTP string = "totp"
+	// FactorLDAPPassword is the password factor verified by the LDAP directory
+	FactorLDAPPassword string = "ldap_password"
 )
 
 var builtInURLPaths = []string{
 	"/widgets/settings",
+	"/saml/idp/callback",
 }
 
 var validate = validator.New()
 
 // State represents the state of an authentication request.
 type State struct {
-	StateToken            string         `json:"state_token" validate:"required"`
-	Status                string         `json:"status" validate:"required"`
-	ClientID              string         `json:"client_id" validate:"required"`
-	UserID                int64          `json:"user_id,string"`
-	SessionID             int64          `json:"session_id,string"`
-	PasswordVerifierState verifier.State `json:"password_verifier_state"`
-	PasswordVerified      bool           `json:"password_verified"`
-	MFAMethod             string         `json:"mfa_method"`
-	MFAVerifierState      verifier.State `json:"mfa_verifier_state"`
-	ResetLinkState        verifier.State `json:"reset_link_state"`
-	IDP                   string         `json:"idp"`
-	IDPState              idp.State      `json:"idp_state"`
-	RedirectURI           string         `json:"redirect_uri" validate:"omitempty,uri"`
-	PKCEChallenge         string         `json:"code_challenge"`
-	PKCEChallengeMethod   string         `json:"code_challenge_method" validate:"required_with=PKCEChallenge"`
-	AuthorizationCode     string         `json:"authorization_code"`
-	ClientState           string         `json:"client_state"`
+	StateToken            string          `json:"state_token" validate:"required"`
+	Status                string          `json:"status" validate:"required"`
+	ClientID              string          `json:"client_id" validate:"required"`
+	UserID                int64           `json:"user_id,string"`
+	Handle                string          `json:"handle"`
+	SessionID             int64           `json:"session_id,string"`
+	PasswordVerifierState verifier.State  `json:"password_verifier_state"`
+	PasswordVerified      bool            `json:"password_verified"`
+	ForcePasswordChange   bool            `json:"force_password_change"`
+	MFAMethod             string          `json:"mfa_method"`
+	MFAVerified           bool            `json:"mfa_verified"`
+	MFAEnrollmentSecret   string          `json:"mfa_enrollment_secret"`
+	MFAEnrollmentPhone    string          `json:"mfa_enrollment_phone"`
+	MFAVerifierState      verifier.State  `json:"mfa_verifier_state"`
+	ResetLinkState        verifier.State  `json:"reset_link_state"`
+	IDP                   string          `json:"idp"`
+	IDPState              idp.State       `json:"idp_state"`
+	IDPIdentity           *idp.Identity   `json:"idp_identity"`
+	EthereumAddress       string          `json:"ethereum_address"`
+	EthereumChainID       int64           `json:"ethereum_chain_id,string"`
+	SIWEState             verifier.State  `json:"siwe_state"`
+	QRCode                string          `json:"qr_code"`
+	QRExpiresAt           *time.Time      `json:"qr_expires_at"`
+	QRDevice              *QRDevice       `json:"qr_device"`
+	QRDeviceID            string          `json:"qr_device_id"`
+	QRUserAgent           string          `json:"qr_user_agent"`
+	RedirectURI           string          `json:"redirect_uri" validate:"omitempty,uri"`
+	PKCEChallenge         string          `json:"code_challenge"`
+	PKCEChallengeMethod   string          `json:"code_challenge_method" validate:"required_with=PKCEChallenge"`
+	AuthorizationCode     string          `json:"authorization_code"`
+	ClientState           string          `json:"client_state"`
+	Risk                  *RiskAssessment `json:"risk"`
+	Challenge             *Challenge      `json:"challenge"`
+	ChallengeNextStatus   string          `json:"challenge_next_status"`
+	SignUpChallenge       bool            `json:"sign_up_challenge"`
+	HookClaims            Claims          `json:"hook_claims"`
 
 	Factors             []string `json:"-"`
 	PasswordMethod      string   `json:"-"`
 	PasswordSalt        []byte   `json:"-"`
 	IDPAuthorizationURL string   `json:"-"`
+	SIWEMessage         string   `json:"-"`
+	QRPayload           string   `json:"-"`
+	TrustedDeviceToken  string   `json:"-"`
+	IDPLinked           bool     `json:"-"`
 }
 
 // Validate validates an State.
@@ -112,6 +169,8 @@ func (s *State) GenerateAuthorizationCode() *AuthorizationCode {
 		PKCEChallengeMethod: s.PKCEChallengeMethod,
 		PKCEChallenge:       s.PKCEChallenge,
 		PasswordVerified:    s.PasswordVerified,
+		MFAVerified:         s.MFAVerified,
+		Claims:              s.HookClaims,
 	}
 }
 
@@ -125,6 +184,8 @@ type AuthorizationCode struct {
 	PKCEChallenge       string `json:"code_challenge"`
 	PKCEChallengeMethod string `json:"code_challenge_method" validate:"required_with=PKCEChallenge"`
 	PasswordVerified    bool   `json:"password_verified"`
+	MFAVerified         bool   `json:"mfa_verified"`
+	Claims              Claims `json:"claims,omitempty"`
 }
 
 // Validate validates an AuthorizationToken.
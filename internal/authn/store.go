@@ -2,39 +2,46 @@ package authn
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/pkg/kvstore"
 	"authcore.io/authcore/pkg/messageencryptor"
 	"authcore.io/authcore/pkg/ratelimiter"
 
-	"github.com/go-redis/redis"
 	"github.com/spf13/viper"
 )
 
 const (
 	authnStateKeyPrefix        = "authn_state/"
 	authorizationCodeKeyPrefix = "authorization_code/"
+	knownDeviceKeyPrefix       = "known_device/"
+	qrCodeKeyPrefix            = "qr_code/"
 )
 
 // Store manages the State model
 type Store struct {
-	redis       *redis.Client
+	kv          kvstore.Store
 	encryptor   *messageencryptor.MessageEncryptor
 	rateLimiter *ratelimiter.RateLimiter
+	limiters    *sourceLimiters
 }
 
 // NewStore initialize a new Store.
-func NewStore(redis *redis.Client, encryptor *messageencryptor.MessageEncryptor) *Store {
+func NewStore(kv kvstore.Store, encryptor *messageencryptor.MessageEncryptor) *Store {
 	rateLimitInterval := viper.GetDuration("authentication_rate_limit_interval")
 	rateLimitCount := viper.GetInt64("authentication_rate_limit_count")
-	rateLimiter := ratelimiter.NewRateLimiter(redis, "rate_limiter/authn/", rateLimitCount, rateLimitInterval)
+	rateLimiter := ratelimiter.NewRateLimiter(kv, "rate_limiter/authn/", rateLimitCount, rateLimitInterval)
 
 	return &Store{
-		redis:       redis,
+		kv:          kv,
 		encryptor:   encryptor,
 		rateLimiter: rateLimiter,
+		limiters:    newSourceLimiters(kv),
 	}
 }
 
@@ -56,7 +63,7 @@ func (s *Store) PutState(ctx context.Context, state *State) error {
 	}
 
 	expiry := viper.GetDuration("authentication_time_limit")
-	err = s.redis.Set(key, encryptedData, expiry).Err()
+	err = s.kv.Set(key, encryptedData, expiry)
 	if err != nil {
 		return errors.Wrap(err, errors.ErrorUnknown, "")
 	}
@@ -66,8 +73,8 @@ func (s *Store) PutState(ctx context.Context, state *State) error {
 // GetState retrieves a state from the store.
 func (s *Store) GetState(ctx context.Context, stateToken string) (*State, error) {
 	key := authnStateKeyPrefix + stateToken
-	encryptedData, err := s.redis.Get(key).Result()
-	if err == redis.Nil {
+	encryptedData, err := s.kv.Get(key)
+	if err == kvstore.ErrNotFound {
 		return nil, errors.New(errors.ErrorNotFound, "")
 	} else if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
@@ -87,6 +94,19 @@ func (s *Store) GetState(ctx context.Context, stateToken string) (*State, error)
 	return state, nil
 }
 
+// DeleteState deletes a state from the store.
+func (s *Store) DeleteState(ctx context.Context, stateToken string) error {
+	key := authnStateKeyPrefix + stateToken
+	deleted, err := s.kv.Delete(key)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	if !deleted {
+		return errors.New(errors.ErrorNotFound, "")
+	}
+	return nil
+}
+
 // PutAuthorizationCode save an AuthorizationCode to the store.
 func (s *Store) PutAuthorizationCode(ctx context.Context, code *AuthorizationCode) error {
 	err := code.Validate()
@@ -105,7 +125,7 @@ func (s *Store) PutAuthorizationCode(ctx context.Context, code *AuthorizationCod
 	}
 
 	expiry := viper.GetDuration("authorization_token_expires_in")
-	err = s.redis.Set(key, encryptedData, expiry).Err()
+	err = s.kv.Set(key, encryptedData, expiry)
 	if err != nil {
 		return errors.Wrap(err, errors.ErrorUnknown, "")
 	}
@@ -115,8 +135,8 @@ func (s *Store) PutAuthorizationCode(ctx context.Context, code *AuthorizationCod
 // GetAuthorizationCode retrieves an AuthorizationCode from the store.
 func (s *Store) GetAuthorizationCode(ctx context.Context, code string) (*AuthorizationCode, error) {
 	key := authorizationCodeKeyPrefix + code
-	encryptedData, err := s.redis.Get(key).Result()
-	if err == redis.Nil {
+	encryptedData, err := s.kv.Get(key)
+	if err == kvstore.ErrNotFound {
 		return nil, errors.New(errors.ErrorNotFound, "")
 	} else if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
@@ -139,11 +159,56 @@ func (s *Store) GetAuthorizationCode(ctx context.Context, code string) (*Authori
 // DeleteAuthorizationCode deletes an AuthorizationCode from the store.
 func (s *Store) DeleteAuthorizationCode(ctx context.Context, code string) error {
 	key := authorizationCodeKeyPrefix + code
-	deleted, err := s.redis.Del(key).Result()
+	deleted, err := s.kv.Delete(key)
 	if err != nil {
 		return errors.Wrap(err, errors.ErrorUnknown, "")
 	}
-	if deleted == 0 {
+	if !deleted {
+		return errors.New(errors.ErrorNotFound, "")
+	}
+	return nil
+}
+
+// PutQRCode saves the state token of a QR sign-in transaction with the QR code. The code expires
+// after expiry.
+func (s *Store) PutQRCode(ctx context.Context, code, stateToken string, expiry time.Duration) error {
+	key := qrCodeKeyPrefix + code
+	encryptedData, err := s.encryptor.Encrypt([]byte(stateToken), []byte(key))
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	err = s.kv.Set(key, encryptedData, expiry)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return nil
+}
+
+// GetQRCode retrieves the state token of a QR code from the store.
+func (s *Store) GetQRCode(ctx context.Context, code string) (string, error) {
+	key := qrCodeKeyPrefix + code
+	encryptedData, err := s.kv.Get(key)
+	if err == kvstore.ErrNotFound {
+		return "", errors.New(errors.ErrorNotFound, "")
+	} else if err != nil {
+		return "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+
+	data, err := s.encryptor.Decrypt(encryptedData, []byte(key))
+	if err != nil {
+		return "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return string(data), nil
+}
+
+// DeleteQRCode deletes a QR code from the store.
+func (s *Store) DeleteQRCode(ctx context.Context, code string) error {
+	key := qrCodeKeyPrefix + code
+	deleted, err := s.kv.Delete(key)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	if !deleted {
 		return errors.New(errors.ErrorNotFound, "")
 	}
 	return nil
@@ -151,10 +216,51 @@ func (s *Store) DeleteAuthorizationCode(ctx context.Context, code string) error
 
 // CheckRateLimiter checks a user if it has exceeded authentication rate limiting.
 func (s *Store) CheckRateLimiter(ctx context.Context, userID int64) error {
-	return s.rateLimiter.Check(fmt.Sprintf("%d/password", userID))
+	return s.rateLimiter.Check(userLimiterKey(userID))
 }
 
 // IncrementRateLimiter increments a user's authentication rate limiting.
 func (s *Store) IncrementRateLimiter(ctx context.Context, userID int64) error {
-	return s.rateLimiter.Increment(fmt.Sprintf("%d/password", userID))
+	return s.rateLimiter.Increment(userLimiterKey(userID))
+}
+
+// CountFailedAttempts returns the number of recent failed authentication attempts of a user.
+func (s *Store) CountFailedAttempts(ctx context.Context, userID int64) (int64, error) {
+	return s.rateLimiter.Count(userLimiterKey(userID))
+}
+
+// IsKnownDevice returns whether a user has successfully authenticated with a device.
+func (s *Store) IsKnownDevice(ctx context.Context, userID int64, deviceID string) (bool, error) {
+	if deviceID == "" {
+		return false, nil
+	}
+	key := fmt.Sprintf("%s%d", knownDeviceKeyPrefix, userID)
+	ok, err := s.kv.SIsMember(key, deviceIDHash(deviceID))
+	if err != nil {
+		return false, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return ok, nil
+}
+
+// PutKnownDevice remembers a device that a user has successfully authenticated with.
+func (s *Store) PutKnownDevice(ctx context.Context, userID int64, deviceID string) error {
+	if deviceID == "" {
+		return nil
+	}
+	key := fmt.Sprintf("%s%d", knownDeviceKeyPrefix, userID)
+	err := s.kv.SAdd(key, deviceIDHash(deviceID))
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	err = s.kv.Expire(key, viper.GetDuration("risk_known_device_expiry"))
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return nil
+}
+
+// deviceIDHash hashes a device ID so that the device cookie cannot be recovered from the store.
+func deviceIDHash(deviceID string) string {
+	h := sha256.Sum256([]byte(deviceID))
+	return hex.EncodeToString(h[:])
 }
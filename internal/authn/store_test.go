@@ -16,13 +16,12 @@ func storeForTest() (*Store, func()) {
 	config.InitDefaults()
 	viper.Set("secret_key_base", "855edf399835e9c9deb61877c1a76bf14eed7c35a167e10ff1b7d43db4363268")
 	config.InitConfig()
-	redis := testutil.RedisForTest()
+	kv := testutil.KVStoreForTest()
 	encryptor := testutil.EncryptorForTest()
-	store := NewStore(redis, encryptor)
+	store := NewStore(kv, encryptor)
 
 	return store, func() {
 		viper.Reset()
-		redis.FlushAll()
 	}
 }
 
@@ -78,3 +77,29 @@ func TestPutAuthorizationCode(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, code, code2)
 }
+
+func TestKnownDevice(t *testing.T) {
+	s, teardown := storeForTest()
+	defer teardown()
+
+	ctx := context.Background()
+	ok, err := s.IsKnownDevice(ctx, 1, "device")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	err = s.PutKnownDevice(ctx, 1, "device")
+	assert.NoError(t, err)
+
+	ok, err = s.IsKnownDevice(ctx, 1, "device")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// Devices are remembered per user
+	ok, err = s.IsKnownDevice(ctx, 2, "device")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = s.IsKnownDevice(ctx, 1, "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
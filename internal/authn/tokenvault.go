@@ -0,0 +1,112 @@
+package authn
+
+import (
+	"context"
+	"time"
+
+	"authcore.io/authcore/internal/authn/idp"
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/log"
+	"authcore.io/authcore/pkg/nulls"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// storeIDPGrant stores the upstream tokens of an IDP grant in the OAuth factor for the token
+// vault. The stored refresh token is kept if the grant has none, as some IDPs issue refresh tokens
+// only when the user is asked for consent.
+func (tc *TransactionController) storeIDPGrant(ctx context.Context, oauthFactor *user.OAuthFactor, grant *idp.AuthorizationGrant) error {
+	if grant.AccessToken == "" && grant.RefreshToken == "" {
+		return nil
+	}
+	setOAuthFactorTokens(oauthFactor, grant)
+	_, err := tc.userStore.UpdateOAuthFactorTokens(ctx, oauthFactor)
+	return err
+}
+
+// UpstreamGrant returns the upstream tokens of the user for an IDP. The access token is refreshed
+// if it expires within idp_token_refresh_leeway.
+func (tc *TransactionController) UpstreamGrant(ctx context.Context, userID int64, idpID string) (*idp.AuthorizationGrant, error) {
+	provider, err := tc.idpFactory.IDP(idpID)
+	if err != nil {
+		return nil, errors.New(errors.ErrorNotFound, "invalid IDP")
+	}
+	oauthService, err := idp.IDToOAuthService(provider.ID())
+	if err != nil {
+		return nil, err
+	}
+	oauthFactors, err := tc.userStore.FindAllOAuthFactorsByUserIDAndService(ctx, userID, oauthService)
+	if err != nil {
+		return nil, err
+	}
+	if len(*oauthFactors) == 0 {
+		return nil, errors.New(errors.ErrorNotFound, "user is not linked with the IDP")
+	}
+	oauthFactor := &(*oauthFactors)[0]
+	if !oauthFactor.AccessToken.Valid && !oauthFactor.RefreshToken.Valid {
+		return nil, errors.New(errors.ErrorNotFound, "no upstream token is stored")
+	}
+
+	grant := oauthFactorGrant(oauthFactor)
+	leeway := viper.GetDuration("idp_token_refresh_leeway")
+	if !oauthFactor.TokenExpiresAt.Valid || time.Until(oauthFactor.TokenExpiresAt.Time) > leeway {
+		return grant, nil
+	}
+	refresher, ok := provider.(idp.TokenRefresher)
+	if !ok || grant.RefreshToken == "" {
+		return nil, errors.New(errors.ErrorFailedPrecondition, "upstream access token has expired")
+	}
+	refreshed, err := refresher.Refresh(ctx, grant)
+	if err != nil {
+		return nil, err
+	}
+	err = tc.storeIDPGrant(ctx, oauthFactor, refreshed)
+	if err != nil {
+		return nil, err
+	}
+	log.GetLogger(ctx).WithFields(logrus.Fields{
+		"idp":             provider.ID(),
+		"oauth_factor_id": oauthFactor.ID,
+	}).Info("upstream access token refreshed")
+	return oauthFactorGrant(oauthFactor), nil
+}
+
+// RevokeUpstreamTokens revokes the upstream tokens of an OAuth factor at the IDP. It is
+// registered with the user store to revoke the tokens when the IDP is unlinked.
+func (tc *TransactionController) RevokeUpstreamTokens(ctx context.Context, oauthFactor *user.OAuthFactor) error {
+	idpID, err := idp.OAuthServiceToID(oauthFactor.Service)
+	if err != nil {
+		return err
+	}
+	provider, err := tc.idpFactory.IDP(idpID)
+	if err != nil {
+		return err
+	}
+	revoker, ok := provider.(idp.TokenRevoker)
+	if !ok {
+		return nil
+	}
+	return revoker.Revoke(ctx, oauthFactorGrant(oauthFactor))
+}
+
+func setOAuthFactorTokens(oauthFactor *user.OAuthFactor, grant *idp.AuthorizationGrant) {
+	oauthFactor.AccessToken = nulls.String{String: grant.AccessToken, Valid: grant.AccessToken != ""}
+	oauthFactor.AccessSecret = nulls.String{String: grant.AccessSecret, Valid: grant.AccessSecret != ""}
+	if grant.RefreshToken != "" {
+		oauthFactor.RefreshToken = nulls.NewString(grant.RefreshToken)
+	}
+	oauthFactor.TokenType = nulls.String{String: grant.TokenType, Valid: grant.TokenType != ""}
+	oauthFactor.TokenExpiresAt = nulls.Time{Time: grant.Expiry, Valid: !grant.Expiry.IsZero()}
+}
+
+func oauthFactorGrant(oauthFactor *user.OAuthFactor) *idp.AuthorizationGrant {
+	return &idp.AuthorizationGrant{
+		AccessToken:  oauthFactor.AccessToken.String,
+		AccessSecret: oauthFactor.AccessSecret.String,
+		TokenType:    oauthFactor.TokenType.String,
+		RefreshToken: oauthFactor.RefreshToken.String,
+		Expiry:       oauthFactor.TokenExpiresAt.Time,
+	}
+}
@@ -0,0 +1,88 @@
+package authn
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/nulls"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamGrant(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	provider, err := tc.idpFactory.IDP("mock")
+	if !assert.NoError(t, err) {
+		return
+	}
+	mock := provider.(*mockIDP)
+	tc.userStore.RegisterOAuthTokenRevoker(tc.RevokeUpstreamTokens)
+
+	// Tokens are stored when the user signs in with the IDP
+	state, err := tc.StartIDP(ctx, "app", "mock", "https://example.com/", "", "", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	state, err = tc.VerifyIDP(ctx, state.StateToken, "vault@example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	userID := state.UserID
+	grant, err := tc.UpstreamGrant(ctx, userID, "mock")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "mock_access_token", grant.AccessToken)
+		assert.Equal(t, "mock_refresh_token", grant.RefreshToken)
+		assert.True(t, grant.Expiry.IsZero())
+	}
+
+	_, err = tc.UpstreamGrant(ctx, userID, "unknown")
+	assert.True(t, errors.IsKind(err, errors.ErrorNotFound))
+	_, err = tc.UpstreamGrant(ctx, 1, "mock")
+	assert.True(t, errors.IsKind(err, errors.ErrorNotFound))
+
+	// Expired access tokens are refreshed
+	oauthFactor, err := tc.userStore.FindOAuthFactorByOAuthIdentity(ctx, user.OAuthService("mock"), "vault@example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	oauthFactor.TokenExpiresAt = nulls.NewTime(time.Now().Add(30 * time.Second))
+	_, err = tc.userStore.UpdateOAuthFactorTokens(ctx, oauthFactor)
+	if !assert.NoError(t, err) {
+		return
+	}
+	grant, err = tc.UpstreamGrant(ctx, userID, "mock")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "mock_refreshed_access_token", grant.AccessToken)
+		assert.Equal(t, "mock_refresh_token", grant.RefreshToken)
+		assert.True(t, grant.Expiry.After(time.Now().Add(time.Minute)))
+	}
+	oauthFactor, err = tc.userStore.FindOAuthFactorByID(ctx, oauthFactor.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "mock_refreshed_access_token", oauthFactor.AccessToken.String)
+	}
+
+	// Expired access tokens without a refresh token cannot be used
+	oauthFactor.RefreshToken = nulls.String{}
+	oauthFactor.TokenExpiresAt = nulls.NewTime(time.Now().Add(-time.Minute))
+	_, err = tc.userStore.UpdateOAuthFactorTokens(ctx, oauthFactor)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = tc.UpstreamGrant(ctx, userID, "mock")
+	assert.True(t, errors.IsKind(err, errors.ErrorFailedPrecondition))
+
+	// Tokens are revoked when the IDP is unlinked
+	err = tc.userStore.DeleteOAuthFactorByUserIDAndService(ctx, userID, user.OAuthService("mock"))
+	assert.NoError(t, err)
+	if assert.Len(t, mock.revoked, 1) {
+		assert.Equal(t, "mock_refreshed_access_token", mock.revoked[0].AccessToken)
+	}
+	_, err = tc.UpstreamGrant(ctx, userID, "mock")
+	assert.True(t, errors.IsKind(err, errors.ErrorNotFound))
+}
@@ -6,9 +6,11 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
-	"time"
+	"strings"
 
+	"authcore.io/authcore/internal/authn/hook"
 	"authcore.io/authcore/internal/authn/idp"
+	"authcore.io/authcore/internal/authn/ldap"
 	"authcore.io/authcore/internal/authn/verifier"
 	"authcore.io/authcore/internal/clientapp"
 	"authcore.io/authcore/internal/db"
@@ -32,17 +34,27 @@ type TransactionController struct {
 	store           *Store
 	userStore       *user.Store
 	sessionStore    *session.Store
+	riskEngine      *RiskEngine
+	challengers     map[string]Challenger
+	hooks           []*hook.Hook
+	directory       *ldap.Directory
+	// provisioningRules are keyed by IDP ID.
+	provisioningRules map[string]*idp.ProvisioningRules
+	idpRoutingRules   []clientapp.IDPRoutingRule
 }
 
 // NewTransactionController returns a new TransactionController.
 func NewTransactionController(db *db.DB, store *Store, userStore *user.Store, sessionStore *session.Store) *TransactionController {
 	return &TransactionController{
-		verifierFactory: verifier.NewFactory(),
-		idpFactory:      idp.NewFactory(),
-		db:              db,
-		store:           store,
-		userStore:       userStore,
-		sessionStore:    sessionStore,
+		verifierFactory:   verifier.NewFactory(),
+		idpFactory:        idp.NewFactory(),
+		db:                db,
+		store:             store,
+		userStore:         userStore,
+		sessionStore:      sessionStore,
+		riskEngine:        NewRiskEngine(store, sessionStore),
+		challengers:       map[string]Challenger{},
+		provisioningRules: map[string]*idp.ProvisioningRules{},
 	}
 }
 
@@ -58,8 +70,31 @@ func (tc *TransactionController) StartPrimary(ctx context.Context, clientID, han
 		return nil, err
 	}
 
+	err = tc.store.CheckSourceRateLimiter(ctx, handle)
+	if err != nil {
+		return
+	}
+
+	clientApp, err := clientapp.GetByClientID(clientID)
+	if err != nil {
+		return
+	}
+	rule := clientApp.MatchIDPRoutingRule(handle, tc.idpRoutingRules)
+	if rule != nil && rule.BlockPassword {
+		return tc.startIDPRedirect(ctx, clientApp, rule, handle, redirectURI, codeChallengeMethod, codeChallenge, clientState)
+	}
+
 	u, err := tc.userStore.UserByHandle(ctx, handle)
 	if err != nil {
+		if errors.IsKind(err, errors.ErrorNotFound) {
+			if rule != nil {
+				return tc.startIDPRedirect(ctx, clientApp, rule, handle, redirectURI, codeChallengeMethod, codeChallenge, clientState)
+			}
+			if tc.isLDAPEnabled(clientApp) {
+				return tc.startLDAP(ctx, clientApp, 0, handle, redirectURI, codeChallengeMethod, codeChallenge, clientState)
+			}
+			tc.store.IncrementSourceRateLimiter(ctx, handle)
+		}
 		return
 	}
 
@@ -68,9 +103,11 @@ func (tc *TransactionController) StartPrimary(ctx context.Context, clientID, han
 		return
 	}
 
-	clientApp, err := clientapp.GetByClientID(clientID)
-	if err != nil {
-		return
+	if rule != nil && !u.IsPasswordAuthenticationEnabled() {
+		return tc.startIDPRedirect(ctx, clientApp, rule, handle, redirectURI, codeChallengeMethod, codeChallenge, clientState)
+	}
+	if tc.isLDAPEnabled(clientApp) && !u.IsPasswordAuthenticationEnabled() {
+		return tc.startLDAP(ctx, clientApp, u.ID, handle, redirectURI, codeChallengeMethod, codeChallenge, clientState)
 	}
 
 	state = &State{
@@ -78,6 +115,7 @@ func (tc *TransactionController) StartPrimary(ctx context.Context, clientID, han
 		Status:              StatusPrimary,
 		ClientID:            clientApp.ID,
 		UserID:              u.ID,
+		Handle:              handle,
 		Factors:             []string{},
 		RedirectURI:         redirectURI,
 		PKCEChallengeMethod: codeChallengeMethod,
@@ -85,29 +123,86 @@ func (tc *TransactionController) StartPrimary(ctx context.Context, clientID, han
 		ClientState:         clientState,
 	}
 
+	err = tc.store.CheckRateLimiter(ctx, u.ID)
+	if err != nil {
+		state.Status = StatusBlocked
+	}
+
+	err = tc.issueChallenge(ctx, state, u.ID)
+	if err != nil {
+		return
+	}
+
+	if state.Status != StatusChallengeRequired {
+		err = mutatePrimary(state, u)
+		if err != nil {
+			return
+		}
+	}
+
+	err = tc.store.PutState(ctx, state)
+	return
+}
+
+// startIDPRedirect returns a state telling the client to authenticate the user with the IDP of
+// an IDP routing rule instead of a password.
+func (tc *TransactionController) startIDPRedirect(ctx context.Context, clientApp *clientapp.ClientApp, rule *clientapp.IDPRoutingRule, handle, redirectURI, codeChallengeMethod, codeChallenge, clientState string) (*State, error) {
+	provider, err := tc.idpFactory.IDP(rule.IDP)
+	if err != nil {
+		log.GetLogger(ctx).WithField("idp", rule.IDP).Error("IDP of routing rule is not available")
+		return nil, errors.New(errors.ErrorFailedPrecondition, "IDP is not available")
+	}
+	state := &State{
+		StateToken:          cryptoutil.RandomToken32(),
+		Status:              StatusIDPRedirect,
+		ClientID:            clientApp.ID,
+		Handle:              handle,
+		IDP:                 provider.ID(),
+		Factors:             []string{"idp_" + provider.ID()},
+		RedirectURI:         redirectURI,
+		PKCEChallengeMethod: codeChallengeMethod,
+		PKCEChallenge:       codeChallenge,
+		ClientState:         clientState,
+	}
+	err = tc.store.PutState(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// spake2PasswordVerifier returns the SPAKE2+ password verifier of the user. It returns a
+// FailedPrecondition error if the user only has an imported password hash.
+func spake2PasswordVerifier(u *user.User) (verifier.Verifier, error) {
+	v, err := u.PasswordVerifier()
+	if err != nil {
+		return nil, err
+	}
+	if v.Method() != verifier.SPAKE2Plus {
+		return nil, errors.Errorf(errors.ErrorFailedPrecondition, "password must be verified with %v method", v.Method())
+	}
+	return v, nil
+}
+
+// mutatePrimary sets the primary factors of the user to the state.
+func mutatePrimary(state *State, u *user.User) error {
+	state.ClearFactors()
 	if u.IsPasswordAuthenticationEnabled() {
 		verifier, err := u.PasswordVerifier()
 		if err != nil {
-			return nil, err
+			return err
 		}
 		state.AppendFactor(FactorPassword)
 		state.PasswordMethod = verifier.Method()
 		state.PasswordSalt = verifier.Salt()
 	}
-
-	err = tc.store.CheckRateLimiter(ctx, u.ID)
-	if err != nil {
-		state.Status = StatusBlocked
-	}
-
-	err = tc.store.PutState(ctx, state)
-	return
+	return nil
 }
 
 // RequestPassword performs a password key exchange
 func (tc *TransactionController) RequestPassword(ctx context.Context, stateToken string, message []byte) (challenge verifier.Challenge, err error) {
 	_, err = tc.stateMutation(ctx, stateToken, StatusPrimary, func(state *State, u *user.User) error {
-		verifier, err := u.PasswordVerifier()
+		verifier, err := spake2PasswordVerifier(u)
 		if err != nil {
 			return err
 		}
@@ -120,15 +215,34 @@ func (tc *TransactionController) RequestPassword(ctx context.Context, stateToken
 
 // VerifyPassword verifies the incoming password confirmation.
 func (tc *TransactionController) VerifyPassword(ctx context.Context, stateToken string, in []byte) (*State, error) {
+	return tc.verifyPrimaryPassword(ctx, stateToken, verifier.SPAKE2Plus, in)
+}
+
+// VerifyLegacyPassword verifies a plaintext password against the password hash imported for the
+// user. On success, the hash is replaced by a SPAKE2+ verifier so that subsequent authentications
+// use VerifyPassword.
+func (tc *TransactionController) VerifyLegacyPassword(ctx context.Context, stateToken string, password []byte) (*State, error) {
+	return tc.verifyPrimaryPassword(ctx, stateToken, verifier.LegacyPassword, password)
+}
+
+func (tc *TransactionController) verifyPrimaryPassword(ctx context.Context, stateToken, method string, in []byte) (*State, error) {
+	upgrade := method == verifier.LegacyPassword
 	return tc.stateMutation(ctx, stateToken, StatusPrimary, func(state *State, u *user.User) error {
 		verifier, err := u.PasswordVerifier()
 		if err != nil {
 			return err
 		}
+		if verifier.Method() != method {
+			return errors.Errorf(errors.ErrorFailedPrecondition, "password must be verified with %v method", verifier.Method())
+		}
 
 		err = tc.store.CheckRateLimiter(ctx, u.ID)
 		if err != nil {
-			err = errors.New(errors.ErrorUserTemporarilyBlocked, "too many authentication attempts")
+			retryAfter := tc.store.UserRateLimiterRetryAfter(ctx, u.ID)
+			return errors.WithRetryAfter(errors.ErrorUserTemporarilyBlocked, "too many authentication attempts", retryAfter)
+		}
+		err = tc.store.CheckSourceRateLimiter(ctx, state.Handle)
+		if err != nil {
 			return err
 		}
 
@@ -138,133 +252,213 @@ func (tc *TransactionController) VerifyPassword(ctx context.Context, stateToken
 				"user_id": u.PublicID(),
 			}).Warn("password authentication rejected")
 			tc.store.IncrementRateLimiter(ctx, u.ID)
+			tc.store.IncrementSourceRateLimiter(ctx, state.Handle)
 			return errors.New(errors.ErrorPermissionDenied, "password incorrect")
 		}
 		log.GetLogger(ctx).WithFields(logrus.Fields{
 			"user_id": u.PublicID(),
 		}).Info("password authentication accepted")
-
-		state.PasswordVerified = true
-
-		secondFactors, err := tc.userStore.FindAllSecondFactorsByUserID(ctx, u.ID)
-		if err != nil {
-			return err
-		}
-		if !verifier.SkipMFA() && len(*secondFactors) > 0 {
-			// MFA_REQUIRED
-			state.Status = StatusMFARequired
-			state.ClearFactors()
-			for _, secondFactor := range *secondFactors {
-				var factor string
-				factor = secondFactor.Type.String()
-				state.AppendFactor(factor)
+		if upgrade {
+			if err := tc.upgradeLegacyPassword(ctx, u, in); err != nil {
+				return err
 			}
-		} else {
-			// SUCCESS
-			tc.mutateSuccess(ctx, state)
 		}
-		return nil
+
+		return tc.mutatePasswordVerified(ctx, state, u, verifier.SkipMFA())
 	})
 }
 
-// RequestMFA requests a MFA challenge.
-func (tc *TransactionController) RequestMFA(ctx context.Context, stateToken, method string, message []byte) (challenge verifier.Challenge, err error) {
-	_, err = tc.stateMutation(ctx, stateToken, StatusMFARequired, func(state *State, u *user.User) error {
-		factor, err := tc.getSecondFactor(ctx, u, method)
-		if err != nil {
-			return err
-		}
+// mutatePasswordVerified proceeds the transaction after the password of the user is verified. MFA
+// is not required if skipMFA is true.
+func (tc *TransactionController) mutatePasswordVerified(ctx context.Context, state *State, u *user.User, skipMFA bool) error {
+	claims, err := tc.runHooks(ctx, hook.PostPrimary, state.ClientID, u)
+	if err != nil {
+		return err
+	}
+	state.HookClaims = mergeClaims(state.HookClaims, claims)
+	state.PasswordVerified = true
 
-		verifier, err := factor.ToVerifier(tc.verifierFactory)
-		if err != nil {
-			return err
-		}
+	clientApp, err := clientapp.GetByClientID(state.ClientID)
+	if err != nil {
+		return err
+	}
+	state.ForcePasswordChange = u.IsPasswordChangeRequired(clientApp.MaxPasswordAge)
 
-		state.MFAMethod = verifier.Method()
-		state.MFAVerifierState, challenge, err = verifier.Request(message)
-		if err != nil {
-			return err
-		}
+	secondFactors, err := tc.userStore.FindAllSecondFactorsByUserID(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	requireMFA := !skipMFA && len(*secondFactors) > 0
+	decision, err := tc.assessRisk(ctx, state, u, *secondFactors)
+	if err != nil {
+		return err
+	}
+	switch decision {
+	case RiskBlock:
 		return nil
+	case RiskAllow:
+		requireMFA = false
+	case RiskRequireMFA:
+		requireMFA = true
+	}
+	// A trusted device does not skip MFA required by the risk engine.
+	if requireMFA && decision != RiskRequireMFA && tc.userStore.VerifyTrustedDeviceToken(ctx, u.ID, TrustedDeviceTokenFromContext(ctx), deviceFingerprint(ctx)) {
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"user_id": u.PublicID(),
+		}).Info("MFA skipped on trusted device")
+		requireMFA = false
+	}
+	enrollMFA, err := tc.isMFAEnrollmentRequired(ctx, state.ClientID, u, *secondFactors)
+	if err != nil {
+		return err
+	}
+	// The enrolled factors, e.g. backup codes, must be verified before enrolling another factor.
+	if enrollMFA && len(*secondFactors) > 0 {
+		requireMFA = true
+	}
+	if requireMFA {
+		// MFA_REQUIRED
+		mutateMFARequired(state, *secondFactors)
+	} else if enrollMFA {
+		// MFA_ENROLLMENT_REQUIRED
+		mutateMFAEnrollmentRequired(ctx, state)
+	} else {
+		// SUCCESS
+		tc.mutateSuccess(ctx, state)
+	}
+	return nil
+}
+
+// assessRisk assesses the risk of the authentication by the user if the risk engine is enabled and
+// returns the decision. The state is BLOCKED if the decision is to block. MFA cannot be required
+// from a user without any second factor, so the authentication is blocked instead.
+func (tc *TransactionController) assessRisk(ctx context.Context, state *State, u *user.User, secondFactors []user.SecondFactor) (string, error) {
+	if !tc.riskEngine.Enabled() {
+		return "", nil
+	}
+	assessment, err := tc.riskEngine.Assess(ctx, u, secondFactors)
+	if err != nil {
+		return "", err
+	}
+	state.Risk = assessment
+	if assessment.Decision == RiskRequireMFA && len(secondFactors) == 0 {
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"user_id": u.PublicID(),
+		}).Warn("MFA required by risk engine but no second factor is enrolled")
+		assessment.Decision = RiskBlock
+	}
+	if assessment.Decision == RiskBlock {
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"user_id": u.PublicID(),
+			"reasons": assessment.Reasons,
+		}).Warn("authentication blocked by risk engine")
+		state.Status = StatusBlocked
+	}
+	return assessment.Decision, nil
+}
+
+// upgradeLegacyPassword replaces the imported password hash of the user with a SPAKE2+ verifier
+// computed from the verified password.
+func (tc *TransactionController) upgradeLegacyPassword(ctx context.Context, u *user.User, password []byte) error {
+	spake2plus, err := verifier.NewSPAKE2Plus()
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	salt, w0, l, err := verifier.GenerateSPAKE2Verifier(password, []byte("authcoreuser"), []byte("authcore"), spake2plus)
+	if err != nil {
+		return err
+	}
+	// Upgrading the verifier does not change the password.
+	changedAt, changeRequired := u.PasswordChangedAt, u.PasswordChangeRequired
+	if err = u.SetPasswordVerifier(salt, w0, l); err != nil {
+		return err
+	}
+	u.PasswordChangedAt, u.PasswordChangeRequired = changedAt, changeRequired
+	if err = tc.userStore.UpdateUser(ctx, u); err != nil {
+		return err
+	}
+	log.GetLogger(ctx).WithFields(logrus.Fields{
+		"user_id": u.PublicID(),
+	}).Info("legacy password hash upgraded to SPAKE2+ verifier")
+	return nil
+}
+
+// RequestMFA requests a MFA challenge.
+func (tc *TransactionController) RequestMFA(ctx context.Context, stateToken, method string, message []byte) (challenge verifier.Challenge, err error) {
+	_, err = tc.stateMutation(ctx, stateToken, StatusMFARequired, func(state *State, u *user.User) error {
+		challenge, err = tc.requestSecondFactor(ctx, state, u, method, message)
+		return err
 	})
 	return
 }
 
-// VerifyMFA verifies a MFA factor.
-func (tc *TransactionController) VerifyMFA(ctx context.Context, stateToken, method string, response []byte) (state *State, err error) {
+// VerifyMFA verifies a MFA factor. If trustDevice is true, the device is trusted to skip MFA in
+// subsequent authentications and a trusted device token is returned in the state.
+func (tc *TransactionController) VerifyMFA(ctx context.Context, stateToken, method string, response []byte, trustDevice bool) (state *State, err error) {
 	return tc.stateMutation(ctx, stateToken, StatusMFARequired, func(state *State, u *user.User) error {
 		return tc.db.RunInTransaction(ctx, func(tx *sqlx.Tx) error {
-			factor, err := tc.getSecondFactor(ctx, u, method)
+			err := tc.store.CheckRateLimiter(ctx, u.ID)
 			if err != nil {
-				return err
+				state.Status = StatusBlocked
+				return nil
 			}
-
-			err = tc.userStore.LockSecondFactor(ctx, factor)
+			err = tc.store.CheckSourceRateLimiter(ctx, state.Handle)
 			if err != nil {
 				return err
 			}
 
-			v, err := factor.ToVerifier(tc.verifierFactory)
+			err = tc.verifySecondFactor(ctx, state, u, method, response)
 			if err != nil {
 				return err
 			}
 
-			if state.MFAMethod != "" && state.MFAMethod != v.Method() {
-				state.MFAVerifierState = nil
-			}
-
-			err = tc.store.CheckRateLimiter(ctx, u.ID)
-			if err != nil {
-				state.Status = StatusBlocked
-				return nil
-			}
-
-			ok, updateVerifier := v.Verify(state.MFAVerifierState, response)
-			if !ok {
-				log.GetLogger(ctx).WithFields(logrus.Fields{
-					"user_id": u.PublicID(),
-				}).Warn("MFA authentication rejected")
-				tc.store.IncrementRateLimiter(ctx, u.ID)
-				return errors.New(errors.ErrorPermissionDenied, "MFA authentication rejected")
-			}
-			log.GetLogger(ctx).WithFields(logrus.Fields{
-				"user_id": u.PublicID(),
-			}).Info("MFA authentication accepted")
-
-			_, err = tc.userStore.UpdateSecondFactorLastUsedAtByID(ctx, factor.ID)
-			if err != nil {
-				return err
-			}
+			tx.Commit()
 
-			if updateVerifier != nil {
-				log.GetLogger(ctx).WithFields(logrus.Fields{
-					"user_id": u.PublicID(),
-				}).Info("updating second factor content")
-				factor.UpdateWithVerifier(updateVerifier)
-				_, err = tc.userStore.UpdateSecondFactorContent(ctx, factor)
+			if trustDevice {
+				ip, _ := ctx.Value(session.IPKey{}).(string)
+				_, token, err := tc.userStore.CreateTrustedDevice(ctx, u.ID, deviceFingerprint(ctx), deviceUserAgent(ctx), ip)
 				if err != nil {
 					return err
 				}
+				log.GetLogger(ctx).WithFields(logrus.Fields{
+					"user_id": u.PublicID(),
+				}).Info("device trusted")
+				state.TrustedDeviceToken = token
 			}
 
-			tx.Commit()
-
-			// SUCCESS
-			return tc.mutateSuccess(ctx, state)
+			return tc.mutateMFAVerified(ctx, state, u)
 		})
 	})
 }
 
 // SignUp creates a new user.
-func (tc *TransactionController) SignUp(ctx context.Context, clientID, redirectURI, email, phone, passwordVerifierJSON, name, lang string) (state *State, err error) {
+//
+// A CHALLENGE_REQUIRED state is returned instead if the client must solve a challenge before signing
+// up. The client then signs up again with the state token and the challenge response.
+func (tc *TransactionController) SignUp(ctx context.Context, clientID, redirectURI, email, phone, passwordVerifierJSON, name, lang, invitationToken, challengeStateToken, challengeResponse string) (state *State, err error) {
 	clientApp, err := clientapp.GetByClientID(clientID)
 	if err != nil {
 		err = errors.New(errors.ErrorInvalidArgument, "invalid client id")
 		return
 	}
-	if !viper.GetBool("sign_up_enabled") {
-		err = errors.New(errors.ErrorPermissionDenied, "create account is not allowed")
-		return
+	var invitation *user.Invitation
+	if invitationToken != "" {
+		invitation, err = tc.userStore.FindInvitationByToken(ctx, invitationToken)
+		if err != nil {
+			return
+		}
+		if invitation.ClientID != clientApp.ID || !strings.EqualFold(invitation.Email, email) {
+			err = errors.New(errors.ErrorPermissionDenied, "invitation does not match")
+			return
+		}
+	} else {
+		if !viper.GetBool("sign_up_enabled") {
+			err = errors.New(errors.ErrorPermissionDenied, "create account is not allowed")
+			return
+		}
+		if err = clientApp.CheckSignUpEmail(email); err != nil {
+			return
+		}
 	}
 	if err = ValidateRedirectURI(clientID, redirectURI); err != nil {
 		return
@@ -273,6 +467,18 @@ func (tc *TransactionController) SignUp(ctx context.Context, clientID, redirectU
 	if err != nil {
 		return
 	}
+	// Invited users skip the sign up challenge.
+	if invitation == nil && challengeStateToken != "" {
+		err = tc.solveSignUpChallenge(ctx, clientApp.ID, challengeStateToken, challengeResponse)
+		if err != nil {
+			return
+		}
+	} else if invitation == nil {
+		state, err = tc.signUpChallenge(ctx, clientApp.ID, redirectURI)
+		if err != nil || state != nil {
+			return
+		}
+	}
 
 	u := &user.User{
 		DisplayNameOld: name,
@@ -298,10 +504,20 @@ func (tc *TransactionController) SignUp(ctx context.Context, clientID, redirectU
 		return
 	}
 
+	claims, err := tc.runHooks(ctx, hook.PreSignUp, clientApp.ID, u)
+	if err != nil {
+		return
+	}
+
 	err = tc.userStore.InsertUser(ctx, u)
 	if err != nil {
 		return
 	}
+	if invitation != nil {
+		if err = tc.userStore.AcceptInvitation(ctx, invitation, u); err != nil {
+			return
+		}
+	}
 
 	state = &State{
 		StateToken:  cryptoutil.RandomToken32(),
@@ -309,11 +525,20 @@ func (tc *TransactionController) SignUp(ctx context.Context, clientID, redirectU
 		ClientID:    clientApp.ID,
 		UserID:      u.ID,
 		RedirectURI: redirectURI,
+		HookClaims:  claims,
 	}
-	code := state.GenerateAuthorizationCode()
-	if err = tc.store.PutAuthorizationCode(ctx, code); err != nil {
+	enrollMFA, err := tc.isMFAEnrollmentRequired(ctx, clientApp.ID, u, nil)
+	if err != nil {
 		return
 	}
+	if enrollMFA {
+		mutateMFAEnrollmentRequired(ctx, state)
+	} else {
+		code := state.GenerateAuthorizationCode()
+		if err = tc.store.PutAuthorizationCode(ctx, code); err != nil {
+			return
+		}
+	}
 	if err = tc.store.PutState(ctx, state); err != nil {
 		return
 	}
@@ -385,6 +610,10 @@ func (tc *TransactionController) VerifyIDP(ctx context.Context, stateToken, code
 		if ident == nil || len(ident.ID) == 0 {
 			return errors.New(errors.ErrorPermissionDenied, "invalid authorization grant")
 		}
+		rules := tc.idpProvisioningRules(state.IDP)
+		if !rules.IsEmailVerifiedTrusted() {
+			ident.EmailVerified = false
+		}
 
 		var localUser *user.User
 		oauthService, err := idp.IDToOAuthService(state.IDP)
@@ -411,7 +640,7 @@ func (tc *TransactionController) VerifyIDP(ctx context.Context, stateToken, code
 						"idp_id":  ident.ID,
 						"user_id": u.PublicID(),
 					}).Info("IDP user's email is found but it is not linked with the IDP")
-					err = tc.mutateIDPAlreadyExists(ctx, state, u)
+					err = tc.mutateIDPAlreadyExists(ctx, state, u, ident)
 					if err != nil {
 						return err
 					}
@@ -433,7 +662,7 @@ func (tc *TransactionController) VerifyIDP(ctx context.Context, stateToken, code
 						"idp_id":  ident.ID,
 						"user_id": u.PublicID(),
 					}).Info("IDP user's phone is found but it is not linked with the IDP")
-					err = tc.mutateIDPAlreadyExists(ctx, state, u)
+					err = tc.mutateIDPAlreadyExists(ctx, state, u, ident)
 					if err != nil {
 						return err
 					}
@@ -444,36 +673,26 @@ func (tc *TransactionController) VerifyIDP(ctx context.Context, stateToken, code
 			if !viper.GetBool("sign_up_enabled") {
 				return errors.New(errors.ErrorPermissionDenied, "create user is not allowed")
 			}
+			clientApp, err := clientapp.GetByClientID(state.ClientID)
+			if err != nil {
+				return err
+			}
+			if err := clientApp.CheckSignUpEmail(ident.Email); err != nil {
+				return err
+			}
 
 			// FIXME: we need a verified email or phone number to register for now. It will result
 			// in error if the IDP ident have no email and phone.
-			emailVerifiedAt := nulls.Time{}
-			if ident.EmailVerified {
-				emailVerifiedAt = nulls.NewTime(time.Now())
-			}
-			phoneVerifiedAt := nulls.Time{}
-			if ident.PhoneNumberVerified {
-				phoneVerifiedAt = nulls.NewTime(time.Now())
-			}
-			localUser = &user.User{
-				DisplayNameOld: ident.Name,
-				Name: nulls.String{
-					String: ident.Name,
-					Valid:  ident.Name != "",
-				},
-				Email: nulls.String{
-					String: ident.Email,
-					Valid:  ident.Email != "",
-				},
-				EmailVerifiedAt: emailVerifiedAt,
-				Phone: nulls.String{
-					String: ident.PhoneNumber,
-					Valid:  ident.PhoneNumber != "",
-				},
-				PhoneVerifiedAt: phoneVerifiedAt,
+			localUser = &user.User{}
+			rules.UpdateUser(localUser, ident)
+
+			claims, err := tc.runHooks(ctx, hook.PreSignUp, state.ClientID, localUser)
+			if err != nil {
+				return err
 			}
+			state.HookClaims = mergeClaims(state.HookClaims, claims)
 
-			err := tc.userStore.InsertUser(ctx, localUser)
+			err = tc.userStore.InsertUser(ctx, localUser)
 			if err != nil {
 				return err
 			}
@@ -483,7 +702,15 @@ func (tc *TransactionController) VerifyIDP(ctx context.Context, stateToken, code
 				return err
 			}
 
-			_, err = tc.userStore.CreateOAuthFactor(ctx, localUser.ID, oauthService, ident.ID, nulls.NewJSON(ident))
+			oauthFactor, err := tc.userStore.CreateOAuthFactor(ctx, localUser.ID, oauthService, ident.ID, nulls.NewJSON(ident))
+			if err != nil {
+				return err
+			}
+			err = tc.storeIDPGrant(ctx, oauthFactor, grant)
+			if err != nil {
+				return err
+			}
+			err = tc.syncIDPRoles(ctx, rules, localUser, ident)
 			if err != nil {
 				return err
 			}
@@ -499,6 +726,25 @@ func (tc *TransactionController) VerifyIDP(ctx context.Context, stateToken, code
 			if err != nil {
 				return err
 			}
+			err = tc.storeIDPGrant(ctx, oauthFactor, grant)
+			if err != nil {
+				return err
+			}
+			if rules.UpdateOnLogin {
+				rules.UpdateUser(localUser, ident)
+				err = tc.userStore.UpdateUser(ctx, localUser)
+				if err != nil {
+					return err
+				}
+				_, err = tc.userStore.UpdateOAuthFactorMetadata(ctx, oauthFactor.ID, nulls.NewJSON(ident))
+				if err != nil {
+					return err
+				}
+				err = tc.syncIDPRoles(ctx, rules, localUser, ident)
+				if err != nil {
+					return err
+				}
+			}
 		}
 
 		// Successfuly login to a registered user
@@ -507,12 +753,85 @@ func (tc *TransactionController) VerifyIDP(ctx context.Context, stateToken, code
 			"idp_id":  ident.ID,
 			"user_id": localUser.PublicID(),
 		}).Info("IDP authentication accepted")
-		state.UserID = localUser.ID
-		tc.mutateSuccess(ctx, state)
-		return nil
+		return tc.mutateIDPAuthenticated(ctx, state, localUser)
 	})
 }
 
+// mutateIDPAuthenticated completes a transaction in which the user has authenticated with an IDP
+// identity bound to u.
+func (tc *TransactionController) mutateIDPAuthenticated(ctx context.Context, state *State, u *user.User) error {
+	claims, err := tc.runHooks(ctx, hook.PostPrimary, state.ClientID, u)
+	if err != nil {
+		return err
+	}
+	state.HookClaims = mergeClaims(state.HookClaims, claims)
+	state.UserID = u.ID
+
+	secondFactors, err := tc.userStore.FindAllSecondFactorsByUserID(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	decision, err := tc.assessRisk(ctx, state, u, *secondFactors)
+	if err != nil {
+		return err
+	}
+	switch decision {
+	case RiskBlock:
+		return nil
+	case RiskRequireMFA:
+		// MFA_REQUIRED
+		mutateMFARequired(state, *secondFactors)
+		return nil
+	}
+	enrollMFA, err := tc.isMFAEnrollmentRequired(ctx, state.ClientID, u, *secondFactors)
+	if err != nil {
+		return err
+	}
+	if enrollMFA {
+		// MFA_ENROLLMENT_REQUIRED
+		mutateMFAEnrollmentRequired(ctx, state)
+		return nil
+	}
+	tc.mutateSuccess(ctx, state)
+	return nil
+}
+
+// mutateMFAVerified completes the transaction after a second factor of the user is verified, unless
+// the user must still enroll a second factor other than backup codes. The pending IDP identity of an
+// IDP_ALREADY_EXISTS transaction is linked to the user.
+func (tc *TransactionController) mutateMFAVerified(ctx context.Context, state *State, u *user.User) error {
+	if state.IDPIdentity != nil {
+		err := tc.linkIDPIdentity(ctx, state, u)
+		if err != nil {
+			return err
+		}
+	}
+	secondFactors, err := tc.userStore.FindAllSecondFactorsByUserID(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	enrollMFA, err := tc.isMFAEnrollmentRequired(ctx, state.ClientID, u, *secondFactors)
+	if err != nil {
+		return err
+	}
+	if enrollMFA {
+		// MFA_ENROLLMENT_REQUIRED
+		mutateMFAEnrollmentRequired(ctx, state)
+		return nil
+	}
+	// SUCCESS
+	return tc.mutateSuccess(ctx, state)
+}
+
+// mutateMFARequired moves the state to MFA_REQUIRED with the second factors of the user.
+func mutateMFARequired(state *State, secondFactors []user.SecondFactor) {
+	state.Status = StatusMFARequired
+	state.ClearFactors()
+	for _, secondFactor := range secondFactors {
+		state.AppendFactor(secondFactor.Type.String())
+	}
+}
+
 // StartIDPBinding starts a third-party ID provider binding transaction.
 func (tc *TransactionController) StartIDPBinding(ctx context.Context, userID int64, clientID, idpID, redirectURI string) (state *State, err error) {
 	if idpID == "" {
@@ -596,7 +915,11 @@ func (tc *TransactionController) VerifyIDPBinding(ctx context.Context, stateToke
 			return errors.New(errors.ErrorAlreadyExists, "IDP user is bound to another user")
 		}
 
-		_, err = tc.userStore.CreateOAuthFactor(ctx, state.UserID, oauthService, ident.ID, nulls.NewJSON(ident))
+		oauthFactor, err := tc.userStore.CreateOAuthFactor(ctx, state.UserID, oauthService, ident.ID, nulls.NewJSON(ident))
+		if err != nil {
+			return err
+		}
+		err = tc.storeIDPGrant(ctx, oauthFactor, grant)
 		if err != nil {
 			return err
 		}
@@ -613,7 +936,8 @@ func (tc *TransactionController) VerifyIDPBinding(ctx context.Context, stateToke
 	})
 }
 
-// StartStepUp starts a step-up password verification transaction with an existing session.
+// StartStepUp starts a step-up verification transaction with an existing session. The user may
+// verify the password or any enrolled second factor.
 func (tc *TransactionController) StartStepUp(ctx context.Context, sessionID int64) (state *State, err error) {
 	sess, err := tc.sessionStore.FindSessionByInternalID(ctx, sessionID)
 	if err != nil {
@@ -629,8 +953,13 @@ func (tc *TransactionController) StartStepUp(ctx context.Context, sessionID int6
 		return
 	}
 
-	if !u.IsPasswordAuthenticationEnabled() {
-		err = errors.New(errors.ErrorPermissionDenied, "password is not set")
+	secondFactors, err := tc.userStore.FindAllSecondFactorsByUserID(ctx, u.ID)
+	if err != nil {
+		return
+	}
+
+	if !u.IsPasswordAuthenticationEnabled() && len(*secondFactors) == 0 {
+		err = errors.New(errors.ErrorPermissionDenied, "no factor is available for step-up")
 		return
 	}
 
@@ -643,13 +972,18 @@ func (tc *TransactionController) StartStepUp(ctx context.Context, sessionID int6
 		ClientID:   sess.ClientID.String,
 	}
 
-	verifier, err := u.PasswordVerifier()
-	if err != nil {
-		return nil, err
+	if u.IsPasswordAuthenticationEnabled() {
+		verifier, err := u.PasswordVerifier()
+		if err != nil {
+			return nil, err
+		}
+		state.AppendFactor(FactorPassword)
+		state.PasswordMethod = verifier.Method()
+		state.PasswordSalt = verifier.Salt()
+	}
+	for _, secondFactor := range *secondFactors {
+		state.AppendFactor(secondFactor.Type.String())
 	}
-	state.AppendFactor(FactorPassword)
-	state.PasswordMethod = verifier.Method()
-	state.PasswordSalt = verifier.Salt()
 
 	err = tc.store.CheckRateLimiter(ctx, u.ID)
 	if err != nil {
@@ -667,7 +1001,7 @@ func (tc *TransactionController) RequestPasswordStepUp(ctx context.Context, stat
 			return errors.New(errors.ErrorPermissionDenied, "illegal state")
 		}
 
-		verifier, err := u.PasswordVerifier()
+		verifier, err := spake2PasswordVerifier(u)
 		if err != nil {
 			return err
 		}
@@ -690,7 +1024,7 @@ func (tc *TransactionController) VerifyPasswordStepUp(ctx context.Context, state
 			return err
 		}
 
-		verifier, err := u.PasswordVerifier()
+		verifier, err := spake2PasswordVerifier(u)
 		if err != nil {
 			return err
 		}
@@ -722,24 +1056,84 @@ func (tc *TransactionController) VerifyPasswordStepUp(ctx context.Context, state
 	})
 }
 
+// RequestMFAStepUp requests a MFA challenge for a step-up verification transaction.
+func (tc *TransactionController) RequestMFAStepUp(ctx context.Context, stateToken string, sessionID int64, method string, message []byte) (challenge verifier.Challenge, err error) {
+	_, err = tc.stateMutation(ctx, stateToken, StatusStepUp, func(state *State, u *user.User) error {
+		if sessionID != state.SessionID {
+			return errors.New(errors.ErrorPermissionDenied, "illegal state")
+		}
+
+		challenge, err = tc.requestSecondFactor(ctx, state, u, method, message)
+		return err
+	})
+	return
+}
+
+// VerifyMFAStepUp verifies a MFA factor to complete a step-up verification transaction.
+func (tc *TransactionController) VerifyMFAStepUp(ctx context.Context, stateToken string, sessionID int64, method string, response []byte) (state *State, err error) {
+	return tc.stateMutation(ctx, stateToken, StatusStepUp, func(state *State, u *user.User) error {
+		if sessionID != state.SessionID {
+			return errors.New(errors.ErrorPermissionDenied, "illegal state")
+		}
+
+		sess, err := tc.sessionStore.FindSessionByInternalID(ctx, state.SessionID)
+		if err != nil {
+			return err
+		}
+
+		return tc.db.RunInTransaction(ctx, func(tx *sqlx.Tx) error {
+			err := tc.store.CheckRateLimiter(ctx, u.ID)
+			if err != nil {
+				return errors.New(errors.ErrorUserTemporarilyBlocked, "too many authentication attempts")
+			}
+
+			err = tc.verifySecondFactor(ctx, state, u, method, response)
+			if err != nil {
+				return err
+			}
+
+			tx.Commit()
+
+			state.Status = StatusStepUpSuccess
+
+			sess.UpdateLastMFAVerifiedAt()
+			_, err = tc.sessionStore.UpdateSession(ctx, sess)
+			return err
+		})
+	})
+}
+
 // StartPasswordReset starts a password reset transaction.
 func (tc *TransactionController) StartPasswordReset(ctx context.Context, clientID, handle string) (state *State, err error) {
 	if handle == "" {
 		return nil, errors.New(errors.ErrorInvalidArgument, "user handle cannot be empty")
 	}
 
-	u, err := tc.userStore.UserByHandle(ctx, handle)
+	err = tc.store.CheckSourceRateLimiter(ctx, handle)
 	if err != nil {
 		return
 	}
 
-	if u.IsCurrentlyLocked() {
-		err = errors.New(errors.ErrorPermissionDenied, "user is locked")
+	clientApp, err := clientapp.GetByClientID(clientID)
+	if err != nil {
+		return
+	}
+	rule := clientApp.MatchIDPRoutingRule(handle, tc.idpRoutingRules)
+	if rule != nil && rule.BlockPassword {
+		err = errors.New(errors.ErrorPermissionDenied, "password authentication is disabled for this domain")
 		return
 	}
 
-	clientApp, err := clientapp.GetByClientID(clientID)
+	u, err := tc.userStore.UserByHandle(ctx, handle)
 	if err != nil {
+		if errors.IsKind(err, errors.ErrorNotFound) {
+			tc.store.IncrementSourceRateLimiter(ctx, handle)
+		}
+		return
+	}
+
+	if u.IsCurrentlyLocked() {
+		err = errors.New(errors.ErrorPermissionDenied, "user is locked")
 		return
 	}
 
@@ -812,6 +1206,9 @@ func (tc *TransactionController) VerifyPasswordReset(ctx context.Context, stateT
 			if err := tc.userStore.UpdateUser(ctx, u); err != nil {
 				return err
 			}
+			if err := tc.userStore.DeleteAllTrustedDevicesByUserID(ctx, u.ID); err != nil {
+				return err
+			}
 
 			log.GetLogger(ctx).WithFields(logrus.Fields{
 				"user_id": u.PublicID(),
@@ -823,11 +1220,142 @@ func (tc *TransactionController) VerifyPasswordReset(ctx context.Context, stateT
 	})
 }
 
+// ChangePassword sets a new password for a user who must change the password to complete the
+// authentication.
+func (tc *TransactionController) ChangePassword(ctx context.Context, stateToken, passwordVerifierJSON string) (*State, error) {
+	return tc.stateMutation(ctx, stateToken, StatusPasswordChangeRequired, func(state *State, u *user.User) error {
+		passwordVerifier, err := tc.verifierFactory.Unmarshal([]byte(passwordVerifierJSON))
+		if err != nil {
+			return errors.Wrap(err, errors.ErrorInvalidArgument, "invalid password verifier")
+		}
+		if err := u.UpdatePasswordWithVerifier(passwordVerifier); err != nil {
+			return err
+		}
+		if err := tc.userStore.UpdateUser(ctx, u); err != nil {
+			return err
+		}
+		if err := tc.userStore.DeleteAllTrustedDevicesByUserID(ctx, u.ID); err != nil {
+			return err
+		}
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"user_id": u.PublicID(),
+		}).Info("password changed")
+
+		state.ForcePasswordChange = false
+		return tc.mutateSuccess(ctx, state)
+	})
+}
+
 // RegisterIDP adds a third-party IDP
 func (tc *TransactionController) RegisterIDP(idp idp.IDP) {
 	tc.idpFactory.Register(idp)
 }
 
+// RegisterProvisioningRules sets the rules to provision users from the identities of an IDP.
+func (tc *TransactionController) RegisterProvisioningRules(idpID string, rules *idp.ProvisioningRules) {
+	tc.provisioningRules[strings.ToLower(idpID)] = rules
+}
+
+// RegisterIDPRoutingRules sets the global rules routing users to an IDP by the domain of their
+// email address.
+func (tc *TransactionController) RegisterIDPRoutingRules(rules []clientapp.IDPRoutingRule) {
+	tc.idpRoutingRules = rules
+}
+
+// idpProvisioningRules returns the provisioning rules of an IDP, or the default rules if none is
+// registered.
+func (tc *TransactionController) idpProvisioningRules(idpID string) *idp.ProvisioningRules {
+	if rules, ok := tc.provisioningRules[strings.ToLower(idpID)]; ok {
+		return rules
+	}
+	return &idp.ProvisioningRules{}
+}
+
+// syncIDPRoles assigns the roles mapped from the identity to the user and unassigns the other
+// roles managed by the rules.
+func (tc *TransactionController) syncIDPRoles(ctx context.Context, rules *idp.ProvisioningRules, u *user.User, ident *idp.Identity) error {
+	managedRoles := rules.ManagedRoles()
+	if len(managedRoles) == 0 {
+		return nil
+	}
+	return tc.userStore.SyncRoles(ctx, u.ID, managedRoles, rules.AssignedRoles(ident))
+}
+
+// requestSecondFactor requests a challenge of the second factor with the given method.
+func (tc *TransactionController) requestSecondFactor(ctx context.Context, state *State, u *user.User, method string, message []byte) (challenge verifier.Challenge, err error) {
+	factor, err := tc.getSecondFactor(ctx, u, method)
+	if err != nil {
+		return
+	}
+
+	v, err := factor.ToVerifier(tc.verifierFactory)
+	if err != nil {
+		return
+	}
+	if ev, ok := v.(verifier.EmailOTPVerifier); ok {
+		v = ev.WithLanguage(u.RealLanguage())
+	}
+
+	state.MFAMethod = v.Method()
+	state.MFAVerifierState, challenge, err = v.Request(message)
+	return
+}
+
+// verifySecondFactor verifies the response of the second factor with the given method. It must be
+// called in a database transaction.
+func (tc *TransactionController) verifySecondFactor(ctx context.Context, state *State, u *user.User, method string, response []byte) error {
+	factor, err := tc.getSecondFactor(ctx, u, method)
+	if err != nil {
+		return err
+	}
+
+	err = tc.userStore.LockSecondFactor(ctx, factor)
+	if err != nil {
+		return err
+	}
+
+	v, err := factor.ToVerifier(tc.verifierFactory)
+	if err != nil {
+		return err
+	}
+
+	if state.MFAMethod != "" && state.MFAMethod != v.Method() {
+		state.MFAVerifierState = nil
+	}
+
+	ok, updateVerifier := v.Verify(state.MFAVerifierState, response)
+	if !ok {
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"user_id": u.PublicID(),
+		}).Warn("MFA authentication rejected")
+		tc.store.IncrementRateLimiter(ctx, u.ID)
+		tc.store.IncrementSourceRateLimiter(ctx, state.Handle)
+		return errors.New(errors.ErrorPermissionDenied, "MFA authentication rejected")
+	}
+	log.GetLogger(ctx).WithFields(logrus.Fields{
+		"user_id": u.PublicID(),
+	}).Info("MFA authentication accepted")
+
+	_, err = tc.userStore.UpdateSecondFactorLastUsedAtByID(ctx, factor.ID)
+	if err != nil {
+		return err
+	}
+
+	if updateVerifier != nil {
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"user_id": u.PublicID(),
+		}).Info("updating second factor content")
+		factor.UpdateWithVerifier(updateVerifier)
+		_, err = tc.userStore.UpdateSecondFactorContent(ctx, factor)
+		if err != nil {
+			return err
+		}
+	}
+
+	state.MFAVerified = true
+	return nil
+}
+
 // ExchangeSession exchanges an authorization code for a session
 func (tc *TransactionController) ExchangeSession(ctx context.Context, clientID, redirectURI, code, codeVerifier string) (*session.Session, error) {
 	authorizationCode, err := tc.store.GetAuthorizationCode(ctx, code)
@@ -851,13 +1379,36 @@ func (tc *TransactionController) ExchangeSession(ctx context.Context, clientID,
 		return nil, errors.New(errors.ErrorPermissionDenied, "code_verifier mismatch")
 	}
 
-	_, err = tc.getUser(ctx, authorizationCode.UserID) // validates user
+	u, err := tc.getUser(ctx, authorizationCode.UserID) // validates user
 	if err != nil {
 		return nil, err
 	}
 
+	claims, err := tc.runHooks(ctx, hook.PreToken, authorizationCode.ClientID, u)
+	if err != nil {
+		return nil, err
+	}
+	claims = mergeClaims(authorizationCode.Claims, claims)
+
 	refreshToken := cryptoutil.RandomToken32()
-	return tc.sessionStore.CreateSession(ctx, authorizationCode.UserID, 0, authorizationCode.ClientID, refreshToken, authorizationCode.PasswordVerified)
+	sess, err := tc.sessionStore.CreateSession(ctx, authorizationCode.UserID, 0, authorizationCode.ClientID, refreshToken, authorizationCode.PasswordVerified)
+	if err != nil {
+		return nil, err
+	}
+	if authorizationCode.MFAVerified || len(claims) > 0 {
+		if authorizationCode.MFAVerified {
+			sess.UpdateLastMFAVerifiedAt()
+		}
+		if len(claims) > 0 {
+			sess.CustomClaims = nulls.NewJSON(claims)
+		}
+		sess, err = tc.sessionStore.UpdateSession(ctx, sess)
+		if err != nil {
+			return nil, err
+		}
+		sess.RefreshToken = refreshToken
+	}
+	return sess, nil
 }
 
 func (tc *TransactionController) stateMutation(ctx context.Context, stateToken, expectStatus string, mutateFunc func(*State, *user.User) error) (state *State, err error) {
@@ -871,7 +1422,7 @@ func (tc *TransactionController) stateMutation(ctx context.Context, stateToken,
 
 	var u *user.User
 	userID := ""
-	if state.Status != StatusIDP {
+	if state.Status != StatusIDP && state.Status != StatusEthereum && state.Status != StatusQRPending && !isLDAPState(state) {
 		u, err = tc.userStore.UserByID(ctx, state.UserID)
 		if err != nil {
 			return
@@ -965,6 +1516,13 @@ func (tc *TransactionController) mutateSuccess(ctx context.Context, state *State
 		err = errors.New(errors.ErrorPermissionDenied, "illegal state")
 		return
 	}
+	if state.ForcePasswordChange {
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"user_id": state.UserID,
+		}).Info("password change required")
+		state.Status = StatusPasswordChangeRequired
+		return
+	}
 	log.GetLogger(ctx).WithFields(logrus.Fields{
 		"user_id": state.UserID,
 	}).Info("authentication completed successfully")
@@ -972,10 +1530,18 @@ func (tc *TransactionController) mutateSuccess(ctx context.Context, state *State
 	code := state.GenerateAuthorizationCode()
 
 	err = tc.store.PutAuthorizationCode(ctx, code)
+	if err != nil {
+		return
+	}
+	if tc.riskEngine.Enabled() {
+		err = tc.riskEngine.RecordSuccess(ctx, state.UserID)
+	}
 	return
 }
 
-func (tc *TransactionController) mutateIDPAlreadyExists(ctx context.Context, state *State, u *user.User) error {
+// mutateIDPAlreadyExists keeps the IDP identity in the state so that it can be linked to u once the
+// user proves the ownership of u with one of the factors listed.
+func (tc *TransactionController) mutateIDPAlreadyExists(ctx context.Context, state *State, u *user.User, ident *idp.Identity) error {
 	// Search for OAuth factors to decide whether to notify the user to sign in with that factor or using password
 	oauthFactors, err := tc.userStore.FindAllOAuthFactorsByUserID(ctx, u.ID)
 	if err != nil {
@@ -990,8 +1556,23 @@ func (tc *TransactionController) mutateIDPAlreadyExists(ctx context.Context, sta
 		state.AppendFactor("idp_" + identifier)
 	}
 	if u.IsPasswordAuthenticationEnabled() {
-		state.AppendFactor(verifier.SPAKE2Plus)
+		passwordVerifier, err := u.PasswordVerifier()
+		if err != nil {
+			return err
+		}
+		state.AppendFactor(passwordVerifier.Method())
+		state.PasswordMethod = passwordVerifier.Method()
+		state.PasswordSalt = passwordVerifier.Salt()
+	}
+	secondFactors, err := tc.userStore.FindAllSecondFactorsByUserID(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	if u.EmailVerified() && len(*secondFactors) == 0 {
+		state.AppendFactor(verifier.EmailOTP)
 	}
+	state.UserID = u.ID
+	state.IDPIdentity = ident
 	state.Status = StatusIDPAlreadyExists
 	return nil
 }
@@ -21,11 +21,13 @@ import (
 	"authcore.io/authcore/internal/testutil"
 	"authcore.io/authcore/internal/user"
 	"authcore.io/authcore/pkg/cryptoutil"
+	"authcore.io/authcore/pkg/nulls"
 
 	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/hotp"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestMain(m *testing.M) {
@@ -41,21 +43,49 @@ func tcForTest() (*TransactionController, func()) {
 	viper.Set("base_path", "../..")
 	viper.Set("applications.app.name", "app")
 	viper.Set("applications.app.allowed_callback_urls", []string{"https://example.com"})
+	viper.Set("applications.b2b.name", "b2b")
+	viper.Set("applications.b2b.allowed_callback_urls", []string{"https://example.com"})
+	viper.Set("applications.b2b.sign_up_allowed_domains", []string{"example.com"})
+	viper.Set("applications.b2b.sign_up_denied_domains", []string{"contractors.example.com"})
+	viper.Set("applications.invite.name", "invite")
+	viper.Set("applications.invite.allowed_callback_urls", []string{"https://example.com"})
+	viper.Set("applications.invite.invitation_only", true)
+	viper.Set("applications.expiring.name", "expiring")
+	viper.Set("applications.expiring.allowed_callback_urls", []string{"https://example.com"})
+	viper.Set("applications.expiring.max_password_age", "720h")
+	viper.Set("applications.hrd.name", "hrd")
+	viper.Set("applications.hrd.allowed_callback_urls", []string{"https://example.com"})
+	viper.Set("applications.hrd.idp_routing_rules", []map[string]interface{}{
+		{"domains": []string{"example.com"}, "idp": "mock"},
+		{"domains": []string{"partner.com"}, "idp": "mock", "block_password": true},
+		{"domains": []string{"broken.com"}, "idp": "unknown"},
+	})
+	viper.Set("applications.staff.name", "staff")
+	viper.Set("applications.staff.allowed_callback_urls", []string{"https://example.com"})
+	viper.Set("applications.staff.ldap_enabled", true)
+	viper.Set("applications.web3.name", "web3")
+	viper.Set("applications.web3.allowed_callback_urls", []string{"https://example.com"})
+	viper.Set("applications.web3.ethereum_enabled", true)
+	viper.Set("applications.qr.name", "qr")
+	viper.Set("applications.qr.allowed_callback_urls", []string{"https://example.com"})
+	viper.Set("applications.qr.qr_sign_in_enabled", true)
 	config.InitConfig()
 
 	testutil.FixturesSetUp()
 	d := db.NewDBFromConfig()
 	redis := testutil.RedisForTest()
+	kv := testutil.KVStoreForTest()
 	encryptor := testutil.EncryptorForTest()
-	store := NewStore(redis, encryptor)
-	userStore := user.NewStore(d, redis, encryptor)
+	store := NewStore(kv, encryptor)
+	userStore := user.NewStore(d, kv, encryptor)
 	sessionStore := session.NewStore(d, redis, userStore)
 	templateStore := template.NewStore(d)
 	smsService := sms.NewService(templateStore)
 	emailService := email.NewService(templateStore)
 	tc := NewTransactionController(d, store, userStore, sessionStore)
-	tc.RegisterVerifier(verifier.SMSOTP, verifier.SMSOTPVerifierFactory(smsService, redis))
-	tc.RegisterVerifier(verifier.ResetLink, verifier.ResetLinkVerifierFactory(smsService, emailService, redis))
+	tc.RegisterVerifier(verifier.SMSOTP, verifier.SMSOTPVerifierFactory(smsService, kv))
+	tc.RegisterVerifier(verifier.EmailOTP, verifier.EmailOTPVerifierFactory(emailService, kv))
+	tc.RegisterVerifier(verifier.ResetLink, verifier.ResetLinkVerifierFactory(smsService, emailService, kv))
 	tc.RegisterIDP(new(mockIDP))
 
 	return tc, func() {
@@ -65,6 +95,133 @@ func tcForTest() (*TransactionController, func()) {
 	}
 }
 
+func TestStartPrimaryIDPRouting(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	// Users with a password are not routed unless password authentication is blocked
+	state, err := tc.StartPrimary(ctx, "hrd", "carol@example.com", "https://example.com/", "", "", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusPrimary, state.Status)
+		assert.Equal(t, []string{FactorPassword}, state.Factors)
+	}
+
+	state, err = tc.StartPrimary(ctx, "hrd", "newcomer@example.com", "https://example.com/", "", "", "state")
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusIDPRedirect, state.Status)
+		assert.Equal(t, "mock", state.IDP)
+		assert.Equal(t, "state", state.ClientState)
+	}
+
+	state, err = tc.StartPrimary(ctx, "hrd", "carol@partner.com", "https://example.com/", "", "", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusIDPRedirect, state.Status)
+		assert.Equal(t, "mock", state.IDP)
+	}
+	_, err = tc.StartPasswordReset(ctx, "hrd", "carol@partner.com")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	_, err = tc.StartPrimary(ctx, "hrd", "carol@broken.com", "https://example.com/", "", "", "")
+	assert.True(t, errors.IsKind(err, errors.ErrorFailedPrecondition))
+
+	// Other clients are not affected
+	_, err = tc.StartPrimary(ctx, "app", "newcomer@example.com", "https://example.com/", "", "", "")
+	assert.True(t, errors.IsKind(err, errors.ErrorNotFound))
+}
+
+func TestVerifyLegacyPassword(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	u := &user.User{Email: nulls.NewString("legacy@example.com")}
+	assert.NoError(t, u.SetLegacyPasswordHash(string(hash)))
+	assert.NoError(t, tc.userStore.InsertUser(ctx, u))
+	assert.True(t, u.IsPasswordAuthenticationEnabled())
+
+	state, err := tc.StartPrimary(ctx, "app", "legacy@example.com", "https://example.com/", "", "", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusPrimary, state.Status)
+		assert.Equal(t, verifier.LegacyPassword, state.PasswordMethod)
+		assert.Empty(t, state.PasswordSalt)
+	}
+	_, err = tc.RequestPassword(ctx, state.StateToken, []byte("message"))
+	assert.True(t, errors.IsKind(err, errors.ErrorFailedPrecondition))
+
+	_, err = tc.VerifyLegacyPassword(ctx, state.StateToken, []byte("wrong password"))
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	state, err = tc.VerifyLegacyPassword(ctx, state.StateToken, []byte("password"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusSuccess, state.Status)
+	}
+
+	// The legacy hash is replaced by a SPAKE2+ verifier
+	u, err = tc.userStore.UserByID(ctx, u.ID)
+	assert.NoError(t, err)
+	assert.False(t, u.LegacyPasswordHash.Valid)
+	state = verifyPasswordForTest(ctx, t, tc, "legacy@example.com")
+	assert.Equal(t, StatusSuccess, state.Status)
+
+	state, err = tc.StartPrimary(ctx, "app", "legacy@example.com", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	_, err = tc.VerifyLegacyPassword(ctx, state.StateToken, []byte("password"))
+	assert.True(t, errors.IsKind(err, errors.ErrorFailedPrecondition))
+}
+
+func TestPasswordChangeRequired(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	u, err := tc.userStore.UserByEmail(ctx, "carol@example.com")
+	assert.NoError(t, err)
+	u.PasswordChangeRequired = true
+	assert.NoError(t, tc.userStore.UpdateUser(ctx, u))
+
+	state := verifyPasswordForTest(ctx, t, tc, "carol@example.com")
+	assert.Equal(t, StatusPasswordChangeRequired, state.Status)
+	assert.Empty(t, state.AuthorizationCode)
+
+	_, err = tc.ChangePassword(ctx, state.StateToken, `{"method":"totp"}`)
+	assert.Error(t, err)
+	state, err = tc.ChangePassword(ctx, state.StateToken, testSignUpVerifierJSON)
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusSuccess, state.Status)
+		assert.NotEmpty(t, state.AuthorizationCode)
+	}
+	_, err = tc.ChangePassword(ctx, state.StateToken, testSignUpVerifierJSON)
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	u, err = tc.userStore.UserByID(ctx, u.ID)
+	assert.NoError(t, err)
+	assert.False(t, u.PasswordChangeRequired)
+	assert.True(t, u.PasswordChangedAt.Valid)
+}
+
+func TestMaxPasswordAge(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	u, err := tc.userStore.UserByEmail(ctx, "carol@example.com")
+	assert.NoError(t, err)
+	u.PasswordChangedAt = nulls.NewTime(time.Now().Add(-31 * 24 * time.Hour))
+	assert.NoError(t, tc.userStore.UpdateUser(ctx, u))
+
+	state := verifyClientPasswordForTest(ctx, t, tc, "app", "carol@example.com")
+	assert.Equal(t, StatusSuccess, state.Status)
+	state = verifyClientPasswordForTest(ctx, t, tc, "expiring", "carol@example.com")
+	assert.Equal(t, StatusPasswordChangeRequired, state.Status)
+
+	u.PasswordChangedAt = nulls.NewTime(time.Now().Add(-29 * 24 * time.Hour))
+	assert.NoError(t, tc.userStore.UpdateUser(ctx, u))
+	state = verifyClientPasswordForTest(ctx, t, tc, "expiring", "carol@example.com")
+	assert.Equal(t, StatusSuccess, state.Status)
+}
+
 func TestPrimaryPassword(t *testing.T) {
 	tc, teardown := tcForTest()
 	defer teardown()
@@ -500,7 +657,7 @@ func TestPrimaryAndTOTP(t *testing.T) {
 
 	// Step 3
 	code := cryptoutil.GetTOTPPin("THISISAWEAKTOTPSECRETFORTESTSXX2", time.Now())
-	state3, err := tc.VerifyMFA(ctx, state.StateToken, "totp", []byte(code))
+	state3, err := tc.VerifyMFA(ctx, state.StateToken, "totp", []byte(code), false)
 	assert.NoError(t, err)
 	assert.Equal(t, "SUCCESS", state3.Status)
 	assert.NotEmpty(t, state3.AuthorizationCode)
@@ -518,6 +675,8 @@ func TestPrimaryAndTOTP(t *testing.T) {
 	assert.Equal(t, int64(3), sess.UserID)
 	assert.Equal(t, "app", sess.ClientID.String)
 	assert.True(t, sess.LastPasswordVerifiedAt.Valid)
+	assert.True(t, sess.LastMFAVerifiedAt.Valid)
+	assert.NotEmpty(t, sess.RefreshToken)
 }
 
 func TestPrimaryAndSMS(t *testing.T) {
@@ -572,7 +731,7 @@ func TestPrimaryAndSMS(t *testing.T) {
 	code := smsCode["code"].(string)
 
 	// Step 4
-	state4, err := tc.VerifyMFA(ctx, state.StateToken, "sms_otp", []byte(code))
+	state4, err := tc.VerifyMFA(ctx, state.StateToken, "sms_otp", []byte(code), false)
 	assert.NoError(t, err)
 	assert.Equal(t, "SUCCESS", state4.Status)
 	assert.NotEmpty(t, state4.AuthorizationCode)
@@ -629,7 +788,7 @@ func TestPrimaryAndBackupCode(t *testing.T) {
 		Digits:    otp.DigitsEight,
 		Algorithm: otp.AlgorithmSHA1,
 	})
-	state3, err := tc.VerifyMFA(ctx, state.StateToken, "backup_code", []byte(code))
+	state3, err := tc.VerifyMFA(ctx, state.StateToken, "backup_code", []byte(code), false)
 	assert.NoError(t, err)
 	assert.Equal(t, "SUCCESS", state3.Status)
 	assert.NotEmpty(t, state3.AuthorizationCode)
@@ -659,7 +818,7 @@ func TestPrimaryAndBackupCode(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Step 3
-	_, err = tc.VerifyMFA(ctx, state4.StateToken, "backup_code", []byte(code))
+	_, err = tc.VerifyMFA(ctx, state4.StateToken, "backup_code", []byte(code), false)
 	assert.Error(t, err)
 	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
 
@@ -702,19 +861,19 @@ func TestPrimaryAndInvalidMFA(t *testing.T) {
 	assert.Empty(t, state2.AuthorizationCode)
 
 	// Invalid TOTP
-	_, err = tc.VerifyMFA(ctx, state.StateToken, "totp", []byte{})
+	_, err = tc.VerifyMFA(ctx, state.StateToken, "totp", []byte{}, false)
 	assert.Error(t, err)
 
 	// Invalid TOTP
-	_, err = tc.VerifyMFA(ctx, state.StateToken, "totp", []byte{0x00, 0x00, 0x00})
+	_, err = tc.VerifyMFA(ctx, state.StateToken, "totp", []byte{0x00, 0x00, 0x00}, false)
 	assert.Error(t, err)
 
 	// Non-existent factor
-	_, err = tc.VerifyMFA(ctx, state.StateToken, "backup_code", []byte{})
+	_, err = tc.VerifyMFA(ctx, state.StateToken, "backup_code", []byte{}, false)
 	assert.Error(t, err)
 
 	// Invalid factor name
-	_, err = tc.VerifyMFA(ctx, state.StateToken, "invalid", []byte{})
+	_, err = tc.VerifyMFA(ctx, state.StateToken, "invalid", []byte{}, false)
 	assert.Error(t, err)
 
 	// Check state
@@ -760,7 +919,7 @@ func TestVerifyTOTPInvalidState(t *testing.T) {
 
 	// VerifyMFA without verifying password
 	code := cryptoutil.GetTOTPPin("THISISAWEAKTOTPSECRETFORTESTSXX2", time.Now())
-	_, err = tc.VerifyMFA(ctx, state.StateToken, "totp", []byte(code))
+	_, err = tc.VerifyMFA(ctx, state.StateToken, "totp", []byte(code), false)
 	assert.Error(t, err)
 
 	// Check state
@@ -785,7 +944,7 @@ func TestSignUp(t *testing.T) {
 		"l": "89obToiiylZJ2bWw9neAUtD+Xvu/zhhj+HHzQveMHMUNhFZh719/tYgBRvp2LRflO6Rko9q7bUCCRgz4mSBYSibpmCo9y8GoFvWBarSUu+dBqAh2OMVT/ifCPAu2qLqdFJQZRAzM"
 	}
 	`
-	state, err := tc.SignUp(ctx, "app", "https://example.com/", "testsignup@example.com", "", verifierJSON, "", "en")
+	state, err := tc.SignUp(ctx, "app", "https://example.com/", "testsignup@example.com", "", verifierJSON, "", "en", "", "", "")
 	assert.NoError(t, err)
 	assert.NotEmpty(t, state.StateToken)
 	assert.Equal(t, "SUCCESS", state.Status)
@@ -804,15 +963,87 @@ func TestSignUp(t *testing.T) {
 	assert.True(t, u.IsPasswordAuthenticationEnabled())
 
 	// Test missing fields
-	_, err = tc.SignUp(ctx, "app", "https://example.com/", "", "", verifierJSON, "", "")
+	_, err = tc.SignUp(ctx, "app", "https://example.com/", "", "", verifierJSON, "", "", "", "", "")
 	assert.Error(t, err)
 
 	// Test create account disabled
 	viper.Set("sign_up_enabled", false)
-	_, err = tc.SignUp(ctx, "app", "https://example.com/", "testsignup@example.com", "", verifierJSON, "", "en")
+	_, err = tc.SignUp(ctx, "app", "https://example.com/", "testsignup@example.com", "", verifierJSON, "", "en", "", "", "")
 	assert.Error(t, err)
 }
 
+func TestSignUpInvitation(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	// The client only allows invited users
+	_, err := tc.SignUp(ctx, "invite", "https://example.com/", "invitee@example.com", "", testSignUpVerifierJSON, "", "en", "", "", "")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	invitation, token, err := tc.userStore.CreateInvitation(ctx, &user.Invitation{
+		Email:     "invitee2@example.com",
+		ClientID:  "invite",
+		RoleIDs:   user.RoleIDs{2},
+		ExpiredAt: time.Now().Add(time.Hour),
+	})
+	assert.NoError(t, err)
+
+	// The email address must match the invitation
+	_, err = tc.SignUp(ctx, "invite", "https://example.com/", "other@example.com", "", testSignUpVerifierJSON, "", "en", token, "", "")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	// Invitations are accepted even if sign-up is disabled
+	viper.Set("sign_up_enabled", false)
+	state, err := tc.SignUp(ctx, "invite", "https://example.com/", "Invitee2@example.com", "", testSignUpVerifierJSON, "", "en", token, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSuccess, state.Status)
+
+	u, err := tc.userStore.UserByID(ctx, state.UserID)
+	assert.NoError(t, err)
+	assert.True(t, u.EmailVerifiedAt.Valid)
+	roles, err := tc.userStore.FindAllRolesByUserID(ctx, u.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, *roles, 1) {
+		assert.Equal(t, "authcore.editor", (*roles)[0].Name)
+	}
+	invitation, err = tc.userStore.FindInvitationByID(ctx, invitation.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, u.ID, invitation.AcceptedBy.Int64)
+
+	// The invitation is used
+	_, err = tc.SignUp(ctx, "invite", "https://example.com/", "invitee2@example.com", "", testSignUpVerifierJSON, "", "en", token, "", "")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+}
+
+func TestSignUpDomainRestricted(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := tc.SignUp(ctx, "b2b", "https://example.com/", "someone@gmail.com", "", testSignUpVerifierJSON, "", "en", "", "", "")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	_, err = tc.SignUp(ctx, "b2b", "https://example.com/", "someone@contractors.example.com", "", testSignUpVerifierJSON, "", "en", "", "", "")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	_, err = tc.SignUp(ctx, "b2b", "https://example.com/", "", "+85223456789", testSignUpVerifierJSON, "", "en", "", "", "")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	state, err := tc.SignUp(ctx, "b2b", "https://example.com/", "someone@example.com", "", testSignUpVerifierJSON, "", "en", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSuccess, state.Status)
+
+	// Just-in-time creation from IDP is restricted in the same way
+	state, err = tc.StartIDP(ctx, "b2b", "mock", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	_, err = tc.VerifyIDP(ctx, state.StateToken, "someone@gmail.com")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	state, err = tc.StartIDP(ctx, "b2b", "mock", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	state, err = tc.VerifyIDP(ctx, state.StateToken, "idp@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusSuccess, state.Status)
+}
+
 func TestVerifyIDPSuccess(t *testing.T) {
 	tc, teardown := tcForTest()
 	defer teardown()
@@ -887,7 +1118,7 @@ func TestVerifyIDPNewUser(t *testing.T) {
 	assert.NotEmpty(t, code.UserID)
 
 	// Check registered user
-	oauthService := user.OAuthService(999)
+	oauthService := user.OAuthService("mock")
 	oauthFactor, err := tc.userStore.FindOAuthFactorByOAuthIdentity(ctx, oauthService, "newuser@example.com")
 	assert.NoError(t, err)
 	assert.Equal(t, code.UserID, oauthFactor.UserID)
@@ -898,6 +1129,96 @@ func TestVerifyIDPNewUser(t *testing.T) {
 	assert.False(t, u.IsPasswordAuthenticationEnabled())
 }
 
+func TestVerifyIDPProvisioningRules(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	provider, err := tc.idpFactory.IDP("mock")
+	if !assert.NoError(t, err) {
+		return
+	}
+	mock := provider.(*mockIDP)
+	mock.claims = map[string]interface{}{
+		"department": "Engineering",
+		"groups":     []interface{}{"admins"},
+	}
+	tc.RegisterProvisioningRules("mock", &idp.ProvisioningRules{
+		Metadata: []idp.MetadataMapping{
+			{Claim: "department", Field: "app_metadata.department"},
+		},
+		Roles: []idp.RoleMapping{
+			{Claim: "groups", Value: "admins", Role: "authcore.admin"},
+		},
+	})
+	verifyIDP := func(code string) *State {
+		state, err := tc.StartIDP(ctx, "app", "mock", "https://example.com/", "", "", "")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		state, err = tc.VerifyIDP(ctx, state.StateToken, code)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return state
+	}
+
+	// Claims are mapped when the user is created
+	state := verifyIDP("provisioned@example.com")
+	assert.Equal(t, "SUCCESS", state.Status)
+	u, err := tc.userStore.UserByID(ctx, state.UserID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, u.EmailVerified())
+	assert.Equal(t, map[string]interface{}{"department": "Engineering"}, u.AppMetadata.Struct)
+	roles, err := tc.userStore.FindAllRolesByUserID(ctx, u.ID)
+	if assert.NoError(t, err) && assert.Len(t, *roles, 1) {
+		assert.Equal(t, "authcore.admin", (*roles)[0].Name)
+	}
+
+	// Attributes are not updated on login by default
+	mock.claims = map[string]interface{}{"department": "Finance"}
+	state = verifyIDP("provisioned@example.com")
+	assert.Equal(t, u.ID, state.UserID)
+	roles, err = tc.userStore.FindAllRolesByUserID(ctx, u.ID)
+	if assert.NoError(t, err) {
+		assert.Len(t, *roles, 1)
+	}
+
+	// Attributes and roles are updated on every login
+	tc.RegisterProvisioningRules("mock", &idp.ProvisioningRules{
+		UpdateOnLogin: true,
+		Metadata: []idp.MetadataMapping{
+			{Claim: "department", Field: "app_metadata.department"},
+		},
+		Roles: []idp.RoleMapping{
+			{Claim: "groups", Value: "admins", Role: "authcore.admin"},
+		},
+	})
+	state = verifyIDP("provisioned@example.com")
+	assert.Equal(t, u.ID, state.UserID)
+	u, err = tc.userStore.UserByID(ctx, u.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]interface{}{"department": "Finance"}, u.AppMetadata.Struct)
+	}
+	roles, err = tc.userStore.FindAllRolesByUserID(ctx, u.ID)
+	if assert.NoError(t, err) {
+		assert.Empty(t, *roles)
+	}
+
+	// Untrusted email_verified is neither verified nor matched with existing users
+	untrusted := false
+	tc.RegisterProvisioningRules("mock", &idp.ProvisioningRules{TrustEmailVerified: &untrusted})
+	state = verifyIDP("untrusted@example.com")
+	assert.Equal(t, "SUCCESS", state.Status)
+	u, err = tc.userStore.UserByID(ctx, state.UserID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "untrusted@example.com", u.Email.String)
+		assert.False(t, u.EmailVerified())
+	}
+}
+
 func TestVerifyIDPNewUserWhenNotAllowed(t *testing.T) {
 	tc, teardown := tcForTest()
 	defer teardown()
@@ -931,7 +1252,179 @@ func TestVerifyIDPAlreadyExists(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "IDP_ALREADY_EXISTS", state3.Status)
 	assert.Equal(t, "mock", state3.IDP)
-	assert.Equal(t, []string{"spake2plus"}, state3.Factors)
+	assert.Equal(t, []string{"spake2plus", "email_otp"}, state3.Factors)
+	assert.Equal(t, "spake2plus", state3.PasswordMethod)
+	assert.NotEmpty(t, state3.PasswordSalt)
+}
+
+func TestVerifyIDPLink(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	state, err := tc.StartIDP(ctx, "app", "mock", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	state, err = tc.VerifyIDP(ctx, state.StateToken, "carol@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusIDPAlreadyExists, state.Status)
+
+	// Unsupported and mismatched methods
+	_, err = tc.RequestIDPLink(ctx, state.StateToken, "sms_otp", nil)
+	assert.Error(t, err)
+	_, err = tc.VerifyIDPLink(ctx, state.StateToken, "legacy_password", []byte("password"))
+	if assert.Error(t, err) {
+		assert.True(t, errors.IsKind(err, errors.ErrorFailedPrecondition))
+	}
+	_, err = tc.VerifyIDPLink(ctx, state.StateToken, "email_otp", []byte("123456"))
+	if assert.Error(t, err) {
+		assert.True(t, errors.IsKind(err, errors.ErrorFailedPrecondition))
+	}
+
+	// Wrong password
+	spake2, err := verifier.NewSPAKE2Plus()
+	assert.NoError(t, err)
+	cs, message, err := spake2.StartClient([]byte("authcoreuser"), []byte("authcore"), []byte("wrong"), state.PasswordSalt, nil)
+	assert.NoError(t, err)
+	challenge, err := tc.RequestIDPLink(ctx, state.StateToken, "spake2plus", message)
+	assert.NoError(t, err)
+	sk, err := cs.Finish(challenge)
+	assert.NoError(t, err)
+	_, err = tc.VerifyIDPLink(ctx, state.StateToken, "spake2plus", sk.GetConfirmation())
+	assert.Error(t, err)
+
+	// Correct password
+	cs, message, err = spake2.StartClient([]byte("authcoreuser"), []byte("authcore"), []byte("password"), state.PasswordSalt, nil)
+	assert.NoError(t, err)
+	challenge, err = tc.RequestIDPLink(ctx, state.StateToken, "spake2plus", message)
+	assert.NoError(t, err)
+	sk, err = cs.Finish(challenge)
+	assert.NoError(t, err)
+	state, err = tc.VerifyIDPLink(ctx, state.StateToken, "spake2plus", sk.GetConfirmation())
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusSuccess, state.Status)
+		assert.Equal(t, int64(2), state.UserID)
+		assert.True(t, state.PasswordVerified)
+		assert.Nil(t, state.IDPIdentity)
+		assert.NotEmpty(t, state.AuthorizationCode)
+	}
+
+	// The state cannot be reused
+	_, err = tc.VerifyIDPLink(ctx, state.StateToken, "spake2plus", sk.GetConfirmation())
+	assert.Error(t, err)
+
+	// The IDP is linked with the user
+	state, err = tc.StartIDP(ctx, "app", "mock", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	state, err = tc.VerifyIDP(ctx, state.StateToken, "carol@example.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusSuccess, state.Status)
+		assert.Equal(t, int64(2), state.UserID)
+	}
+}
+
+func TestVerifyIDPLinkWithMFA(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	state, err := tc.StartIDP(ctx, "app", "mock", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	state, err = tc.VerifyIDP(ctx, state.StateToken, "factor@example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, StatusIDPAlreadyExists, state.Status)
+	assert.Equal(t, []string{"spake2plus"}, state.Factors)
+
+	// Email OTP cannot prove the ownership of a user with second factors
+	_, err = tc.RequestIDPLink(ctx, state.StateToken, "email_otp", nil)
+	assert.True(t, errors.IsKind(err, errors.ErrorFailedPrecondition))
+
+	spake2, err := verifier.NewSPAKE2Plus()
+	assert.NoError(t, err)
+	cs, message, err := spake2.StartClient([]byte("authcoreuser"), []byte("authcore"), []byte("password"), state.PasswordSalt, nil)
+	assert.NoError(t, err)
+	challenge, err := tc.RequestIDPLink(ctx, state.StateToken, "spake2plus", message)
+	assert.NoError(t, err)
+	sk, err := cs.Finish(challenge)
+	assert.NoError(t, err)
+	state, err = tc.VerifyIDPLink(ctx, state.StateToken, "spake2plus", sk.GetConfirmation())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, StatusMFARequired, state.Status)
+	assert.Equal(t, []string{"totp", "backup_code"}, state.Factors)
+	assert.False(t, state.IDPLinked)
+	assert.Empty(t, state.AuthorizationCode)
+
+	// The IDP is not linked before MFA is verified
+	state2, err := tc.StartIDP(ctx, "app", "mock", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	state2, err = tc.VerifyIDP(ctx, state2.StateToken, "factor@example.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusIDPAlreadyExists, state2.Status)
+	}
+
+	code := cryptoutil.GetTOTPPin("THISISAWEAKTOTPSECRETFORTESTSXX2", time.Now())
+	state, err = tc.VerifyMFA(ctx, state.StateToken, "totp", []byte(code), false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusSuccess, state.Status)
+		assert.Equal(t, int64(3), state.UserID)
+		assert.True(t, state.IDPLinked)
+		assert.Nil(t, state.IDPIdentity)
+		assert.NotEmpty(t, state.AuthorizationCode)
+	}
+
+	// The IDP is linked with the user
+	state, err = tc.StartIDP(ctx, "app", "mock", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	state, err = tc.VerifyIDP(ctx, state.StateToken, "factor@example.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusSuccess, state.Status)
+		assert.Equal(t, int64(3), state.UserID)
+	}
+}
+
+func TestVerifyIDPLinkRiskBlock(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	viper.Set("risk_engine_enabled", true)
+	viper.Set("risk_rules", map[string]string{RiskSignalNewDevice: RiskBlock})
+	ctx := WithDeviceID(context.Background(), "device")
+
+	state, err := tc.StartIDP(ctx, "app", "mock", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	state, err = tc.VerifyIDP(ctx, state.StateToken, "factor@example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, StatusIDPAlreadyExists, state.Status)
+
+	spake2, err := verifier.NewSPAKE2Plus()
+	assert.NoError(t, err)
+	cs, message, err := spake2.StartClient([]byte("authcoreuser"), []byte("authcore"), []byte("password"), state.PasswordSalt, nil)
+	assert.NoError(t, err)
+	challenge, err := tc.RequestIDPLink(ctx, state.StateToken, "spake2plus", message)
+	assert.NoError(t, err)
+	sk, err := cs.Finish(challenge)
+	assert.NoError(t, err)
+	state, err = tc.VerifyIDPLink(ctx, state.StateToken, "spake2plus", sk.GetConfirmation())
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusBlocked, state.Status)
+		assert.Equal(t, []string{RiskSignalNewDevice}, state.Risk.Reasons)
+		assert.False(t, state.IDPLinked)
+	}
+
+	// The IDP is not linked
+	code := cryptoutil.GetTOTPPin("THISISAWEAKTOTPSECRETFORTESTSXX2", time.Now())
+	_, err = tc.VerifyMFA(ctx, state.StateToken, "totp", []byte(code), false)
+	assert.Error(t, err)
+	state, err = tc.StartIDP(ctx, "app", "mock", "https://example.com/", "", "", "")
+	assert.NoError(t, err)
+	state, err = tc.VerifyIDP(ctx, state.StateToken, "factor@example.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, StatusIDPAlreadyExists, state.Status)
+	}
 }
 
 func TestIDPBinding(t *testing.T) {
@@ -975,7 +1468,7 @@ func TestIDPBinding(t *testing.T) {
 	assert.Equal(t, "IDP_BINDING_SUCCESS", state5.Status)
 	assert.Empty(t, state5.AuthorizationCode)
 
-	oauthService := user.OAuthService(999)
+	oauthService := user.OAuthService("mock")
 	oauthFactor, err := tc.userStore.FindOAuthFactorByOAuthIdentity(ctx, oauthService, "bob@example.com")
 	assert.NoError(t, err)
 	assert.Equal(t, int64(1), oauthFactor.UserID)
@@ -1031,6 +1524,54 @@ func TestPasswordStepUp(t *testing.T) {
 	assert.True(t, sess.LastPasswordVerifiedAt.Valid)
 }
 
+func TestMFAStepUp(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	sess, err := tc.sessionStore.CreateSession(ctx, 3, 0, "app", "", false)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Step 1
+	state, err := tc.StartStepUp(ctx, sess.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "STEP_UP", state.Status)
+	assert.Equal(t, []string{"password", "totp", "backup_code"}, state.Factors)
+
+	// Another session
+	code := cryptoutil.GetTOTPPin("THISISAWEAKTOTPSECRETFORTESTSXX2", time.Now())
+	_, err = tc.VerifyMFAStepUp(ctx, state.StateToken, 6, "totp", []byte(code))
+	assert.Error(t, err)
+
+	// Invalid TOTP
+	_, err = tc.VerifyMFAStepUp(ctx, state.StateToken, sess.ID, "totp", []byte("000000"))
+	assert.Error(t, err)
+
+	// Step 2
+	state2, err := tc.VerifyMFAStepUp(ctx, state.StateToken, sess.ID, "totp", []byte(code))
+	assert.NoError(t, err)
+	assert.Equal(t, "STEP_UP_SUCCESS", state2.Status)
+	assert.Empty(t, state2.AuthorizationCode)
+	assert.True(t, state2.MFAVerified)
+
+	sess, err = tc.sessionStore.FindSessionByInternalID(ctx, sess.ID)
+	assert.NoError(t, err)
+	assert.False(t, sess.LastPasswordVerifiedAt.Valid)
+	assert.True(t, sess.LastMFAVerifiedAt.Valid)
+}
+
+func TestStepUpWithoutFactor(t *testing.T) {
+	tc, teardown := tcForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	// User 1 has neither password nor second factors
+	_, err := tc.StartStepUp(ctx, 1)
+	assert.Error(t, err)
+}
+
 func TestPasswordReset(t *testing.T) {
 	tc, teardown := tcForTest()
 	defer teardown()
@@ -1073,7 +1614,10 @@ func TestPasswordReset(t *testing.T) {
 	assert.Equal(t, "PASSWORD_RESET_SUCCESS", state3.Status)
 }
 
-type mockIDP struct{}
+type mockIDP struct {
+	claims  map[string]interface{}
+	revoked []*idp.AuthorizationGrant
+}
 
 func (p *mockIDP) ID() string {
 	return "mock"
@@ -1097,6 +1641,24 @@ func (p *mockIDP) Exchange(ctx context.Context, state idp.State, code string) (*
 			PreferredUsername: "mock_username",
 			Email:             code,
 			EmailVerified:     true,
+			Claims:            p.claims,
 		},
 	}, nil
 }
+
+func (p *mockIDP) Refresh(ctx context.Context, grant *idp.AuthorizationGrant) (*idp.AuthorizationGrant, error) {
+	if grant.RefreshToken != "mock_refresh_token" {
+		return nil, errors.New(errors.ErrorPermissionDenied, "invalid refresh token")
+	}
+	return &idp.AuthorizationGrant{
+		AccessToken:  "mock_refreshed_access_token",
+		TokenType:    "bearer",
+		RefreshToken: grant.RefreshToken,
+		Expiry:       time.Now().Add(time.Hour),
+	}, nil
+}
+
+func (p *mockIDP) Revoke(ctx context.Context, grant *idp.AuthorizationGrant) error {
+	p.revoked = append(p.revoked, grant)
+	return nil
+}
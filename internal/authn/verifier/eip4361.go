@@ -0,0 +1,215 @@
+package verifier
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// EIP4361 represents a Sign-In with Ethereum verifier.
+	EIP4361 string = "eip4361"
+)
+
+// EIP4361Verifier verifies Sign-In with Ethereum (EIP-4361) messages signed by an Ethereum account.
+// The message is bound to the address, the chain ID, the domain and the URI of Authcore and the
+// state token of the transaction as its request ID.
+type EIP4361Verifier struct {
+	MethodName string `json:"method"`
+	Address    string `json:"address"`
+	ChainID    int64  `json:"chain_id,string"`
+	Domain     string `json:"domain"`
+	URI        string `json:"uri"`
+	RequestID  string `json:"request_id"`
+}
+
+// SIWEMessage is a Sign-In with Ethereum message.
+type SIWEMessage struct {
+	Domain         string    `json:"domain"`
+	Address        string    `json:"address"`
+	Statement      string    `json:"statement"`
+	URI            string    `json:"uri"`
+	Version        string    `json:"version"`
+	ChainID        int64     `json:"chain_id,string"`
+	Nonce          string    `json:"nonce"`
+	IssuedAt       time.Time `json:"issued_at"`
+	ExpirationTime time.Time `json:"expiration_time"`
+	RequestID      string    `json:"request_id"`
+}
+
+// NewEIP4361Verifier returns a new EIP4361Verifier for the address. The domain and the URI are
+// derived from base_url.
+func NewEIP4361Verifier(address string, chainID int64, requestID string) (EIP4361Verifier, error) {
+	address, err := EthereumAddress(address)
+	if err != nil {
+		return EIP4361Verifier{}, err
+	}
+	if chainID <= 0 {
+		return EIP4361Verifier{}, errors.New(errors.ErrorInvalidArgument, "invalid chain ID")
+	}
+	baseURL, err := url.Parse(viper.GetString("base_url"))
+	if err != nil {
+		return EIP4361Verifier{}, errors.Wrap(err, errors.ErrorUnknown, "invalid base_url")
+	}
+	return EIP4361Verifier{
+		MethodName: EIP4361,
+		Address:    address,
+		ChainID:    chainID,
+		Domain:     baseURL.Host,
+		URI:        baseURL.String(),
+		RequestID:  requestID,
+	}, nil
+}
+
+// EthereumAddress returns the EIP-55 checksum encoding of a hex-encoded Ethereum address.
+func EthereumAddress(address string) (string, error) {
+	if !strings.HasPrefix(address, "0x") || !common.IsHexAddress(address) {
+		return "", errors.New(errors.ErrorInvalidArgument, "invalid Ethereum address")
+	}
+	return common.HexToAddress(address).Hex(), nil
+}
+
+// Method returns "eip4361".
+func (v EIP4361Verifier) Method() string {
+	return EIP4361
+}
+
+// IsPrimary returns whether this method can be used as the primary authentication.
+func (v EIP4361Verifier) IsPrimary() bool {
+	return true
+}
+
+// SkipMFA returns whether this method is sufficient for completing the authentication.
+func (v EIP4361Verifier) SkipMFA() bool {
+	return true
+}
+
+// Salt returns nil as EIP-4361 does not require a salt.
+func (v EIP4361Verifier) Salt() []byte {
+	return nil
+}
+
+// Request returns a new SIWE message with a random nonce as the challenge. The message expires
+// after siwe_message_expiry.
+func (v EIP4361Verifier) Request(in []byte) (state State, challenge Challenge, err error) {
+	if v.Address == "" || v.RequestID == "" {
+		err = errors.New(errors.ErrorInvalidArgument, "invalid verifier")
+		return
+	}
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		err = errors.Wrap(err, errors.ErrorUnknown, "")
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	message := SIWEMessage{
+		Domain:         v.Domain,
+		Address:        v.Address,
+		Statement:      viper.GetString("siwe_statement"),
+		URI:            v.URI,
+		Version:        "1",
+		ChainID:        v.ChainID,
+		Nonce:          hex.EncodeToString(nonce),
+		IssuedAt:       now,
+		ExpirationTime: now.Add(viper.GetDuration("siwe_message_expiry")),
+		RequestID:      v.RequestID,
+	}
+	state, err = json.Marshal(message)
+	if err != nil {
+		err = errors.Wrap(err, errors.ErrorUnknown, "")
+		return
+	}
+	challenge = Challenge(message.String())
+	return
+}
+
+// Verify verifies the hex-encoded signature of the SIWE message in the state. The signature is
+// valid if it is signed by the address of the verifier with EIP-191 personal_sign.
+func (v EIP4361Verifier) Verify(state State, in []byte) (bool, Verifier) {
+	if len(state) == 0 || len(in) == 0 {
+		return false, nil
+	}
+	var message SIWEMessage
+	if err := json.Unmarshal(state, &message); err != nil {
+		log.Error("invalid SIWE state")
+		return false, nil
+	}
+	if message.Address != v.Address || message.ChainID != v.ChainID || message.RequestID != v.RequestID {
+		log.WithFields(log.Fields{
+			"address": v.Address,
+		}).Error("SIWE message does not match the verifier")
+		return false, nil
+	}
+	if time.Now().After(message.ExpirationTime) {
+		log.WithFields(log.Fields{
+			"address": v.Address,
+		}).Error("SIWE message expired")
+		return false, nil
+	}
+	signer, err := recoverSIWESigner(message.String(), string(in))
+	if err != nil || signer != v.Address {
+		log.WithFields(log.Fields{
+			"address": v.Address,
+			"signer":  signer,
+		}).Error("SIWE signature rejected")
+		return false, nil
+	}
+	return true, nil
+}
+
+// String returns the message in the EIP-4361 format to be signed by the wallet.
+func (m SIWEMessage) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s wants you to sign in with your Ethereum account:\n%s\n\n", m.Domain, m.Address)
+	if m.Statement != "" {
+		fmt.Fprintf(&b, "%s\n\n", m.Statement)
+	}
+	fmt.Fprintf(&b, "URI: %s\n", m.URI)
+	fmt.Fprintf(&b, "Version: %s\n", m.Version)
+	fmt.Fprintf(&b, "Chain ID: %d\n", m.ChainID)
+	fmt.Fprintf(&b, "Nonce: %s\n", m.Nonce)
+	fmt.Fprintf(&b, "Issued At: %s\n", m.IssuedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "Expiration Time: %s\n", m.ExpirationTime.Format(time.RFC3339))
+	fmt.Fprintf(&b, "Request ID: %s", m.RequestID)
+	return b.String()
+}
+
+// recoverSIWESigner returns the checksum address of the account signing the message with the
+// hex-encoded 65-byte signature.
+func recoverSIWESigner(message, signature string) (string, error) {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if err != nil || len(sig) != crypto.SignatureLength {
+		return "", errors.New(errors.ErrorInvalidArgument, "invalid signature")
+	}
+	// Wallets encode the recovery ID as 27 or 28
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	pub, err := crypto.SigToPub(accounts.TextHash([]byte(message)), sig)
+	if err != nil {
+		return "", errors.Wrap(err, errors.ErrorInvalidArgument, "invalid signature")
+	}
+	return crypto.PubkeyToAddress(*pub).Hex(), nil
+}
+
+// EIP4361VerifierFromJSON unmarshals an EIP4361Verifier from a JSON data.
+func EIP4361VerifierFromJSON(data []byte) (v Verifier, err error) {
+	t := EIP4361Verifier{}
+	if err = json.Unmarshal(data, &t); err != nil {
+		return
+	}
+	v = t
+	return
+}
@@ -0,0 +1,89 @@
+package verifier
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func signSIWEMessage(t *testing.T, hexKey string, message []byte) []byte {
+	key, err := crypto.HexToECDSA(hexKey)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	sig, err := crypto.Sign(accounts.TextHash(message), key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+	return []byte("0x" + hex.EncodeToString(sig))
+}
+
+func TestEIP4361Verifier(t *testing.T) {
+	viper.Set("base_url", "https://authcore.localhost/")
+	viper.Set("siwe_statement", "Sign in to Authcore.")
+	viper.Set("siwe_message_expiry", "5m")
+	key := "b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291"
+	privateKey, err := crypto.HexToECDSA(key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	address := crypto.PubkeyToAddress(privateKey.PublicKey).Hex()
+
+	v, err := NewEIP4361Verifier(strings.ToLower(address), 1, "state_token")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, address, v.Address)
+	assert.Equal(t, "authcore.localhost", v.Domain)
+	assert.Equal(t, "eip4361", v.Method())
+	assert.True(t, v.IsPrimary())
+
+	state, challenge, err := v.Request(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	lines := strings.Split(string(challenge), "\n")
+	assert.Equal(t, "authcore.localhost wants you to sign in with your Ethereum account:", lines[0])
+	assert.Equal(t, address, lines[1])
+	assert.Equal(t, "Sign in to Authcore.", lines[3])
+	assert.Contains(t, lines, "URI: https://authcore.localhost/")
+	assert.Contains(t, lines, "Chain ID: 1")
+	assert.Contains(t, lines, "Request ID: state_token")
+
+	// A signature of the account is accepted
+	ok, _ := v.Verify(state, signSIWEMessage(t, key, challenge))
+	assert.True(t, ok)
+
+	// A signature of another account is rejected
+	otherKey := "289c2857d4598e37fb9647507e47a309d6133539bf21a8b9cb6df88fd5232032"
+	ok, _ = v.Verify(state, signSIWEMessage(t, otherKey, challenge))
+	assert.False(t, ok)
+	ok, _ = v.Verify(state, []byte("0x1234"))
+	assert.False(t, ok)
+
+	// The message must match the verifier and must not have expired
+	other, err := NewEIP4361Verifier(address, 1, "other_state_token")
+	if assert.NoError(t, err) {
+		ok, _ = other.Verify(state, signSIWEMessage(t, key, challenge))
+		assert.False(t, ok)
+	}
+	var message SIWEMessage
+	assert.NoError(t, json.Unmarshal(state, &message))
+	message.ExpirationTime = time.Now().Add(-time.Minute)
+	expiredState, _ := json.Marshal(message)
+	ok, _ = v.Verify(expiredState, signSIWEMessage(t, key, []byte(message.String())))
+	assert.False(t, ok)
+
+	_, err = NewEIP4361Verifier("0x1234", 1, "state_token")
+	assert.Error(t, err)
+	_, err = NewEIP4361Verifier(address, 0, "state_token")
+	assert.Error(t, err)
+}
@@ -0,0 +1,181 @@
+package verifier
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"time"
+
+	"authcore.io/authcore/internal/email"
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/pkg/cryptoutil"
+	"authcore.io/authcore/pkg/kvstore"
+	"authcore.io/authcore/pkg/ratelimiter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// EmailOTP represents an email OTP verifier.
+	EmailOTP string = "email_otp"
+)
+
+// EmailOTPVerifier verifies OTP sent to a verified email address. This verifier depends on other
+// services to provide its functions.
+type EmailOTPVerifier struct {
+	MethodName string `json:"method"`
+	Email      string `json:"email"`
+	Lang       string `json:"lang"`
+
+	emailService *email.Service
+	rateLimiter  *ratelimiter.RateLimiter
+}
+
+// NewEmailOTPVerifier returns a new EmailOTPVerifier instance.
+func NewEmailOTPVerifier(email, lang string, emailService *email.Service, kv kvstore.Store) EmailOTPVerifier {
+	return EmailOTPVerifier{
+		MethodName: EmailOTP,
+		Email:      email,
+		Lang:       lang,
+
+		emailService: emailService,
+		rateLimiter:  emailOTPRateLimiter(kv),
+	}
+}
+
+// Method returns "email_otp".
+func (v EmailOTPVerifier) Method() string {
+	return EmailOTP
+}
+
+// IsPrimary returns whether this method can be used as the primary authentication.
+func (v EmailOTPVerifier) IsPrimary() bool {
+	return false
+}
+
+// SkipMFA returns whether this method is sufficient for completing the authentication.
+func (v EmailOTPVerifier) SkipMFA() bool {
+	return false
+}
+
+// Salt returns a salt. Or nil if salt is not used by the verifier.
+func (v EmailOTPVerifier) Salt() []byte {
+	return nil
+}
+
+// WithLanguage returns a copy of the verifier that sends emails in the given language.
+func (v EmailOTPVerifier) WithLanguage(lang string) EmailOTPVerifier {
+	v.Lang = lang
+	return v
+}
+
+// Request requests an OTP to be sent to the email address.
+func (v EmailOTPVerifier) Request(in []byte) (state State, challenge Challenge, err error) {
+	if len(v.Email) == 0 {
+		err = errors.New(errors.ErrorInvalidArgument, "invalid verifier")
+		return
+	}
+	err = v.rateLimiter.Check(v.Email)
+	if err != nil {
+		err = errors.New(errors.ErrorResourceExhausted, "")
+		return
+	}
+	err = v.rateLimiter.Increment(v.Email)
+	if err != nil {
+		err = errors.New(errors.ErrorResourceExhausted, "")
+		return
+	}
+
+	codeLength := int64(viper.GetInt("email_otp_code_length"))
+	code := cryptoutil.RandomCode(codeLength)
+	expiry := viper.GetDuration("email_otp_code_expiry")
+	expireAt := time.Now().Add(expiry)
+
+	codeState := codeState{
+		Code:     code,
+		ExpireAt: expireAt,
+	}
+
+	log.WithFields(log.Fields{
+		"email": v.Email,
+	}).Info("send authentication email")
+
+	ctx := context.Background()
+	err = v.emailService.SendAuthenticationMail(
+		ctx,
+		v.Email,
+		v.Lang,
+		code,
+	)
+	if err != nil {
+		return
+	}
+	state, err = codeState.ToState()
+	return
+}
+
+// Verify verifies the incoming OTP. Returns true if the code is valid. Otherwise, return false.
+func (v EmailOTPVerifier) Verify(state State, in []byte) (bool, Verifier) {
+	if len(state) == 0 {
+		return false, nil
+	}
+	if len(in) == 0 {
+		return false, nil
+	}
+
+	cs, err := codeStateFromState(state)
+	if err != nil {
+		log.Error("invalid email code state")
+		return false, nil
+	}
+
+	if cs.Code == "" {
+		log.Error("invalid email code state")
+		return false, nil
+	}
+
+	code := string(in)
+	if cs.Expired() {
+		log.WithFields(log.Fields{
+			"email": v.Email,
+		}).Error("email OTP expired")
+		return false, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(code), []byte(cs.Code)) != 1 {
+		log.WithFields(log.Fields{
+			"email": v.Email,
+		}).Error("email OTP rejected")
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// EmailOTPVerifierFactory returns a function that unmarshalls EmailOTPVerifier from a JSON data.
+func EmailOTPVerifierFactory(emailService *email.Service, kv kvstore.Store) Unmarshaller {
+	rateLimiter := emailOTPRateLimiter(kv)
+	return func(data []byte) (Verifier, error) {
+		return emailOTPVerifierFromJSON(data, emailService, rateLimiter)
+	}
+}
+
+func emailOTPVerifierFromJSON(data []byte, emailService *email.Service, rateLimiter *ratelimiter.RateLimiter) (v Verifier, err error) {
+	t := EmailOTPVerifier{}
+	if err = json.Unmarshal(data, &t); err != nil {
+		return
+	}
+
+	t.emailService = emailService
+	t.rateLimiter = rateLimiter
+	v = t
+	return
+}
+
+func emailOTPRateLimiter(kv kvstore.Store) *ratelimiter.RateLimiter {
+	rateLimitInterval := viper.GetDuration("email_otp_rate_limit_interval")
+	rateLimitCount := viper.GetInt64("email_otp_rate_limit_count")
+
+	return ratelimiter.NewRateLimiter(kv, "rate_limiter/email_otp/", rateLimitCount, rateLimitInterval)
+}
@@ -0,0 +1,97 @@
+package verifier
+
+import (
+	"testing"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailOTPVerifier(t *testing.T) {
+	f, teardown := factoryForTest()
+	defer teardown()
+
+	data := `{
+		"method": "email_otp",
+		"email": "bob@example.com",
+		"lang": "en"
+	}`
+	verifier, err := f.Unmarshal([]byte(data))
+	assert.NoError(t, err)
+	_, ok := verifier.(EmailOTPVerifier)
+	assert.True(t, ok)
+	assert.Equal(t, "email_otp", verifier.Method())
+	assert.False(t, verifier.IsPrimary())
+	assert.False(t, verifier.SkipMFA())
+	assert.Empty(t, verifier.Salt())
+
+	vs, challenge, err := verifier.Request(nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, vs)
+	assert.Empty(t, challenge)
+
+	// Incorrect OTP
+	ok, _ = verifier.Verify(vs, []byte("123456"))
+	assert.False(t, ok)
+	ok, _ = verifier.Verify(vs, nil)
+	assert.False(t, ok)
+
+	// Incorrect VerifierState
+	ok, _ = verifier.Verify([]byte("xxx"), []byte("123456"))
+	assert.False(t, ok)
+	ok, _ = verifier.Verify(nil, []byte("123456"))
+	assert.False(t, ok)
+
+	// Correct OTP
+	cs, err := codeStateFromState(vs)
+	assert.NoError(t, err)
+	ok, vs2 := verifier.Verify(vs, []byte(cs.Code))
+	assert.True(t, ok)
+	assert.Nil(t, vs2)
+}
+
+func TestEmailOTPVerifierTooManyRequests(t *testing.T) {
+	f, teardown := factoryForTest()
+	defer teardown()
+
+	data := `{
+		"method": "email_otp",
+		"email": "bob@example.com"
+	}`
+	verifier, err := f.Unmarshal([]byte(data))
+	assert.NoError(t, err)
+
+	_, _, err = verifier.Request(nil)
+	assert.NoError(t, err)
+
+	_, _, err = verifier.Request(nil)
+	assert.Error(t, err)
+	assert.True(t, errors.IsKind(err, errors.ErrorResourceExhausted))
+}
+
+func TestEmailOTPVerifierOTPExpire(t *testing.T) {
+	f, teardown := factoryForTest()
+	defer teardown()
+	viper.Set("email_otp_code_expiry", "100ms")
+
+	data := `{
+		"method": "email_otp",
+		"email": "bob@example.com"
+	}`
+	verifier, err := f.Unmarshal([]byte(data))
+	assert.NoError(t, err)
+
+	vs, _, err := verifier.Request(nil)
+	assert.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+
+	cs, err := codeStateFromState(vs)
+	assert.NoError(t, err)
+	ok, vs2 := verifier.Verify(vs, []byte(cs.Code))
+	assert.False(t, ok)
+	assert.Nil(t, vs2)
+}
@@ -0,0 +1,240 @@
+package verifier
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"authcore.io/authcore/internal/errors"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// LegacyPassword represents a password hash imported from another system.
+	LegacyPassword string = "legacy_password"
+)
+
+// The maximum cost parameters of the imported hashes. Hashes exceeding them are rejected, so that
+// a crafted hash cannot exhaust the CPU or the memory of the server when a password is verified.
+const (
+	maxBcryptCost       = 15
+	maxPBKDF2Iterations = 2000000
+	maxArgon2Memory     = 256 * 1024 // KiB
+	maxArgon2Time       = 16
+	maxArgon2Threads    = 16
+	maxKeyLength        = 64
+)
+
+// passlibEncoding is the adapted base64 encoding used by passlib's PBKDF2 hashes.
+var passlibEncoding = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./").WithPadding(base64.NoPadding)
+
+// LegacyPasswordVerifier verifies a plaintext password against a password hash imported from
+// another system. The supported formats are:
+//
+//	bcrypt:           $2a$10$..., $2b$..., $2y$...
+//	PBKDF2 (passlib): $pbkdf2$<iterations>$<salt>$<hash>, $pbkdf2-sha256$..., $pbkdf2-sha512$...
+//	PBKDF2 (Django):  pbkdf2_sha256$<iterations>$<salt>$<hash>, pbkdf2_sha1$...
+//	argon2 (PHC):     $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>, $argon2i$...
+//
+// Unlike SPAKE2+, the plaintext password is sent to the server. It is only meant to migrate
+// users to SPAKE2+ verifiers on their first sign-in.
+type LegacyPasswordVerifier struct {
+	MethodName string `json:"method"`
+	Hash       string `json:"hash"`
+}
+
+// NewLegacyPasswordVerifier returns a new LegacyPasswordVerifier instance.
+func NewLegacyPasswordVerifier(hash string) LegacyPasswordVerifier {
+	return LegacyPasswordVerifier{
+		MethodName: LegacyPassword,
+		Hash:       hash,
+	}
+}
+
+// Method returns "legacy_password".
+func (v LegacyPasswordVerifier) Method() string {
+	return LegacyPassword
+}
+
+// IsPrimary returns true as this method can be used as a primary factor.
+func (v LegacyPasswordVerifier) IsPrimary() bool {
+	return true
+}
+
+// SkipMFA returns whether this method is sufficient for completing the authentication.
+func (v LegacyPasswordVerifier) SkipMFA() bool {
+	return false
+}
+
+// Salt returns nil as the salt is embedded in the hash and never sent to clients.
+func (v LegacyPasswordVerifier) Salt() []byte {
+	return nil
+}
+
+// Request returns an empty state and challenge as the plaintext password is verified directly.
+func (v LegacyPasswordVerifier) Request(in []byte) (State, Challenge, error) {
+	return nil, nil, nil
+}
+
+// Verify verifies the plaintext password against the hash.
+func (v LegacyPasswordVerifier) Verify(state State, in []byte) (bool, Verifier) {
+	if len(in) == 0 {
+		return false, nil
+	}
+	ok, err := compareLegacyPasswordHash(v.Hash, in)
+	if err != nil {
+		return false, nil
+	}
+	return ok, nil
+}
+
+// ValidateLegacyPasswordHash returns an InvalidArgument error if the hash is not in a supported
+// format or its cost parameters exceed the maximums.
+func ValidateLegacyPasswordHash(hash string) error {
+	_, err := compareLegacyPasswordHash(hash, nil)
+	return err
+}
+
+// compareLegacyPasswordHash compares a password with the hash. It returns an error if the hash
+// cannot be parsed or its cost parameters exceed the maximums. The password is not compared if it
+// is nil.
+func compareLegacyPasswordHash(encoded string, password []byte) (bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		cost, err := bcrypt.Cost([]byte(encoded))
+		if err != nil {
+			return false, errors.Wrap(err, errors.ErrorInvalidArgument, "invalid bcrypt hash")
+		}
+		if cost > maxBcryptCost {
+			return false, errors.New(errors.ErrorInvalidArgument, "bcrypt cost is too high")
+		}
+		if password == nil {
+			return false, nil
+		}
+		return bcrypt.CompareHashAndPassword([]byte(encoded), password) == nil, nil
+	case strings.HasPrefix(encoded, "$pbkdf2"):
+		return comparePasslibHash(encoded, password)
+	case strings.HasPrefix(encoded, "pbkdf2_"):
+		return compareDjangoHash(encoded, password)
+	case strings.HasPrefix(encoded, "$argon2"):
+		return compareArgon2Hash(encoded, password)
+	}
+	return false, errors.New(errors.ErrorInvalidArgument, "unsupported password hash format")
+}
+
+// comparePasslibHash compares a password with a PBKDF2 hash in passlib format.
+func comparePasslibHash(encoded string, password []byte) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 {
+		return false, errors.New(errors.ErrorInvalidArgument, "invalid pbkdf2 hash")
+	}
+	var h func() hash.Hash
+	switch parts[1] {
+	case "pbkdf2":
+		h = sha1.New
+	case "pbkdf2-sha256":
+		h = sha256.New
+	case "pbkdf2-sha512":
+		h = sha512.New
+	default:
+		return false, errors.Errorf(errors.ErrorInvalidArgument, "unsupported pbkdf2 digest %v", parts[1])
+	}
+	iterations, err := strconv.Atoi(parts[2])
+	if err != nil || iterations <= 0 || iterations > maxPBKDF2Iterations {
+		return false, errors.New(errors.ErrorInvalidArgument, "invalid pbkdf2 iterations")
+	}
+	salt, err := passlibEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false, errors.Wrap(err, errors.ErrorInvalidArgument, "invalid pbkdf2 salt")
+	}
+	key, err := passlibEncoding.DecodeString(parts[4])
+	if err != nil || len(key) == 0 || len(key) > maxKeyLength {
+		return false, errors.New(errors.ErrorInvalidArgument, "invalid pbkdf2 hash")
+	}
+	if password == nil {
+		return false, nil
+	}
+	dk := pbkdf2.Key(password, salt, iterations, len(key), h)
+	return subtle.ConstantTimeCompare(dk, key) == 1, nil
+}
+
+// compareDjangoHash compares a password with a PBKDF2 hash in Django format.
+func compareDjangoHash(encoded string, password []byte) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 {
+		return false, errors.New(errors.ErrorInvalidArgument, "invalid pbkdf2 hash")
+	}
+	var h func() hash.Hash
+	switch parts[0] {
+	case "pbkdf2_sha1":
+		h = sha1.New
+	case "pbkdf2_sha256":
+		h = sha256.New
+	default:
+		return false, errors.Errorf(errors.ErrorInvalidArgument, "unsupported pbkdf2 digest %v", parts[0])
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 || iterations > maxPBKDF2Iterations {
+		return false, errors.New(errors.ErrorInvalidArgument, "invalid pbkdf2 iterations")
+	}
+	key, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 || len(key) > maxKeyLength {
+		return false, errors.New(errors.ErrorInvalidArgument, "invalid pbkdf2 hash")
+	}
+	if password == nil {
+		return false, nil
+	}
+	dk := pbkdf2.Key(password, []byte(parts[2]), iterations, len(key), h)
+	return subtle.ConstantTimeCompare(dk, key) == 1, nil
+}
+
+// compareArgon2Hash compares a password with an argon2 hash in PHC string format.
+func compareArgon2Hash(encoded string, password []byte) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, errors.New(errors.ErrorInvalidArgument, "invalid argon2 hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.New(errors.ErrorInvalidArgument, "unsupported argon2 version")
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time == 0 || threads == 0 {
+		return false, errors.New(errors.ErrorInvalidArgument, "invalid argon2 parameters")
+	}
+	if memory > maxArgon2Memory || time > maxArgon2Time || threads > maxArgon2Threads {
+		return false, errors.New(errors.ErrorInvalidArgument, "argon2 parameters are too high")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errors.Wrap(err, errors.ErrorInvalidArgument, "invalid argon2 salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 || len(key) > maxKeyLength {
+		return false, errors.New(errors.ErrorInvalidArgument, "invalid argon2 hash")
+	}
+	var derive func(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte
+	switch parts[1] {
+	case "argon2i":
+		derive = argon2.Key
+	case "argon2id":
+		derive = argon2.IDKey
+	default:
+		return false, errors.Errorf(errors.ErrorInvalidArgument, "unsupported argon2 variant %v", parts[1])
+	}
+	if password == nil {
+		return false, nil
+	}
+	dk := derive(password, salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(dk, key) == 1, nil
+}
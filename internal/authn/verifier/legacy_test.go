@@ -0,0 +1,80 @@
+package verifier
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestLegacyPasswordVerifier(t *testing.T) {
+	password := []byte("password")
+	salt := []byte("somesalt12345678")
+
+	bcryptHash, err := bcrypt.GenerateFromPassword(password, bcrypt.MinCost)
+	assert.NoError(t, err)
+	passlibHash := fmt.Sprintf("$pbkdf2-sha256$1000$%s$%s",
+		passlibEncoding.EncodeToString(salt),
+		passlibEncoding.EncodeToString(pbkdf2.Key(password, salt, 1000, 32, sha256.New)))
+	djangoHash := fmt.Sprintf("pbkdf2_sha256$1000$%s$%s",
+		salt,
+		base64.StdEncoding.EncodeToString(pbkdf2.Key(password, salt, 1000, 32, sha256.New)))
+	argon2Hash := fmt.Sprintf("$argon2id$v=19$m=1024,t=1,p=1$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey(password, salt, 1, 1024, 1, 32)))
+
+	hashes := []string{
+		string(bcryptHash),
+		passlibHash,
+		djangoHash,
+		argon2Hash,
+		// Example from passlib documentation
+		"$pbkdf2-sha256$6400$0ZrzXitFSGltTQnBWOsdAw$Y11AchqV4b0sUisdZd0Xr97KWoymNE0LNNrnEgY4H9M",
+	}
+	for _, hash := range hashes {
+		assert.NoError(t, ValidateLegacyPasswordHash(hash), hash)
+		v := NewLegacyPasswordVerifier(hash)
+		assert.Equal(t, LegacyPassword, v.Method())
+		assert.True(t, v.IsPrimary())
+		assert.Empty(t, v.Salt())
+
+		ok, _ := v.Verify(nil, password)
+		assert.True(t, ok, hash)
+		ok, _ = v.Verify(nil, []byte("wrong password"))
+		assert.False(t, ok, hash)
+		ok, _ = v.Verify(nil, nil)
+		assert.False(t, ok, hash)
+	}
+
+	invalidHashes := []string{
+		"",
+		"password",
+		"$1$saltsalt$hash",
+		"$2a$10$tooshort",
+		"$pbkdf2-md5$1000$c2FsdA$aGFzaA",
+		"$pbkdf2-sha256$0$c2FsdA$aGFzaA",
+		"pbkdf2_sha256$1000$salt$",
+		"$argon2d$v=19$m=1024,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$aGFzaA",
+		// Cost parameters exceeding the maximums
+		"$2a$31$PvtbknSx4g2eDMXKiSdLVOJ6CjiYQzT14VT9tixCr2KEBqYRcWgBe",
+		"$pbkdf2-sha256$2147483648$c2FsdA$aGFzaA",
+		"pbkdf2_sha256$2000001$salt$aGFzaA==",
+		"$pbkdf2-sha256$1000$c2FsdA$" + passlibEncoding.EncodeToString(make([]byte, 65)),
+		"$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=4294967295,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=1,p=255$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$" + base64.RawStdEncoding.EncodeToString(make([]byte, 65)),
+	}
+	for _, hash := range invalidHashes {
+		assert.Error(t, ValidateLegacyPasswordHash(hash), hash)
+		ok, _ := NewLegacyPasswordVerifier(hash).Verify(nil, password)
+		assert.False(t, ok, hash)
+	}
+}
@@ -10,9 +10,9 @@ import (
 	"authcore.io/authcore/internal/errors"
 	"authcore.io/authcore/internal/sms"
 	"authcore.io/authcore/pkg/cryptoutil"
+	"authcore.io/authcore/pkg/kvstore"
 	"authcore.io/authcore/pkg/ratelimiter"
 
-	"github.com/go-redis/redis"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
@@ -40,7 +40,7 @@ type ResetLinkVerifier struct {
 }
 
 // NewResetLinkVerifier returns a new ResetLinkVerifier instance.
-func NewResetLinkVerifier(phoneNumber string, email string, clientID string, smsService *sms.Service, emailService *email.Service, redisClient *redis.Client) ResetLinkVerifier {
+func NewResetLinkVerifier(phoneNumber string, email string, clientID string, smsService *sms.Service, emailService *email.Service, kv kvstore.Store) ResetLinkVerifier {
 	return ResetLinkVerifier{
 		MethodName:  ResetLink,
 		PhoneNumber: phoneNumber,
@@ -49,7 +49,7 @@ func NewResetLinkVerifier(phoneNumber string, email string, clientID string, sms
 
 		smsService:   smsService,
 		emailService: emailService,
-		rateLimiter:  rateLimiter(redisClient),
+		rateLimiter:  rateLimiter(kv),
 	}
 }
 
@@ -194,8 +194,8 @@ func (v ResetLinkVerifier) Verify(state State, in []byte) (bool, Verifier) {
 }
 
 // ResetLinkVerifierFactory returns a function that unmarshalls ResetLinkVerifier from a JSON data.
-func ResetLinkVerifierFactory(smsService *sms.Service, emailService *email.Service, redisClient *redis.Client) Unmarshaller {
-	rateLimiter := rateLimiter(redisClient)
+func ResetLinkVerifierFactory(smsService *sms.Service, emailService *email.Service, kv kvstore.Store) Unmarshaller {
+	rateLimiter := rateLimiter(kv)
 	return func(data []byte) (Verifier, error) {
 		return resetLinkVerifierFromJSON(data, smsService, emailService, rateLimiter)
 	}
@@ -214,11 +214,11 @@ func resetLinkVerifierFromJSON(data []byte, smsService *sms.Service, emailServic
 	return
 }
 
-func rateLimiter(redisClient *redis.Client) *ratelimiter.RateLimiter {
+func rateLimiter(kv kvstore.Store) *ratelimiter.RateLimiter {
 	rateLimitInterval := viper.GetDuration("reset_link_rate_limit_interval")
 	rateLimitCount := viper.GetInt64("reset_link_rate_limit_count")
 
-	return ratelimiter.NewRateLimiter(redisClient, "rate_limiter/reset_link/", rateLimitCount, rateLimitInterval)
+	return ratelimiter.NewRateLimiter(kv, "rate_limiter/reset_link/", rateLimitCount, rateLimitInterval)
 }
 
 type resetLinkState struct {
@@ -23,17 +23,16 @@ func resetLinkFactoryForTest() (*Factory, func()) {
 	config.InitConfig()
 	testutil.FixturesSetUp()
 	d := db.NewDBFromConfig()
-	redis := testutil.RedisForTest()
+	kv := testutil.KVStoreForTest()
 	templateStore := template.NewStore(d)
 	smsService := sms.NewService(templateStore)
 	emailService := email.NewService(templateStore)
 	f := NewFactory()
-	f.Register(ResetLink, ResetLinkVerifierFactory(smsService, emailService, redis))
+	f.Register(ResetLink, ResetLinkVerifierFactory(smsService, emailService, kv))
 
 	return f, func() {
 		d.Close()
 		viper.Reset()
-		redis.FlushAll()
 	}
 }
 
@@ -8,9 +8,9 @@ import (
 	"authcore.io/authcore/internal/errors"
 	"authcore.io/authcore/internal/sms"
 	"authcore.io/authcore/pkg/cryptoutil"
+	"authcore.io/authcore/pkg/kvstore"
 	"authcore.io/authcore/pkg/ratelimiter"
 
-	"github.com/go-redis/redis"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
@@ -30,13 +30,13 @@ type SMSOTPVerifier struct {
 }
 
 // NewSMSOTPVerifier returns a new SMSOTPVerifier instance.
-func NewSMSOTPVerifier(phoneNumber string, smsService *sms.Service, redisClient *redis.Client) SMSOTPVerifier {
+func NewSMSOTPVerifier(phoneNumber string, smsService *sms.Service, kv kvstore.Store) SMSOTPVerifier {
 	return SMSOTPVerifier{
 		MethodName:  SMSOTP,
 		PhoneNumber: phoneNumber,
 
 		smsService:  smsService,
-		rateLimiter: smsRateLimiter(redisClient),
+		rateLimiter: smsRateLimiter(kv),
 	}
 }
 
@@ -145,8 +145,8 @@ func (v SMSOTPVerifier) Verify(state State, in []byte) (bool, Verifier) {
 }
 
 // SMSOTPVerifierFactory returns a function that unmarshalls SMSOTPVerifier from a JSON data.
-func SMSOTPVerifierFactory(smsService *sms.Service, redisClient *redis.Client) Unmarshaller {
-	rateLimiter := smsRateLimiter(redisClient)
+func SMSOTPVerifierFactory(smsService *sms.Service, kv kvstore.Store) Unmarshaller {
+	rateLimiter := smsRateLimiter(kv)
 	return func(data []byte) (Verifier, error) {
 		return smsotpVerifierFromJSON(data, smsService, rateLimiter)
 	}
@@ -164,11 +164,11 @@ func smsotpVerifierFromJSON(data []byte, smsService *sms.Service, rateLimiter *r
 	return
 }
 
-func smsRateLimiter(redisClient *redis.Client) *ratelimiter.RateLimiter {
+func smsRateLimiter(kv kvstore.Store) *ratelimiter.RateLimiter {
 	contactRateLimitInterval := viper.GetDuration("contact_rate_limit_interval")
 	contactRateLimitCount := viper.GetInt64("contact_rate_limit_count")
 
-	return ratelimiter.NewRateLimiter(redisClient, "rate_limiter/sms/", contactRateLimitCount, contactRateLimitInterval)
+	return ratelimiter.NewRateLimiter(kv, "rate_limiter/sms/", contactRateLimitCount, contactRateLimitInterval)
 }
 
 type codeState struct {
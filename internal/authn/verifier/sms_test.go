@@ -6,6 +6,7 @@ import (
 
 	"authcore.io/authcore/internal/config"
 	"authcore.io/authcore/internal/db"
+	"authcore.io/authcore/internal/email"
 	"authcore.io/authcore/internal/errors"
 	"authcore.io/authcore/internal/sms"
 	"authcore.io/authcore/internal/template"
@@ -22,16 +23,17 @@ func factoryForTest() (*Factory, func()) {
 	config.InitConfig()
 	testutil.FixturesSetUp()
 	d := db.NewDBFromConfig()
-	redis := testutil.RedisForTest()
+	kv := testutil.KVStoreForTest()
 	templateStore := template.NewStore(d)
 	smsService := sms.NewService(templateStore)
+	emailService := email.NewService(templateStore)
 	f := NewFactory()
-	f.Register(SMSOTP, SMSOTPVerifierFactory(smsService, redis))
+	f.Register(SMSOTP, SMSOTPVerifierFactory(smsService, kv))
+	f.Register(EmailOTP, EmailOTPVerifierFactory(emailService, kv))
 
 	return f, func() {
 		d.Close()
 		viper.Reset()
-		redis.FlushAll()
 	}
 }
 
@@ -37,6 +37,7 @@ func NewFactory() *Factory {
 			SPAKE2Plus: SPAKE2PlusVerifierFromJSON,
 			TOTP:       TOTPVerifierFromJSON,
 			BackupCode: BackupCodeVerifierFromJSON,
+			EIP4361:    EIP4361VerifierFromJSON,
 		},
 	}
 }
@@ -5,6 +5,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"authcore.io/authcore/internal/errors"
 
@@ -26,6 +27,140 @@ type ClientApp struct {
 	AppDomains          []string `mapstructure:"app_domains"`
 	AllowedCallbackURLs []string `mapstructure:"allowed_callback_urls"`
 	IDPList             []string `mapstructure:"idp_list"`
+	RequireMFA          bool     `mapstructure:"require_mfa"`
+	// MaxPasswordAge forces users to change passwords older than it. max_password_age is used if
+	// it is zero.
+	MaxPasswordAge time.Duration `mapstructure:"max_password_age"`
+
+	// InvitationOnly allows sign-up only with an invitation.
+	InvitationOnly bool `mapstructure:"invitation_only"`
+	// SignUpAllowedDomains restricts sign-up without an invitation to email addresses in these
+	// domains and their subdomains. Sign-up is not restricted if it is empty.
+	SignUpAllowedDomains []string `mapstructure:"sign_up_allowed_domains"`
+	// SignUpDeniedDomains rejects sign-up without an invitation from email addresses in these
+	// domains and their subdomains.
+	SignUpDeniedDomains []string `mapstructure:"sign_up_denied_domains"`
+	// IDPRoutingRules route users to an IDP by the domain of their email address. They take
+	// precedence over the global idp_routing_rules config.
+	IDPRoutingRules []IDPRoutingRule `mapstructure:"idp_routing_rules"`
+	// LDAPEnabled authenticates users without a local password with the password in the LDAP
+	// directory.
+	LDAPEnabled bool `mapstructure:"ldap_enabled"`
+	// EthereumEnabled allows users to sign in and sign up with an Ethereum account using Sign-In
+	// with Ethereum (EIP-4361).
+	EthereumEnabled bool `mapstructure:"ethereum_enabled"`
+	// QRSignInEnabled allows users to sign in by scanning a QR code with a device where they have
+	// already signed in.
+	QRSignInEnabled bool `mapstructure:"qr_sign_in_enabled"`
+	// SAML configures the client as a SAML 2.0 service provider of Authcore.
+	SAML *SAMLServiceProvider `mapstructure:"saml"`
+}
+
+// SAMLServiceProvider is the configuration of a client app that signs in users with SAML 2.0.
+// The service provider is described by its metadata, or by its entity ID and an assertion consumer
+// service URL using the HTTP-POST binding if it does not publish metadata.
+//
+// NameID and the attributes are user fields: id, public_id, name, username, email,
+// email_verified, phone, phone_verified, language, or a path prefixed with user_metadata. or
+// app_metadata.
+type SAMLServiceProvider struct {
+	EntityID     string          `mapstructure:"entity_id"`
+	Metadata     string          `mapstructure:"metadata"`
+	ACSURL       string          `mapstructure:"acs_url"`
+	NameIDFormat string          `mapstructure:"name_id_format"`
+	NameID       string          `mapstructure:"name_id"`
+	Attributes   []SAMLAttribute `mapstructure:"attributes"`
+}
+
+// SAMLAttribute maps a user field to a SAML attribute. It is a list rather than a map because
+// attribute names are case-sensitive.
+type SAMLAttribute struct {
+	Name  string `mapstructure:"name"`
+	Field string `mapstructure:"field"`
+}
+
+// IDPRoutingRule routes users with email addresses in the domains and their subdomains to an IDP
+// instead of asking for a password.
+type IDPRoutingRule struct {
+	Domains []string `mapstructure:"domains"`
+	IDP     string   `mapstructure:"idp"`
+	// BlockPassword disables password authentication for the domains. Otherwise only users without
+	// a password are routed to the IDP.
+	BlockPassword bool `mapstructure:"block_password"`
+}
+
+// MatchIDPRoutingRule returns the IDP routing rule matching the domain of the handle, or nil if
+// the handle is not an email address or no rule matches. The rules of the client take precedence
+// over globalRules.
+func (app *ClientApp) MatchIDPRoutingRule(handle string, globalRules []IDPRoutingRule) *IDPRoutingRule {
+	domain, ok := emailDomain(handle)
+	if !ok {
+		return nil
+	}
+	for _, rules := range [][]IDPRoutingRule{app.IDPRoutingRules, globalRules} {
+		for i := range rules {
+			if matchDomain(rules[i].Domains, domain) {
+				return &rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+// LoadIDPRoutingRules loads the global IDP routing rules from the idp_routing_rules config.
+func LoadIDPRoutingRules() ([]IDPRoutingRule, error) {
+	var rules []IDPRoutingRule
+	err := viper.UnmarshalKey("idp_routing_rules", &rules)
+	if err != nil {
+		return nil, errors.Errorf(errors.ErrorUnknown, "error reading idp_routing_rules config: %v", err)
+	}
+	for i, rule := range rules {
+		if len(rule.Domains) == 0 || rule.IDP == "" {
+			return nil, errors.Errorf(errors.ErrorInvalidArgument, "IDP routing rule %v requires domains and idp", i)
+		}
+	}
+	return rules, nil
+}
+
+// CheckSignUpEmail returns a PermissionDenied error if the client does not allow users to sign up
+// with the email address without an invitation.
+func (app *ClientApp) CheckSignUpEmail(email string) error {
+	if app.InvitationOnly {
+		return errors.New(errors.ErrorPermissionDenied, "sign-up requires an invitation")
+	}
+	if len(app.SignUpAllowedDomains) == 0 && len(app.SignUpDeniedDomains) == 0 {
+		return nil
+	}
+	domain, ok := emailDomain(email)
+	if !ok {
+		return errors.New(errors.ErrorPermissionDenied, "sign-up requires an email address")
+	}
+	if matchDomain(app.SignUpDeniedDomains, domain) {
+		return errors.New(errors.ErrorPermissionDenied, "email domain is not allowed to sign up")
+	}
+	if len(app.SignUpAllowedDomains) > 0 && !matchDomain(app.SignUpAllowedDomains, domain) {
+		return errors.New(errors.ErrorPermissionDenied, "email domain is not allowed to sign up")
+	}
+	return nil
+}
+
+// emailDomain returns the lower-cased domain of an email address.
+func emailDomain(email string) (string, bool) {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return "", false
+	}
+	return strings.ToLower(email[at+1:]), true
+}
+
+func matchDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
 }
 
 // GetByClientID retrieve ClientApp from viper configs
@@ -43,6 +178,25 @@ func GetByClientID(clientID string) (*ClientApp, error) {
 		clientID = viper.GetString("default_client_id")
 	}
 
+	clientApp, ok := clientApps()[strings.ToLower(clientID)]
+	if !ok {
+		return nil, errors.Errorf(errors.ErrorUnknown, "invalid client id %v", clientID)
+	}
+	return &clientApp, nil
+}
+
+// GetBySAMLEntityID returns the ClientApp configured as the SAML service provider with the entity
+// ID.
+func GetBySAMLEntityID(entityID string) (*ClientApp, error) {
+	for _, clientApp := range clientApps() {
+		if clientApp.SAML != nil && clientApp.SAML.EntityID == entityID {
+			return &clientApp, nil
+		}
+	}
+	return nil, errors.Errorf(errors.ErrorNotFound, "unknown SAML service provider %v", entityID)
+}
+
+func clientApps() map[string]ClientApp {
 	loadConfigOnce.Do(func() {
 		var err error
 		clientAppsMap, err = LoadClientApps()
@@ -51,12 +205,7 @@ func GetByClientID(clientID string) (*ClientApp, error) {
 			clientAppsMap = make(map[string]ClientApp)
 		}
 	})
-
-	clientApp, ok := clientAppsMap[strings.ToLower(clientID)]
-	if !ok {
-		return nil, errors.Errorf(errors.ErrorUnknown, "invalid client id %v", clientID)
-	}
-	return &clientApp, nil
+	return clientAppsMap
 }
 
 // GetAdminPortalClientApp returns a ClientApp instance that represents the built-in Authcore portal
@@ -92,7 +241,7 @@ func LoadClientApps() (map[string]ClientApp, error) {
 
 	adminPortal, err := GetAdminPortalClientApp()
 	if err != nil {
-		return nil, errors.Errorf(errors.ErrorUnknown, "error reading applications config: %w", err)
+		return nil, errors.Errorf(errors.ErrorUnknown, "error reading applications config: %v", err)
 	}
 	rawMap[AdminPortalClientID] = adminPortal
 
@@ -102,6 +251,9 @@ func LoadClientApps() (map[string]ClientApp, error) {
 		if app.IDPList == nil {
 			app.IDPList = viper.GetStringSlice("default_idp_list")
 		}
+		if app.MaxPasswordAge == 0 {
+			app.MaxPasswordAge = viper.GetDuration("max_password_age")
+		}
 		clientApps[app.ID] = app
 	}
 	return clientApps, nil
@@ -15,6 +15,7 @@ func TestGetByClientID(t *testing.T) {
 		"google",
 		"facebook",
 	})
+	viper.Set("applications.testing.saml.entity_id", "https://wiki.authcore.testing/saml")
 	clientApp, err := GetByClientID("testing")
 	if assert.NoError(t, err) {
 		assert.Equal(t, "testing", clientApp.ID)
@@ -58,3 +59,85 @@ func TestGetByClientID(t *testing.T) {
 		}, clientApp.IDPList)
 	}
 }
+
+func TestGetBySAMLEntityID(t *testing.T) {
+	viper.Set("applications.testing.saml.entity_id", "https://wiki.authcore.testing/saml")
+	clientApp, err := GetBySAMLEntityID("https://wiki.authcore.testing/saml")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "testing", clientApp.ID)
+	}
+
+	_, err = GetBySAMLEntityID("https://unknown.authcore.testing/saml")
+	assert.Error(t, err)
+}
+
+func TestCheckSignUpEmail(t *testing.T) {
+	app := &ClientApp{}
+	assert.NoError(t, app.CheckSignUpEmail("bob@example.com"))
+	assert.NoError(t, app.CheckSignUpEmail(""))
+
+	app = &ClientApp{
+		SignUpAllowedDomains: []string{"example.com"},
+		SignUpDeniedDomains:  []string{"contractors.example.com"},
+	}
+	assert.NoError(t, app.CheckSignUpEmail("bob@example.com"))
+	assert.NoError(t, app.CheckSignUpEmail("bob@EU.Example.com"))
+	assert.Error(t, app.CheckSignUpEmail("bob@contractors.example.com"))
+	assert.Error(t, app.CheckSignUpEmail("bob@notexample.com"))
+	assert.Error(t, app.CheckSignUpEmail(""))
+
+	app = &ClientApp{InvitationOnly: true}
+	assert.Error(t, app.CheckSignUpEmail("bob@example.com"))
+}
+
+func TestMatchIDPRoutingRule(t *testing.T) {
+	globalRules := []IDPRoutingRule{
+		{Domains: []string{"partner.com"}, IDP: "google"},
+		{Domains: []string{"example.com"}, IDP: "facebook"},
+	}
+	app := &ClientApp{
+		IDPRoutingRules: []IDPRoutingRule{
+			{Domains: []string{"example.com"}, IDP: "mock", BlockPassword: true},
+		},
+	}
+	rule := app.MatchIDPRoutingRule("bob@Sales.Partner.com", globalRules)
+	if assert.NotNil(t, rule) {
+		assert.Equal(t, "google", rule.IDP)
+		assert.False(t, rule.BlockPassword)
+	}
+	// Client rules take precedence over global rules
+	rule = app.MatchIDPRoutingRule("bob@example.com", globalRules)
+	if assert.NotNil(t, rule) {
+		assert.Equal(t, "mock", rule.IDP)
+		assert.True(t, rule.BlockPassword)
+	}
+
+	assert.Nil(t, app.MatchIDPRoutingRule("bob@notpartner.com", globalRules))
+	assert.Nil(t, app.MatchIDPRoutingRule("bob", globalRules))
+}
+
+func TestLoadIDPRoutingRules(t *testing.T) {
+	viper.Set("idp_routing_rules", []map[string]interface{}{
+		{"domains": []string{"partner.com"}, "idp": "google", "block_password": true},
+	})
+	defer viper.Set("idp_routing_rules", nil)
+
+	rules, err := LoadIDPRoutingRules()
+	if assert.NoError(t, err) && assert.Len(t, rules, 1) {
+		assert.Equal(t, []string{"partner.com"}, rules[0].Domains)
+		assert.Equal(t, "google", rules[0].IDP)
+		assert.True(t, rules[0].BlockPassword)
+	}
+
+	// A rule without an IDP
+	viper.Set("idp_routing_rules", []map[string]interface{}{
+		{"domains": []string{"partner.com"}},
+	})
+	_, err = LoadIDPRoutingRules()
+	assert.Error(t, err)
+
+	// Malformed config
+	viper.Set("idp_routing_rules", "partner.com")
+	_, err = LoadIDPRoutingRules()
+	assert.Error(t, err)
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"encoding/json"
+	"strings"
 	"sync"
 
 	"authcore.io/authcore/pkg/secret"
@@ -26,6 +27,9 @@ var SecretConfigKey = []string{
 	"apple_app_private_key",
 	"matters_app_secret",
 	"twitter_consumer_secret",
+	"saml_sp_private_key",
+	"saml_idp_private_key",
+	"ldap_bind_password",
 	"sendgrid_api_key",
 	"twilio_account_sid",
 	"twilio_service_sid",
@@ -40,6 +44,14 @@ var SecretConfigKey = []string{
 	"secrets.secretd_client_private_key",
 }
 
+// SecretConfigKeyPattern contains patterns of secret config keys nested in maps keyed by name that
+// are masked when the config is printed. A "*" segment matches any key.
+var SecretConfigKeyPattern = []string{
+	"oidc_providers.*.client_secret",
+	"oauth2_providers.*.client_secret",
+	"authn_hooks.*.secret",
+}
+
 // InitConfig set the defaults and read config from config files.
 func InitConfig() {
 	initEnv("authcore")
@@ -60,13 +72,36 @@ func InitSecretConfig(keys []string) {
 
 // PrintConfig prints all settings to stdout.
 func PrintConfig() {
-	allSettings, err := json.MarshalIndent(viper.AllSettings(), "", "  ")
+	settings := viper.AllSettings()
+	for _, pattern := range SecretConfigKeyPattern {
+		maskSettings(settings, strings.Split(pattern, "."))
+	}
+	allSettings, err := json.MarshalIndent(settings, "", "  ")
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
 	log.Printf("resolved settings: %s", allSettings)
 }
 
+// maskSettings replaces the string settings at path with secret.String so that they are masked
+// when marshalled.
+func maskSettings(settings map[string]interface{}, path []string) {
+	for key, value := range settings {
+		if path[0] != "*" && key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			if s, ok := value.(string); ok {
+				settings[key] = secret.NewString(s)
+			}
+			continue
+		}
+		if m, ok := value.(map[string]interface{}); ok {
+			maskSettings(m, path[1:])
+		}
+	}
+}
+
 // InitDefaults initializes default configs.
 func InitDefaults() {
 	// template
@@ -91,6 +126,7 @@ func InitDefaults() {
 	viper.SetDefault("apiv1_enabled", false)
 
 	// server
+	viper.SetDefault("storage_backend", "redis") // One of "redis" or "memory".
 	viper.SetDefault("redis_address", "localhost:6379")
 	viper.SetDefault("redis_password", "")
 	viper.SetDefault("redis_db", 0)
@@ -116,24 +152,120 @@ func InitDefaults() {
 	viper.SetDefault("second_factor_rate_limit_count", "10")
 	viper.SetDefault("authentication_rate_limit_interval", "3h")
 	viper.SetDefault("authentication_rate_limit_count", "10")
+	viper.SetDefault("authentication_ip_rate_limit_interval", "1h")
+	viper.SetDefault("authentication_ip_rate_limit_count", "50")
+	viper.SetDefault("authentication_ip_rate_limit_ipv4_prefix", 32)
+	viper.SetDefault("authentication_ip_rate_limit_ipv6_prefix", 64)
+	viper.SetDefault("authentication_handle_rate_limit_interval", "1h")
+	viper.SetDefault("authentication_handle_rate_limit_count", "10")
+	viper.SetDefault("authentication_global_rate_limit_interval", "1m")
+	viper.SetDefault("authentication_global_rate_limit_count", "0") // Disabled.
 	viper.SetDefault("pow_challenge_time_limit", "10m")
 	viper.SetDefault("authentication_time_limit", "15m")
 	viper.SetDefault("reset_password_count_limit", 5)
 	viper.SetDefault("authenticate_reset_password_time_limit", "504h") // 3 weeks.
 	viper.SetDefault("authorization_token_expires_in", "10m")
 	viper.SetDefault("pow_challenge_difficulty", "65536")
+	viper.SetDefault("pow_challenge_max_difficulty", "4194304")
+	viper.SetDefault("challenge_type", "pow") // One of "pow" or "captcha".
+	viper.SetDefault("challenge_required", false)
+	viper.SetDefault("challenge_failure_threshold", "3")
+	viper.SetDefault("captcha_provider", "") // "stub" accepts captcha_stub_response for testing.
+	viper.SetDefault("captcha_stub_site_key", "")
+	viper.SetDefault("captcha_stub_response", "")
+	viper.SetDefault("invitation_expires_in", "168h") // 7 days.
+	viper.SetDefault("authn_hook_timeout", "5s")
+	viper.SetDefault("authn_hooks", map[string]interface{}{}) // Keyed by name; see authn/hook.Hook.
 	viper.SetDefault("access_token_expires_in", "8h")
 	viper.SetDefault("access_token_private_key", "")
-	viper.SetDefault("session_expires_in", "720h") // 30 days.
+	viper.SetDefault("session_expires_in", "720h")     // 30 days.
+	viper.SetDefault("impersonation_expires_in", "1h") // Default and maximum lifetime of impersonation sessions.
 	viper.SetDefault("default_client_id", "")
 	viper.SetDefault("sms_code_length", "6")
 	viper.SetDefault("sms_code_expiry", "5m")
+	viper.SetDefault("email_otp_code_length", "6")
+	viper.SetDefault("email_otp_code_expiry", "10m")
+	viper.SetDefault("email_otp_rate_limit_interval", "1m")
+	viper.SetDefault("email_otp_rate_limit_count", "1")
+	viper.SetDefault("second_factor_enrollment_time_limit", "15m")
 	viper.SetDefault("reset_link_expiry", "5m")
 	viper.SetDefault("reset_password_redirect_link", "%s/web/sign-in")
 	viper.SetDefault("default_idp_list", []string{})
+	viper.SetDefault("max_password_age", "0s") // Disabled.
+	// idp_routing_rules is a list of {domains, idp, block_password} routing users to an IDP by the
+	// domain of their email address.
+	viper.SetDefault("idp_routing_rules", []interface{}{})
+	viper.SetDefault("oidc_providers", map[string]interface{}{})   // Keyed by name; see authn/idp.OIDCConfig.
+	viper.SetDefault("oauth2_providers", map[string]interface{}{}) // Keyed by name; see authn/idp.OAuth2Config.
+	viper.SetDefault("saml_providers", map[string]interface{}{})   // Keyed by name; see authn/idp.SAMLConfig.
+	viper.SetDefault("idp_provisioning", map[string]interface{}{}) // Keyed by IDP; see authn/idp.ProvisioningRules.
+	viper.SetDefault("saml_sp_private_key", "")                    // PEM-encoded RSA key signing SAML requests.
+	viper.SetDefault("saml_sp_certificate", "")                    // PEM-encoded certificate of saml_sp_private_key.
+	viper.SetDefault("saml_idp_private_key", "")                   // PEM-encoded RSA key signing SAML assertions.
+	viper.SetDefault("saml_idp_certificate", "")                   // PEM-encoded certificate of saml_idp_private_key; enables the SAML IdP.
+	// Upstream IDP tokens are stored for the token vault. Google issues refresh tokens only with
+	// google_offline_access.
+	viper.SetDefault("google_scopes", []string{"email"})
+	viper.SetDefault("google_offline_access", false)
+	viper.SetDefault("idp_token_refresh_leeway", "1m") // Refresh access tokens expiring within it.
+	// Signing keys of IDPs are cached for the lifetime given by the cache headers of the JWKS endpoint.
+	viper.SetDefault("jwks_refetch_interval", "1m") // Minimum interval between fetches for unknown key IDs.
+	viper.SetDefault("jwks_max_stale", "24h")       // Use expired keys while the endpoint is unreachable.
+	// Sign-In with Ethereum (EIP-4361) for the client apps with ethereum_enabled.
+	viper.SetDefault("siwe_statement", "Sign in with your Ethereum account.")
+	viper.SetDefault("siwe_message_expiry", "5m")
+	// Cross-device sign-in by QR code for the client apps with qr_sign_in_enabled.
+	viper.SetDefault("qr_code_expiry", "2m")
+	viper.SetDefault("get_state_max_wait", "30s") // Maximum wait of long-polling get_state.
+	// LDAP directory for the client apps with ldap_enabled. ldap:// URLs require ldap_start_tls.
+	viper.SetDefault("ldap_url", "") // Enables the LDAP directory, e.g. ldaps://ad.example.com.
+	viper.SetDefault("ldap_start_tls", false)
+	viper.SetDefault("ldap_ca_certificate", "") // PEM-encoded CA certificates of the directory; system roots if empty.
+	viper.SetDefault("ldap_bind_dn", "")        // Service account searching users; anonymous if empty.
+	viper.SetDefault("ldap_bind_password", "")
+	viper.SetDefault("ldap_base_dn", "")
+	viper.SetDefault("ldap_user_filter", "(&(objectClass=person)(|(sAMAccountName={handle})(mail={handle})))")
+	viper.SetDefault("ldap_id_attribute", "objectGUID")
+	viper.SetDefault("ldap_attributes", map[string]string{ // User field to LDAP attribute.
+		"name":  "displayName",
+		"email": "mail",
+	})
+	viper.SetDefault("ldap_group_attribute", "memberOf")
+	viper.SetDefault("ldap_group_roles", []interface{}{}) // List of {group, role}; roles are synced on sign in.
+	viper.SetDefault("ldap_link_users_by_email", false)   // Links new entries to users of the same verified email without proof of ownership.
 
 	viper.SetDefault("create_oauth_factor_state_expires_in", "10m")
 
+	// risk engine
+	viper.SetDefault("risk_engine_enabled", false)
+	// Each signal maps to one of "allow", "challenge", "require_mfa" or "block".
+	viper.SetDefault("risk_rules", map[string]string{
+		"new_device":        "require_mfa",
+		"new_subnet":        "require_mfa",
+		"impossible_travel": "block",
+		"failed_attempts":   "require_mfa",
+		"mfa_expired":       "require_mfa",
+	})
+	viper.SetDefault("risk_known_device_expiry", "2160h") // 90 days.
+	viper.SetDefault("risk_recent_session_count", 10)
+	viper.SetDefault("risk_subnet_ipv4_prefix", 24)
+	viper.SetDefault("risk_subnet_ipv6_prefix", 48)
+	viper.SetDefault("risk_impossible_travel_speed", 1000) // km/h
+	viper.SetDefault("risk_failed_attempts_threshold", 3)
+	viper.SetDefault("risk_mfa_max_age", "720h") // 30 days.
+	viper.SetDefault("geoip_database_path", "")
+
+	// MFA enrollment
+	viper.SetDefault("mfa_required", false)
+	viper.SetDefault("mfa_required_roles", []string{})
+	viper.SetDefault("mfa_enrollment_methods", []string{"totp", "sms_otp"})
+
+	// step-up authentication
+	viper.SetDefault("step_up_max_age", "5m")
+
+	// trusted devices
+	viper.SetDefault("trusted_device_expires_in", "720h") // 30 days.
+
 	viper.SetDefault("matters_unlink_disabled", false)
 	viper.SetDefault("analytics_token", "")
 
@@ -147,6 +279,12 @@ func InitDefaults() {
 	viper.SetDefault("reset_password_authentication_email_sender_address", "noreply@authcore.io")
 	viper.SetDefault("verification_email_sender_name", "Authcore")
 	viper.SetDefault("verification_email_sender_address", "noreply@authcore.io")
+	viper.SetDefault("authentication_email_sender_name", "Authcore")
+	viper.SetDefault("authentication_email_sender_address", "noreply@authcore.io")
+	viper.SetDefault("invitation_email_sender_name", "Authcore")
+	viper.SetDefault("invitation_email_sender_address", "noreply@authcore.io")
+	viper.SetDefault("impersonation_email_sender_name", "Authcore")
+	viper.SetDefault("impersonation_email_sender_address", "noreply@authcore.io")
 
 	// identity
 	viper.SetDefault("require_user_email_or_phone", true)
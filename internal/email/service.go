@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"authcore.io/authcore/internal/languages"
 	"authcore.io/authcore/internal/template"
@@ -94,6 +95,48 @@ func (s *Service) SendResetLinkV2(ctx context.Context, resetLink, emailAddress,
 	return sendMail(emailTemplate, m, "", emailAddress, viper.GetString("reset_password_authentication_email_sender_name"), viper.GetString("reset_password_authentication_email_sender_address"))
 }
 
+// SendAuthenticationMail sends a mail containing an one-time password for authentication.
+func (s *Service) SendAuthenticationMail(ctx context.Context, emailAddress, lang, code string) error {
+	emailTemplate, err := s.getEmailTemplate(ctx, "AuthenticationMail", lang)
+	if err != nil {
+		return err
+	}
+	m := map[string]string{
+		"code":         code,
+		"display_name": "",
+	}
+	return sendMail(emailTemplate, m, "", emailAddress, viper.GetString("authentication_email_sender_name"), viper.GetString("authentication_email_sender_address"))
+}
+
+// SendInvitationMail sends a mail containing an invitation link to sign up.
+func (s *Service) SendInvitationMail(ctx context.Context, invitationLink, emailAddress, lang string, expiredAt time.Time) error {
+	emailTemplate, err := s.getEmailTemplate(ctx, "InvitationMail", lang)
+	if err != nil {
+		return err
+	}
+	m := map[string]string{
+		"invitation_link": invitationLink,
+		"expired_at":      expiredAt.UTC().Format("2006-01-02 15:04 MST"),
+		"display_name":    "",
+	}
+	return sendMail(emailTemplate, m, "", emailAddress, viper.GetString("invitation_email_sender_name"), viper.GetString("invitation_email_sender_address"))
+}
+
+// SendImpersonationMail sends a mail notifying the user that an administrator has signed in to the
+// account.
+func (s *Service) SendImpersonationMail(ctx context.Context, displayName, emailAddress, lang, impersonatorName string, expiredAt time.Time) error {
+	emailTemplate, err := s.getEmailTemplate(ctx, "ImpersonationMail", lang)
+	if err != nil {
+		return err
+	}
+	m := map[string]string{
+		"impersonator_name": impersonatorName,
+		"expired_at":        expiredAt.UTC().Format("2006-01-02 15:04 MST"),
+		"display_name":      displayName,
+	}
+	return sendMail(emailTemplate, m, displayName, emailAddress, viper.GetString("impersonation_email_sender_name"), viper.GetString("impersonation_email_sender_address"))
+}
+
 func sendMail(emailTemplate emailTemplate, emailContentMap map[string]string, displayName, emailAddress, senderName, senderAddress string) error {
 	if strings.HasSuffix(os.Args[0], ".test") {
 		return nil
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	stringsUtil "authcore.io/authcore/pkg/strings"
 
@@ -52,6 +53,7 @@ type Error struct {
 	error
 	kind            Kind
 	fieldViolations []FieldViolation
+	retryAfter      time.Duration
 }
 
 // Format formats the error.
@@ -73,6 +75,12 @@ func (e *Error) FieldViolations() []FieldViolation {
 	return e.fieldViolations
 }
 
+// RetryAfter returns the duration after which the request may be retried. It returns zero if there
+// is no hint.
+func (e *Error) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
 // GRPCStatus implements the GRPCStatus from internal error, it builds field violations detail if provided.
 func (e *Error) GRPCStatus() *status.Status {
 	code := GRPCStatusCodeFromKind(e.kind)
@@ -148,6 +156,19 @@ func WithFieldViolations(kind Kind, msg string, fieldViolations []FieldViolation
 	}
 }
 
+// WithRetryAfter returns an error with a hint of the duration after which the request may be
+// retried.
+func WithRetryAfter(kind Kind, msg string, retryAfter time.Duration) error {
+	if msg == "" {
+		msg = string(kind)
+	}
+	return &Error{
+		error:      errors.New(msg),
+		kind:       kind,
+		retryAfter: retryAfter,
+	}
+}
+
 // WithValidateError maps a Validate error into an internal error representation.
 func WithValidateError(err error) error {
 	if err == nil {
@@ -4,6 +4,7 @@ import (
 	stderrors "errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
@@ -32,6 +33,15 @@ func TestHTTPError(t *testing.T) {
 	assert.Equal(t, "internal error", he.Message)
 }
 
+func TestRetryAfter(t *testing.T) {
+	err := WithRetryAfter(ErrorResourceExhausted, "", 30*time.Second)
+	assert.Equal(t, 30*time.Second, err.(*Error).RetryAfter())
+	assert.Equal(t, 429, err.(*Error).HTTPError().Code)
+
+	err = New(ErrorResourceExhausted, "")
+	assert.Equal(t, time.Duration(0), err.(*Error).RetryAfter())
+}
+
 func TestIsKind(t *testing.T) {
 	err := New(ErrorNotFound, "internal error")
 	assert.True(t, IsKind(err, ErrorNotFound))
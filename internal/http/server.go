@@ -1,7 +1,9 @@
 package http
 
 import (
+	"math"
 	"path/filepath"
+	"strconv"
 
 	"authcore.io/authcore/internal/errors"
 	"authcore.io/authcore/internal/validator"
@@ -61,6 +63,10 @@ func (s *Server) Echo() *echo.Echo {
 // handle it using echo.DefaultHTTPErrorHandler.
 func (s *Server) httpErrorHandler(err error, c echo.Context) {
 	if ie, ok := err.(*errors.Error); ok {
+		if retryAfter := ie.RetryAfter(); retryAfter > 0 {
+			seconds := int64(math.Ceil(retryAfter.Seconds()))
+			c.Response().Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+		}
 		err = ie.HTTPError()
 	}
 	s.e.DefaultHTTPErrorHandler(err, c)
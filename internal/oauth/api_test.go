@@ -40,9 +40,10 @@ oNBTatFJjSOJ/qRrBbqvbZDiPOLpJ7vlaQ==
 	testutil.FixturesSetUp()
 	d := db.NewDBFromConfig()
 	redis := testutil.RedisForTest()
+	kv := testutil.KVStoreForTest()
 	encryptor := testutil.EncryptorForTest()
-	authnStore := authn.NewStore(redis, encryptor)
-	userStore := user.NewStore(d, redis, encryptor)
+	authnStore := authn.NewStore(kv, encryptor)
+	userStore := user.NewStore(d, kv, encryptor)
 	sessionStore := session.NewStore(d, redis, userStore)
 	tc := authn.NewTransactionController(d, authnStore, userStore, sessionStore)
 
@@ -32,8 +32,9 @@ func enforcerForTest() (*Enforcer, func()) {
 	testutil.FixturesSetUp()
 	db := dbx.NewDBFromConfig()
 	redis := testutil.RedisForTest()
+	kv := testutil.KVStoreForTest()
 	encryptor := testutil.EncryptorForTest()
-	userStore := user.NewStore(db, redis, encryptor)
+	userStore := user.NewStore(db, kv, encryptor)
 	sessionStore := session.NewStore(db, redis, userStore)
 	enforcer := NewEnforcer(userStore, sessionStore)
 
@@ -0,0 +1,205 @@
+package samlidp
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"time"
+
+	"authcore.io/authcore/internal/authn"
+	"authcore.io/authcore/internal/clientapp"
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/cryptoutil"
+	"authcore.io/authcore/pkg/kvstore"
+
+	"github.com/crewjam/saml"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// requestExpiry is the time for a user to sign in after an AuthnRequest is received.
+	requestExpiry = 30 * time.Minute
+)
+
+// API registers the endpoints of the SAML 2.0 identity provider. The SSO endpoint accepts
+// AuthnRequests with the HTTP-Redirect and HTTP-POST bindings and redirects users to the sign in
+// widget. The widget runs the authn transaction and redirects back to the callback endpoint with an
+// authorization code, which is exchanged for a session to issue the assertion.
+func API(identityProvider *saml.IdentityProvider, userStore *user.Store, tc *authn.TransactionController, kv kvstore.Store) func(e *echo.Echo) {
+	return func(e *echo.Echo) {
+		h := &handler{
+			idp:       identityProvider,
+			userStore: userStore,
+			tc:        tc,
+			kv:        kv,
+		}
+		e.GET("/saml/idp/metadata", h.Metadata)
+		e.GET("/saml/idp/sso", h.SSO)
+		e.POST("/saml/idp/sso", h.SSO)
+		e.GET("/saml/idp/callback", h.Callback)
+	}
+}
+
+type handler struct {
+	idp       *saml.IdentityProvider
+	userStore *user.Store
+	tc        *authn.TransactionController
+	kv        kvstore.Store
+}
+
+// pendingRequest is an AuthnRequest waiting for the user to sign in.
+type pendingRequest struct {
+	ClientID     string    `json:"client_id"`
+	Request      []byte    `json:"request"`
+	RelayState   string    `json:"relay_state"`
+	ReceivedAt   time.Time `json:"received_at"`
+	CodeVerifier string    `json:"code_verifier"`
+}
+
+// Metadata returns the SAML metadata of the identity provider.
+func (h *handler) Metadata(c echo.Context) error {
+	data, err := xml.MarshalIndent(Metadata(h.idp), "", "  ")
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return c.Blob(http.StatusOK, "application/samlmetadata+xml", data)
+}
+
+// SSO implements the single sign-on service.
+func (h *handler) SSO(c echo.Context) error {
+	req, err := saml.NewIdpAuthnRequest(h.idp, c.Request())
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorInvalidArgument, "invalid SAML request")
+	}
+	err = req.Validate()
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorInvalidArgument, "invalid SAML request")
+	}
+	clientApp, err := clientapp.GetBySAMLEntityID(req.ServiceProviderMetadata.EntityID)
+	if err != nil {
+		return err
+	}
+
+	pending := &pendingRequest{
+		ClientID:     clientApp.ID,
+		Request:      req.RequestBuffer,
+		RelayState:   req.RelayState,
+		ReceivedAt:   req.Now,
+		CodeVerifier: cryptoutil.RandomToken32(),
+	}
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	token := cryptoutil.RandomToken32()
+	err = h.kv.Set(requestKey(token), string(data), requestExpiry)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+
+	// Redirect to sign in widget
+	redirectURL, err := url.Parse("/widgets/signin")
+	if err != nil {
+		log.Fatal(err)
+	}
+	codeChallenge := sha256.Sum256([]byte(pending.CodeVerifier))
+	q := redirectURL.Query()
+	q.Add("responseType", "code")
+	q.Add("clientId", clientApp.ID)
+	q.Add("redirectURI", endpointURL("callback").String())
+	q.Add("clientState", token)
+	q.Add("codeChallenge", base64.RawURLEncoding.EncodeToString(codeChallenge[:]))
+	q.Add("codeChallengeMethod", "S256")
+	redirectURL.RawQuery = q.Encode()
+	return c.Redirect(http.StatusFound, redirectURL.String())
+}
+
+// Callback issues an assertion to the service provider with the HTTP-POST binding after the user
+// has signed in.
+func (h *handler) Callback(c echo.Context) error {
+	r := new(CallbackRequest)
+	if err := c.Bind(r); err != nil {
+		return err
+	}
+	if err := c.Validate(r); err != nil {
+		return err
+	}
+	ctx := c.Request().Context()
+
+	data, err := h.kv.Get(requestKey(r.State))
+	if err == kvstore.ErrNotFound {
+		return errors.New(errors.ErrorNotFound, "SAML request not found or expired")
+	} else if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	_, err = h.kv.Delete(requestKey(r.State))
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	pending := &pendingRequest{}
+	err = json.Unmarshal([]byte(data), pending)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+
+	sess, err := h.tc.ExchangeSession(ctx, pending.ClientID, endpointURL("callback").String(), r.Code, pending.CodeVerifier)
+	if err != nil {
+		return err
+	}
+	u, err := h.userStore.UserByID(ctx, sess.UserID)
+	if err != nil {
+		return err
+	}
+
+	// The request is validated again against the current service provider configuration at the
+	// time it was received.
+	req := &saml.IdpAuthnRequest{
+		IDP:           h.idp,
+		HTTPRequest:   c.Request(),
+		RelayState:    pending.RelayState,
+		RequestBuffer: pending.Request,
+		Now:           pending.ReceivedAt,
+	}
+	err = req.Validate()
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorInvalidArgument, "invalid SAML request")
+	}
+	req.Now = saml.TimeNow()
+	clientApp, err := clientapp.GetBySAMLEntityID(req.ServiceProviderMetadata.EntityID)
+	if err != nil {
+		return err
+	}
+	if clientApp.ID != pending.ClientID {
+		return errors.New(errors.ErrorPermissionDenied, "client_id mismatch")
+	}
+
+	err = makeAssertion(req, clientApp.SAML, u, sess)
+	if err != nil {
+		return err
+	}
+	err = req.MakeAssertionEl()
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	err = req.WriteResponse(c.Response())
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return nil
+}
+
+func requestKey(token string) string {
+	return "saml_idp_request/" + token
+}
+
+// CallbackRequest is the request for Callback.
+type CallbackRequest struct {
+	Code  string `query:"code" validate:"required"`
+	State string `query:"state" validate:"required"`
+}
@@ -0,0 +1,219 @@
+// Package samlidp implements Authcore as a SAML 2.0 identity provider for client apps.
+package samlidp
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"authcore.io/authcore/internal/authn/idp"
+	"authcore.io/authcore/internal/clientapp"
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/session"
+	"authcore.io/authcore/internal/user"
+
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// nameIDFormats lists the NameID formats published in the IdP metadata.
+var nameIDFormats = []saml.NameIDFormat{
+	saml.PersistentNameIDFormat,
+	saml.EmailAddressNameIDFormat,
+	saml.UnspecifiedNameIDFormat,
+}
+
+// NewIdentityProvider returns a SAML identity provider signing assertions with the key pair in the
+// saml_idp_private_key and saml_idp_certificate config.
+func NewIdentityProvider() (*saml.IdentityProvider, error) {
+	key, cert, err := idp.SAMLKeyPair("saml_idp_private_key", "saml_idp_certificate")
+	if err != nil {
+		return nil, err
+	}
+	return &saml.IdentityProvider{
+		Key:                     key,
+		Certificate:             cert,
+		MetadataURL:             *endpointURL("metadata"),
+		SSOURL:                  *endpointURL("sso"),
+		ServiceProviderProvider: serviceProviders{},
+		SignatureMethod:         dsig.RSASHA256SignatureMethod,
+	}, nil
+}
+
+// Metadata returns the metadata of the identity provider.
+func Metadata(identityProvider *saml.IdentityProvider) *saml.EntityDescriptor {
+	metadata := identityProvider.Metadata()
+	metadata.IDPSSODescriptors[0].NameIDFormats = nameIDFormats
+	return metadata
+}
+
+// serviceProviders looks up the metadata of service providers from the client apps.
+type serviceProviders struct{}
+
+// GetServiceProvider implements saml.ServiceProviderProvider.
+func (serviceProviders) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	clientApp, err := clientapp.GetBySAMLEntityID(serviceProviderID)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	return serviceProviderMetadata(clientApp.SAML)
+}
+
+// serviceProviderMetadata returns the metadata of a service provider, which is built from the entity
+// ID and the ACS URL if the metadata is not configured.
+func serviceProviderMetadata(sp *clientapp.SAMLServiceProvider) (*saml.EntityDescriptor, error) {
+	if sp.Metadata != "" {
+		metadata := &saml.EntityDescriptor{}
+		err := xml.Unmarshal([]byte(sp.Metadata), metadata)
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrorInvalidArgument, "invalid SAML service provider metadata")
+		}
+		if metadata.EntityID != sp.EntityID {
+			return nil, errors.Errorf(errors.ErrorInvalidArgument, "SAML service provider metadata has entity ID %v, expected %v", metadata.EntityID, sp.EntityID)
+		}
+		return metadata, nil
+	}
+	if sp.ACSURL == "" {
+		return nil, errors.Errorf(errors.ErrorInvalidArgument, "SAML service provider %v requires metadata or acs_url", sp.EntityID)
+	}
+	return &saml.EntityDescriptor{
+		EntityID: sp.EntityID,
+		SPSSODescriptors: []saml.SPSSODescriptor{{
+			SSODescriptor: saml.SSODescriptor{
+				RoleDescriptor: saml.RoleDescriptor{
+					ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+				},
+			},
+			AssertionConsumerServices: []saml.IndexedEndpoint{{
+				Binding:  saml.HTTPPostBinding,
+				Location: sp.ACSURL,
+				Index:    1,
+			}},
+		}},
+	}, nil
+}
+
+// makeAssertion builds the assertion for the user in the session and assigns it to req.Assertion.
+// The NameID and the attributes are mapped from the user as configured for the service provider.
+func makeAssertion(req *saml.IdpAuthnRequest, sp *clientapp.SAMLServiceProvider, u *user.User, sess *session.Session) error {
+	nameIDField := sp.NameID
+	if nameIDField == "" {
+		nameIDField = "public_id"
+	}
+	nameID, ok := userField(u, nameIDField)
+	if !ok || nameID == "" {
+		return errors.Errorf(errors.ErrorFailedPrecondition, "user has no %v for SAML NameID", nameIDField)
+	}
+	nameIDFormat := sp.NameIDFormat
+	if nameIDFormat == "" {
+		nameIDFormat = string(saml.PersistentNameIDFormat)
+	}
+
+	err := saml.DefaultAssertionMaker{}.MakeAssertion(req, &saml.Session{
+		ID:           sess.PublicID(),
+		CreateTime:   sess.CreatedAt,
+		ExpireTime:   sess.ExpiredAt,
+		Index:        sess.PublicID(),
+		NameID:       nameID,
+		NameIDFormat: nameIDFormat,
+	})
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+
+	// Replace the default attributes which are derived from the attributes requested in the SP
+	// metadata.
+	var attributes []saml.Attribute
+	for _, attr := range sp.Attributes {
+		value, ok := userField(u, attr.Field)
+		if !ok {
+			continue
+		}
+		nameFormat := "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+		if strings.Contains(attr.Name, ":") {
+			nameFormat = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+		}
+		attributes = append(attributes, saml.Attribute{
+			Name:       attr.Name,
+			NameFormat: nameFormat,
+			Values:     []saml.AttributeValue{{Type: "xs:string", Value: value}},
+		})
+	}
+	if len(attributes) == 0 {
+		req.Assertion.AttributeStatements = nil
+	} else {
+		req.Assertion.AttributeStatements = []saml.AttributeStatement{{Attributes: attributes}}
+	}
+	return nil
+}
+
+// userField returns the value of a user field for SAML. It returns false if the field is not set.
+func userField(u *user.User, field string) (string, bool) {
+	switch field {
+	case "id", "public_id":
+		return u.PublicID(), true
+	case "name":
+		return u.Name.String, u.Name.Valid
+	case "username":
+		return u.Username.String, u.Username.Valid
+	case "email":
+		return u.Email.String, u.Email.Valid
+	case "email_verified":
+		return strconv.FormatBool(u.EmailVerified()), true
+	case "phone":
+		return u.Phone.String, u.Phone.Valid
+	case "phone_verified":
+		return strconv.FormatBool(u.PhoneVerified()), true
+	case "language":
+		return u.RealLanguage(), true
+	}
+	if path := strings.TrimPrefix(field, "user_metadata."); path != field {
+		return metadataField(u.UserMetadata.Struct, path)
+	}
+	if path := strings.TrimPrefix(field, "app_metadata."); path != field {
+		return metadataField(u.AppMetadata.Struct, path)
+	}
+	return "", false
+}
+
+// metadataField returns the scalar value at a dot-separated path of user or app metadata.
+func metadataField(metadata map[string]interface{}, path string) (string, bool) {
+	var v interface{} = metadata
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		v, ok = m[key]
+		if !ok {
+			return "", false
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// endpointURL returns the URL of an endpoint of the identity provider.
+func endpointURL(endpoint string) *url.URL {
+	baseURL, err := url.Parse(viper.GetString("base_url"))
+	if err != nil {
+		log.Fatalf("invalid base_url: %v", err)
+	}
+	u, err := baseURL.Parse("/saml/idp/" + endpoint)
+	if err != nil {
+		log.Fatalf("error building SAML URL: %v", err)
+	}
+	return u
+}
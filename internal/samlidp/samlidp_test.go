@@ -0,0 +1,290 @@
+package samlidp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"authcore.io/authcore/internal/clientapp"
+	"authcore.io/authcore/internal/config"
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/session"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/internal/validator"
+	"authcore.io/authcore/pkg/kvstore"
+	"authcore.io/authcore/pkg/nulls"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func keyPairForTest(t *testing.T, cn string) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cert, err := x509.ParseCertificate(der)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return key, cert
+}
+
+func TestSSO(t *testing.T) {
+	config.InitDefaults()
+	defer viper.Reset()
+
+	idpKey, idpCert := keyPairForTest(t, "authcore.localhost")
+	viper.Set("saml_idp_private_key", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(idpKey)})))
+	viper.Set("saml_idp_certificate", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: idpCert.Raw})))
+	identityProvider, err := NewIdentityProvider()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	spKey, spCert := keyPairForTest(t, "wiki.example.com")
+	spMetadataURL, _ := url.Parse("https://wiki.example.com/saml/metadata")
+	spACSURL, _ := url.Parse("https://wiki.example.com/saml/acs")
+	sp := &saml.ServiceProvider{
+		EntityID:    spMetadataURL.String(),
+		Key:         spKey,
+		Certificate: spCert,
+		MetadataURL: *spMetadataURL,
+		AcsURL:      *spACSURL,
+		IDPMetadata: Metadata(identityProvider),
+	}
+	spMetadata, err := xml.Marshal(sp.Metadata())
+	if !assert.NoError(t, err) {
+		return
+	}
+	viper.Set("applications.wiki.name", "Wiki")
+	viper.Set("applications.wiki.saml", map[string]interface{}{
+		"entity_id":      sp.EntityID,
+		"metadata":       string(spMetadata),
+		"name_id_format": string(saml.EmailAddressNameIDFormat),
+		"name_id":        "email",
+		"attributes": []interface{}{
+			map[string]interface{}{"name": "displayName", "field": "name"},
+			map[string]interface{}{"name": "department", "field": "app_metadata.org.department"},
+			map[string]interface{}{"name": "nickname", "field": "user_metadata.nickname"},
+		},
+	})
+
+	kv := kvstore.NewMemoryStore()
+	e := echo.New()
+	e.Validator = validator.Validator
+	API(identityProvider, nil, nil, kv)(e)
+
+	// Metadata
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/saml/idp/metadata", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "https://authcore.localhost/saml/idp/sso")
+	assert.Contains(t, rec.Body.String(), string(saml.EmailAddressNameIDFormat))
+
+	// AuthnRequest with the HTTP-Redirect binding
+	authnRequest, err := sp.MakeAuthenticationRequest(identityProvider.SSOURL.String(), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if !assert.NoError(t, err) {
+		return
+	}
+	authURL, err := authnRequest.Redirect("relay", sp)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, authURL.RequestURI(), nil))
+	if !assert.Equal(t, http.StatusFound, rec.Code) {
+		return
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "/widgets/signin", location.Path)
+	assert.Equal(t, "wiki", location.Query().Get("clientId"))
+	assert.Equal(t, "https://authcore.localhost/saml/idp/callback", location.Query().Get("redirectURI"))
+	assert.Equal(t, "S256", location.Query().Get("codeChallengeMethod"))
+
+	data, err := kv.Get(requestKey(location.Query().Get("clientState")))
+	if !assert.NoError(t, err) {
+		return
+	}
+	pending := &pendingRequest{}
+	if !assert.NoError(t, json.Unmarshal([]byte(data), pending)) {
+		return
+	}
+	assert.Equal(t, "wiki", pending.ClientID)
+	assert.Equal(t, "relay", pending.RelayState)
+
+	// AuthnRequest with the HTTP-POST binding
+	authnRequest, err = sp.MakeAuthenticationRequest(identityProvider.SSOURL.String(), saml.HTTPPostBinding, saml.HTTPPostBinding)
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(authnRequest.Element())
+	requestXML, err := doc.WriteToBytes()
+	if !assert.NoError(t, err) {
+		return
+	}
+	form := url.Values{
+		"SAMLRequest": {base64.StdEncoding.EncodeToString(requestXML)},
+		"RelayState":  {"relay"},
+	}
+	httpReq := httptest.NewRequest(http.MethodPost, "/saml/idp/sso", strings.NewReader(form.Encode()))
+	httpReq.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httpReq)
+	assert.Equal(t, http.StatusFound, rec.Code)
+
+	// Unknown service provider
+	unknownSP := *sp
+	unknownSP.EntityID = "https://unknown.example.com/saml/metadata"
+	authnRequest, err = unknownSP.MakeAuthenticationRequest(identityProvider.SSOURL.String(), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if !assert.NoError(t, err) {
+		return
+	}
+	unknownURL, err := authnRequest.Redirect("relay", &unknownSP)
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := &handler{idp: identityProvider, kv: kv}
+	err = h.SSO(e.NewContext(httptest.NewRequest(http.MethodGet, unknownURL.RequestURI(), nil), httptest.NewRecorder()))
+	assert.True(t, errors.IsKind(err, errors.ErrorInvalidArgument))
+
+	// Assertion for the pending request after the user signs in
+	req := &saml.IdpAuthnRequest{
+		IDP:           identityProvider,
+		HTTPRequest:   httptest.NewRequest(http.MethodGet, "/saml/idp/callback", nil),
+		RelayState:    pending.RelayState,
+		RequestBuffer: pending.Request,
+		Now:           pending.ReceivedAt,
+	}
+	if !assert.NoError(t, req.Validate()) {
+		return
+	}
+	req.Now = saml.TimeNow()
+	u := &user.User{
+		ID:          1,
+		Name:        nulls.NewString("Alice"),
+		Email:       nulls.NewString("alice@example.com"),
+		AppMetadata: nulls.NewJSON(`{"org": {"department": "Engineering"}}`),
+	}
+	sess := &session.Session{ID: 2, UserID: 1, CreatedAt: time.Now(), ExpiredAt: time.Now().Add(time.Hour)}
+	clientApp, err := clientapp.GetBySAMLEntityID(sp.EntityID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = makeAssertion(req, clientApp.SAML, u, sess)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, req.MakeAssertionEl()) || !assert.NoError(t, req.MakeResponse()) {
+		return
+	}
+	doc = etree.NewDocument()
+	doc.SetRoot(req.ResponseEl)
+	responseXML, err := doc.WriteToBytes()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assertion, err := sp.ParseXMLResponse(responseXML, []string{req.Request.ID})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "alice@example.com", assertion.Subject.NameID.Value)
+	assert.Equal(t, string(saml.EmailAddressNameIDFormat), assertion.Subject.NameID.Format)
+	if assert.Len(t, assertion.AttributeStatements, 1) && assert.Len(t, assertion.AttributeStatements[0].Attributes, 2) {
+		attributes := assertion.AttributeStatements[0].Attributes
+		assert.Equal(t, "displayName", attributes[0].Name)
+		assert.Equal(t, "Alice", attributes[0].Values[0].Value)
+		assert.Equal(t, "department", attributes[1].Name)
+		assert.Equal(t, "Engineering", attributes[1].Values[0].Value)
+	}
+
+	// NameID is required
+	u.Email = nulls.String{}
+	err = makeAssertion(req, clientApp.SAML, u, sess)
+	assert.Error(t, err)
+}
+
+func TestServiceProviderMetadata(t *testing.T) {
+	metadata, err := serviceProviderMetadata(&clientapp.SAMLServiceProvider{
+		EntityID: "https://tickets.example.com",
+		ACSURL:   "https://tickets.example.com/saml/consume",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://tickets.example.com", metadata.EntityID)
+		assert.Equal(t, "https://tickets.example.com/saml/consume", metadata.SPSSODescriptors[0].AssertionConsumerServices[0].Location)
+		assert.Equal(t, saml.HTTPPostBinding, metadata.SPSSODescriptors[0].AssertionConsumerServices[0].Binding)
+	}
+
+	// Missing ACS URL
+	_, err = serviceProviderMetadata(&clientapp.SAMLServiceProvider{EntityID: "https://tickets.example.com"})
+	assert.Error(t, err)
+
+	// Entity ID mismatch
+	_, err = serviceProviderMetadata(&clientapp.SAMLServiceProvider{
+		EntityID: "https://tickets.example.com",
+		Metadata: `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://evil.example.com"></EntityDescriptor>`,
+	})
+	assert.Error(t, err)
+}
+
+func TestUserField(t *testing.T) {
+	u := &user.User{
+		ID:           42,
+		Email:        nulls.NewString("bob@example.com"),
+		UserMetadata: nulls.NewJSON(`{"nickname": "bobby", "age": 30, "tags": ["a"]}`),
+	}
+	v, ok := userField(u, "public_id")
+	assert.True(t, ok)
+	assert.Equal(t, "42", v)
+	v, ok = userField(u, "email")
+	assert.True(t, ok)
+	assert.Equal(t, "bob@example.com", v)
+	v, ok = userField(u, "email_verified")
+	assert.True(t, ok)
+	assert.Equal(t, "false", v)
+	v, ok = userField(u, "user_metadata.nickname")
+	assert.True(t, ok)
+	assert.Equal(t, "bobby", v)
+	v, ok = userField(u, "user_metadata.age")
+	assert.True(t, ok)
+	assert.Equal(t, "30", v)
+
+	_, ok = userField(u, "phone")
+	assert.False(t, ok)
+	_, ok = userField(u, "user_metadata.tags")
+	assert.False(t, ok)
+	_, ok = userField(u, "app_metadata.department")
+	assert.False(t, ok)
+	_, ok = userField(u, "password")
+	assert.False(t, ok)
+}
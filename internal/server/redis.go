@@ -1,7 +1,10 @@
 package server
 
 import (
+	"authcore.io/authcore/pkg/kvstore"
+
 	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
@@ -38,3 +41,18 @@ func NewRedisFailoverOptionsFromConfig() *redis.FailoverOptions {
 		DB:            db,
 	}
 }
+
+// NewKVStoreFromConfig creates the storage backend for ephemeral data according to config values.
+// The "memory" backend keeps data in process memory and is only suitable for single-node
+// deployments.
+func NewKVStoreFromConfig(client *redis.Client) kvstore.Store {
+	switch backend := viper.GetString("storage_backend"); backend {
+	case "redis":
+		return kvstore.NewRedisStore(client)
+	case "memory":
+		return kvstore.NewMemoryStore()
+	default:
+		log.Fatalf("unsupported storage backend: %v", backend)
+		return nil
+	}
+}
@@ -8,14 +8,18 @@ import (
 
 	"authcore.io/authcore/internal/audit"
 	"authcore.io/authcore/internal/authn"
+	"authcore.io/authcore/internal/authn/hook"
 	"authcore.io/authcore/internal/authn/idp"
+	"authcore.io/authcore/internal/authn/ldap"
 	"authcore.io/authcore/internal/authn/verifier"
+	"authcore.io/authcore/internal/clientapp"
 	"authcore.io/authcore/internal/config"
 	"authcore.io/authcore/internal/db"
 	"authcore.io/authcore/internal/email"
 	httpServer "authcore.io/authcore/internal/http"
 	"authcore.io/authcore/internal/oauth"
 	"authcore.io/authcore/internal/rbac"
+	"authcore.io/authcore/internal/samlidp"
 	"authcore.io/authcore/internal/secretdgateway"
 	"authcore.io/authcore/internal/session"
 	"authcore.io/authcore/internal/settings"
@@ -30,6 +34,7 @@ import (
 	managementapipb "authcore.io/authcore/pkg/api/managementapi"
 	secretdgatewaypb "authcore.io/authcore/pkg/api/secretdgateway"
 	"authcore.io/authcore/pkg/grpcinterceptor/xrequestid"
+	"authcore.io/authcore/pkg/kvstore"
 	"authcore.io/authcore/pkg/messageencryptor"
 	"authcore.io/authcore/pkg/secret"
 
@@ -55,6 +60,7 @@ type Server struct {
 	rpcLock          sync.Mutex
 	db               *db.DB
 	redis            *redis.Client
+	kv               kvstore.Store
 	keyGenerator     *messageencryptor.KeyGenerator
 	messageEncryptor *messageencryptor.MessageEncryptor
 
@@ -147,6 +153,7 @@ func (s *Server) initDB() {
 
 func (s *Server) initRedis() {
 	s.redis = NewRedisClientFromConfig()
+	s.kv = NewKVStoreFromConfig(s.redis)
 }
 
 func (s *Server) initService() {
@@ -154,7 +161,8 @@ func (s *Server) initService() {
 	s.templateStore = template.NewStore(s.db)
 	s.emailService = email.NewService(s.templateStore)
 	s.smsService = sms.NewService(s.templateStore)
-	s.userStore = user.NewStore(s.db, s.redis, s.messageEncryptor)
+	s.userStore = user.NewStore(s.db, s.kv, s.messageEncryptor)
+	s.userStore.RegisterVerifier(verifier.EmailOTP, verifier.EmailOTPVerifierFactory(s.emailService, s.kv))
 	s.sessionStore = session.NewStore(s.db, s.redis, s.userStore)
 	s.authenticationService = authentication.NewService(s.redis, s.userStore)
 	s.auditStore = audit.NewStore(s.db)
@@ -163,7 +171,7 @@ func (s *Server) initService() {
 	s.rbacService = rbac.NewService(roleResolver, managementapi.PermissionAssignments)
 	s.managementService = managementapi.NewService(s.db, s.userStore, s.sessionStore, s.authenticationService, s.auditStore, s.rbacService, s.templateStore, s.emailService, s.smsService)
 	s.secretdGatewayService, _ = secretdgateway.NewService(s.auditStore)
-	s.authnStore = authn.NewStore(s.redis, s.messageEncryptor)
+	s.authnStore = authn.NewStore(s.kv, s.messageEncryptor)
 	s.enforcer = rbac.NewEnforcer(s.userStore, s.sessionStore)
 	s.initAuthnTC()
 	s.initHTTPServer()
@@ -193,8 +201,21 @@ func (s *Server) initEncryptor() {
 
 func (s *Server) initAuthnTC() {
 	tc := authn.NewTransactionController(s.db, s.authnStore, s.userStore, s.sessionStore)
-	tc.RegisterVerifier(verifier.SMSOTP, verifier.SMSOTPVerifierFactory(s.smsService, s.redis))
-	tc.RegisterVerifier(verifier.ResetLink, verifier.ResetLinkVerifierFactory(s.smsService, s.emailService, s.redis))
+	tc.RegisterVerifier(verifier.SMSOTP, verifier.SMSOTPVerifierFactory(s.smsService, s.kv))
+	tc.RegisterVerifier(verifier.EmailOTP, verifier.EmailOTPVerifierFactory(s.emailService, s.kv))
+	tc.RegisterVerifier(verifier.ResetLink, verifier.ResetLinkVerifierFactory(s.smsService, s.emailService, s.kv))
+	tc.RegisterChallenger(authn.NewPoWChallenger())
+	if viper.GetString("captcha_provider") == "stub" {
+		provider := authn.NewStubCaptchaProvider(viper.GetString("captcha_stub_site_key"), viper.GetString("captcha_stub_response"))
+		tc.RegisterChallenger(authn.NewCaptchaChallenger(provider))
+	}
+	hooks, err := hook.LoadHooks()
+	if err != nil {
+		log.Fatalf("cannot load authentication hooks: %v", err)
+	}
+	for _, h := range hooks {
+		tc.RegisterHook(h)
+	}
 	if viper.IsSet("google_app_id") {
 		tc.RegisterIDP(idp.NewGoogleIDP())
 	}
@@ -210,6 +231,37 @@ func (s *Server) initAuthnTC() {
 	if viper.IsSet("matters_app_id") {
 		tc.RegisterIDP(idp.NewMattersIDP())
 	}
+	idps, err := idp.LoadIDPs(s.kv)
+	if err != nil {
+		log.Fatalf("cannot load IDPs: %v", err)
+	}
+	for _, p := range idps {
+		tc.RegisterIDP(p)
+	}
+	provisioningRules, err := idp.LoadProvisioningRules()
+	if err != nil {
+		log.Fatalf("cannot load IDP provisioning rules: %v", err)
+	}
+	for idpID, rules := range provisioningRules {
+		tc.RegisterProvisioningRules(idpID, rules)
+	}
+	idpRoutingRules, err := clientapp.LoadIDPRoutingRules()
+	if err != nil {
+		log.Fatalf("cannot load IDP routing rules: %v", err)
+	}
+	tc.RegisterIDPRoutingRules(idpRoutingRules)
+	ldapConfig, err := ldap.LoadConfig()
+	if err != nil {
+		log.Fatalf("cannot load LDAP config: %v", err)
+	}
+	if ldapConfig != nil {
+		directory, err := ldap.NewDirectory(*ldapConfig)
+		if err != nil {
+			log.Fatalf("cannot load LDAP directory: %v", err)
+		}
+		tc.RegisterLDAPDirectory(directory)
+	}
+	s.userStore.RegisterOAuthTokenRevoker(tc.RevokeUpstreamTokens)
 	s.authnTC = tc
 }
 
@@ -261,8 +313,15 @@ func (s *Server) initHTTPServer() {
 	s.http.Register(user.APIv2(s.userStore))
 	s.http.Register(registration.APIv2(s.userStore, s.sessionStore, s.emailService, s.smsService))
 	s.http.Register(template.APIv2(s.templateStore))
-	s.http.Register(session.APIv2(s.sessionStore))
+	s.http.Register(session.APIv2(s.sessionStore, s.emailService, s.auditStore))
 	s.http.Register(settings.APIv2())
+	if viper.GetString("saml_idp_certificate") != "" {
+		samlIDP, err := samlidp.NewIdentityProvider()
+		if err != nil {
+			log.Fatalf("cannot load SAML identity provider: %v", err)
+		}
+		s.http.Register(samlidp.API(samlIDP, s.userStore, s.authnTC, s.kv))
+	}
 }
 
 func (s *Server) startGRPCServer() {
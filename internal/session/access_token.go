@@ -19,20 +19,28 @@ type AccessToken struct {
 	ExpiresIn   int64
 }
 
-func generateAccessToken(signer *ecdsa.PrivateKey, userID, sessionID, audience string, userRecord *user.User) (AccessToken, error) {
+// generateAccessToken generates an access token, and an ID token if userRecord is given. Custom
+// claims are added to both tokens but never override the standard claims. If actorID is not empty,
+// the tokens carry an act claim identifying the user acting on behalf of the subject. The tokens
+// never expire after notAfter if it is not zero.
+func generateAccessToken(signer *ecdsa.PrivateKey, userID, sessionID, audience string, userRecord *user.User, customClaims map[string]interface{}, actorID string, notAfter time.Time) (AccessToken, error) {
 	expiresIn := viper.GetDuration("access_token_expires_in")
 	issuer := viper.GetString("base_url")
 	issuedAt := time.Now()
 	expireAt := issuedAt.Add(expiresIn)
+	if !notAfter.IsZero() && notAfter.Before(expireAt) {
+		expireAt = notAfter
+		expiresIn = expireAt.Sub(issuedAt)
+	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, withCustomClaims(withActor(jwt.MapClaims{
 		"iat": issuedAt.Unix(),
 		"exp": expireAt.Unix(),
 		"iss": issuer,
 		"sub": userID,
 		"sid": sessionID,
 		"aud": audience,
-	})
+	}, actorID), customClaims))
 	keyID, err := kidFromECPublicKey(&signer.PublicKey)
 	if err != nil {
 		return AccessToken{}, err
@@ -46,7 +54,7 @@ func generateAccessToken(signer *ecdsa.PrivateKey, userID, sessionID, audience s
 
 	var idTokenString string
 	if userRecord != nil {
-		idToken := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		idToken := jwt.NewWithClaims(jwt.SigningMethodES256, withCustomClaims(withActor(jwt.MapClaims{
 			"iat":                   issuedAt.Unix(),
 			"exp":                   expireAt.Unix(),
 			"iss":                   issuer,
@@ -59,7 +67,7 @@ func generateAccessToken(signer *ecdsa.PrivateKey, userID, sessionID, audience s
 			"phone_number":          userRecord.Phone.String,
 			"phone_number_verified": userRecord.PhoneVerifiedAt.Valid,
 			"preferred_username":    userRecord.Username.String,
-		})
+		}, actorID), customClaims))
 
 		idTokenString, err = idToken.SignedString(signer)
 		if err != nil {
@@ -74,6 +82,23 @@ func generateAccessToken(signer *ecdsa.PrivateKey, userID, sessionID, audience s
 	}, nil
 }
 
+// withActor adds an act claim (RFC 8693) to the claims if actorID is not empty.
+func withActor(claims jwt.MapClaims, actorID string) jwt.MapClaims {
+	if actorID != "" {
+		claims["act"] = map[string]interface{}{"sub": actorID}
+	}
+	return claims
+}
+
+func withCustomClaims(claims jwt.MapClaims, customClaims map[string]interface{}) jwt.MapClaims {
+	for k, v := range customClaims {
+		if _, ok := claims[k]; !ok {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
 // verifyAccessToken verifies the signature of a give JWT token and returns the asserted userID and sessionID.
 func verifyAccessToken(accessTokenPublicKey *ecdsa.PublicKey, serviceAccountsMap map[string]ServiceAccount, token string) (userID string, sessionID string, err error) {
 	jwtToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
@@ -5,8 +5,10 @@ import (
 	"time"
 
 	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/user"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -92,3 +94,51 @@ func TestVerifyServiceAccountAccessToken(t *testing.T) {
 	assert.Equal(t, "", userID)
 	assert.Equal(t, "", sessionID)
 }
+
+func TestGenerateAccessTokenCustomClaims(t *testing.T) {
+	accessTokenPrivateKey, _ := jwt.ParseECPrivateKeyFromPEM([]byte(accessTokenPrivateKeyForTest))
+	customClaims := map[string]interface{}{
+		"plan": "pro",
+		"sub":  "spoofed",
+	}
+	u := &user.User{ID: 1}
+	token, err := generateAccessToken(accessTokenPrivateKey, "1", "2", "app", u, customClaims, "", time.Time{})
+	assert.NoError(t, err)
+
+	for _, tokenString := range []string{token.AccessToken, token.IDToken} {
+		claims := jwt.MapClaims{}
+		_, _, err = new(jwt.Parser).ParseUnverified(tokenString, claims)
+		assert.NoError(t, err)
+		assert.Equal(t, "pro", claims["plan"])
+		assert.Equal(t, "1", claims["sub"])
+	}
+}
+
+func TestGenerateAccessTokenActor(t *testing.T) {
+	viper.Set("access_token_expires_in", "8h")
+	defer viper.Reset()
+	accessTokenPrivateKey, _ := jwt.ParseECPrivateKeyFromPEM([]byte(accessTokenPrivateKeyForTest))
+	customClaims := map[string]interface{}{
+		"act": "spoofed",
+	}
+	notAfter := time.Now().Add(10 * time.Minute)
+	u := &user.User{ID: 1}
+	token, err := generateAccessToken(accessTokenPrivateKey, "1", "2", "app", u, customClaims, "5", notAfter)
+	assert.NoError(t, err)
+	assert.True(t, token.ExpiresIn <= 600)
+
+	for _, tokenString := range []string{token.AccessToken, token.IDToken} {
+		claims := jwt.MapClaims{}
+		_, _, err = new(jwt.Parser).ParseUnverified(tokenString, claims)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"sub": "5"}, claims["act"])
+		assert.Equal(t, float64(notAfter.Unix()), claims["exp"])
+	}
+
+	token, err = generateAccessToken(accessTokenPrivateKey, "1", "2", "app", nil, nil, "", time.Time{})
+	assert.NoError(t, err)
+	claims := jwt.MapClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(token.AccessToken, claims)
+	assert.NoError(t, err)
+	assert.NotContains(t, claims, "act")
+}
@@ -6,21 +6,27 @@ import (
 	"time"
 
 	"authcore.io/authcore/internal/apiutil"
+	"authcore.io/authcore/internal/audit"
+	"authcore.io/authcore/internal/email"
 	"authcore.io/authcore/internal/errors"
 	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/log"
 	"authcore.io/authcore/pkg/nulls"
 	"authcore.io/authcore/pkg/paging"
 	"github.com/jinzhu/copier"
 	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 )
 
 // APIv2 returns a function that registers API 2.0 endpoints with an Echo instance.
-func APIv2(store *Store) func(e *echo.Echo) {
+func APIv2(store *Store, emailService *email.Service, auditor audit.Auditor) func(e *echo.Echo) {
 	return func(e *echo.Echo) {
-		h := &handler{store: store}
+		h := &handler{store: store, emailService: emailService, auditor: auditor}
 
 		g := e.Group("/api/v2")
 		g.GET("/users/:id/sessions", h.ListUserSessions)
+		g.POST("/users/:id/impersonate", h.ImpersonateUser)
 		//g.POST("/users/:id/sessions/create", h.CreateUserSession)
 		g.GET("/sessions/:id", h.GetSession)
 		g.DELETE("/sessions/:id", h.DeleteSession)
@@ -33,7 +39,9 @@ func APIv2(store *Store) func(e *echo.Echo) {
 }
 
 type handler struct {
-	store *Store
+	store        *Store
+	emailService *email.Service
+	auditor      audit.Auditor
 }
 
 func (h *handler) ListUserSessions(c echo.Context) error {
@@ -168,6 +176,112 @@ func (h *handler) DeleteCurrentUserSession(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
+// ImpersonateUser creates a time-limited session for the user on behalf of the current user. Users
+// with system roles cannot be impersonated, and an impersonation session cannot be used to
+// impersonate another user.
+func (h *handler) ImpersonateUser(c echo.Context) error {
+	impersonator, ok := user.FromContext(c)
+	if !ok {
+		return errors.New(errors.ErrorUnauthenticated, "")
+	}
+	if currentSession, ok := FromContext(c); ok && currentSession.IsImpersonated() {
+		return errors.New(errors.ErrorPermissionDenied, "cannot impersonate in an impersonation session")
+	}
+	r := ImpersonateUserRequest{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+	if err := c.Validate(&r); err != nil {
+		return err
+	}
+	maxExpiresIn := viper.GetDuration("impersonation_expires_in")
+	expiresIn := time.Duration(r.ExpiresIn) * time.Second
+	if expiresIn == 0 {
+		expiresIn = maxExpiresIn
+	} else if expiresIn > maxExpiresIn {
+		return errors.Errorf(errors.ErrorInvalidArgument, "expires_in must not exceed %v seconds", int64(maxExpiresIn.Seconds()))
+	}
+
+	ctx := c.Request().Context()
+	u, err := h.store.userStore.UserByPublicID(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if u.ID == impersonator.ID {
+		return errors.New(errors.ErrorInvalidArgument, "cannot impersonate yourself")
+	}
+	if u.IsCurrentlyLocked() {
+		return errors.New(errors.ErrorFailedPrecondition, "user is locked")
+	}
+	roles, err := h.store.userStore.FindAllRolesByUserID(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	for _, role := range *roles {
+		if role.IsSystemRole {
+			return errors.New(errors.ErrorPermissionDenied, "cannot impersonate a user with system roles")
+		}
+	}
+
+	sess, err := h.store.CreateImpersonationSession(ctx, impersonator.ID, u.ID, r.ClientID, expiresIn)
+	if err != nil {
+		return err
+	}
+	accessToken, err := h.store.GenerateAccessToken(ctx, sess, true)
+	if err != nil {
+		return err
+	}
+	target := map[string]interface{}{
+		"user_id":    u.PublicID(),
+		"session_id": sess.PublicID(),
+		"client_id":  r.ClientID,
+		"expired_at": sess.ExpiredAt,
+	}
+	h.auditor.LogEvent(c, impersonator, "user.impersonate", target, audit.EventResultSuccess)
+
+	if r.Notify && u.EmailVerified() {
+		err = h.emailService.SendImpersonationMail(ctx, u.DisplayName(), u.Email.String, u.RealLanguage(), impersonator.DisplayName(), sess.ExpiredAt)
+		if err != nil {
+			// The session is already created. Failing to notify does not revoke it.
+			log.GetLogger(ctx).WithFields(logrus.Fields{
+				"user_id": u.PublicID(),
+				"error":   err.Error(),
+			}).Error("error sending impersonation notification")
+		}
+	}
+
+	jsonSession, err := NewJSONSession(sess)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, &ImpersonateUserResponse{
+		TokenType:    "bearer",
+		AccessToken:  accessToken.AccessToken,
+		IDToken:      accessToken.IDToken,
+		ExpiresIn:    accessToken.ExpiresIn,
+		RefreshToken: sess.RefreshToken,
+		Session:      jsonSession,
+	})
+}
+
+// ImpersonateUserRequest is the request for ImpersonateUser. ExpiresIn is the lifetime of the
+// session in seconds.
+type ImpersonateUserRequest struct {
+	ClientID  string `json:"client_id" validate:"required"`
+	ExpiresIn int64  `json:"expires_in" validate:"omitempty,gte=0"`
+	Notify    bool   `json:"notify"`
+}
+
+// ImpersonateUserResponse is the response for ImpersonateUser.
+type ImpersonateUserResponse struct {
+	TokenType    string      `json:"token_type"`
+	AccessToken  string      `json:"access_token"`
+	IDToken      string      `json:"id_token"`
+	ExpiresIn    int64       `json:"expires_in"`
+	RefreshToken string      `json:"refresh_token"`
+	Session      JSONSession `json:"session"`
+}
+
 // UserSessionQuery represent a query to user sessions
 type UserSessionQuery struct {
 	PageToken string `query:"page_token"`
@@ -192,17 +306,21 @@ func (q *UserSessionQuery) PageOptions() paging.PageOptions {
 
 // JSONSession represents a session in management API.
 type JSONSession struct {
-	ID         int64        `json:"id"`
-	ClientID   nulls.String `json:"client_id"`
-	DeviceID   nulls.String `json:"device_id"`
-	LastSeenAt time.Time    `json:"last_seen_at"`
-	LastSeenIP string       `json:"last_seen_ip"`
-	UserAgent  string       `json:"user_agent"`
+	ID             int64        `json:"id"`
+	ClientID       nulls.String `json:"client_id"`
+	DeviceID       nulls.String `json:"device_id"`
+	LastSeenAt     time.Time    `json:"last_seen_at"`
+	LastSeenIP     string       `json:"last_seen_ip"`
+	UserAgent      string       `json:"user_agent"`
+	Impersonated   bool         `json:"impersonated"`
+	ImpersonatorID nulls.Int64  `json:"impersonator_id"`
+	ExpiredAt      time.Time    `json:"expired_at"`
 }
 
 // NewJSONSession converts a Session into JSONSession.
 func NewJSONSession(s *Session) (JSONSession, error) {
 	j := JSONSession{}
 	err := copier.Copy(&j, s)
+	j.Impersonated = s.IsImpersonated()
 	return j, errors.Wrap(err, errors.ErrorUnknown, "")
 }
@@ -4,10 +4,15 @@ import (
 	"context"
 	"net/http"
 	"testing"
+	"time"
 
+	"authcore.io/authcore/internal/audit"
+	"authcore.io/authcore/internal/email"
+	"authcore.io/authcore/internal/template"
 	"authcore.io/authcore/internal/testutil"
 	"authcore.io/authcore/internal/validator"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 )
@@ -16,7 +21,7 @@ func echoForTest() (*echo.Echo, func()) {
 	store, teardown := storeForTest()
 	e := echo.New()
 	e.Validator = validator.Validator
-	APIv2(store)(e)
+	APIv2(store, email.NewService(template.NewStore(store.db)), audit.NewLoggingAuditor())(e)
 	return e, teardown
 }
 
@@ -183,3 +188,68 @@ func TestAPIDeleteCurrentUserSession(t *testing.T) {
 	assert.Error(t, err)
 	assert.Equal(t, http.StatusNotFound, code)
 }
+
+func TestAPIImpersonateUser(t *testing.T) {
+	e, teardown := echoForTest()
+	defer teardown()
+	store, teardownStore := storeForTest()
+	defer teardownStore()
+
+	ctx := context.Background()
+	admin, err := store.userStore.UserByID(ctx, 1)
+	assert.NoError(t, err)
+
+	payload := map[string]interface{}{"client_id": "test-client", "expires_in": 600}
+	code, res, err := testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/3/impersonate", payload, admin)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, res["refresh_token"])
+	jsonSession := res["session"].(map[string]interface{})
+	assert.Equal(t, true, jsonSession["impersonated"])
+	assert.Equal(t, float64(1), jsonSession["impersonator_id"])
+	assert.LessOrEqual(t, res["expires_in"], float64(600))
+
+	claims := jwt.MapClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(res["access_token"].(string), claims)
+	assert.NoError(t, err)
+	assert.Equal(t, "3", claims["sub"])
+	assert.Equal(t, map[string]interface{}{"sub": "1"}, claims["act"])
+
+	sess, err := store.FindSessionByInternalID(ctx, int64(jsonSession["id"].(float64)))
+	if assert.NoError(t, err) {
+		assert.True(t, sess.IsImpersonated())
+		assert.True(t, sess.ExpiredAt.Before(time.Now().Add(601*time.Second)))
+	}
+
+	// The session is flagged in the user's session listing
+	code, res, err = testutil.JSONRequest(e, http.MethodGet, "/api/v2/users/3/sessions", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, res["results"].([]interface{})[0].(map[string]interface{})["impersonated"])
+
+	// An impersonation session cannot impersonate another user
+	code, _, err = testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/5/impersonate", payload, admin, sess)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// Users with system roles
+	code, _, err = testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/2/impersonate", payload, admin)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// Self
+	code, _, err = testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/1/impersonate", payload, admin)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Longer than impersonation_expires_in
+	payload["expires_in"] = 86400
+	code, _, err = testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/3/impersonate", payload, admin)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Unauthenticated
+	code, _, err = testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/3/impersonate", payload)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
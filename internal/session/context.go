@@ -3,6 +3,8 @@ package session
 import (
 	"context"
 
+	"authcore.io/authcore/internal/user"
+
 	"github.com/labstack/echo/v4"
 )
 
@@ -24,3 +26,10 @@ func FromContext(c echo.Context) (sess *Session, ok bool) {
 	sess, ok = c.Get(sessionKey).(*Session)
 	return
 }
+
+// ImpersonatorFromContext returns the admin acting as the current user if the current session is
+// an impersonation session.
+func ImpersonatorFromContext(c echo.Context) (u *user.User, ok bool) {
+	u, ok = c.Get(impersonatorKey).(*user.User)
+	return
+}
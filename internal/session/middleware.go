@@ -19,10 +19,11 @@ type UserAgentKey struct{}
 type IPKey struct{}
 
 const (
-	userKey    = "user"
-	userIDKey  = "user_id"
-	sessionKey = "session"
-	subjectKey = "subject"
+	userKey         = "user"
+	userIDKey       = "user_id"
+	sessionKey      = "session"
+	subjectKey      = "subject"
+	impersonatorKey = "impersonator"
 )
 
 var errJWTMissing = errors.New(errors.ErrorUnauthenticated, "missing or malformed jwt")
@@ -65,6 +66,16 @@ func AccessTokenAuthMiddleware(skipper middleware.Skipper, store *Store) echo.Mi
 					}
 					return err
 				}
+				if s.IsImpersonated() {
+					impersonator, err := store.userStore.UserByID(ctx, s.ImpersonatorID.Int64)
+					if err != nil {
+						if errors.IsKind(err, errors.ErrorNotFound) {
+							return errors.Wrap(err, errors.ErrorUnauthenticated, "impersonator not found")
+						}
+						return err
+					}
+					c.Set(impersonatorKey, impersonator)
+				}
 				c.Set(userKey, u)
 				c.Set(userIDKey, u.PublicID())
 				c.Set(sessionKey, s)
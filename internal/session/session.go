@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/user"
 	"authcore.io/authcore/internal/validator"
 	"authcore.io/authcore/pkg/cryptoutil"
 	"authcore.io/authcore/pkg/nulls"
@@ -27,6 +28,9 @@ type Session struct {
 	LastSeenIP             string       `db:"last_seen_ip" validate:"omitempty,ip"`
 	LastSeenLocation       string       `db:"last_seen_location"`
 	LastPasswordVerifiedAt nulls.Time   `db:"last_password_verified_at"`
+	LastMFAVerifiedAt      nulls.Time   `db:"last_mfa_verified_at"`
+	CustomClaims           nulls.JSON   `db:"custom_claims"`   // Claims added by authentication hooks
+	ImpersonatorID         nulls.Int64  `db:"impersonator_id"` // The admin acting as the user
 	UserAgent              string       `db:"user_agent"`
 	IsInvalid              bool         `db:"is_invalid"`
 	ExpiredAt              time.Time    `db:"expired_at"`
@@ -75,7 +79,12 @@ func (s *Session) Refresh(ctx context.Context, newRefreshToken bool) string {
 	s.LastSeenAt = time.Now()
 	s.LastSeenLocation = "null"
 
-	s.ExpiredAt = time.Now().Add(expiresIn)
+	expiredAt := time.Now().Add(expiresIn)
+	if s.IsImpersonated() && !s.ExpiredAt.IsZero() && s.ExpiredAt.Before(expiredAt) {
+		// Impersonation sessions are never extended.
+		expiredAt = s.ExpiredAt
+	}
+	s.ExpiredAt = expiredAt
 
 	refreshToken := ""
 	if newRefreshToken {
@@ -100,6 +109,11 @@ func (s *Session) UpdateLastSeen(ctx context.Context) {
 	s.LastSeenLocation = "null"
 }
 
+// IsImpersonated returns whether the session is created by an admin on behalf of the user.
+func (s *Session) IsImpersonated() bool {
+	return s.ImpersonatorID.Valid
+}
+
 // PublicID returns a textual unique identifier of the session.
 func (s *Session) PublicID() string {
 	return strconv.FormatInt(s.ID, 10)
@@ -115,8 +129,29 @@ func (s *Session) UpdateLastPasswordVerifiedAt() {
 	s.LastPasswordVerifiedAt = nulls.NewTime(time.Now())
 }
 
-// UpdateCurrentUserPasswordAllowed returns whether the session allow changing user password.
-func (s *Session) UpdateCurrentUserPasswordAllowed() bool {
-	recentTime := time.Now().Add(-5 * time.Minute)
-	return s.LastPasswordVerifiedAt.Valid && s.LastPasswordVerifiedAt.Time.After(recentTime)
+// UpdateLastMFAVerifiedAt updates the last second factor verification timestamp.
+func (s *Session) UpdateLastMFAVerifiedAt() {
+	s.LastMFAVerifiedAt = nulls.NewTime(time.Now())
+}
+
+// LastVerifiedAt returns the last time the user is verified at the given assurance level in the
+// session.
+func (s *Session) LastVerifiedAt(level user.AssuranceLevel) nulls.Time {
+	switch level {
+	case user.AssuranceLevel1:
+		if s.LastMFAVerifiedAt.Valid && (!s.LastPasswordVerifiedAt.Valid || s.LastMFAVerifiedAt.Time.After(s.LastPasswordVerifiedAt.Time)) {
+			return s.LastMFAVerifiedAt
+		}
+		return s.LastPasswordVerifiedAt
+	case user.AssuranceLevel2:
+		return s.LastMFAVerifiedAt
+	}
+	return nulls.Time{}
+}
+
+// IsVerifiedWithin returns whether the user is verified at the given assurance level in the session
+// within maxAge.
+func (s *Session) IsVerifiedWithin(level user.AssuranceLevel, maxAge time.Duration) bool {
+	verifiedAt := s.LastVerifiedAt(level)
+	return verifiedAt.Valid && verifiedAt.Time.After(time.Now().Add(-maxAge))
 }
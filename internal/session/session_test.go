@@ -0,0 +1,30 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/nulls"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionIsVerifiedWithin(t *testing.T) {
+	s := &Session{}
+	assert.False(t, s.IsVerifiedWithin(user.AssuranceLevel1, 5*time.Minute))
+	assert.False(t, s.IsVerifiedWithin(user.AssuranceLevel2, 5*time.Minute))
+
+	s.UpdateLastPasswordVerifiedAt()
+	assert.True(t, s.IsVerifiedWithin(user.AssuranceLevel1, 5*time.Minute))
+	assert.False(t, s.IsVerifiedWithin(user.AssuranceLevel2, 5*time.Minute))
+
+	s.LastPasswordVerifiedAt = nulls.NewTime(time.Now().Add(-10 * time.Minute))
+	assert.False(t, s.IsVerifiedWithin(user.AssuranceLevel1, 5*time.Minute))
+	assert.True(t, s.IsVerifiedWithin(user.AssuranceLevel1, 15*time.Minute))
+
+	// Second factor verification satisfies the lower level
+	s.UpdateLastMFAVerifiedAt()
+	assert.True(t, s.IsVerifiedWithin(user.AssuranceLevel1, 5*time.Minute))
+	assert.True(t, s.IsVerifiedWithin(user.AssuranceLevel2, 5*time.Minute))
+}
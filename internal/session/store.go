@@ -8,6 +8,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"strconv"
+	"time"
 
 	"authcore.io/authcore/internal/clientapp"
 	"authcore.io/authcore/internal/db"
@@ -109,6 +110,45 @@ func (s *Store) CreateSession(ctx context.Context, userID, deviceID int64, clien
 	return session, nil
 }
 
+// CreateImpersonationSession creates a session for the user on behalf of the impersonator. The
+// session expires after expiresIn and is never extended.
+func (s *Store) CreateImpersonationSession(ctx context.Context, impersonatorID, userID int64, clientID string, expiresIn time.Duration) (*Session, error) {
+	ip, ok := ctx.Value(IPKey{}).(string)
+	if !ok {
+		ip = ""
+	}
+	clientApp, err := clientapp.GetByClientID(clientID)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorInvalidArgument, "")
+	}
+	session := &Session{
+		UserID:         userID,
+		ClientID:       nulls.NewString(clientApp.ID),
+		DeviceID:       nulls.Int64{},
+		IsMachine:      false,
+		LastSeenIP:     ip,
+		UserAgent:      "null",
+		ImpersonatorID: nulls.NewInt64(impersonatorID),
+	}
+	refreshToken := session.Refresh(ctx, true)
+	session.ExpiredAt = time.Now().Add(expiresIn)
+
+	id, err := s.createSession(ctx, session)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+
+	session, err = s.FindSessionByInternalID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Save refresh token in the returning session
+	session.RefreshToken = refreshToken
+
+	return session, nil
+}
+
 // CreateMachineSession creates new machine-to-machine session and saves it to database.
 func (s *Store) CreateMachineSession(ctx context.Context, userID int64) (*Session, error) {
 	session := &Session{
@@ -155,7 +195,10 @@ func (s *Store) createSession(ctx context.Context, session *Session) (int64, err
 			last_seen_ip,
 			user_agent,
 			expired_at,
-			last_password_verified_at
+			last_password_verified_at,
+			last_mfa_verified_at,
+			custom_claims,
+			impersonator_id
 		) VALUES (
 			:user_id,
 			:client_id,
@@ -167,7 +210,10 @@ func (s *Store) createSession(ctx context.Context, session *Session) (int64, err
 			:last_seen_ip,
 			:user_agent,
 			:expired_at,
-			:last_password_verified_at
+			:last_password_verified_at,
+			:last_mfa_verified_at,
+			:custom_claims,
+			:impersonator_id
 		)`,
 		&session)
 	if err != nil {
@@ -192,7 +238,9 @@ func (s *Store) UpdateSession(ctx context.Context, session *Session) (*Session,
 			last_seen_at=:last_seen_at,
 			last_seen_location=:last_seen_location,
 			last_seen_ip=:last_seen_ip,
-			last_password_verified_at=:last_password_verified_at
+			last_password_verified_at=:last_password_verified_at,
+			last_mfa_verified_at=:last_mfa_verified_at,
+			custom_claims=:custom_claims
 		WHERE id=:id`, &session)
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
@@ -272,6 +320,19 @@ func (s *Store) FindAllSessionsByUser(ctx context.Context, pageOptions paging.Pa
 	return &sessions, page, nil
 }
 
+// FindRecentSessionsByUserID lookups the most recently seen non-machine sessions of a user,
+// including the expired and invalidated ones.
+func (s *Store) FindRecentSessionsByUserID(ctx context.Context, userID int64, limit int) (*[]Session, error) {
+	sessions := []Session{}
+	err := sqlx.SelectContext(ctx, s.db, &sessions,
+		"SELECT * FROM sessions WHERE user_id = ? AND is_machine = 0 ORDER BY last_seen_at DESC LIMIT ?",
+		userID, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return &sessions, nil
+}
+
 // InvalidateSessionByID invalidates a session by id
 func (s *Store) InvalidateSessionByID(ctx context.Context, id int64) (int64, error) {
 	_, err := s.FindSessionByInternalID(ctx, id)
@@ -302,7 +363,13 @@ func (s *Store) GenerateAccessToken(ctx context.Context, session *Session, idTok
 		// clear it to skip id token
 		u = nil
 	}
-	return generateAccessToken(s.accessTokenPrivateKey, userID, session.PublicID(), session.ClientID.String, u)
+	var actorID string
+	var notAfter time.Time
+	if session.IsImpersonated() {
+		actorID = strconv.FormatInt(session.ImpersonatorID.Int64, 10)
+		notAfter = session.ExpiredAt
+	}
+	return generateAccessToken(s.accessTokenPrivateKey, userID, session.PublicID(), session.ClientID.String, u, session.CustomClaims.Struct, actorID, notAfter)
 }
 
 // VerifyAccessToken verifies the signature of a give JWT token and returns the asserted userID and sessionID.
@@ -36,8 +36,9 @@ func storeForTest() (*Store, func()) {
 	testutil.FixturesSetUp()
 	db := dbx.NewDBFromConfig()
 	redis := testutil.RedisForTest()
+	kv := testutil.KVStoreForTest()
 	encryptor := testutil.EncryptorForTest()
-	userStore := user.NewStore(db, redis, encryptor)
+	userStore := user.NewStore(db, kv, encryptor)
 	store := NewStore(db, redis, userStore)
 
 	return store, func() {
@@ -222,6 +223,17 @@ func TestFindAllSessionsByUser(t *testing.T) {
 	}
 }
 
+func TestFindRecentSessionsByUserID(t *testing.T) {
+	store, teardown := storeForTest()
+	defer teardown()
+
+	sessions, err := store.FindRecentSessionsByUserID(context.TODO(), 1, 2)
+	if assert.NoError(t, err) {
+		assert.Len(t, *sessions, 2)
+		assert.False(t, (*sessions)[0].LastSeenAt.Before((*sessions)[1].LastSeenAt))
+	}
+}
+
 func TestInvalidateSessionByID(t *testing.T) {
 	store, teardown := storeForTest()
 	defer teardown()
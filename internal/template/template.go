@@ -57,7 +57,7 @@ type Template struct {
 
 // Lists the available templates
 var (
-	EmailTemplates = []string{"VerificationMail", "ResetPasswordAuthenticationMail"}
+	EmailTemplates = []string{"VerificationMail", "ResetPasswordAuthenticationMail", "AuthenticationMail", "InvitationMail", "ImpersonationMail"}
 	SMSTemplates   = []string{"AuthenticationSMS", "VerificationSMS", "ResetPasswordAuthenticationSMS"}
 )
 
@@ -0,0 +1,322 @@
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPEntry is an entry in the directory of an LDAPServer. Users bind with the DN and the password
+// of the entry.
+type LDAPEntry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// LDAPServer is an in-process LDAP server over TLS for tests. It supports simple binds and searches
+// with and, or, not, equality and presence filters. Other operations are rejected.
+type LDAPServer struct {
+	listener      net.Listener
+	caCertificate []byte
+
+	mu      sync.Mutex
+	entries []*LDAPEntry
+}
+
+// NewLDAPServer starts an LDAPServer listening on a random local port with a certificate issued by
+// a newly generated CA.
+func NewLDAPServer(entries ...*LDAPEntry) (*LDAPServer, error) {
+	caCert, serverCert, err := ldapCertificatesForTest()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &LDAPServer{
+		listener:      listener,
+		caCertificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}),
+		entries:       entries,
+	}
+	go s.serve()
+	return s, nil
+}
+
+// URL returns the ldaps:// URL of the server.
+func (s *LDAPServer) URL() string {
+	return "ldaps://" + s.listener.Addr().String()
+}
+
+// CACertificate returns the PEM encoded certificate of the CA that issued the server certificate.
+func (s *LDAPServer) CACertificate() string {
+	return string(s.caCertificate)
+}
+
+// AddEntry adds an entry to the directory.
+func (s *LDAPServer) AddEntry(entry *LDAPEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+}
+
+// Close stops the server.
+func (s *LDAPServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *LDAPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *LDAPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID, ok := packet.Children[0].Value.(int64)
+		if !ok {
+			return
+		}
+		op := packet.Children[1]
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			responses = []*ber.Packet{s.bind(op)}
+		case ldap.ApplicationSearchRequest:
+			responses = s.search(op)
+		case ldap.ApplicationUnbindRequest:
+			return
+		case ldap.ApplicationAbandonRequest:
+			continue
+		case ldap.ApplicationModifyRequest, ldap.ApplicationAddRequest, ldap.ApplicationDelRequest,
+			ldap.ApplicationModifyDNRequest, ldap.ApplicationCompareRequest, ldap.ApplicationExtendedRequest:
+			responses = []*ber.Packet{ldapResult(op.Tag+1, ldap.LDAPResultUnwillingToPerform, "operation not supported")}
+		default:
+			return
+		}
+		for _, response := range responses {
+			message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+			message.AppendChild(response)
+			if _, err := conn.Write(message.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *LDAPServer) bind(op *ber.Packet) *ber.Packet {
+	if len(op.Children) < 3 || op.Children[2].Tag != 0 {
+		return ldapResult(ldap.ApplicationBindResponse, ldap.LDAPResultAuthMethodNotSupported, "only simple bind is supported")
+	}
+	dn := op.Children[1].Data.String()
+	password := op.Children[2].Data.String()
+	if dn == "" && password == "" {
+		return ldapResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess, "")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range s.entries {
+		if strings.EqualFold(entry.DN, dn) && entry.Password != "" && entry.Password == password {
+			return ldapResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess, "")
+		}
+	}
+	return ldapResult(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials, "invalid credentials")
+}
+
+func (s *LDAPServer) search(op *ber.Packet) []*ber.Packet {
+	if len(op.Children) < 8 {
+		return []*ber.Packet{ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError, "invalid search request")}
+	}
+	baseDN := op.Children[0].Data.String()
+	scope, _ := op.Children[1].Value.(int64)
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+	var attributes []string
+	for _, attribute := range op.Children[7].Children {
+		attributes = append(attributes, attribute.Data.String())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var responses []*ber.Packet
+	for _, entry := range s.entries {
+		if !entry.inScope(baseDN, scope) || !entry.match(filter) {
+			continue
+		}
+		if sizeLimit > 0 && int64(len(responses)) == sizeLimit {
+			return append(responses, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded, ""))
+		}
+		responses = append(responses, entry.searchResultEntry(attributes))
+	}
+	return append(responses, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, ""))
+}
+
+func (e *LDAPEntry) inScope(baseDN string, scope int64) bool {
+	dn, baseDN := strings.ToLower(e.DN), strings.ToLower(baseDN)
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return dn == baseDN
+	case ldap.ScopeSingleLevel:
+		i := strings.Index(dn, ",")
+		return i >= 0 && dn[i+1:] == baseDN
+	default:
+		return dn == baseDN || baseDN == "" || strings.HasSuffix(dn, ","+baseDN)
+	}
+}
+
+func (e *LDAPEntry) values(attribute string) []string {
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, attribute) {
+			return v
+		}
+	}
+	return nil
+}
+
+func (e *LDAPEntry) match(filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !e.match(child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if e.match(child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(filter.Children) == 1 && !e.match(filter.Children[0])
+	case ldap.FilterEqualityMatch:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		for _, v := range e.values(filter.Children[0].Data.String()) {
+			if strings.EqualFold(v, filter.Children[1].Data.String()) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		attribute := filter.Data.String()
+		return strings.EqualFold(attribute, "objectClass") || len(e.values(attribute)) > 0
+	}
+	return false
+}
+
+func (e *LDAPEntry) searchResultEntry(attributes []string) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "Object Name"))
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for name, values := range e.Attributes {
+		if !requested(attributes, name) {
+			continue
+		}
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attribute.AppendChild(set)
+		list.AppendChild(attribute)
+	}
+	p.AppendChild(list)
+	return p
+}
+
+// requested returns true if the attribute is in the attribute list of a search request. All
+// attributes are returned if the list is empty.
+func requested(attributes []string, name string) bool {
+	if len(attributes) == 0 {
+		return true
+	}
+	for _, attribute := range attributes {
+		if attribute == "*" || strings.EqualFold(attribute, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func ldapResult(tag ber.Tag, resultCode uint16, message string) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(resultCode), "Result Code"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "Diagnostic Message"))
+	return p
+}
+
+// ldapCertificatesForTest generates a CA and a server certificate for 127.0.0.1 issued by the CA.
+func ldapCertificatesForTest() (*x509.Certificate, tls.Certificate, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Authcore Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:     []string{"localhost"},
+	}
+	serverDER, err := x509.CreateCertificate(rand.Reader, serverTemplate, caCert, serverKey.Public(), caKey)
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+	return caCert, tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}, nil
+}
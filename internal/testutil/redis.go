@@ -4,6 +4,8 @@ import (
 	"log"
 	"sync"
 
+	"authcore.io/authcore/pkg/kvstore"
+
 	"github.com/alicebob/miniredis"
 	"github.com/go-redis/redis"
 )
@@ -25,3 +27,8 @@ func RedisForTest() *redis.Client {
 	})
 	return redisClient
 }
+
+// KVStoreForTest creates an empty in-memory kvstore.Store for tests.
+func KVStoreForTest() kvstore.Store {
+	return kvstore.NewMemoryStore()
+}
@@ -10,9 +10,12 @@ import (
 	"github.com/labstack/echo/v4"
 
 	"authcore.io/authcore/internal/apiutil"
+	"authcore.io/authcore/internal/authn/verifier"
 	"authcore.io/authcore/internal/errors"
 	"authcore.io/authcore/pkg/nulls"
 	"authcore.io/authcore/pkg/paging"
+
+	"github.com/spf13/viper"
 )
 
 // APIv2 returns a function that registers API 2.0 endpoints with an Echo instance.
@@ -32,6 +35,8 @@ func APIv2(store *Store) func(e *echo.Echo) {
 		g.GET("/users/:id/idp", h.ListUserIDP)
 		g.DELETE("/users/:id/idp/:service", h.DeleteUserIDP)
 		g.GET("/users/:id/mfa", h.ListUserMFA)
+		g.GET("/users/:id/trusted_devices", h.ListUserTrustedDevices)
+		g.DELETE("/users/:id/trusted_devices/:device_id", h.DeleteUserTrustedDevice)
 
 		g.GET("/users/current", h.GetCurrentUser)
 		g.GET("/users/current/idp", h.ListCurrentUserIDP)
@@ -40,6 +45,8 @@ func APIv2(store *Store) func(e *echo.Echo) {
 		g.DELETE("/users/current/mfa/:id", h.DeleteCurrentUserMFA)
 		g.DELETE("/users/current/idp/:service", h.DeleteCurrentUserIDP)
 		g.PUT("/users/current/password", h.UpdateCurrentUserPassword)
+		g.GET("/users/current/trusted_devices", h.ListCurrentUserTrustedDevices)
+		g.DELETE("/users/current/trusted_devices/:id", h.DeleteCurrentUserTrustedDevice)
 
 		g.GET("/idp/:id", h.GetIDP)
 		g.DELETE("/mfa/:id", h.DeleteMFA)
@@ -179,12 +186,19 @@ func (h *handler) UpdateUserPassword(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	// Users must choose a new password after a reset by an administrator.
+	user.PasswordChangeRequired = true
 
 	err = h.store.UpdateUser(ctx, user)
 	if err != nil {
 		return err
 	}
 
+	err = h.store.DeleteAllTrustedDevicesByUserID(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
 	return c.NoContent(http.StatusNoContent)
 }
 
@@ -290,6 +304,104 @@ func (h *handler) ListUserMFA(c echo.Context) error {
 	return c.JSON(http.StatusOK, resp)
 }
 
+func (h *handler) ListUserTrustedDevices(c echo.Context) error {
+	s := c.Param("id")
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorInvalidArgument, "")
+	}
+	return h.listTrustedDevices(c, id)
+}
+
+func (h *handler) DeleteUserTrustedDevice(c echo.Context) error {
+	s := c.Param("id")
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorInvalidArgument, "")
+	}
+	return h.deleteTrustedDevice(c, id, c.Param("device_id"))
+}
+
+func (h *handler) ListCurrentUserTrustedDevices(c echo.Context) error {
+	me, ok := FromContext(c)
+	if !ok {
+		return errors.New(errors.ErrorUnauthenticated, "")
+	}
+	return h.listTrustedDevices(c, me.ID)
+}
+
+func (h *handler) DeleteCurrentUserTrustedDevice(c echo.Context) error {
+	me, ok := FromContext(c)
+	if !ok {
+		return errors.New(errors.ErrorUnauthenticated, "")
+	}
+	return h.deleteTrustedDevice(c, me.ID, c.Param("id"))
+}
+
+// requireStepUp returns an error if the current session is not verified at the given assurance
+// level within maxAge. The level is lowered to the highest level the user is able to achieve with
+// the enrolled factors, and step-up is not required for users without any factor.
+func (h *handler) requireStepUp(c echo.Context, me *User, level AssuranceLevel, maxAge time.Duration) error {
+	sess, ok := sessionFromContext(c)
+	if !ok {
+		return errors.New(errors.ErrorUnauthenticated, "")
+	}
+	secondFactors, err := h.store.FindAllSecondFactorsByUserID(c.Request().Context(), me.ID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case level >= AssuranceLevel2 && len(*secondFactors) > 0:
+		level = AssuranceLevel2
+	case me.IsPasswordAuthenticationEnabled() || len(*secondFactors) > 0:
+		level = AssuranceLevel1
+	default:
+		return nil
+	}
+	if !sess.IsVerifiedWithin(level, maxAge) {
+		return errors.New(errors.ErrorPermissionDenied, "step-up authentication is required")
+	}
+	return nil
+}
+
+func (h *handler) listTrustedDevices(c echo.Context, userID int64) error {
+	ctx := c.Request().Context()
+	devices, err := h.store.FindAllTrustedDevicesByUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	jsonDevices := make([]JSONTrustedDevice, len(*devices))
+	for i, d := range *devices {
+		jsonDevices[i], err = NewJSONTrustedDevice(&d)
+		if err != nil {
+			return err
+		}
+	}
+	resp := apiutil.NewListPagination(jsonDevices, &paging.Page{})
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *handler) deleteTrustedDevice(c echo.Context, userID int64, deviceID string) error {
+	id, err := strconv.ParseInt(deviceID, 10, 64)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorInvalidArgument, "")
+	}
+	ctx := c.Request().Context()
+	device, err := h.store.FindTrustedDeviceByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if device.UserID != userID {
+		// Return 404 as if the device ID doesn't exist to avoid guessing the ID.
+		return errors.New(errors.ErrorNotFound, "")
+	}
+	err = h.store.DeleteTrustedDeviceByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
 func (h *handler) DeleteMFA(c echo.Context) error {
 	s := c.Param("id")
 	id, err := strconv.ParseInt(s, 10, 64)
@@ -343,30 +455,78 @@ func (h *handler) CreateCurrentUserMFA(c echo.Context) error {
 	if err != nil {
 		return errors.Errorf(errors.ErrorInvalidArgument, "unknown type %v", r.Type)
 	}
-
-	// Only TOTP is supported in v2 API
-	if secondFactorType != SecondFactorTOTP {
-		return errors.Errorf(errors.ErrorInvalidArgument, "unknown type %v", r.Type)
-	}
-
-	secondFactor := &SecondFactor{
-		UserID: me.ID,
-		Type:   secondFactorType,
-		Content: SecondFactorContent{
-			Secret: nulls.NewString(r.Secret),
-		},
-	}
-	v, err := secondFactor.ToVerifier(h.store.verifierFactory)
-	if err != nil {
+	if err := h.requireStepUp(c, me, AssuranceLevel2, viper.GetDuration("step_up_max_age")); err != nil {
 		return err
 	}
 
-	ok, _ = v.Verify([]byte{}, r.Verifier)
-	if !ok {
-		return errors.New(errors.ErrorInvalidArgument, "verifier is invalid")
+	ctx := c.Request().Context()
+	var secondFactor *SecondFactor
+	switch secondFactorType {
+	case SecondFactorTOTP:
+		if r.Secret == "" || len(r.Verifier) == 0 {
+			return errors.New(errors.ErrorInvalidArgument, "secret and verifier are required")
+		}
+		secondFactor = &SecondFactor{
+			UserID: me.ID,
+			Type:   secondFactorType,
+			Content: SecondFactorContent{
+				Secret: nulls.NewString(r.Secret),
+			},
+		}
+		v, err := secondFactor.ToVerifier(h.store.verifierFactory)
+		if err != nil {
+			return err
+		}
+
+		ok, _ = v.Verify([]byte{}, r.Verifier)
+		if !ok {
+			return errors.New(errors.ErrorInvalidArgument, "verifier is invalid")
+		}
+	case SecondFactorEmailOTP:
+		// Email OTP can only be bound to a verified email address.
+		if !me.Email.Valid || !me.EmailVerified() {
+			return errors.New(errors.ErrorFailedPrecondition, "a verified email is required")
+		}
+		secondFactor = &SecondFactor{
+			UserID: me.ID,
+			Type:   secondFactorType,
+			Content: SecondFactorContent{
+				Email: me.Email,
+			},
+		}
+		v, err := secondFactor.ToVerifier(h.store.verifierFactory)
+		if err != nil {
+			return err
+		}
+		if ev, ok := v.(verifier.EmailOTPVerifier); ok {
+			v = ev.WithLanguage(me.RealLanguage())
+		}
+
+		// Without a verifier, send an OTP to the email address and confirm it in a later request.
+		if len(r.Verifier) == 0 {
+			state, _, err := v.Request(nil)
+			if err != nil {
+				return err
+			}
+			err = h.store.PutSecondFactorEnrollmentState(ctx, me.ID, secondFactorType, state)
+			if err != nil {
+				return err
+			}
+			return c.NoContent(http.StatusAccepted)
+		}
+
+		state, err := h.store.BurnSecondFactorEnrollmentState(ctx, me.ID, secondFactorType)
+		if err != nil {
+			return errors.New(errors.ErrorInvalidArgument, "verifier is invalid")
+		}
+		ok, _ = v.Verify(state, r.Verifier)
+		if !ok {
+			return errors.New(errors.ErrorInvalidArgument, "verifier is invalid")
+		}
+	default:
+		return errors.Errorf(errors.ErrorInvalidArgument, "unknown type %v", r.Type)
 	}
 
-	ctx := c.Request().Context()
 	secondFactors, err := h.store.FindAllSecondFactorsByUserIDAndType(ctx, me.ID, secondFactorType)
 	if err != nil {
 		return err
@@ -397,6 +557,9 @@ func (h *handler) DeleteCurrentUserMFA(c echo.Context) error {
 	if !ok {
 		return errors.New(errors.ErrorUnauthenticated, "")
 	}
+	if err := h.requireStepUp(c, me, AssuranceLevel2, viper.GetDuration("step_up_max_age")); err != nil {
+		return err
+	}
 	ctx := c.Request().Context()
 	secondFactor, err := h.store.FindSecondFactorByID(ctx, id)
 	if err != nil {
@@ -498,13 +661,8 @@ func (h *handler) UpdateCurrentUserPassword(c echo.Context) error {
 	if !ok {
 		return errors.New(errors.ErrorUnauthenticated, "")
 	}
-	sess, ok := sessionFromContext(c)
-	if !ok {
-		return errors.New(errors.ErrorUnauthenticated, "")
-	}
-
-	if me.IsPasswordAuthenticationEnabled() && !sess.UpdateCurrentUserPasswordAllowed() {
-		return errors.New(errors.ErrorPermissionDenied, "step-up authentication is required")
+	if err := h.requireStepUp(c, me, AssuranceLevel1, viper.GetDuration("step_up_max_age")); err != nil {
+		return err
 	}
 
 	r := new(PasswordVerifier)
@@ -526,6 +684,10 @@ func (h *handler) UpdateCurrentUserPassword(c echo.Context) error {
 		return err
 	}
 
+	if err := h.store.DeleteAllTrustedDevicesByUserID(ctx, me.ID); err != nil {
+		return err
+	}
+
 	roles, err := h.store.FindAllRolesByUserID(ctx, me.ID)
 	if err != nil {
 		return err
@@ -569,6 +731,8 @@ type JSONUser struct {
 	Phone                           nulls.String `json:"phone_number"`
 	PhoneVerified                   bool         `json:"phone_number_verified"`
 	IsPasswordAuthenticationEnabled bool         `json:"is_password_set"`
+	PasswordChangedAt               nulls.Time   `json:"password_changed_at"`
+	PasswordChangeRequired          bool         `json:"password_change_required"`
 	IsLocked                        bool         `json:"locked"`
 	UserMetadata                    nulls.JSON   `json:"user_metadata"`
 	AppMetadata                     nulls.JSON   `json:"app_metadata"`
@@ -660,6 +824,9 @@ func loadUpdateUserRequest(m map[string]interface{}, user *User) {
 			user.LockExpiredAt = nulls.Time{}
 		}
 	}
+	if passwordChangeRequired, ok := m["password_change_required"].(bool); ok {
+		user.PasswordChangeRequired = passwordChangeRequired
+	}
 }
 
 // PasswordVerifier represents a password verifier.
@@ -675,11 +842,12 @@ type RolesRequest struct {
 	RoleID int64 `json:"role_id"`
 }
 
-// CreateMFARequest is a request for CreateCurrentUserMFA.
+// CreateMFARequest is a request for CreateCurrentUserMFA. Secret is required for TOTP. For email
+// OTP, a request without verifier sends an OTP to the user's email.
 type CreateMFARequest struct {
 	Type     string `json:"type" validate:"required"`
-	Secret   string `json:"secret" validate:"required"`
-	Verifier []byte `json:"verifier" validate:"required"`
+	Secret   string `json:"secret"`
+	Verifier []byte `json:"verifier"`
 }
 
 // JSONRole represents a role record in management API.
@@ -714,10 +882,29 @@ func NewJSONSecondFactor(sf *SecondFactor) (JSONSecondFactor, error) {
 	j.Type = sf.Type.String()
 	if j.Type == "sms_otp" {
 		j.Value = sf.Content.PhoneNumber.String
+	} else if j.Type == "email_otp" {
+		j.Value = sf.Content.Email.String
 	}
 	return j, errors.Wrap(err, errors.ErrorUnknown, "")
 }
 
+// JSONTrustedDevice represents a trusted device in API.
+type JSONTrustedDevice struct {
+	ID         int64        `json:"id"`
+	UserAgent  string       `json:"user_agent"`
+	IP         nulls.String `json:"ip"`
+	ExpiredAt  time.Time    `json:"expired_at"`
+	LastUsedAt nulls.Time   `json:"last_used_at"`
+	CreatedAt  time.Time    `json:"created_at"`
+}
+
+// NewJSONTrustedDevice converts a TrustedDevice to JSONTrustedDevice.
+func NewJSONTrustedDevice(d *TrustedDevice) (JSONTrustedDevice, error) {
+	j := JSONTrustedDevice{}
+	err := copier.Copy(&j, d)
+	return j, errors.Wrap(err, errors.ErrorUnknown, "")
+}
+
 // JSONIDP represents a IDP binding.
 type JSONIDP struct {
 	ServiceName string    `json:"service"`
@@ -10,6 +10,7 @@ import (
 	"authcore.io/authcore/internal/testutil"
 	"authcore.io/authcore/internal/validator"
 	"authcore.io/authcore/pkg/cryptoutil"
+	"authcore.io/authcore/pkg/nulls"
 
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
@@ -187,6 +188,18 @@ func TestAPIUpdateUserPassword(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusNoContent, code)
 
+	// The user must change the password reset by an administrator
+	code, res, err := testutil.JSONRequest(e, http.MethodGet, "/api/v2/users/1", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, res["password_change_required"])
+	assert.NotNil(t, res["password_changed_at"])
+
+	code, res, err = testutil.JSONRequest(e, http.MethodPut, "/api/v2/users/1", map[string]interface{}{"password_change_required": false})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, false, res["password_change_required"])
+
 	code, _, err = testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/999/password", payload)
 	assert.Error(t, err)
 	assert.Equal(t, http.StatusNotFound, code)
@@ -424,13 +437,14 @@ func TestAPICreateCurrentUserMFA(t *testing.T) {
 	defer teardown()
 
 	me := &User{ID: 1}
+	sess := &mockSession{}
 	req := map[string]interface{}{
 		"type":   "totp",
 		"secret": "THISISATOTPSECRETXXXXXXXXXXXXXXX",
 	}
 
 	// Invalid verifier
-	code, _, err := testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/current/mfa", req, me)
+	code, _, err := testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/current/mfa", req, me, sess)
 	assert.Error(t, err)
 	assert.Equal(t, http.StatusBadRequest, code)
 
@@ -441,33 +455,107 @@ func TestAPICreateCurrentUserMFA(t *testing.T) {
 		"secret":   "THISISATOTPSECRETXXXXXXXXXXXXXXX",
 		"verifier": []byte(totpCode),
 	}
-	code, _, err = testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/current/mfa", req, me)
+	code, _, err = testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/current/mfa", req, me, sess)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, code)
 
-	code, res, err := testutil.JSONRequest(e, http.MethodGet, "/api/v2/users/current/mfa", nil, me)
+	code, res, err := testutil.JSONRequest(e, http.MethodGet, "/api/v2/users/current/mfa", nil, me, sess)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, code)
 	assert.Len(t, res["results"], 1)
 	assert.Equal(t, "totp", res["results"].([]interface{})[0].(map[string]interface{})["type"])
 }
 
+func TestAPICreateCurrentUserEmailOTP(t *testing.T) {
+	e, teardown := echoForTest()
+	defer teardown()
+
+	req := map[string]interface{}{
+		"type": "email_otp",
+	}
+
+	sess := &mockSession{}
+
+	// Unverified email
+	me := &User{ID: 7, Email: nulls.NewString("non-verified@example.com")}
+	code, _, err := testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/current/mfa", req, me, sess)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Request OTP
+	me = &User{ID: 1, Email: nulls.NewString("bob@example.com"), EmailVerifiedAt: nulls.NewTime(time.Now())}
+	code, _, err = testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/current/mfa", req, me, sess)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, code)
+
+	// Invalid verifier
+	req["verifier"] = []byte("000000")
+	code, _, err = testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/current/mfa", req, me, sess)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
 func TestAPIDeleteCurrentUserMFA(t *testing.T) {
 	e, teardown := echoForTest()
 	defer teardown()
 
 	me := &User{ID: 3}
 
-	code, _, err := testutil.JSONRequest(e, http.MethodDelete, "/api/v2/users/current/mfa/2", nil, me)
+	// Require step-up authentication with MFA
+	sess := &mockSession{level: AssuranceLevel1}
+	code, _, err := testutil.JSONRequest(e, http.MethodDelete, "/api/v2/users/current/mfa/2", nil, me, sess)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	sess = &mockSession{level: AssuranceLevel2}
+	code, _, err = testutil.JSONRequest(e, http.MethodDelete, "/api/v2/users/current/mfa/2", nil, me, sess)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusNoContent, code)
 
 	// Another user's MFA
-	code, _, err = testutil.JSONRequest(e, http.MethodDelete, "/api/v2/users/current/mfa/1", nil, me)
+	code, _, err = testutil.JSONRequest(e, http.MethodDelete, "/api/v2/users/current/mfa/1", nil, me, sess)
 	assert.Error(t, err)
 	assert.Equal(t, http.StatusNotFound, code)
 }
 
+func TestAPIListUserTrustedDevices(t *testing.T) {
+	e, teardown := echoForTest()
+	defer teardown()
+
+	code, res, err := testutil.JSONRequest(e, http.MethodGet, "/api/v2/users/1/trusted_devices", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	// Expired device is not listed
+	assert.Len(t, res["results"], 1)
+	assert.Equal(t, float64(1), res["results"].([]interface{})[0].(map[string]interface{})["id"])
+
+	code, res, err = testutil.JSONRequest(e, http.MethodGet, "/api/v2/users/2/trusted_devices", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, res["results"], 0)
+}
+
+func TestAPIDeleteCurrentUserTrustedDevice(t *testing.T) {
+	e, teardown := echoForTest()
+	defer teardown()
+
+	// Another user's device
+	me := &User{ID: 2}
+	code, _, err := testutil.JSONRequest(e, http.MethodDelete, "/api/v2/users/current/trusted_devices/1", nil, me)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	me = &User{ID: 1}
+	code, _, err = testutil.JSONRequest(e, http.MethodDelete, "/api/v2/users/current/trusted_devices/1", nil, me)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, code)
+
+	code, res, err := testutil.JSONRequest(e, http.MethodGet, "/api/v2/users/current/trusted_devices", nil, me)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, res["results"], 0)
+}
+
 func TestAPIDeleteRole(t *testing.T) {
 	e, teardown := echoForTest()
 	defer teardown()
@@ -539,21 +627,21 @@ func TestAPIUpdateCurrentUserPassword(t *testing.T) {
 
 	// Success
 	me := &User{ID: 2}
-	sess := &mockSession{updateCurrentUserPasswordAllowed: true}
+	sess := &mockSession{level: AssuranceLevel1}
 	code, res, err := testutil.JSONRequest(e, http.MethodPut, "/api/v2/users/current/password", payload, me, sess)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, code)
 	assert.True(t, res["is_password_set"].(bool))
 
 	// Require step-up authentication
-	sess = &mockSession{updateCurrentUserPasswordAllowed: false}
+	sess = &mockSession{}
 	code, _, err = testutil.JSONRequest(e, http.MethodPut, "/api/v2/users/current/password", payload, me, sess)
 	assert.Error(t, err)
 	assert.Equal(t, http.StatusForbidden, code)
 
 	// Set new password
 	me = &User{ID: 1}
-	sess = &mockSession{updateCurrentUserPasswordAllowed: false}
+	sess = &mockSession{}
 	code, res, err = testutil.JSONRequest(e, http.MethodPut, "/api/v2/users/current/password", payload, me, sess)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, code)
@@ -561,9 +649,9 @@ func TestAPIUpdateCurrentUserPassword(t *testing.T) {
 }
 
 type mockSession struct {
-	updateCurrentUserPasswordAllowed bool
+	level AssuranceLevel
 }
 
-func (s *mockSession) UpdateCurrentUserPasswordAllowed() bool {
-	return s.updateCurrentUserPasswordAllowed
+func (s *mockSession) IsVerifiedWithin(level AssuranceLevel, maxAge time.Duration) bool {
+	return level <= s.level
 }
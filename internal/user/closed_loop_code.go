@@ -109,14 +109,14 @@ func (s *Store) CreateClosedLoopCode(ctx context.Context, key string, expiry tim
 
 	// Setting the key "closed_loop_code/key/<key>" to be the closed loop code
 	closedLoopCodeKey := fmt.Sprintf("%s/key/%s", closedLoopCodePrefix, key)
-	err = s.redis.Set(closedLoopCodeKey, closedLoopCodeJSON, expiry).Err()
+	err = s.kv.Set(closedLoopCodeKey, string(closedLoopCodeJSON), expiry)
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
 	}
 
 	// Setting the key "closed_loop_code/token/<token>" to point to the key of the closed loop code
 	closedLoopCodePointer := fmt.Sprintf("%s/token/%s", closedLoopCodePrefix, token)
-	err = s.redis.Set(closedLoopCodePointer, closedLoopCodeKey, expiry).Err()
+	err = s.kv.Set(closedLoopCodePointer, closedLoopCodeKey, expiry)
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
 	}
@@ -127,7 +127,7 @@ func (s *Store) CreateClosedLoopCode(ctx context.Context, key string, expiry tim
 // FindClosedLoopCodeByKey finds a closed loop code by key
 func (s *Store) FindClosedLoopCodeByKey(ctx context.Context, key string) (*ClosedLoopCode, error) {
 	closedLoopCodeKey := fmt.Sprintf("%s/key/%s", closedLoopCodePrefix, key)
-	closedLoopCodeJSON, err := s.redis.Get(closedLoopCodeKey).Result()
+	closedLoopCodeJSON, err := s.kv.Get(closedLoopCodeKey)
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorNotFound, "")
 	}
@@ -143,11 +143,11 @@ func (s *Store) FindClosedLoopCodeByKey(ctx context.Context, key string) (*Close
 // FindClosedLoopCodeByToken finds a contact code by token
 func (s *Store) FindClosedLoopCodeByToken(ctx context.Context, token string) (*ClosedLoopCode, error) {
 	closedLoopCodePointer := fmt.Sprintf("%s/token/%s", closedLoopCodePrefix, token)
-	closedLoopCodeKey, err := s.redis.Get(closedLoopCodePointer).Result()
+	closedLoopCodeKey, err := s.kv.Get(closedLoopCodePointer)
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorNotFound, "")
 	}
-	closedLoopCodeJSON, err := s.redis.Get(closedLoopCodeKey).Result()
+	closedLoopCodeJSON, err := s.kv.Get(closedLoopCodeKey)
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorNotFound, "")
 	}
@@ -185,7 +185,7 @@ func (s *Store) BurnClosedLoopCodeByCode(ctx context.Context, key string, code s
 	}
 
 	closedLoopCodeKey := fmt.Sprintf("%s/key/%s", closedLoopCodePrefix, key)
-	s.redis.Del(closedLoopCodeKey)
+	s.kv.Delete(closedLoopCodeKey)
 	if closedLoopCode.CodeExpireAt.Before(time.Now()) {
 		return nil, errors.New(errors.ErrorDeadlineExceeded, "")
 	}
@@ -206,7 +206,7 @@ func (s *Store) BurnClosedLoopCodeByToken(ctx context.Context, token string) (*C
 	}
 
 	closedLoopCodeKey := fmt.Sprintf("%s/key/%s", closedLoopCodePrefix, closedLoopCode.Key)
-	s.redis.Del(closedLoopCodeKey)
+	s.kv.Delete(closedLoopCodeKey)
 	if closedLoopCode.CodeExpireAt.Before(time.Now()) {
 		return nil, errors.New(errors.ErrorDeadlineExceeded, "")
 	}
@@ -217,7 +217,7 @@ func (s *Store) BurnClosedLoopCodeByToken(ctx context.Context, token string) (*C
 func (s *Store) DecrementClosedLoopCodeRemainingAttempts(key string) error {
 	closedLoopCodeKey := fmt.Sprintf("%s/key/%s", closedLoopCodePrefix, key)
 
-	closedLoopCodeJSON, err := s.redis.Get(closedLoopCodeKey).Result()
+	closedLoopCodeJSON, err := s.kv.Get(closedLoopCodeKey)
 	if err != nil {
 		return errors.Wrap(err, errors.ErrorUnknown, "")
 	}
@@ -237,7 +237,7 @@ func (s *Store) DecrementClosedLoopCodeRemainingAttempts(key string) error {
 		return errors.Wrap(err, errors.ErrorUnknown, "")
 	}
 	expiry := closedLoopCode.Expiry()
-	err = s.redis.Set(closedLoopCodeKey, updatedClosedLoopCodeJSON, expiry).Err()
+	err = s.kv.Set(closedLoopCodeKey, string(updatedClosedLoopCodeJSON), expiry)
 	if err != nil {
 		return errors.Wrap(err, errors.ErrorUnknown, "")
 	}
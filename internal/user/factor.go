@@ -43,6 +43,8 @@ func (secondFactor *SecondFactor) UpdateWithVerifier(v verifier.Verifier) (err e
 		secondFactor.Content.UsedCodeMask.Int64 = vt.UsedCodeMask
 	case verifier.SMSOTPVerifier:
 		break
+	case verifier.EmailOTPVerifier:
+		break
 	default:
 		err = errors.New(errors.ErrorInvalidArgument, "unknown factor type")
 	}
@@ -61,6 +63,9 @@ func (secondFactor *SecondFactor) ToVerifier(factory *verifier.Factory) (v verif
 	case SecondFactorSMS:
 		m["method"] = verifier.SMSOTP
 		m["phone_number"] = secondFactor.Content.PhoneNumber
+	case SecondFactorEmailOTP:
+		m["method"] = verifier.EmailOTP
+		m["email"] = secondFactor.Content.Email
 	case SecondFactorBackupCode:
 		m["method"] = verifier.BackupCode
 		m["secret"] = secondFactor.Content.Secret
@@ -86,6 +91,7 @@ const (
 	SecondFactorSMS        SecondFactorType = 0
 	SecondFactorTOTP       SecondFactorType = 1
 	SecondFactorBackupCode SecondFactorType = 2
+	SecondFactorEmailOTP   SecondFactorType = 3
 )
 
 // SecondFactorTypeFromString returns a SecondFactorType from the given string.
@@ -97,6 +103,8 @@ func SecondFactorTypeFromString(s string) (SecondFactorType, error) {
 		return SecondFactorTOTP, nil
 	case "backup_code":
 		return SecondFactorBackupCode, nil
+	case "email_otp":
+		return SecondFactorEmailOTP, nil
 	}
 	return SecondFactorSMS, errors.New(errors.ErrorInvalidArgument, "invalid factor type")
 }
@@ -124,6 +132,8 @@ func (t SecondFactorType) String() string {
 		return verifier.TOTP
 	case SecondFactorBackupCode:
 		return verifier.BackupCode
+	case SecondFactorEmailOTP:
+		return verifier.EmailOTP
 	}
 	return ""
 }
@@ -131,6 +141,7 @@ func (t SecondFactorType) String() string {
 // SecondFactorContent represents a second factor content.
 type SecondFactorContent struct {
 	PhoneNumber     nulls.String `json:"phone_number"`                                                // For SMS
+	Email           nulls.String `json:"email"`                                                       // For email OTP
 	Identifier      nulls.String `json:"identifier"`                                                  // For TOTP
 	Secret          nulls.String `json:"-" encrypt:"" encryptPurpose:"second_factors.content.secret"` // For TOTP
 	EncryptedSecret nulls.String `json:"encrypted_secret"`                                            // For TOTP & backup code
@@ -185,58 +196,62 @@ func (as *ResetPasswordToken) Validate() error {
 	return validator.Validate.Struct(as)
 }
 
-// OAuthService is a type enumerating the oauth services
-type OAuthService int32
-
-// MarshalJSON marshal OAuthService into service string.
-func (o OAuthService) MarshalJSON() ([]byte, error) {
-	return json.Marshal(OAuthServiceToName(o))
-}
+// OAuthService is the key of the IDP that an OAuth factor belongs to. It is the ID of a built-in
+// IDP such as "google" or the name of a configured OIDC provider.
+type OAuthService string
 
-// Enumerates the OAuthService
+// Enumerates the built-in OAuthService
 const (
-	OAuthFacebook OAuthService = 0
-	OAuthGoogle   OAuthService = 1
-	OAuthApple    OAuthService = 2
-	OAuthMatters  OAuthService = 3
-	OAuthTwitter  OAuthService = 4
+	OAuthFacebook OAuthService = "facebook"
+	OAuthGoogle   OAuthService = "google"
+	OAuthApple    OAuthService = "apple"
+	OAuthMatters  OAuthService = "matters"
+	OAuthTwitter  OAuthService = "twitter"
+	// OAuthLDAP links users to the entries of the LDAP directory.
+	OAuthLDAP OAuthService = "ldap"
+	// OAuthEthereum links users to Ethereum accounts verified with Sign-In with Ethereum.
+	OAuthEthereum OAuthService = "ethereum"
 )
 
+// v1OAuthServices lists the services supported by API v1, indexed by their enum values.
+var v1OAuthServices = []OAuthService{
+	OAuthFacebook,
+	OAuthGoogle,
+	OAuthApple,
+	OAuthMatters,
+	OAuthTwitter,
+}
+
 // ToOAuthService converts string to OAuthService.
-func ToOAuthService(s string) (o OAuthService, err error) {
-	switch s {
-	case "facebook":
-		o = OAuthFacebook
-	case "google":
-		o = OAuthGoogle
-	case "apple":
-		o = OAuthApple
-	case "matters":
-		o = OAuthMatters
-	case "twitter":
-		o = OAuthTwitter
-	default:
-		return -1, errors.Wrap(err, errors.ErrorUnknown, "")
+func ToOAuthService(s string) (OAuthService, error) {
+	if s == "" {
+		return "", errors.New(errors.ErrorInvalidArgument, "empty OAuth service")
 	}
-	return
+	return OAuthService(s), nil
 }
 
 // OAuthServiceToName converts OAuthService to name.
 func OAuthServiceToName(o OAuthService) string {
-	switch o {
-	case OAuthFacebook:
-		return "facebook"
-	case OAuthGoogle:
-		return "google"
-	case OAuthApple:
-		return "apple"
-	case OAuthMatters:
-		return "matters"
-	case OAuthTwitter:
-		return "twitter"
-	default:
-		return strconv.FormatInt(int64(o), 10)
+	return string(o)
+}
+
+// OAuthServiceFromV1 converts an OAuth service enum value in API v1 to OAuthService.
+func OAuthServiceFromV1(v int32) (OAuthService, error) {
+	if v < 0 || int(v) >= len(v1OAuthServices) {
+		return "", errors.Errorf(errors.ErrorInvalidArgument, "unknown OAuth service %v", v)
 	}
+	return v1OAuthServices[v], nil
+}
+
+// V1 returns the enum value of the service in API v1. It returns -1 for services that are not
+// supported by API v1.
+func (o OAuthService) V1() int32 {
+	for i, service := range v1OAuthServices {
+		if service == o {
+			return int32(i)
+		}
+	}
+	return -1
 }
 
 // OAuthFactor is a struct describing the oauth factor
@@ -249,6 +264,16 @@ type OAuthFactor struct {
 	CreatedAt   time.Time    `db:"created_at" json:"created_at"`
 	LastUsedAt  time.Time    `db:"last_used_at" json:"last_used_at"`
 	Metadata    nulls.JSON   `db:"metadata" json:"metadata"`
+
+	// Upstream tokens of the IDP, which are stored encrypted and never serialized.
+	AccessToken           nulls.String `db:"-" json:"-" encrypt:"" encryptPurpose:"oauth_factors.access_token"`
+	EncryptedAccessToken  nulls.String `db:"encrypted_access_token" json:"-"`
+	AccessSecret          nulls.String `db:"-" json:"-" encrypt:"" encryptPurpose:"oauth_factors.access_secret"` // OAuth 1.0
+	EncryptedAccessSecret nulls.String `db:"encrypted_access_secret" json:"-"`
+	RefreshToken          nulls.String `db:"-" json:"-" encrypt:"" encryptPurpose:"oauth_factors.refresh_token"`
+	EncryptedRefreshToken nulls.String `db:"encrypted_refresh_token" json:"-"`
+	TokenType             nulls.String `db:"token_type" json:"-"`
+	TokenExpiresAt        nulls.Time   `db:"token_expires_at" json:"-"`
 }
 
 // ServiceName returns the service name.
@@ -0,0 +1,31 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOAuthServiceV1(t *testing.T) {
+	service, err := OAuthServiceFromV1(1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, OAuthGoogle, service)
+	}
+	_, err = OAuthServiceFromV1(5)
+	assert.Error(t, err)
+	_, err = OAuthServiceFromV1(-1)
+	assert.Error(t, err)
+
+	assert.Equal(t, int32(4), OAuthTwitter.V1())
+	assert.Equal(t, int32(-1), OAuthService("okta").V1())
+}
+
+func TestToOAuthService(t *testing.T) {
+	service, err := ToOAuthService("okta")
+	if assert.NoError(t, err) {
+		assert.Equal(t, OAuthService("okta"), service)
+		assert.Equal(t, "okta", OAuthServiceToName(service))
+	}
+	_, err = ToOAuthService("")
+	assert.Error(t, err)
+}
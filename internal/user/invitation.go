@@ -0,0 +1,251 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/validator"
+	"authcore.io/authcore/pkg/nulls"
+	"authcore.io/authcore/pkg/paging"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const invitationTokenPurpose = "invitation"
+
+// Invitation allows the invitee to sign up with an email address even if sign-up is otherwise
+// restricted. The email address is verified and the roles are assigned on sign-up.
+type Invitation struct {
+	ID         int64       `db:"id"`
+	Email      string      `db:"email" validate:"required,email"`
+	ClientID   string      `db:"client_id" validate:"required"`
+	RoleIDs    RoleIDs     `db:"role_ids"`
+	InvitedBy  nulls.Int64 `db:"invited_by"`
+	AcceptedBy nulls.Int64 `db:"accepted_by"`
+	AcceptedAt nulls.Time  `db:"accepted_at"`
+	ExpiredAt  time.Time   `db:"expired_at"`
+	UpdatedAt  time.Time   `db:"updated_at"`
+	CreatedAt  time.Time   `db:"created_at"`
+}
+
+// Validate validates the struct of an Invitation model.
+func (i *Invitation) Validate() error {
+	return validator.Validate.Struct(i)
+}
+
+// IsExpired returns whether the invitation is expired.
+func (i *Invitation) IsExpired() bool {
+	return i.ExpiredAt.Before(time.Now())
+}
+
+// IsAccepted returns whether the invitation has been used to sign up.
+func (i *Invitation) IsAccepted() bool {
+	return i.AcceptedAt.Valid
+}
+
+// RoleIDs is a list of role IDs stored as a JSON array.
+type RoleIDs []int64
+
+// Scan implements the sql.Scanner interface.
+func (r *RoleIDs) Scan(v interface{}) error {
+	var b []byte
+	switch v := v.(type) {
+	case nil:
+		*r = RoleIDs{}
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return errors.Errorf(errors.ErrorUnknown, "cannot scan %T into RoleIDs", v)
+	}
+	ids := RoleIDs{}
+	if err := json.Unmarshal(b, &ids); err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	*r = ids
+	return nil
+}
+
+// Value implements the driver.Valuer interface.
+func (r RoleIDs) Value() (driver.Value, error) {
+	if r == nil {
+		r = RoleIDs{}
+	}
+	b, err := json.Marshal([]int64(r))
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// InvitationsQuery is the query for listing invitations.
+type InvitationsQuery struct {
+	PageToken string `query:"page_token"`
+	Limit     uint   `query:"limit" validate:"omitempty,gte=0,lte=1000"`
+}
+
+// PageOptions returns a PageOptions for the query.
+func (q *InvitationsQuery) PageOptions() paging.PageOptions {
+	limit := q.Limit
+	if limit <= 0 || limit > 1000 {
+		limit = 50
+	}
+	return paging.PageOptions{
+		SortColumn:     "created_at",
+		UniqueColumn:   "id",
+		SortDirection:  paging.Desc,
+		CountFoundRows: true,
+		Limit:          limit,
+		PageToken:      paging.PageToken(q.PageToken),
+	}
+}
+
+// invitationToken is the payload of an invitation token.
+type invitationToken struct {
+	ID    int64  `json:"id"`
+	Email string `json:"email"`
+}
+
+// CreateInvitation creates an invitation. It returns a token that should be sent to the invitee
+// and presented at sign-up.
+func (s *Store) CreateInvitation(ctx context.Context, invitation *Invitation) (*Invitation, string, error) {
+	invitation.Email = strings.TrimSpace(invitation.Email)
+	if err := invitation.Validate(); err != nil {
+		return nil, "", errors.WithValidateError(err)
+	}
+	for _, roleID := range invitation.RoleIDs {
+		if _, err := s.FindRoleByID(ctx, roleID); err != nil {
+			return nil, "", errors.Wrap(err, errors.ErrorInvalidArgument, "role not found")
+		}
+	}
+	result, err := sqlx.NamedExecContext(
+		ctx,
+		s.db,
+		`INSERT INTO invitations (email, client_id, role_ids, invited_by, expired_at)
+		VALUES (:email, :client_id, :role_ids, :invited_by, :expired_at)`,
+		invitation,
+	)
+	if err != nil {
+		return nil, "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	invitation, err = s.FindInvitationByID(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, err := json.Marshal(invitationToken{ID: invitation.ID, Email: invitation.Email})
+	if err != nil {
+		return nil, "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	token, err := s.encryptor.Encrypt(data, []byte(invitationTokenPurpose))
+	if err != nil {
+		return nil, "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return invitation, token, nil
+}
+
+// FindInvitationByToken finds a pending invitation by its token. It returns a PermissionDenied
+// error if the token is invalid, or the invitation is expired or accepted.
+func (s *Store) FindInvitationByToken(ctx context.Context, token string) (*Invitation, error) {
+	data, err := s.encryptor.Decrypt(token, []byte(invitationTokenPurpose))
+	if err != nil {
+		return nil, errors.New(errors.ErrorPermissionDenied, "invalid invitation token")
+	}
+	t := invitationToken{}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, errors.New(errors.ErrorPermissionDenied, "invalid invitation token")
+	}
+	invitation, err := s.FindInvitationByID(ctx, t.ID)
+	if errors.IsKind(err, errors.ErrorNotFound) {
+		return nil, errors.New(errors.ErrorPermissionDenied, "invitation not found")
+	} else if err != nil {
+		return nil, err
+	}
+	if invitation.IsExpired() || invitation.IsAccepted() {
+		return nil, errors.New(errors.ErrorPermissionDenied, "invitation is expired or used")
+	}
+	return invitation, nil
+}
+
+// FindInvitationByID finds an invitation by id.
+func (s *Store) FindInvitationByID(ctx context.Context, id int64) (*Invitation, error) {
+	invitation := &Invitation{}
+	err := s.db.QueryRowxContext(ctx, "SELECT * FROM invitations WHERE id = ?", id).StructScan(invitation)
+	if err == sql.ErrNoRows {
+		return nil, errors.New(errors.ErrorNotFound, "")
+	} else if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return invitation, nil
+}
+
+// AllInvitationsWithQuery finds invitations with pagination.
+func (s *Store) AllInvitationsWithQuery(ctx context.Context, query InvitationsQuery) (*[]Invitation, *paging.Page, error) {
+	invitations := []Invitation{}
+	page, err := paging.SelectContext(ctx, s.db, query.PageOptions(), &invitations, "SELECT * FROM invitations")
+	if err != nil {
+		return nil, nil, err
+	}
+	return &invitations, page, nil
+}
+
+// DeleteInvitationByID revokes an invitation.
+func (s *Store) DeleteInvitationByID(ctx context.Context, id int64) error {
+	result, err := s.db.ExecContext(ctx, "DELETE FROM invitations WHERE id = ?", id)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	if rowsAffected == 0 {
+		return errors.New(errors.ErrorNotFound, "")
+	}
+	return nil
+}
+
+// AcceptInvitation marks an invitation as used by a newly signed up user, verifies the user's
+// email address and assigns the roles of the invitation.
+func (s *Store) AcceptInvitation(ctx context.Context, invitation *Invitation, u *User) error {
+	result, err := s.db.ExecContext(
+		ctx,
+		"UPDATE invitations SET accepted_by = ?, accepted_at = ? WHERE id = ? AND accepted_at IS NULL",
+		u.ID, time.Now(), invitation.ID,
+	)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	if rowsAffected == 0 {
+		return errors.New(errors.ErrorPermissionDenied, "invitation is expired or used")
+	}
+
+	if strings.EqualFold(u.Email.String, invitation.Email) && !u.EmailVerifiedAt.Valid {
+		u.EmailVerifiedAt = nulls.NewTime(time.Now())
+		if _, err := s.db.ExecContext(ctx, "UPDATE users SET email_verified_at = ? WHERE id = ?", u.EmailVerifiedAt, u.ID); err != nil {
+			return errors.Wrap(err, errors.ErrorUnknown, "")
+		}
+	}
+	for _, roleID := range invitation.RoleIDs {
+		err := s.AssignRole(ctx, &RoleUser{RoleID: roleID, UserID: u.ID})
+		if err != nil && !errors.IsKind(err, errors.ErrorAlreadyExists) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleIDs(t *testing.T) {
+	var ids RoleIDs
+	assert.NoError(t, ids.Scan([]byte("[1,2]")))
+	assert.Equal(t, RoleIDs{1, 2}, ids)
+	assert.NoError(t, ids.Scan(nil))
+	assert.Equal(t, RoleIDs{}, ids)
+	assert.Error(t, ids.Scan(1))
+
+	v, err := RoleIDs(nil).Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "[]", v)
+	v, err = RoleIDs{3}.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "[3]", v)
+}
+
+func TestInvitation(t *testing.T) {
+	store, teardown := storeForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	_, _, err := store.CreateInvitation(ctx, &Invitation{Email: "invalid", ClientID: "app", ExpiredAt: time.Now().Add(time.Hour)})
+	assert.True(t, errors.IsKind(err, errors.ErrorInvalidArgument))
+	_, _, err = store.CreateInvitation(ctx, &Invitation{Email: "new@example.com", ClientID: "app", RoleIDs: RoleIDs{100}, ExpiredAt: time.Now().Add(time.Hour)})
+	assert.True(t, errors.IsKind(err, errors.ErrorInvalidArgument))
+
+	invitation, token, err := store.CreateInvitation(ctx, &Invitation{
+		Email:     " new@example.com ",
+		ClientID:  "app",
+		RoleIDs:   RoleIDs{1, 2},
+		ExpiredAt: time.Now().Add(time.Hour),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "new@example.com", invitation.Email)
+	assert.Equal(t, RoleIDs{1, 2}, invitation.RoleIDs)
+	assert.NotEmpty(t, token)
+
+	found, err := store.FindInvitationByToken(ctx, token)
+	assert.NoError(t, err)
+	assert.Equal(t, invitation.ID, found.ID)
+	_, err = store.FindInvitationByToken(ctx, "invalid")
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+
+	u := &User{ID: 7}
+	u.Email.String = "new@example.com"
+	assert.NoError(t, store.AcceptInvitation(ctx, found, u))
+	assert.True(t, u.EmailVerifiedAt.Valid)
+	roles, err := store.FindAllRolesByUserID(ctx, 7)
+	assert.NoError(t, err)
+	assert.Len(t, *roles, 2)
+
+	// The invitation cannot be used again
+	_, err = store.FindInvitationByToken(ctx, token)
+	assert.True(t, errors.IsKind(err, errors.ErrorPermissionDenied))
+	assert.True(t, errors.IsKind(store.AcceptInvitation(ctx, found, u), errors.ErrorPermissionDenied))
+
+	invitations, _, err := store.AllInvitationsWithQuery(ctx, InvitationsQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, *invitations, 3)
+
+	assert.NoError(t, store.DeleteInvitationByID(ctx, invitation.ID))
+	assert.True(t, errors.IsKind(store.DeleteInvitationByID(ctx, invitation.ID), errors.ErrorNotFound))
+}
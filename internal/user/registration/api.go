@@ -26,6 +26,11 @@ func APIv2(userStore *user.Store, sessionStore *session.Store, emailService *ema
 
 		g := e.Group("/api/v2")
 		g.POST("/users", h.CreateUser)
+		g.POST("/users/import", h.ImportUsers)
+		g.POST("/invitations", h.CreateInvitation)
+		g.GET("/invitations", h.ListInvitations)
+		g.GET("/invitations/:id", h.GetInvitation)
+		g.DELETE("/invitations/:id", h.DeleteInvitation)
 	}
 }
 
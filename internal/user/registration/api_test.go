@@ -1,6 +1,8 @@
 package registration
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"testing"
 
@@ -17,6 +19,7 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func storeForTest() (*user.Store, *session.Store, *email.Service, *sms.Service, func()) {
@@ -31,8 +34,9 @@ func storeForTest() (*user.Store, *session.Store, *email.Service, *sms.Service,
 	testutil.FixturesSetUp()
 	d := db.NewDBFromConfig()
 	redis := testutil.RedisForTest()
+	kv := testutil.KVStoreForTest()
 	encryptor := testutil.EncryptorForTest()
-	userStore := user.NewStore(d, redis, encryptor)
+	userStore := user.NewStore(d, kv, encryptor)
 	sessionStore := session.NewStore(d, redis, userStore)
 	templateStore := template.NewStore(d)
 	emailService := email.NewService(templateStore)
@@ -69,3 +73,89 @@ func TestAPICreateUser(t *testing.T) {
 	assert.Equal(t, "test", res["user"].(map[string]interface{})["preferred_username"])
 	assert.NotEqual(t, "", res["refresh_token"])
 }
+
+func TestAPIImportUsers(t *testing.T) {
+	userStore, sessionStore, emailService, smsService, teardown := storeForTest()
+	defer teardown()
+	e := echo.New()
+	e.Validator = validator.Validator
+	APIv2(userStore, sessionStore, emailService, smsService)(e)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	payload := map[string]interface{}{
+		"users": []map[string]interface{}{
+			{
+				"email":                "imported@example.com",
+				"email_verified":       true,
+				"legacy_password_hash": string(hash),
+			},
+			{
+				"email":                "unsupported@example.com",
+				"legacy_password_hash": "$1$saltsalt$hash",
+			},
+			{
+				"email": "carol@example.com",
+			},
+		},
+	}
+	code, res, err := testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/import", payload)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	results := res["results"].([]interface{})
+	if assert.Len(t, results, 3) {
+		imported := results[0].(map[string]interface{})["user"].(map[string]interface{})
+		assert.Equal(t, "imported@example.com", imported["email"])
+		assert.Equal(t, true, imported["email_verified"])
+		assert.Equal(t, true, imported["is_password_set"])
+		assert.NotEmpty(t, results[1].(map[string]interface{})["error"])
+		assert.NotEmpty(t, results[2].(map[string]interface{})["error"])
+	}
+
+	u, err := userStore.UserByEmail(context.Background(), "imported@example.com")
+	assert.NoError(t, err)
+	assert.True(t, u.LegacyPasswordHash.Valid)
+
+	payload = map[string]interface{}{"users": []map[string]interface{}{}}
+	code, _, _ = testutil.JSONRequest(e, http.MethodPost, "/api/v2/users/import", payload)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestAPIInvitations(t *testing.T) {
+	e, teardown := echoForTest()
+	defer teardown()
+
+	payload := map[string]interface{}{
+		"email":     "invited@example.com",
+		"client_id": "app",
+		"role_ids":  []int64{2},
+	}
+	code, res, err := testutil.JSONRequest(e, http.MethodPost, "/api/v2/invitations", payload)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "invited@example.com", res["email"])
+	assert.Equal(t, []interface{}{float64(2)}, res["role_ids"])
+	assert.Contains(t, res["invitation_link"], "invitationToken=")
+	id := int64(res["id"].(float64))
+
+	payload["client_id"] = "unknown"
+	code, _, _ = testutil.JSONRequest(e, http.MethodPost, "/api/v2/invitations", payload)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, res, err = testutil.JSONRequest(e, http.MethodGet, "/api/v2/invitations", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, res["results"], 3)
+
+	path := fmt.Sprintf("/api/v2/invitations/%d", id)
+	code, res, err = testutil.JSONRequest(e, http.MethodGet, path, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, res["invitation_link"])
+
+	code, _, err = testutil.JSONRequest(e, http.MethodDelete, path, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _, _ = testutil.JSONRequest(e, http.MethodGet, path, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+}
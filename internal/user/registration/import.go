@@ -0,0 +1,110 @@
+package registration
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"authcore.io/authcore/internal/db"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/log"
+	"authcore.io/authcore/pkg/nulls"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ImportUsersRequest represents a request to import users from another system.
+type ImportUsersRequest struct {
+	Users []ImportUser `json:"users" validate:"required,min=1,max=1000,dive"`
+}
+
+// ImportUser represents a user to be imported. LegacyPasswordHash is a bcrypt, PBKDF2 or argon2
+// password hash that is replaced by a SPAKE2+ verifier on the first sign-in.
+type ImportUser struct {
+	Username           string `json:"preferred_username"`
+	Name               string `json:"name"`
+	Email              string `json:"email" validate:"omitempty,email"`
+	EmailVerified      bool   `json:"email_verified"`
+	Phone              string `json:"phone_number" validate:"omitempty,phone"`
+	PhoneVerified      bool   `json:"phone_number_verified"`
+	Language           string `json:"language" validate:"omitempty,language"`
+	LegacyPasswordHash string `json:"legacy_password_hash"`
+}
+
+// ImportUsersResponse represents the results of an import users request, in the same order as the
+// users in the request.
+type ImportUsersResponse struct {
+	Results []ImportUserResult `json:"results"`
+}
+
+// ImportUserResult is the result of importing a user. Error is set if the user is not imported.
+type ImportUserResult struct {
+	User  *user.JSONUser `json:"user,omitempty"`
+	Error string         `json:"error,omitempty"`
+}
+
+// ImportUsers creates users without sending verification messages or creating sessions. A user
+// that fails to import does not stop the others.
+func (h *handler) ImportUsers(c echo.Context) error {
+	r := ImportUsersRequest{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+	if err := c.Validate(&r); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	resp := ImportUsersResponse{Results: make([]ImportUserResult, len(r.Users))}
+	imported := 0
+	for i, iu := range r.Users {
+		u, err := h.importUser(ctx, iu)
+		if err != nil {
+			resp.Results[i].Error = err.Error()
+			continue
+		}
+		jsonUser, err := user.NewJSONUser(u)
+		if err != nil {
+			return err
+		}
+		resp.Results[i].User = &jsonUser
+		imported++
+	}
+	log.GetLogger(ctx).WithFields(logrus.Fields{
+		"imported": imported,
+		"failed":   len(r.Users) - imported,
+	}).Info("users imported")
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *handler) importUser(ctx context.Context, iu ImportUser) (*user.User, error) {
+	language := iu.Language
+	if language == "" {
+		language = viper.GetStringSlice("available_languages")[0]
+	}
+	u := &user.User{
+		Username: db.NullableString(iu.Username),
+		Name:     db.NullableString(iu.Name),
+		Email:    db.NullableString(iu.Email),
+		Phone:    db.NullableString(iu.Phone),
+		Language: db.NullableString(language),
+	}
+	now := time.Now()
+	if iu.EmailVerified && u.Email.Valid {
+		u.EmailVerifiedAt = nulls.NewTime(now)
+	}
+	if iu.PhoneVerified && u.Phone.Valid {
+		u.PhoneVerifiedAt = nulls.NewTime(now)
+	}
+	if iu.LegacyPasswordHash != "" {
+		if err := u.SetLegacyPasswordHash(iu.LegacyPasswordHash); err != nil {
+			return nil, err
+		}
+	}
+	if err := h.userStore.InsertUser(ctx, u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
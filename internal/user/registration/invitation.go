@@ -0,0 +1,172 @@
+package registration
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"authcore.io/authcore/internal/apiutil"
+	"authcore.io/authcore/internal/clientapp"
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/nulls"
+
+	"github.com/jinzhu/copier"
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+)
+
+// CreateInvitationRequest represents a create invitation request.
+type CreateInvitationRequest struct {
+	Email    string  `json:"email" validate:"required,email"`
+	ClientID string  `json:"client_id" validate:"required"`
+	RoleIDs  []int64 `json:"role_ids"`
+	// ExpiresIn is the lifetime of the invitation in seconds. invitation_expires_in is used if it
+	// is zero.
+	ExpiresIn int64  `json:"expires_in" validate:"gte=0"`
+	Language  string `json:"language"`
+}
+
+// JSONInvitation represents an invitation in API responses.
+type JSONInvitation struct {
+	ID         int64       `json:"id"`
+	Email      string      `json:"email"`
+	ClientID   string      `json:"client_id"`
+	RoleIDs    []int64     `json:"role_ids"`
+	InvitedBy  nulls.Int64 `json:"invited_by"`
+	AcceptedBy nulls.Int64 `json:"accepted_by"`
+	AcceptedAt nulls.Time  `json:"accepted_at"`
+	ExpiredAt  time.Time   `json:"expired_at"`
+	CreatedAt  time.Time   `json:"created_at"`
+	// InvitationLink is only returned when the invitation is created.
+	InvitationLink string `json:"invitation_link,omitempty"`
+}
+
+// NewJSONInvitation converts an Invitation to JSONInvitation.
+func NewJSONInvitation(i *user.Invitation) (JSONInvitation, error) {
+	j := JSONInvitation{}
+	err := copier.Copy(&j, i)
+	j.RoleIDs = []int64(i.RoleIDs)
+	return j, errors.Wrap(err, errors.ErrorUnknown, "")
+}
+
+func (h *handler) CreateInvitation(c echo.Context) error {
+	r := CreateInvitationRequest{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+	if err := c.Validate(&r); err != nil {
+		return err
+	}
+	clientApp, err := clientapp.GetByClientID(r.ClientID)
+	if err != nil {
+		return errors.New(errors.ErrorInvalidArgument, "invalid client_id")
+	}
+
+	expiresIn := viper.GetDuration("invitation_expires_in")
+	if r.ExpiresIn > 0 {
+		expiresIn = time.Duration(r.ExpiresIn) * time.Second
+	}
+	invitation := &user.Invitation{
+		Email:     r.Email,
+		ClientID:  clientApp.ID,
+		RoleIDs:   r.RoleIDs,
+		ExpiredAt: time.Now().Add(expiresIn),
+	}
+	if me, ok := user.FromContext(c); ok {
+		invitation.InvitedBy = nulls.NewInt64(me.ID)
+	}
+
+	ctx := c.Request().Context()
+	invitation, token, err := h.userStore.CreateInvitation(ctx, invitation)
+	if err != nil {
+		return err
+	}
+	link, err := invitationLink(clientApp.ID, token)
+	if err != nil {
+		return err
+	}
+	err = h.emailService.SendInvitationMail(ctx, link, invitation.Email, r.Language, invitation.ExpiredAt)
+	if err != nil {
+		return err
+	}
+
+	resp, err := NewJSONInvitation(invitation)
+	if err != nil {
+		return err
+	}
+	resp.InvitationLink = link
+	return c.JSON(http.StatusCreated, resp)
+}
+
+func (h *handler) ListInvitations(c echo.Context) error {
+	r := user.InvitationsQuery{}
+	if err := c.Bind(&r); err != nil {
+		return err
+	}
+	if err := c.Validate(&r); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	invitations, page, err := h.userStore.AllInvitationsWithQuery(ctx, r)
+	if err != nil {
+		return err
+	}
+	jsonInvitations := make([]JSONInvitation, len(*invitations))
+	for i, invitation := range *invitations {
+		jsonInvitations[i], err = NewJSONInvitation(&invitation)
+		if err != nil {
+			return err
+		}
+	}
+	return c.JSON(http.StatusOK, apiutil.NewListPagination(jsonInvitations, page))
+}
+
+func (h *handler) GetInvitation(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorInvalidArgument, "")
+	}
+	ctx := c.Request().Context()
+	invitation, err := h.userStore.FindInvitationByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	resp, err := NewJSONInvitation(invitation)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (h *handler) DeleteInvitation(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorInvalidArgument, "")
+	}
+	ctx := c.Request().Context()
+	err = h.userStore.DeleteInvitationByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// invitationLink returns the link to the sign-up page with an invitation token.
+func invitationLink(clientID, token string) (string, error) {
+	baseURL, err := url.Parse(viper.GetString("base_url"))
+	if err != nil {
+		return "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	link, err := baseURL.Parse("/widgets/register")
+	if err != nil {
+		return "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	q := link.Query()
+	q.Add("clientId", clientID)
+	q.Add("invitationToken", token)
+	link.RawQuery = q.Encode()
+	return link.String(), nil
+}
@@ -51,12 +51,13 @@ func appForTest() (*testApp, func()) {
 
 	testutil.FixturesSetUp()
 	redis := testutil.RedisForTest()
+	kv := testutil.KVStoreForTest()
 	encryptor := testutil.EncryptorForTest()
 	db := dbx.NewDBFromConfig()
 	templateStore := template.NewStore(db)
 	app := new(testApp)
 	app.db = db
-	app.userStore = user.NewStore(app.db, redis, encryptor)
+	app.userStore = user.NewStore(app.db, kv, encryptor)
 	app.sessionStore = session.NewStore(app.db, redis, app.userStore)
 	app.emailService = email.NewService(templateStore)
 	app.smsService = sms.NewService(templateStore)
@@ -1,5 +1,17 @@
 package user
 
+import "time"
+
+// AssuranceLevel is the level of confidence that the user of a session is the account owner.
+type AssuranceLevel int
+
+const (
+	// AssuranceLevel1 requires the user to have verified any one factor, e.g. password.
+	AssuranceLevel1 AssuranceLevel = 1
+	// AssuranceLevel2 requires the user to have verified a second factor.
+	AssuranceLevel2 AssuranceLevel = 2
+)
+
 type session interface {
-	UpdateCurrentUserPasswordAllowed() bool
-}
\ No newline at end of file
+	IsVerifiedWithin(level AssuranceLevel, maxAge time.Duration) bool
+}
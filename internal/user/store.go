@@ -11,37 +11,56 @@ import (
 	"authcore.io/authcore/internal/db"
 	"authcore.io/authcore/internal/errors"
 	"authcore.io/authcore/internal/validator"
+	"authcore.io/authcore/pkg/kvstore"
+	"authcore.io/authcore/pkg/log"
 	"authcore.io/authcore/pkg/messageencryptor"
 	"authcore.io/authcore/pkg/nulls"
 	"authcore.io/authcore/pkg/paging"
 
-	"github.com/go-redis/redis"
 	"github.com/huandu/go-sqlbuilder"
 	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 var userStruct = sqlbuilder.NewStruct(new(User))
 
+const secondFactorEnrollmentKeyPrefix = "second_factor_enrollment/"
+
 // Store manages User, Contact, and Role models.
 type Store struct {
 	db              *db.DB
-	redis           *redis.Client
+	kv              kvstore.Store
 	encryptor       *messageencryptor.MessageEncryptor
 	verifierFactory *verifier.Factory
+	tokenRevoker    OAuthTokenRevoker
 }
 
+// OAuthTokenRevoker revokes the upstream tokens of an OAuth factor at the IDP.
+type OAuthTokenRevoker func(ctx context.Context, oauthFactor *OAuthFactor) error
+
 // NewStore retrusn a new Store instance.
-func NewStore(db *db.DB, redis *redis.Client, encryptor *messageencryptor.MessageEncryptor) *Store {
+func NewStore(db *db.DB, kv kvstore.Store, encryptor *messageencryptor.MessageEncryptor) *Store {
 	store := &Store{
 		db:              db,
-		redis:           redis,
+		kv:              kv,
 		encryptor:       encryptor,
 		verifierFactory: verifier.NewFactory(),
 	}
 	return store
 }
 
+// RegisterVerifier adds an additional verifier method for enrolling second factors.
+func (s *Store) RegisterVerifier(method string, unmarshaller verifier.Unmarshaller) {
+	s.verifierFactory.Register(method, unmarshaller)
+}
+
+// RegisterOAuthTokenRevoker sets the function that revokes the upstream tokens of OAuth factors
+// before they are deleted.
+func (s *Store) RegisterOAuthTokenRevoker(revoker OAuthTokenRevoker) {
+	s.tokenRevoker = revoker
+}
+
 // InsertUser inserts the User and refresh the struct with data from database.
 func (s *Store) InsertUser(ctx context.Context, user *User) error {
 	if err := s.BeforeInsert(user); err != nil {
@@ -80,7 +99,30 @@ func (s *Store) UpdateUser(ctx context.Context, user *User) error {
 	ub.Where(ub.E("id", user.ID))
 	uq, ua := ub.Build()
 	_, err := s.db.ExecContext(ctx, uq, ua...)
-	return errors.WithSQLError(err)
+	if err != nil {
+		return errors.WithSQLError(err)
+	}
+	return s.deleteStaleEmailOTPFactors(ctx, user)
+}
+
+// deleteStaleEmailOTPFactors deletes the email OTP factors of the user bound to an email address
+// other than the current verified email, so that OTPs are not sent to an address the user may no
+// longer own.
+func (s *Store) deleteStaleEmailOTPFactors(ctx context.Context, user *User) error {
+	secondFactors, err := s.FindAllSecondFactorsByUserIDAndType(ctx, user.ID, SecondFactorEmailOTP)
+	if err != nil {
+		return err
+	}
+	for _, secondFactor := range *secondFactors {
+		if user.EmailVerified() && secondFactor.Content.Email.String == user.Email.String {
+			continue
+		}
+		err = s.DeleteSecondFactorByID(ctx, secondFactor.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // UpdateUserLastSeenAt updates the last seen at for the given user.
@@ -160,6 +202,14 @@ func (s *Store) DeleteUserByID(ctx context.Context, id int64) error {
 			return errors.Wrap(err, errors.ErrorNotFound, "user not found")
 		}
 
+		oauthFactors, err := s.FindAllOAuthFactorsByUserID(ctx, id)
+		if err != nil {
+			return err
+		}
+		for i := range *oauthFactors {
+			s.revokeOAuthTokens(ctx, &(*oauthFactors)[i])
+		}
+
 		_, err = tx.ExecContext(ctx, "DELETE FROM contacts WHERE user_id = ?", id)
 		if err != nil {
 			return errors.Wrap(err, errors.ErrorUnknown, "")
@@ -185,6 +235,11 @@ func (s *Store) DeleteUserByID(ctx context.Context, id int64) error {
 			return errors.Wrap(err, errors.ErrorUnknown, "")
 		}
 
+		_, err = tx.ExecContext(ctx, "DELETE FROM trusted_devices WHERE user_id = ?", id)
+		if err != nil {
+			return errors.Wrap(err, errors.ErrorUnknown, "")
+		}
+
 		_, err = tx.ExecContext(ctx, "DELETE FROM secrets WHERE user_id = ?", id)
 		if err != nil {
 			return errors.Wrap(err, errors.ErrorUnknown, "")
@@ -320,6 +375,12 @@ func (s *Store) CreateSecondFactor(ctx context.Context, secondFactor *SecondFact
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
 	}
+
+	// Trusted devices are revoked when MFA factors change.
+	err = s.DeleteAllTrustedDevicesByUserID(ctx, secondFactor.UserID)
+	if err != nil {
+		return nil, err
+	}
 	return s.FindSecondFactorByID(ctx, id)
 }
 
@@ -424,13 +485,52 @@ func (s *Store) UpdateSecondFactorContent(ctx context.Context, secondFactor *Sec
 
 // DeleteSecondFactorByID deletes a second factor by id.
 func (s *Store) DeleteSecondFactorByID(ctx context.Context, id int64) error {
-	_, err := s.db.QueryxContext(ctx, "DELETE FROM second_factors WHERE id = ?", id)
+	// Trusted devices are revoked when MFA factors change.
+	_, err := s.db.ExecContext(ctx, "DELETE FROM trusted_devices WHERE user_id = (SELECT user_id FROM second_factors WHERE id = ?)", id)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	_, err = s.db.QueryxContext(ctx, "DELETE FROM second_factors WHERE id = ?", id)
 	if err != nil {
 		return errors.Wrap(err, errors.ErrorUnknown, "")
 	}
 	return nil
 }
 
+// PutSecondFactorEnrollmentState saves the verifier state of a pending second factor enrollment.
+func (s *Store) PutSecondFactorEnrollmentState(ctx context.Context, userID int64, secondFactorType SecondFactorType, state verifier.State) error {
+	key := fmt.Sprintf("%s%d/%s", secondFactorEnrollmentKeyPrefix, userID, secondFactorType)
+	encryptedData, err := s.encryptor.Encrypt(state, []byte(key))
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	expiry := viper.GetDuration("second_factor_enrollment_time_limit")
+	err = s.kv.Set(key, encryptedData, expiry)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return nil
+}
+
+// BurnSecondFactorEnrollmentState retrieves and removes the verifier state of a pending second
+// factor enrollment.
+func (s *Store) BurnSecondFactorEnrollmentState(ctx context.Context, userID int64, secondFactorType SecondFactorType) (verifier.State, error) {
+	key := fmt.Sprintf("%s%d/%s", secondFactorEnrollmentKeyPrefix, userID, secondFactorType)
+	encryptedData, err := s.kv.Get(key)
+	if err == kvstore.ErrNotFound {
+		return nil, errors.New(errors.ErrorNotFound, "")
+	} else if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	s.kv.Delete(key)
+
+	data, err := s.encryptor.Decrypt(encryptedData, []byte(key))
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return verifier.State(data), nil
+}
+
 // FindAllOAuthFactorsByUserID finds the list of OAuth factors by a user id.
 func (s *Store) FindAllOAuthFactorsByUserID(ctx context.Context, userID int64) (*[]OAuthFactor, error) {
 	oauthFactors := &[]OAuthFactor{}
@@ -438,6 +538,12 @@ func (s *Store) FindAllOAuthFactorsByUserID(ctx context.Context, userID int64) (
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
 	}
+	for i := range *oauthFactors {
+		err = s.AfterSelect(&(*oauthFactors)[i])
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+		}
+	}
 	return oauthFactors, nil
 }
 
@@ -448,6 +554,12 @@ func (s *Store) FindAllOAuthFactorsByUserIDAndService(ctx context.Context, userI
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
 	}
+	for i := range *oauthFactors {
+		err = s.AfterSelect(&(*oauthFactors)[i])
+		if err != nil {
+			return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+		}
+	}
 	return oauthFactors, nil
 }
 
@@ -460,21 +572,41 @@ func (s *Store) FindOAuthFactorByID(ctx context.Context, ID int64) (*OAuthFactor
 	} else if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
 	}
+	err = s.AfterSelect(oauthFactor)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
 
 	return oauthFactor, nil
 }
 
-// DeleteOAuthFactorByID deletes an OAuth factor by id.
+// DeleteOAuthFactorByID deletes an OAuth factor by id. The upstream tokens of the factor are
+// revoked.
 func (s *Store) DeleteOAuthFactorByID(ctx context.Context, id int64) error {
-	_, err := s.db.ExecContext(ctx, "DELETE FROM oauth_factors WHERE id = ?", id)
+	oauthFactor, err := s.FindOAuthFactorByID(ctx, id)
+	if err != nil && !errors.IsKind(err, errors.ErrorNotFound) {
+		return err
+	}
+	if oauthFactor != nil {
+		s.revokeOAuthTokens(ctx, oauthFactor)
+	}
+	_, err = s.db.ExecContext(ctx, "DELETE FROM oauth_factors WHERE id = ?", id)
 	if err != nil {
 		return errors.Wrap(err, errors.ErrorUnknown, "")
 	}
 	return nil
 }
 
-// DeleteOAuthFactorByUserIDAndService deletes an OAuth factor by user id and service.
+// DeleteOAuthFactorByUserIDAndService deletes an OAuth factor by user id and service. The upstream
+// tokens of the factor are revoked.
 func (s *Store) DeleteOAuthFactorByUserIDAndService(ctx context.Context, userID int64, service OAuthService) error {
+	oauthFactors, err := s.FindAllOAuthFactorsByUserIDAndService(ctx, userID, service)
+	if err != nil {
+		return err
+	}
+	for i := range *oauthFactors {
+		s.revokeOAuthTokens(ctx, &(*oauthFactors)[i])
+	}
 	result, err := s.db.ExecContext(ctx, "DELETE FROM oauth_factors WHERE user_id = ? AND service = ?", userID, service)
 	if err != nil {
 		return errors.Wrap(err, errors.ErrorUnknown, "")
@@ -503,6 +635,10 @@ func (s *Store) FindOAuthFactorByOAuthIdentity(ctx context.Context, service OAut
 	} else if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
 	}
+	err = s.AfterSelect(oauthFactor)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
 	return oauthFactor, nil
 }
 
@@ -542,6 +678,44 @@ func (s *Store) UpdateOAuthFactorMetadata(ctx context.Context, id int64, metadat
 	return s.FindOAuthFactorByID(ctx, id)
 }
 
+// UpdateOAuthFactorTokens encrypts and updates the upstream tokens of an oauth factor.
+func (s *Store) UpdateOAuthFactorTokens(ctx context.Context, oauthFactor *OAuthFactor) (*OAuthFactor, error) {
+	err := s.encryptor.EncryptStruct(oauthFactor)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	_, err = s.db.ExecContext(
+		ctx,
+		"UPDATE oauth_factors SET encrypted_access_token = ?, encrypted_access_secret = ?, encrypted_refresh_token = ?, token_type = ?, token_expires_at = ? WHERE id = ?",
+		oauthFactor.EncryptedAccessToken,
+		oauthFactor.EncryptedAccessSecret,
+		oauthFactor.EncryptedRefreshToken,
+		oauthFactor.TokenType,
+		oauthFactor.TokenExpiresAt,
+		oauthFactor.ID,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+
+	return s.FindOAuthFactorByID(ctx, oauthFactor.ID)
+}
+
+// revokeOAuthTokens revokes the upstream tokens of an oauth factor. Failures are logged and do
+// not prevent the factor from being deleted.
+func (s *Store) revokeOAuthTokens(ctx context.Context, oauthFactor *OAuthFactor) {
+	if s.tokenRevoker == nil || (!oauthFactor.AccessToken.Valid && !oauthFactor.RefreshToken.Valid) {
+		return
+	}
+	err := s.tokenRevoker(ctx, oauthFactor)
+	if err != nil {
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"oauth_factor_id": oauthFactor.ID,
+			"service":         oauthFactor.Service,
+		}).Warnf("error revoking upstream tokens: %v", err)
+	}
+}
+
 // UpdateOAuthFactorLastUsedAt update an oauth factor last used time.
 func (s *Store) UpdateOAuthFactorLastUsedAt(ctx context.Context, id int64, lastUsedAt time.Time) (*OAuthFactor, error) {
 	_, err := s.db.ExecContext(ctx, "UPDATE oauth_factors SET last_used_at = ? WHERE id = ?", lastUsedAt, id)
@@ -684,6 +858,51 @@ func (s *Store) FindAllRolesByUserID(ctx context.Context, userID int64) (*[]Role
 	return roles, nil
 }
 
+// SyncRoles assigns roles to the user and unassigns the other managed roles, so that the managed
+// roles assigned to the user are exactly roles. Roles that are not managed are left unchanged and
+// roles that do not exist are ignored.
+func (s *Store) SyncRoles(ctx context.Context, userID int64, managedRoles, roles []string) error {
+	allRoles, err := s.FindAllRoles(ctx)
+	if err != nil {
+		return err
+	}
+	roleIDs := make(map[string]int64, len(*allRoles))
+	for _, role := range *allRoles {
+		roleIDs[role.Name] = role.ID
+	}
+	assignedRoles, err := s.FindAllRolesByUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	assigned := make(map[string]bool, len(*assignedRoles))
+	for _, role := range *assignedRoles {
+		assigned[role.Name] = true
+	}
+
+	want := make(map[string]bool, len(roles))
+	for _, name := range roles {
+		want[name] = true
+		roleID, ok := roleIDs[name]
+		if !ok || assigned[name] {
+			continue
+		}
+		err := s.AssignRole(ctx, &RoleUser{RoleID: roleID, UserID: userID})
+		if err != nil && !errors.IsKind(err, errors.ErrorAlreadyExists) {
+			return err
+		}
+	}
+	for _, name := range managedRoles {
+		if want[name] || !assigned[name] {
+			continue
+		}
+		err := s.UnassignByRoleIDAndUserID(ctx, roleIDs[name], userID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // AllUsersByRoleID finds all users with a given assigned role id
 func (s *Store) AllUsersByRoleID(ctx context.Context, roleID int64) (*[]User, error) {
 	users := &[]User{}
@@ -6,9 +6,12 @@ import (
 	"testing"
 	"time"
 
+	"authcore.io/authcore/internal/authn/verifier"
 	"authcore.io/authcore/internal/config"
 	dbx "authcore.io/authcore/internal/db"
+	"authcore.io/authcore/internal/email"
 	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/internal/template"
 	"authcore.io/authcore/internal/testutil"
 	"authcore.io/authcore/internal/validator"
 	"authcore.io/authcore/pkg/nulls"
@@ -38,14 +41,15 @@ func storeForTest() (*Store, func()) {
 
 	testutil.FixturesSetUp()
 	db := dbx.NewDBFromConfig()
-	redis := testutil.RedisForTest()
+	kv := testutil.KVStoreForTest()
 	encryptor := testutil.EncryptorForTest()
-	store := NewStore(db, redis, encryptor)
+	store := NewStore(db, kv, encryptor)
+	emailService := email.NewService(template.NewStore(db))
+	store.RegisterVerifier(verifier.EmailOTP, verifier.EmailOTPVerifierFactory(emailService, kv))
 
 	return store, func() {
 		db.Close()
 		viper.Reset()
-		redis.FlushAll()
 	}
 }
 
@@ -103,6 +107,45 @@ func TestUpdateUser(t *testing.T) {
 	}
 }
 
+func TestUpdateUserEmailDeletesEmailOTPFactor(t *testing.T) {
+	store, teardown := storeForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	u, err := store.UserByID(ctx, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	u.EmailVerifiedAt = nulls.NewTime(time.Now())
+	assert.NoError(t, store.UpdateUser(ctx, u))
+	_, err = store.CreateSecondFactor(ctx, &SecondFactor{
+		UserID: u.ID,
+		Type:   SecondFactorEmailOTP,
+		Content: SecondFactorContent{
+			Email: u.Email,
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The factor is kept while the email is unchanged
+	u.Name = nulls.NewString("Bob")
+	assert.NoError(t, store.UpdateUser(ctx, u))
+	secondFactors, err := store.FindAllSecondFactorsByUserIDAndType(ctx, u.ID, SecondFactorEmailOTP)
+	if assert.NoError(t, err) {
+		assert.Len(t, *secondFactors, 1)
+	}
+
+	// The factor is deleted once the email changes
+	u.Email = nulls.NewString("bob_new@example.com")
+	assert.NoError(t, store.UpdateUser(ctx, u))
+	secondFactors, err = store.FindAllSecondFactorsByUserIDAndType(ctx, u.ID, SecondFactorEmailOTP)
+	if assert.NoError(t, err) {
+		assert.Len(t, *secondFactors, 0)
+	}
+}
+
 func TestUpdateUserMetadata(t *testing.T) {
 	store, teardown := storeForTest()
 	defer teardown()
@@ -413,7 +456,7 @@ func TestDeleteOAuthFactorByUserIDAndService(t *testing.T) {
 	store, teardown := storeForTest()
 	defer teardown()
 
-	err := store.DeleteOAuthFactorByUserIDAndService(context.TODO(), 11, 999)
+	err := store.DeleteOAuthFactorByUserIDAndService(context.TODO(), 11, "mock")
 	assert.NoError(t, err)
 
 	oauthFactors, err := store.FindAllOAuthFactorsByUserID(context.TODO(), 11)
@@ -421,12 +464,55 @@ func TestDeleteOAuthFactorByUserIDAndService(t *testing.T) {
 		assert.Len(t, *oauthFactors, 2)
 	}
 
-	err = store.DeleteOAuthFactorByUserIDAndService(context.TODO(), 1, 999)
+	err = store.DeleteOAuthFactorByUserIDAndService(context.TODO(), 1, "mock")
 	if assert.Error(t, err) {
 		assert.True(t, errors.IsKind(err, errors.ErrorNotFound))
 	}
 }
 
+func TestUpdateOAuthFactorTokens(t *testing.T) {
+	store, teardown := storeForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	oauthFactor, err := store.FindOAuthFactorByID(ctx, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, oauthFactor.AccessToken.Valid)
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	oauthFactor.AccessToken = nulls.NewString("access-token")
+	oauthFactor.RefreshToken = nulls.NewString("refresh-token")
+	oauthFactor.TokenType = nulls.NewString("Bearer")
+	oauthFactor.TokenExpiresAt = nulls.NewTime(expiresAt)
+	oauthFactor, err = store.UpdateOAuthFactorTokens(ctx, oauthFactor)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "access-token", oauthFactor.AccessToken.String)
+		assert.Equal(t, "refresh-token", oauthFactor.RefreshToken.String)
+		assert.False(t, oauthFactor.AccessSecret.Valid)
+		assert.Equal(t, "Bearer", oauthFactor.TokenType.String)
+		assert.True(t, expiresAt.Equal(oauthFactor.TokenExpiresAt.Time))
+		assert.NotContains(t, oauthFactor.EncryptedAccessToken.String, "access-token")
+	}
+
+	// Tokens are revoked when the factor is deleted
+	var revoked []*OAuthFactor
+	store.RegisterOAuthTokenRevoker(func(ctx context.Context, oauthFactor *OAuthFactor) error {
+		revoked = append(revoked, oauthFactor)
+		return errors.New(errors.ErrorUnavailable, "")
+	})
+	err = store.DeleteOAuthFactorByID(ctx, oauthFactor.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, revoked, 1) {
+		assert.Equal(t, "refresh-token", revoked[0].RefreshToken.String)
+	}
+
+	// Factors without tokens are not revoked
+	err = store.DeleteOAuthFactorByUserIDAndService(ctx, 11, "mock")
+	assert.NoError(t, err)
+	assert.Len(t, revoked, 1)
+}
+
 func TestUpdateOAuthFactorMetadata(t *testing.T) {
 	store, teardown := storeForTest()
 	defer teardown()
@@ -654,6 +740,28 @@ func TestFindAllRolesByUserID(t *testing.T) {
 		assert.Equal(t, int64(2), role2.ID)
 	}
 }
+func TestSyncRoles(t *testing.T) {
+	store, teardown := storeForTest()
+	defer teardown()
+
+	// User 1 has authcore.admin and authcore.editor. authcore.editor is not managed.
+	err := store.SyncRoles(context.TODO(), 1, []string{"authcore.admin", "snowdrop.admin"}, []string{"snowdrop.admin", "unknown"})
+	assert.NoError(t, err)
+	roles, err := store.FindAllRolesByUserID(context.TODO(), 1)
+	if assert.NoError(t, err) && assert.Len(t, *roles, 2) {
+		assert.Equal(t, "authcore.editor", (*roles)[0].Name)
+		assert.Equal(t, "snowdrop.admin", (*roles)[1].Name)
+	}
+
+	// No changes
+	err = store.SyncRoles(context.TODO(), 1, []string{"authcore.admin", "snowdrop.admin"}, []string{"snowdrop.admin"})
+	assert.NoError(t, err)
+	roles, err = store.FindAllRolesByUserID(context.TODO(), 1)
+	if assert.NoError(t, err) {
+		assert.Len(t, *roles, 2)
+	}
+}
+
 func TestAllUsersByRoleID(t *testing.T) {
 	store, teardown := storeForTest()
 	defer teardown()
@@ -0,0 +1,145 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"authcore.io/authcore/internal/errors"
+	"authcore.io/authcore/pkg/nulls"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/viper"
+)
+
+const trustedDeviceTokenPurpose = "trusted_device"
+
+// TrustedDevice represents a device that is allowed to skip MFA.
+type TrustedDevice struct {
+	ID          int64        `db:"id"`
+	UserID      int64        `db:"user_id"`
+	Fingerprint []byte       `db:"fingerprint"`
+	UserAgent   string       `db:"user_agent"`
+	IP          nulls.String `db:"ip"`
+	ExpiredAt   time.Time    `db:"expired_at"`
+	LastUsedAt  nulls.Time   `db:"last_used_at"`
+	UpdatedAt   time.Time    `db:"updated_at"`
+	CreatedAt   time.Time    `db:"created_at"`
+}
+
+// IsExpired returns whether the device trust is expired.
+func (d *TrustedDevice) IsExpired() bool {
+	return d.ExpiredAt.Before(time.Now())
+}
+
+// trustedDeviceToken is the payload of a trusted device token.
+type trustedDeviceToken struct {
+	ID     int64 `json:"id"`
+	UserID int64 `json:"user_id"`
+}
+
+// CreateTrustedDevice trusts a device with the given fingerprint. It returns a token that should
+// be presented by the device to skip MFA.
+func (s *Store) CreateTrustedDevice(ctx context.Context, userID int64, fingerprint []byte, userAgent, ip string) (*TrustedDevice, string, error) {
+	expiredAt := time.Now().Add(viper.GetDuration("trusted_device_expires_in"))
+	result, err := s.db.ExecContext(
+		ctx,
+		"INSERT INTO trusted_devices (user_id, fingerprint, user_agent, ip, expired_at) VALUES (?, ?, ?, ?, ?)",
+		userID,
+		fingerprint,
+		userAgent,
+		nulls.String{String: ip, Valid: ip != ""},
+		expiredAt,
+	)
+	if err != nil {
+		return nil, "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	device, err := s.FindTrustedDeviceByID(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, err := json.Marshal(trustedDeviceToken{ID: device.ID, UserID: device.UserID})
+	if err != nil {
+		return nil, "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	token, err := s.encryptor.Encrypt(data, []byte(trustedDeviceTokenPurpose))
+	if err != nil {
+		return nil, "", errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return device, token, nil
+}
+
+// VerifyTrustedDeviceToken returns whether the token is issued to the user and the device with the
+// given fingerprint, and the trust is neither expired nor revoked.
+func (s *Store) VerifyTrustedDeviceToken(ctx context.Context, userID int64, token string, fingerprint []byte) bool {
+	if token == "" {
+		return false
+	}
+	data, err := s.encryptor.Decrypt(token, []byte(trustedDeviceTokenPurpose))
+	if err != nil {
+		return false
+	}
+	t := trustedDeviceToken{}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return false
+	}
+	if t.UserID != userID {
+		return false
+	}
+	device, err := s.FindTrustedDeviceByID(ctx, t.ID)
+	if err != nil {
+		return false
+	}
+	if device.UserID != userID || device.IsExpired() || !bytes.Equal(device.Fingerprint, fingerprint) {
+		return false
+	}
+	_, err = s.db.ExecContext(ctx, "UPDATE trusted_devices SET last_used_at = ? WHERE id = ?", time.Now(), device.ID)
+	return err == nil
+}
+
+// FindTrustedDeviceByID finds a trusted device by id.
+func (s *Store) FindTrustedDeviceByID(ctx context.Context, id int64) (*TrustedDevice, error) {
+	device := &TrustedDevice{}
+	err := s.db.QueryRowxContext(ctx, "SELECT * FROM trusted_devices WHERE id = ?", id).StructScan(device)
+	if err == sql.ErrNoRows {
+		return nil, errors.New(errors.ErrorNotFound, "")
+	} else if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return device, nil
+}
+
+// FindAllTrustedDevicesByUserID finds all unexpired trusted devices of a user.
+func (s *Store) FindAllTrustedDevicesByUserID(ctx context.Context, userID int64) (*[]TrustedDevice, error) {
+	devices := &[]TrustedDevice{}
+	err := sqlx.SelectContext(ctx, s.db, devices, "SELECT * FROM trusted_devices WHERE user_id = ? AND expired_at > NOW() ORDER BY id DESC", userID)
+	if err != nil {
+		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return devices, nil
+}
+
+// DeleteTrustedDeviceByID revokes a trusted device.
+func (s *Store) DeleteTrustedDeviceByID(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM trusted_devices WHERE id = ?", id)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return nil
+}
+
+// DeleteAllTrustedDevicesByUserID revokes all trusted devices of a user.
+func (s *Store) DeleteAllTrustedDevicesByUserID(ctx context.Context, userID int64) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM trusted_devices WHERE user_id = ?", userID)
+	if err != nil {
+		return errors.Wrap(err, errors.ErrorUnknown, "")
+	}
+	return nil
+}
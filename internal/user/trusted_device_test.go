@@ -0,0 +1,49 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustedDevice(t *testing.T) {
+	store, teardown := storeForTest()
+	defer teardown()
+	ctx := context.Background()
+
+	device, token, err := store.CreateTrustedDevice(ctx, 2, []byte("fingerprint"), "Chrome 71.0 (Mac OS X 10.14.2)", "127.0.0.1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), device.UserID)
+		assert.False(t, device.IsExpired())
+		assert.NotEmpty(t, token)
+	}
+
+	assert.True(t, store.VerifyTrustedDeviceToken(ctx, 2, token, []byte("fingerprint")))
+	assert.False(t, store.VerifyTrustedDeviceToken(ctx, 2, token, []byte("another")))
+	assert.False(t, store.VerifyTrustedDeviceToken(ctx, 1, token, []byte("fingerprint")))
+	assert.False(t, store.VerifyTrustedDeviceToken(ctx, 2, "invalid", []byte("fingerprint")))
+
+	device, err = store.FindTrustedDeviceByID(ctx, device.ID)
+	if assert.NoError(t, err) {
+		assert.True(t, device.LastUsedAt.Valid)
+	}
+
+	// Expired device
+	assert.False(t, store.VerifyTrustedDeviceToken(ctx, 1, tokenForTrustedDevice(t, store, 2, 1), []byte("test-fingerprint")))
+
+	err = store.DeleteAllTrustedDevicesByUserID(ctx, 2)
+	assert.NoError(t, err)
+	assert.False(t, store.VerifyTrustedDeviceToken(ctx, 2, token, []byte("fingerprint")))
+}
+
+func tokenForTrustedDevice(t *testing.T, store *Store, id, userID int64) string {
+	data, err := json.Marshal(trustedDeviceToken{ID: id, UserID: userID})
+	assert.NoError(t, err)
+	token, err := store.encryptor.Encrypt(data, []byte(trustedDeviceTokenPurpose))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return token
+}
@@ -34,6 +34,10 @@ type User struct {
 	PasswordVerifierL           nulls.ByteSlice `db:"-" encrypt:"" encryptPurpose:"users.password_verifier_l"`
 	EncryptedPasswordVerifierW0 nulls.String    `db:"encrypted_password_verifier_w0" fieldtag:"insert,update"`
 	EncryptedPasswordVerifierL  nulls.String    `db:"encrypted_password_verifier_l" fieldtag:"insert,update"`
+	LegacyPasswordHash          nulls.String    `db:"-" encrypt:"" encryptPurpose:"users.legacy_password_hash"`
+	EncryptedLegacyPasswordHash nulls.String    `db:"encrypted_legacy_password_hash" fieldtag:"insert,update"`
+	PasswordChangedAt           nulls.Time      `db:"password_changed_at" fieldtag:"insert,update"`
+	PasswordChangeRequired      bool            `db:"password_change_required" fieldtag:"insert,update"`
 	IsLocked                    bool            `db:"is_locked" fieldtag:"update"`
 	LockExpiredAt               nulls.Time      `db:"lock_expired_at" fieldtag:"update"`
 	LockDescription             nulls.String    `db:"lock_description" fieldtag:"update"`
@@ -68,6 +72,20 @@ func (user *User) SetPasswordVerifier(salt, verifierW0, verifierL []byte) error
 	user.PasswordSaltBase64 = nulls.NewString(base64.RawURLEncoding.EncodeToString(salt))
 	user.PasswordVerifierW0 = nulls.NewByteSlice(verifierW0)
 	user.PasswordVerifierL = nulls.NewByteSlice(verifierL)
+	// A SPAKE2+ verifier supersedes an imported password hash.
+	user.LegacyPasswordHash = nulls.String{}
+	user.PasswordChangedAt = nulls.NewTime(time.Now())
+	user.PasswordChangeRequired = false
+	return nil
+}
+
+// SetLegacyPasswordHash sets a password hash imported from another system. It is replaced by a
+// SPAKE2+ verifier when the user signs in with the password.
+func (user *User) SetLegacyPasswordHash(hash string) error {
+	if err := verifier.ValidateLegacyPasswordHash(hash); err != nil {
+		return err
+	}
+	user.LegacyPasswordHash = nulls.NewString(hash)
 	return nil
 }
 
@@ -118,7 +136,29 @@ func (user *User) IsCurrentlyLocked() bool {
 
 // IsPasswordAuthenticationEnabled checks if an user can be authenticated with password
 func (user *User) IsPasswordAuthenticationEnabled() bool {
-	return len(user.PasswordSalt()) > 0 && user.PasswordVerifierW0.Valid && user.PasswordVerifierL.Valid
+	return len(user.PasswordSalt()) > 0 && user.PasswordVerifierW0.Valid && user.PasswordVerifierL.Valid ||
+		user.LegacyPasswordHash.Valid
+}
+
+// IsPasswordChangeRequired returns whether the user must change the password before completing an
+// authentication, either because the user is flagged or the password is older than maxAge. The
+// password age is counted from the user creation if it has never been changed. A zero maxAge
+// disables password expiry.
+func (user *User) IsPasswordChangeRequired(maxAge time.Duration) bool {
+	if !user.IsPasswordAuthenticationEnabled() {
+		return false
+	}
+	if user.PasswordChangeRequired {
+		return true
+	}
+	if maxAge <= 0 {
+		return false
+	}
+	changedAt := user.PasswordChangedAt.Time
+	if !user.PasswordChangedAt.Valid {
+		changedAt = user.CreatedAt
+	}
+	return time.Since(changedAt) > maxAge
 }
 
 // RealLanguage checks the language in user model is available in system and return it or the fallback value
@@ -135,13 +175,15 @@ func (user *User) PasswordVerifier() (v verifier.Verifier, err error) {
 	w0 := user.PasswordVerifierW0.ByteSlice
 	l := user.PasswordVerifierL.ByteSlice
 
-	if len(salt) == 0 || len(w0) == 0 || len(l) == 0 {
+	if len(salt) > 0 && len(w0) > 0 && len(l) > 0 {
+		v = verifier.NewSPAKE2PlusVerifier(salt, w0, l)
+	} else if user.LegacyPasswordHash.Valid {
+		v = verifier.NewLegacyPasswordVerifier(user.LegacyPasswordHash.String)
+	} else {
 		err = errors.New(errors.ErrorInvalidArgument, "password was not set for user")
 		return
 	}
 
-	v = verifier.NewSPAKE2PlusVerifier(salt, w0, l)
-
 	if !v.IsPrimary() {
 		v = nil
 		err = errors.New(errors.ErrorPermissionDenied, "not a primary factor")
@@ -3,8 +3,11 @@ package user
 import (
 	"context"
 	"testing"
+	"time"
 
 	"authcore.io/authcore/internal/authn/verifier"
+	"authcore.io/authcore/pkg/nulls"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,6 +25,28 @@ func TestPasswordVerifierFromUserNoPassword(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestIsPasswordChangeRequired(t *testing.T) {
+	u := &User{CreatedAt: time.Now().Add(-48 * time.Hour)}
+	assert.False(t, u.IsPasswordChangeRequired(time.Hour))
+
+	assert.NoError(t, u.SetPasswordVerifier(make([]byte, 32), []byte("w0"), []byte("l")))
+	assert.True(t, u.PasswordChangedAt.Valid)
+	assert.False(t, u.IsPasswordChangeRequired(0))
+	assert.False(t, u.IsPasswordChangeRequired(time.Hour))
+
+	u.PasswordChangedAt = nulls.NewTime(time.Now().Add(-2 * time.Hour))
+	assert.False(t, u.IsPasswordChangeRequired(0))
+	assert.True(t, u.IsPasswordChangeRequired(time.Hour))
+
+	// The password age is counted from the user creation if it has never been changed
+	u.PasswordChangedAt = nulls.Time{}
+	assert.True(t, u.IsPasswordChangeRequired(24*time.Hour))
+	assert.False(t, u.IsPasswordChangeRequired(72*time.Hour))
+
+	u.PasswordChangeRequired = true
+	assert.True(t, u.IsPasswordChangeRequired(0))
+}
+
 func TestFromSecondFactor(t *testing.T) {
 	store, teardown := storeForTest()
 	defer teardown()
@@ -1,16 +1,16 @@
 package oauth
 
 import (
-	"crypto/rsa"
+	"context"
 	"crypto/x509"
 	"encoding/pem"
 	"time"
 
+	"authcore.io/authcore/internal/authn/idp"
 	"authcore.io/authcore/internal/errors"
 	"authcore.io/authcore/pkg/secret"
 
 	"github.com/dgrijalva/jwt-go"
-	"github.com/lestrrat-go/jwx/jwk"
 	"github.com/spf13/viper"
 	"golang.org/x/oauth2"
 )
@@ -64,7 +64,7 @@ func (factor AppleOAuthFactor) GetUser(accessToken, idToken string) (*User, erro
 		if !ok {
 			return nil, errors.New(errors.ErrorInvalidArgument, "")
 		}
-		return getCertificateFromApple(kid)
+		return idp.SharedJWKSCache(idp.AppleJWKSURL).Key(context.Background(), kid)
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorInvalidArgument, "")
@@ -89,30 +89,3 @@ func (factor AppleOAuthFactor) GetUser(accessToken, idToken string) (*User, erro
 	user.Email = email
 	return &user, nil
 }
-
-type appleKeysResponse struct {
-	Keys []jwk.RSAPublicKey `json:"keys"`
-}
-type appleKeyHeader struct {
-	Kid string
-}
-
-func getCertificateFromApple(keyID string) (*rsa.PublicKey, error) {
-	set, err := jwk.Fetch("https://appleid.apple.com/auth/keys")
-	if err != nil {
-		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
-	}
-	keys := set.LookupKeyID(keyID)
-	if len(keys) == 0 {
-		return nil, errors.New(errors.ErrorInvalidArgument, "key not found")
-	}
-	key, err := keys[0].Materialize()
-	if err != nil {
-		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
-	}
-	rsaKey, ok := key.(*rsa.PublicKey)
-	if !ok {
-		return nil, errors.New(errors.ErrorUnknown, "verification key not being rsa key")
-	}
-	return rsaKey, nil
-}
@@ -1,11 +1,9 @@
 package oauth
 
 import (
-	"crypto/rsa"
-	"encoding/json"
-	"io/ioutil"
-	"net/http"
+	"context"
 
+	"authcore.io/authcore/internal/authn/idp"
 	"authcore.io/authcore/internal/errors"
 	"authcore.io/authcore/pkg/secret"
 
@@ -38,7 +36,7 @@ func (factor GoogleOAuthFactor) GetUser(accessToken, idToken string) (*User, err
 		if !ok {
 			return nil, errors.New(errors.ErrorInvalidArgument, "")
 		}
-		return getCertificateFromGoogle(kid)
+		return idp.SharedJWKSCache(idp.GoogleJWKSURL).Key(context.Background(), kid)
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, errors.ErrorInvalidArgument, "")
@@ -63,34 +61,3 @@ func (factor GoogleOAuthFactor) GetUser(accessToken, idToken string) (*User, err
 	user.Email = email
 	return &user, nil
 }
-
-func getCertificateFromGoogle(keyID string) (*rsa.PublicKey, error) {
-	resp, err := http.Get("https://www.googleapis.com/oauth2/v1/certs")
-	if err != nil {
-		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
-	}
-	response, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
-	}
-	var certificates map[string]string
-	err = json.Unmarshal(response, &certificates)
-	if err != nil {
-		return nil, errors.Wrap(err, errors.ErrorUnknown, "")
-	}
-	var googleOAuthCertificates map[string]*rsa.PublicKey
-	googleOAuthCertificates = make(map[string]*rsa.PublicKey)
-	for kid, certificate := range certificates {
-		parsedCertificate, err := jwt.ParseRSAPublicKeyFromPEM([]byte(certificate))
-		if err != nil {
-			panic("cannot parse certificate from google for oauth")
-		}
-		googleOAuthCertificates[kid] = parsedCertificate
-	}
-	certificate, ok := googleOAuthCertificates[keyID]
-	if !ok {
-		return nil, errors.New(errors.ErrorInvalidArgument, "certificate not found")
-	}
-	return certificate, nil
-}
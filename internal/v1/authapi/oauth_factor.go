@@ -71,7 +71,11 @@ func (s *Service) CreateOAuthFactor(ctx context.Context, in *authapi.CreateOAuth
 		return nil, errors.New(errors.ErrorPermissionDenied, "")
 	}
 
-	oauthFactors, err := s.UserStore.FindAllOAuthFactorsByUserIDAndService(ctx, currentUser.ID, user.OAuthService(in.Service))
+	service, err := user.OAuthServiceFromV1(int32(in.Service))
+	if err != nil {
+		return nil, err
+	}
+	oauthFactors, err := s.UserStore.FindAllOAuthFactorsByUserIDAndService(ctx, currentUser.ID, service)
 	if err != nil {
 		return nil, err
 	}
@@ -93,13 +97,13 @@ func (s *Service) CreateOAuthFactor(ctx context.Context, in *authapi.CreateOAuth
 	if err != nil {
 		return nil, err
 	}
-	_, err = s.UserStore.FindOAuthFactorByOAuthIdentity(ctx, user.OAuthService(in.Service), oauthUser.ID)
+	_, err = s.UserStore.FindOAuthFactorByOAuthIdentity(ctx, service, oauthUser.ID)
 	if err != nil && !errors.IsKind(err, errors.ErrorNotFound) {
 		return nil, err
 	} else if err == nil {
 		return nil, errors.New(errors.ErrorAlreadyExists, "")
 	}
-	_, err = s.UserStore.CreateOAuthFactor(ctx, currentUser.ID, user.OAuthService(in.Service), oauthUser.ID, nulls.NewJSON(oauthUser.Metadata))
+	_, err = s.UserStore.CreateOAuthFactor(ctx, currentUser.ID, service, oauthUser.ID, nulls.NewJSON(oauthUser.Metadata))
 	if err != nil {
 		return nil, err
 	}
@@ -117,7 +121,11 @@ func (s *Service) CreateOAuthFactorByAccessToken(ctx context.Context, in *authap
 
 	accessToken := in.AccessToken // TODO: Decrypt the access token
 	idToken := in.IdToken         // TODO: Decrypt the id token
-	oauthFactors, err := s.UserStore.FindAllOAuthFactorsByUserIDAndService(ctx, currentUser.ID, user.OAuthService(in.Service))
+	service, err := user.OAuthServiceFromV1(int32(in.Service))
+	if err != nil {
+		return nil, err
+	}
+	oauthFactors, err := s.UserStore.FindAllOAuthFactorsByUserIDAndService(ctx, currentUser.ID, service)
 	if err != nil {
 		return nil, err
 	}
@@ -129,13 +137,13 @@ func (s *Service) CreateOAuthFactorByAccessToken(ctx context.Context, in *authap
 	if err != nil {
 		return nil, err
 	}
-	_, err = s.UserStore.FindOAuthFactorByOAuthIdentity(ctx, user.OAuthService(in.Service), oauthUser.ID)
+	_, err = s.UserStore.FindOAuthFactorByOAuthIdentity(ctx, service, oauthUser.ID)
 	if err != nil && !errors.IsKind(err, errors.ErrorNotFound) {
 		return nil, err
 	} else if err == nil {
 		return nil, errors.New(errors.ErrorAlreadyExists, "")
 	}
-	_, err = s.UserStore.CreateOAuthFactor(ctx, currentUser.ID, user.OAuthService(in.Service), oauthUser.ID, nulls.NewJSON(oauthUser.Metadata))
+	_, err = s.UserStore.CreateOAuthFactor(ctx, currentUser.ID, service, oauthUser.ID, nulls.NewJSON(oauthUser.Metadata))
 	if err != nil {
 		return nil, err
 	}
@@ -194,7 +202,7 @@ func (s *Service) DeleteOAuthFactor(ctx context.Context, in *authapi.DeleteOAuth
 
 	// Check if matter is disabled
 	isMatterDisabled := viper.GetBool("matters_unlink_disabled")
-	if isMatterDisabled && authapi.OAuthFactor_OAuthService(oauthFactor.Service) == authapi.OAuthFactor_MATTERS {
+	if isMatterDisabled && oauthFactor.Service == user.OAuthMatters {
 		return nil, errors.New(errors.ErrorPermissionDenied, "")
 	}
 
@@ -230,7 +238,7 @@ func MarshalOAuthFactor(in *user.OAuthFactor) (*authapi.OAuthFactor, error) {
 	return &authapi.OAuthFactor{
 		Id:          in.ID,
 		UserId:      in.UserID,
-		Service:     authapi.OAuthFactor_OAuthService(in.Service),
+		Service:     authapi.OAuthFactor_OAuthService(in.Service.V1()),
 		OauthUserId: in.OAuthUserID,
 		LastUsedAt: &timestamp.Timestamp{
 			Seconds: in.LastUsedAt.Unix(),
@@ -106,6 +106,11 @@ func (s *Service) ResetPassword(ctx context.Context, in *authapi.ResetPasswordRe
 		return nil, err
 	}
 
+	err = s.UserStore.DeleteAllTrustedDevicesByUserID(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
 	err = s.AuthenticationService.DeleteResetPasswordToken(ctx, token)
 	if err != nil {
 		return nil, err
@@ -8,6 +8,7 @@ import (
 	"authcore.io/authcore/internal/session"
 	"authcore.io/authcore/internal/sms"
 	"authcore.io/authcore/internal/user"
+	"authcore.io/authcore/pkg/kvstore"
 	"authcore.io/authcore/pkg/ratelimiter"
 
 	"github.com/go-redis/redis"
@@ -50,9 +51,11 @@ func NewService(db *db.DB,
 	authenticationLimitInterval := viper.GetDuration("authentication_rate_limit_interval")
 	authenticationLimitCount := viper.GetInt64("authentication_rate_limit_count")
 
-	secondFactorRateLimiter := ratelimiter.NewRateLimiter(redis, "rate_limiter/", secondFactorRateLimtCount, secondFactorRateLimitInterval)
-	contactRateLimiter := ratelimiter.NewRateLimiter(redis, "rate_limiter/", contactRateLimitCount, contactRateLimitInterval)
-	authenticationRateLimiter := ratelimiter.NewRateLimiter(redis, "rate_limiter/", authenticationLimitCount, authenticationLimitInterval)
+	// The legacy API always keeps its rate limiters in Redis.
+	kv := kvstore.NewRedisStore(redis)
+	secondFactorRateLimiter := ratelimiter.NewRateLimiter(kv, "rate_limiter/", secondFactorRateLimtCount, secondFactorRateLimitInterval)
+	contactRateLimiter := ratelimiter.NewRateLimiter(kv, "rate_limiter/", contactRateLimitCount, contactRateLimitInterval)
+	authenticationRateLimiter := ratelimiter.NewRateLimiter(kv, "rate_limiter/", authenticationLimitCount, authenticationLimitInterval)
 	srv := &Service{
 		DB:                    db,
 		Redis:                 redis,
@@ -55,7 +55,7 @@ oNBTatFJjSOJ/qRrBbqvbZDiPOLpJ7vlaQ==
 	templateStore := template.NewStore(db)
 	emailService := email.NewService(templateStore)
 	smsService := sms.NewService(templateStore)
-	userStore := user.NewStore(db, redisClient, encryptor)
+	userStore := user.NewStore(db, testutil.KVStoreForTest(), encryptor)
 	sessionStore := session.NewStore(db, redisClient, userStore)
 	authenticationService := authentication.NewService(redisClient, userStore)
 	auditStore := audit.NewStore(db)
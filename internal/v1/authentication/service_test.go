@@ -36,7 +36,7 @@ func ServiceForTest() (*Service, func()) {
 	config.InitConfig()
 
 	encryptor := testutil.EncryptorForTest()
-	userStore := user.NewStore(db, redisClient, encryptor)
+	userStore := user.NewStore(db, testutil.KVStoreForTest(), encryptor)
 	service := NewService(redisClient, userStore)
 
 	return service, func() {
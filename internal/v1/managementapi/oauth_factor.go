@@ -102,7 +102,7 @@ func MarshalOAuthFactor(in *user.OAuthFactor) (*authapi.OAuthFactor, error) {
 	return &authapi.OAuthFactor{
 		Id:          in.ID,
 		UserId:      in.UserID,
-		Service:     authapi.OAuthFactor_OAuthService(in.Service),
+		Service:     authapi.OAuthFactor_OAuthService(in.Service.V1()),
 		OauthUserId: in.OAuthUserID,
 		CreatedAt: &timestamp.Timestamp{
 			Seconds: in.CreatedAt.Unix(),
@@ -33,6 +33,8 @@ func (s *Service) ChangePassword(ctx context.Context, in *managementapi.ChangePa
 	if err != nil {
 		return nil, err
 	}
+	// Users must choose a new password after a reset by an administrator.
+	user.PasswordChangeRequired = true
 
 	err = s.UserStore.UpdateUser(ctx, user)
 	if err != nil {
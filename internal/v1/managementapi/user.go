@@ -184,7 +184,11 @@ func (s *Service) CreateUser(ctx context.Context, in *managementapi.CreateUserRe
 		if oauthFactor.OauthUserId == "" {
 			return nil, errors.New(errors.ErrorInvalidArgument, "oauth id could not be empty")
 		}
-		_, err = s.UserStore.FindOAuthFactorByOAuthIdentity(ctx, user.OAuthService(oauthFactor.Service), oauthFactor.OauthUserId)
+		service, err := user.OAuthServiceFromV1(int32(oauthFactor.Service))
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.UserStore.FindOAuthFactorByOAuthIdentity(ctx, service, oauthFactor.OauthUserId)
 		if err != nil && !errors.IsKind(err, errors.ErrorNotFound) {
 			return nil, err
 		} else if err == nil {
@@ -199,7 +203,11 @@ func (s *Service) CreateUser(ctx context.Context, in *managementapi.CreateUserRe
 
 	// create oauth factors
 	for _, oauthFactor := range in.OauthFactors {
-		_, err = s.UserStore.CreateOAuthFactor(ctx, u.ID, user.OAuthService(oauthFactor.Service), oauthFactor.OauthUserId, nulls.NewJSON(oauthFactor.Metadata))
+		service, err := user.OAuthServiceFromV1(int32(oauthFactor.Service))
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.UserStore.CreateOAuthFactor(ctx, u.ID, service, oauthFactor.OauthUserId, nulls.NewJSON(oauthFactor.Metadata))
 		if err != nil {
 			return nil, err
 		}
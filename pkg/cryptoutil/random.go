@@ -58,3 +58,14 @@ func RandomBackupCodeSecret() string {
 	}
 	return base32.StdEncoding.EncodeToString(backupCodeSecret)
 }
+
+// RandomTOTPSecret returns a 32-character base32 string as a secret for TOTP. It has the same
+// entropy as RandomBackupCodeSecret.
+func RandomTOTPSecret() string {
+	totpSecret := make([]byte, 20)
+	_, err := rand.Read(totpSecret)
+	if err != nil {
+		log.Fatal("failed to generate random token")
+	}
+	return base32.StdEncoding.EncodeToString(totpSecret)
+}
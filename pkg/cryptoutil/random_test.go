@@ -50,3 +50,13 @@ func TestRandomBackupCodeSecret(t *testing.T) {
 
 	assert.NotEqual(t, backupCodeSecret1, backupCodeSecret2)
 }
+
+func TestRandomTOTPSecret(t *testing.T) {
+	totpSecret1 := RandomTOTPSecret()
+	assert.Len(t, totpSecret1, 32)
+
+	totpSecret2 := RandomTOTPSecret()
+	assert.Len(t, totpSecret2, 32)
+
+	assert.NotEqual(t, totpSecret1, totpSecret2)
+}
@@ -0,0 +1,144 @@
+// Package geoip provides IP geolocation lookups with an offline database.
+package geoip
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const earthRadiusKm = 6371.0
+
+// Location is a geographical coordinate.
+type Location struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// DistanceTo returns the great-circle distance to another location in kilometers.
+func (l Location) DistanceTo(o Location) float64 {
+	lat1 := l.Latitude * math.Pi / 180
+	lat2 := o.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (o.Longitude - l.Longitude) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+type block struct {
+	start    net.IP
+	network  *net.IPNet
+	location Location
+}
+
+// DB is an in-memory GeoIP database.
+type DB struct {
+	blocks []block
+}
+
+// Open loads a GeoIP database from a CSV file. The file must have a header row with the columns
+// "network", "latitude" and "longitude", which is compatible with the GeoLite2 City blocks CSV.
+func Open(path string) (*DB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Read loads a GeoIP database from a CSV reader. See Open for the format.
+func Read(r io.Reader) (*DB, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read header")
+	}
+	networkCol, latCol, lonCol := -1, -1, -1
+	for i, name := range header {
+		switch name {
+		case "network":
+			networkCol = i
+		case "latitude":
+			latCol = i
+		case "longitude":
+			lonCol = i
+		}
+	}
+	if networkCol < 0 || latCol < 0 || lonCol < 0 {
+		return nil, errors.New("network, latitude and longitude columns are required")
+	}
+
+	db := &DB{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(record) <= networkCol || len(record) <= latCol || len(record) <= lonCol {
+			continue
+		}
+		// Blocks without coordinates are not useful for lookup.
+		if record[latCol] == "" || record[lonCol] == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(record[networkCol])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network %v", record[networkCol])
+		}
+		lat, err := strconv.ParseFloat(record[latCol], 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid latitude %v", record[latCol])
+		}
+		lon, err := strconv.ParseFloat(record[lonCol], 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid longitude %v", record[lonCol])
+		}
+		db.blocks = append(db.blocks, block{
+			start:    normalizeIP(network.IP),
+			network:  network,
+			location: Location{Latitude: lat, Longitude: lon},
+		})
+	}
+	sort.Slice(db.blocks, func(i, j int) bool {
+		return bytes.Compare(db.blocks[i].start, db.blocks[j].start) < 0
+	})
+	return db, nil
+}
+
+// Lookup returns the location of an IP address. The second return value is false if the IP
+// address is not found in the database.
+func (db *DB) Lookup(ip net.IP) (Location, bool) {
+	if ip == nil {
+		return Location{}, false
+	}
+	ip = normalizeIP(ip)
+	// Find the last block that starts before or at the IP address.
+	i := sort.Search(len(db.blocks), func(i int) bool {
+		return bytes.Compare(db.blocks[i].start, ip) > 0
+	})
+	if i == 0 {
+		return Location{}, false
+	}
+	b := db.blocks[i-1]
+	if !b.network.Contains(ip) {
+		return Location{}, false
+	}
+	return b.location, true
+}
+
+// normalizeIP returns the 16-byte representation so that IPv4 and IPv6 addresses can be compared.
+func normalizeIP(ip net.IP) net.IP {
+	return ip.To16()
+}
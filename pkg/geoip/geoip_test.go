@@ -0,0 +1,59 @@
+package geoip
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testCSV = `network,geoname_id,latitude,longitude,accuracy_radius
+1.1.1.0/24,1,22.2783,114.1747,100
+8.8.8.0/24,2,37.751,-97.822,1000
+10.0.0.0/8,3,,,
+2001:db8::/32,4,51.5074,-0.1278,100
+`
+
+func TestLookup(t *testing.T) {
+	db, err := Read(strings.NewReader(testCSV))
+	assert.NoError(t, err)
+
+	loc, ok := db.Lookup(net.ParseIP("1.1.1.1"))
+	assert.True(t, ok)
+	assert.Equal(t, 22.2783, loc.Latitude)
+	assert.Equal(t, 114.1747, loc.Longitude)
+
+	loc, ok = db.Lookup(net.ParseIP("8.8.8.8"))
+	assert.True(t, ok)
+	assert.Equal(t, 37.751, loc.Latitude)
+
+	loc, ok = db.Lookup(net.ParseIP("2001:db8::1"))
+	assert.True(t, ok)
+	assert.Equal(t, 51.5074, loc.Latitude)
+
+	// Not found
+	_, ok = db.Lookup(net.ParseIP("1.1.2.1"))
+	assert.False(t, ok)
+	_, ok = db.Lookup(net.ParseIP("10.0.0.1"))
+	assert.False(t, ok)
+	_, ok = db.Lookup(net.ParseIP("0.0.0.1"))
+	assert.False(t, ok)
+	_, ok = db.Lookup(nil)
+	assert.False(t, ok)
+}
+
+func TestReadInvalid(t *testing.T) {
+	_, err := Read(strings.NewReader("network,latitude\n1.1.1.0/24,1\n"))
+	assert.Error(t, err)
+
+	_, err = Read(strings.NewReader("network,latitude,longitude\nxxx,1,1\n"))
+	assert.Error(t, err)
+}
+
+func TestDistanceTo(t *testing.T) {
+	hongKong := Location{Latitude: 22.3193, Longitude: 114.1694}
+	london := Location{Latitude: 51.5074, Longitude: -0.1278}
+	assert.InDelta(t, 9630, hongKong.DistanceTo(london), 50)
+	assert.InDelta(t, 0, hongKong.DistanceTo(hongKong), 0.001)
+}
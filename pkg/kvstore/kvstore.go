@@ -0,0 +1,44 @@
+// Package kvstore provides storage backends for ephemeral data such as authentication states,
+// one-time codes and rate limiter buckets.
+package kvstore
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned when a key or a list element does not exist.
+var ErrNotFound = errors.New("kvstore: not found")
+
+// Store is a key-value store with expiry. A zero TTL means the key does not expire.
+type Store interface {
+	// Get returns the value of a key.
+	Get(key string) (string, error)
+	// Set sets the value of a key.
+	Set(key, value string, ttl time.Duration) error
+	// Delete deletes a key and returns whether it existed.
+	Delete(key string) (bool, error)
+	// Expire sets the TTL of an existing key.
+	Expire(key string, ttl time.Duration) error
+
+	// Incr atomically increments the counter of a key and returns the new value.
+	Incr(key string) (int64, error)
+
+	// RPush appends a value to the list of a key.
+	RPush(key, value string) error
+	// LPop removes and returns the first element of a list.
+	LPop(key string) (string, error)
+	// LIndex returns the element at index of a list.
+	LIndex(key string, index int64) (string, error)
+	// LLen returns the length of a list.
+	LLen(key string) (int64, error)
+	// LRange returns the elements of a list from start to stop inclusively. Negative indices count
+	// from the end of the list.
+	LRange(key string, start, stop int64) ([]string, error)
+
+	// SAdd adds a member to the set of a key.
+	SAdd(key, member string) error
+	// SIsMember returns whether member is in the set of a key.
+	SIsMember(key, member string) (bool, error)
+}
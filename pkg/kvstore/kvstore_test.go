@@ -0,0 +1,147 @@
+package kvstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func storesForTest(t *testing.T) (map[string]Store, func()) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]Store{
+		"redis":  NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()})),
+		"memory": NewMemoryStore(),
+	}
+	return stores, mr.Close
+}
+
+func TestKeyValue(t *testing.T) {
+	stores, teardown := storesForTest(t)
+	defer teardown()
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			_, err := s.Get("key")
+			assert.Equal(t, ErrNotFound, err)
+
+			assert.NoError(t, s.Set("key", "value", time.Minute))
+			value, err := s.Get("key")
+			assert.NoError(t, err)
+			assert.Equal(t, "value", value)
+
+			deleted, err := s.Delete("key")
+			assert.NoError(t, err)
+			assert.True(t, deleted)
+			deleted, err = s.Delete("key")
+			assert.NoError(t, err)
+			assert.False(t, deleted)
+		})
+	}
+}
+
+func TestCounter(t *testing.T) {
+	stores, teardown := storesForTest(t)
+	defer teardown()
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			n, err := s.Incr("counter")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), n)
+			n, err = s.Incr("counter")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(2), n)
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	stores, teardown := storesForTest(t)
+	defer teardown()
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			n, err := s.LLen("list")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(0), n)
+			_, err = s.LIndex("list", 0)
+			assert.Equal(t, ErrNotFound, err)
+
+			assert.NoError(t, s.RPush("list", "a"))
+			assert.NoError(t, s.RPush("list", "b"))
+			assert.NoError(t, s.RPush("list", "c"))
+
+			n, err = s.LLen("list")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(3), n)
+			value, err := s.LIndex("list", -1)
+			assert.NoError(t, err)
+			assert.Equal(t, "c", value)
+			values, err := s.LRange("list", 0, -1)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"a", "b", "c"}, values)
+			values, err = s.LRange("list", 1, 5)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"b", "c"}, values)
+
+			value, err = s.LPop("list")
+			assert.NoError(t, err)
+			assert.Equal(t, "a", value)
+			n, err = s.LLen("list")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(2), n)
+
+			_, err = s.Get("list")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	stores, teardown := storesForTest(t)
+	defer teardown()
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			ok, err := s.SIsMember("set", "a")
+			assert.NoError(t, err)
+			assert.False(t, ok)
+
+			assert.NoError(t, s.SAdd("set", "a"))
+			ok, err = s.SIsMember("set", "a")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = s.SIsMember("set", "b")
+			assert.NoError(t, err)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	now := time.Now()
+	s := NewMemoryStore()
+	s.now = func() time.Time { return now }
+
+	assert.NoError(t, s.Set("key", "value", time.Minute))
+	assert.NoError(t, s.RPush("list", "a"))
+	assert.NoError(t, s.Expire("list", time.Second))
+
+	now = now.Add(30 * time.Second)
+	_, err := s.Get("key")
+	assert.NoError(t, err)
+	n, err := s.LLen("list")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+
+	now = now.Add(time.Minute)
+	_, err = s.Get("key")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Empty(t, s.entries)
+}
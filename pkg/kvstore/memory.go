@@ -0,0 +1,275 @@
+package kvstore
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sweepInterval is the number of writes between scans for expired keys.
+const sweepInterval = 1000
+
+// errWrongType is returned when a key holds a value of another kind, like Redis' WRONGTYPE.
+var errWrongType = errors.New("kvstore: operation against a key holding the wrong kind of value")
+
+// MemoryStore is a Store kept in process memory. It is suitable for single-node deployments and
+// tests. Expired keys are removed when they are accessed and periodically on writes.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+	writes  int
+	now     func() time.Time
+}
+
+type memoryEntry struct {
+	value    *string
+	list     []string
+	set      map[string]struct{}
+	expireAt time.Time
+}
+
+// NewMemoryStore returns a new MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries: map[string]*memoryEntry{},
+		now:     time.Now,
+	}
+}
+
+// Get implements Store.
+func (s *MemoryStore) Get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entry(key)
+	if e == nil {
+		return "", ErrNotFound
+	}
+	if e.value == nil {
+		return "", errWrongType
+	}
+	return *e.value, nil
+}
+
+// Set implements Store.
+func (s *MemoryStore) Set(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	e := &memoryEntry{value: &value}
+	if ttl > 0 {
+		e.expireAt = s.now().Add(ttl)
+	}
+	s.entries[key] = e
+	return nil
+}
+
+// Delete implements Store.
+func (s *MemoryStore) Delete(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entry(key) == nil {
+		return false, nil
+	}
+	delete(s.entries, key)
+	return true, nil
+}
+
+// Expire implements Store.
+func (s *MemoryStore) Expire(key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entry(key)
+	if e == nil {
+		return nil
+	}
+	if ttl <= 0 {
+		delete(s.entries, key)
+		return nil
+	}
+	e.expireAt = s.now().Add(ttl)
+	return nil
+}
+
+// Incr implements Store.
+func (s *MemoryStore) Incr(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	e := s.entry(key)
+	if e == nil {
+		e = &memoryEntry{value: new(string)}
+		*e.value = "0"
+		s.entries[key] = e
+	}
+	if e.value == nil {
+		return 0, errWrongType
+	}
+	n, err := strconv.ParseInt(*e.value, 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "kvstore: value is not an integer")
+	}
+	n++
+	*e.value = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+// RPush implements Store.
+func (s *MemoryStore) RPush(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	e := s.entry(key)
+	if e == nil {
+		e = &memoryEntry{list: []string{}}
+		s.entries[key] = e
+	}
+	if e.list == nil {
+		return errWrongType
+	}
+	e.list = append(e.list, value)
+	return nil
+}
+
+// LPop implements Store.
+func (s *MemoryStore) LPop(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.listEntry(key)
+	if err != nil {
+		return "", err
+	}
+	if len(list) == 0 {
+		return "", ErrNotFound
+	}
+	value := list[0]
+	if len(list) == 1 {
+		delete(s.entries, key)
+	} else {
+		s.entries[key].list = list[1:]
+	}
+	return value, nil
+}
+
+// LIndex implements Store.
+func (s *MemoryStore) LIndex(key string, index int64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.listEntry(key)
+	if err != nil {
+		return "", err
+	}
+	n := int64(len(list))
+	if index < 0 {
+		index += n
+	}
+	if index < 0 || index >= n {
+		return "", ErrNotFound
+	}
+	return list[index], nil
+}
+
+// LLen implements Store.
+func (s *MemoryStore) LLen(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.listEntry(key)
+	return int64(len(list)), err
+}
+
+// LRange implements Store.
+func (s *MemoryStore) LRange(key string, start, stop int64) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list, err := s.listEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	n := int64(len(list))
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return []string{}, nil
+	}
+	return append([]string{}, list[start:stop+1]...), nil
+}
+
+// SAdd implements Store.
+func (s *MemoryStore) SAdd(key, member string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	e := s.entry(key)
+	if e == nil {
+		e = &memoryEntry{set: map[string]struct{}{}}
+		s.entries[key] = e
+	}
+	if e.set == nil {
+		return errWrongType
+	}
+	e.set[member] = struct{}{}
+	return nil
+}
+
+// SIsMember implements Store.
+func (s *MemoryStore) SIsMember(key, member string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entry(key)
+	if e == nil {
+		return false, nil
+	}
+	if e.set == nil {
+		return false, errWrongType
+	}
+	_, ok := e.set[member]
+	return ok, nil
+}
+
+// entry returns the entry of a key, or nil if it does not exist or has expired. The caller must
+// hold the lock.
+func (s *MemoryStore) entry(key string) *memoryEntry {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if !e.expireAt.IsZero() && !s.now().Before(e.expireAt) {
+		delete(s.entries, key)
+		return nil
+	}
+	return e
+}
+
+// sweep removes expired keys every sweepInterval writes. The caller must hold the lock.
+func (s *MemoryStore) sweep() {
+	s.writes++
+	if s.writes < sweepInterval {
+		return
+	}
+	s.writes = 0
+	for key := range s.entries {
+		s.entry(key)
+	}
+}
+
+func (s *MemoryStore) listEntry(key string) ([]string, error) {
+	e := s.entry(key)
+	if e == nil {
+		return nil, nil
+	}
+	if e.list == nil {
+		return nil, errWrongType
+	}
+	return e.list, nil
+}
@@ -0,0 +1,85 @@
+package kvstore
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisStore is a Store backed by Redis.
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore returns a new RedisStore.
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+// Get implements Store.
+func (s *RedisStore) Get(key string) (string, error) {
+	return notFound(s.client.Get(key).Result())
+}
+
+// Set implements Store.
+func (s *RedisStore) Set(key, value string, ttl time.Duration) error {
+	return s.client.Set(key, value, ttl).Err()
+}
+
+// Delete implements Store.
+func (s *RedisStore) Delete(key string) (bool, error) {
+	deleted, err := s.client.Del(key).Result()
+	return deleted > 0, err
+}
+
+// Expire implements Store.
+func (s *RedisStore) Expire(key string, ttl time.Duration) error {
+	return s.client.Expire(key, ttl).Err()
+}
+
+// Incr implements Store.
+func (s *RedisStore) Incr(key string) (int64, error) {
+	return s.client.Incr(key).Result()
+}
+
+// RPush implements Store.
+func (s *RedisStore) RPush(key, value string) error {
+	return s.client.RPush(key, value).Err()
+}
+
+// LPop implements Store.
+func (s *RedisStore) LPop(key string) (string, error) {
+	return notFound(s.client.LPop(key).Result())
+}
+
+// LIndex implements Store.
+func (s *RedisStore) LIndex(key string, index int64) (string, error) {
+	return notFound(s.client.LIndex(key, index).Result())
+}
+
+// LLen implements Store.
+func (s *RedisStore) LLen(key string) (int64, error) {
+	return s.client.LLen(key).Result()
+}
+
+// LRange implements Store.
+func (s *RedisStore) LRange(key string, start, stop int64) ([]string, error) {
+	return s.client.LRange(key, start, stop).Result()
+}
+
+// SAdd implements Store.
+func (s *RedisStore) SAdd(key, member string) error {
+	return s.client.SAdd(key, member).Err()
+}
+
+// SIsMember implements Store.
+func (s *RedisStore) SIsMember(key, member string) (bool, error) {
+	return s.client.SIsMember(key, member).Result()
+}
+
+func notFound(value string, err error) (string, error) {
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return value, err
+}
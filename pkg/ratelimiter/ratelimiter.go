@@ -4,47 +4,48 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/go-redis/redis"
+	"authcore.io/authcore/pkg/kvstore"
+
 	"github.com/pkg/errors"
 )
 
 // RateLimiter is a rate limiter limiting user-based requests
 type RateLimiter struct {
-	redis          *redis.Client
-	redisKeyPrefix string
-	requestLimit   int64
-	duration       time.Duration
+	store        kvstore.Store
+	keyPrefix    string
+	requestLimit int64
+	duration     time.Duration
 }
 
 // NewRateLimiter creates a new RateLimiter
-func NewRateLimiter(redis *redis.Client, redisKeyPrefix string, requestLimit int64, duration time.Duration) *RateLimiter {
+func NewRateLimiter(store kvstore.Store, keyPrefix string, requestLimit int64, duration time.Duration) *RateLimiter {
 	return &RateLimiter{
-		redis:          redis,
-		redisKeyPrefix: redisKeyPrefix,
-		requestLimit:   requestLimit,
-		duration:       duration,
+		store:        store,
+		keyPrefix:    keyPrefix,
+		requestLimit: requestLimit,
+		duration:     duration,
 	}
 }
 
 // Check checks if there are too much requests for the rate limiter for the key
 func (r *RateLimiter) Check(key string) error {
-	redisKey := r.redisKeyPrefix + key
-	requestsLen, err := r.redis.LLen(redisKey).Result()
+	storeKey := r.keyPrefix + key
+	requestsLen, err := r.store.LLen(storeKey)
 	if err != nil {
 		return err
 	}
 	if requestsLen < r.requestLimit {
 		return nil
 	}
-	requestTimestampString, err := r.redis.LIndex(redisKey, int64(0)).Result()
-	if err != nil && err != redis.Nil {
+	requestTimestampString, err := r.store.LIndex(storeKey, 0)
+	if err != nil && err != kvstore.ErrNotFound {
 		return err
 	} else if err == nil {
 		requestTimestamp, err := strconv.ParseInt(requestTimestampString, 10, 64)
 		if err != nil {
 			return err
 		} else if time.Unix(requestTimestamp, 0).Add(r.duration).Before(time.Now()) {
-			_, err = r.redis.LPop(redisKey).Result()
+			_, err = r.store.LPop(storeKey)
 			if err != nil {
 				return err
 			}
@@ -61,14 +62,74 @@ func (r *RateLimiter) Increment(key string) error {
 	if err != nil {
 		return err
 	}
-	redisKey := r.redisKeyPrefix + key
-	err = r.redis.RPush(redisKey, time.Now().Unix()).Err()
+	storeKey := r.keyPrefix + key
+	err = r.store.RPush(storeKey, strconv.FormatInt(time.Now().Unix(), 10))
 	if err != nil {
 		return err
 	}
-	err = r.redis.Expire(redisKey, r.duration).Err()
+	err = r.store.Expire(storeKey, r.duration)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// Count returns the number of requests of the key within the rate limiting interval.
+func (r *RateLimiter) Count(key string) (int64, error) {
+	storeKey := r.keyPrefix + key
+	timestamps, err := r.store.LRange(storeKey, 0, -1)
+	if err != nil {
+		return 0, err
+	}
+	count := int64(0)
+	since := time.Now().Add(-r.duration)
+	for _, t := range timestamps {
+		requestTimestamp, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		if time.Unix(requestTimestamp, 0).After(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// RetryAfter returns the duration until the key is allowed again. It returns zero if the key is not
+// limited.
+func (r *RateLimiter) RetryAfter(key string) (time.Duration, error) {
+	storeKey := r.keyPrefix + key
+	requestsLen, err := r.store.LLen(storeKey)
+	if err != nil {
+		return 0, err
+	}
+	if requestsLen < r.requestLimit {
+		return 0, nil
+	}
+	requestTimestampString, err := r.store.LIndex(storeKey, 0)
+	if err == kvstore.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	requestTimestamp, err := strconv.ParseInt(requestTimestampString, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	retryAfter := time.Until(time.Unix(requestTimestamp, 0).Add(r.duration))
+	if retryAfter < 0 {
+		return 0, nil
+	}
+	return retryAfter, nil
+}
+
+// Reset clears the requests of the key.
+func (r *RateLimiter) Reset(key string) error {
+	_, err := r.store.Delete(r.keyPrefix + key)
+	return err
+}
+
+// Limit returns the maximum number of requests within the rate limiting interval.
+func (r *RateLimiter) Limit() int64 {
+	return r.requestLimit
+}
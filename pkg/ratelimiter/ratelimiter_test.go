@@ -6,6 +6,8 @@ import (
 	"testing"
 	"time"
 
+	"authcore.io/authcore/pkg/kvstore"
+
 	"github.com/alicebob/miniredis"
 	"github.com/go-redis/redis"
 	"github.com/stretchr/testify/assert"
@@ -15,8 +17,8 @@ var redisOnce sync.Once
 var miniRedis *miniredis.Miniredis
 var redisClient *redis.Client
 
-// RedisForTest creates a *redis.Client that for tests.
-func RedisForTest() *redis.Client {
+// RedisForTest creates a kvstore.Store backed by Redis for tests.
+func RedisForTest() kvstore.Store {
 	redisOnce.Do(func() {
 		miniRedis, err := miniredis.Run()
 		if err != nil {
@@ -26,7 +28,7 @@ func RedisForTest() *redis.Client {
 			Addr: miniRedis.Addr(),
 		})
 	})
-	return redisClient
+	return kvstore.NewRedisStore(redisClient)
 }
 
 func TestRateLimiter(t *testing.T) {
@@ -59,3 +61,56 @@ func TestRateLimiter(t *testing.T) {
 	err = rateLimiter.Increment("a_random_key")
 	assert.NoError(t, err)
 }
+
+func TestRateLimiterCount(t *testing.T) {
+	redis := RedisForTest()
+	rateLimiter := NewRateLimiter(redis, "rate_limiter_count/", 5, 1*time.Minute)
+
+	count, err := rateLimiter.Count("a_random_key")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+
+	err = rateLimiter.Increment("a_random_key")
+	assert.NoError(t, err)
+	err = rateLimiter.Increment("a_random_key")
+	assert.NoError(t, err)
+
+	count, err = rateLimiter.Count("a_random_key")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestRateLimiterRetryAfterAndReset(t *testing.T) {
+	redis := RedisForTest()
+	rateLimiter := NewRateLimiter(redis, "rate_limiter_retry_after/", 2, 1*time.Minute)
+
+	retryAfter, err := rateLimiter.RetryAfter("a_random_key")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), retryAfter)
+
+	assert.NoError(t, rateLimiter.Increment("a_random_key"))
+	assert.NoError(t, rateLimiter.Increment("a_random_key"))
+
+	retryAfter, err = rateLimiter.RetryAfter("a_random_key")
+	assert.NoError(t, err)
+	assert.True(t, retryAfter > 0 && retryAfter <= 1*time.Minute)
+
+	err = rateLimiter.Reset("a_random_key")
+	assert.NoError(t, err)
+	count, err := rateLimiter.Count("a_random_key")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+	assert.Equal(t, int64(2), rateLimiter.Limit())
+}
+
+func TestRateLimiterMemoryStore(t *testing.T) {
+	rateLimiter := NewRateLimiter(kvstore.NewMemoryStore(), "rate_limiter_memory/", 2, 1*time.Minute)
+
+	assert.NoError(t, rateLimiter.Increment("a_random_key"))
+	assert.NoError(t, rateLimiter.Increment("a_random_key"))
+	assert.Error(t, rateLimiter.Check("a_random_key"))
+
+	count, err := rateLimiter.Count("a_random_key")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+}